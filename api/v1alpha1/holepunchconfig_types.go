@@ -0,0 +1,77 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HolepunchConfigSpec changes how holepunch behaves while it's running. Anything left unset keeps holepunch's own
+// setting, as given on its command line.
+type HolepunchConfigSpec struct {
+	// RouterURL is the URL of the root device description of the router to configure, for example
+	// "http://192.168.1.1:5000/rootDesc.xml". This overrides --router-root-desc.
+	// +optional
+	RouterURL string `json:"routerURL,omitempty"`
+
+	// LeaseDurationSeconds is how long port mapping leases last for, unless a service asks for something else with the
+	// lease duration annotation. If unset then leases last for an hour.
+	// +kubebuilder:validation:Minimum=60
+	// +kubebuilder:validation:Maximum=86400
+	// +optional
+	LeaseDurationSeconds *int32 `json:"leaseDurationSeconds,omitempty"`
+
+	// DryRun stops holepunch from making any changes to the router, and logs them instead. This overrides --dry-run.
+	// +optional
+	DryRun *bool `json:"dryRun,omitempty"`
+
+	// AuditIntervalSeconds is how often to check that every service's port mappings are still on the router. Zero
+	// disables the check. This overrides --audit-interval.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	AuditIntervalSeconds *int32 `json:"auditIntervalSeconds,omitempty"`
+
+	// CleanupOnShutdown asks for the port mappings of every service to be removed when holepunch stops. This overrides
+	// --cleanup-on-shutdown.
+	// +optional
+	CleanupOnShutdown *bool `json:"cleanupOnShutdown,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// HolepunchConfig is the Schema for the holepunchconfigs API. Holepunch only uses the HolepunchConfig named
+// "holepunch", and picks up changes to it without needing to be restarted.
+type HolepunchConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec HolepunchConfigSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// HolepunchConfigList contains a list of HolepunchConfig
+type HolepunchConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []HolepunchConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&HolepunchConfig{}, &HolepunchConfigList{})
+}
@@ -0,0 +1,69 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HolepunchPolicySpec sets defaults for every service in its namespace. A service's own annotations always win over
+// the policy.
+type HolepunchPolicySpec struct {
+	// DefaultLeaseDuration is how long port mapping leases last for services that don't have the lease duration
+	// annotation, for example "30m". If unset then holepunch's own lease duration is used.
+	// +optional
+	DefaultLeaseDuration *metav1.Duration `json:"defaultLeaseDuration,omitempty"`
+
+	// DefaultRemoteHost is the IP address that port mappings are restricted to for services that don't have the
+	// remote host annotation. If unset then any remote host is allowed.
+	// +optional
+	DefaultRemoteHost string `json:"defaultRemoteHost,omitempty"`
+
+	// ForwardUnannotatedServices forwards the ports of every LoadBalancer and NodePort service in the namespace, even
+	// those without the holepunch annotation, unless they set the annotation to "false". If false then only services
+	// with the annotation have their ports forwarded.
+	// +optional
+	ForwardUnannotatedServices bool `json:"forwardUnannotatedServices,omitempty"`
+
+	// SkipPorts are the service ports that aren't forwarded for services that don't have the skip ports annotation.
+	// +optional
+	SkipPorts []int32 `json:"skipPorts,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// HolepunchPolicy is the Schema for the holepunchpolicies API. Every HolepunchPolicy applies to the services in its
+// own namespace.
+type HolepunchPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec HolepunchPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// HolepunchPolicyList contains a list of HolepunchPolicy
+type HolepunchPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []HolepunchPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&HolepunchPolicy{}, &HolepunchPolicyList{})
+}
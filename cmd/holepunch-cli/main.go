@@ -0,0 +1,195 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// holepunch-cli talks to a router in the same way that the holepunch controller does, without needing Kubernetes. It
+// can be used to check that a router works with holepunch, or to manage port mappings by hand.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/JamesLaverack/holepunch/controllers"
+)
+
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCommand() *cobra.Command {
+	var routerRootDesc []string
+	var timeout time.Duration
+
+	root := &cobra.Command{
+		Use:          "holepunch-cli",
+		Short:        "Manage UPnP port mappings on your router",
+		SilenceUsage: true,
+	}
+	root.PersistentFlags().StringSliceVar(&routerRootDesc, "router-root-desc", nil,
+		"URL of the root device description of the router to use (e.g., http://192.168.1.1:5000/rootDesc.xml). "+
+			"Give a comma-separated list of URLs to use several routers at once. "+
+			"If not set, a router will be discovered on the local network.")
+	root.PersistentFlags().DurationVar(&timeout, "timeout", 30*time.Second, "How long to wait to find a router.")
+
+	pickRouter := func() (controllers.RouterClient, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return controllers.PickRouterClient(ctx, routerRootDesc...)
+	}
+
+	root.AddCommand(
+		newAddCommand(pickRouter),
+		newDeleteCommand(pickRouter),
+		newListCommand(pickRouter),
+		newExternalIPCommand(pickRouter),
+	)
+	return root
+}
+
+func newAddCommand(pickRouter func() (controllers.RouterClient, error)) *cobra.Command {
+	var externalPort, internalPort uint16
+	var internalIP, protocol, description, remoteHost string
+	var leaseDuration time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Forward a port on the router",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if internalPort == 0 {
+				internalPort = externalPort
+			}
+			router, err := pickRouter()
+			if err != nil {
+				return err
+			}
+			err = router.AddPortMapping(remoteHost, externalPort, strings.ToUpper(protocol), internalPort, internalIP,
+				true, description, uint32(leaseDuration/time.Second))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Forwarded %d/%s to %s:%d\n", externalPort, strings.ToUpper(protocol),
+				internalIP, internalPort)
+			return nil
+		},
+	}
+	cmd.Flags().Uint16Var(&externalPort, "external-port", 0, "The port to open on the router.")
+	cmd.Flags().StringVar(&internalIP, "internal-ip", "", "The IP address on the local network to forward to.")
+	cmd.Flags().Uint16Var(&internalPort, "internal-port", 0, "The port to forward to. Defaults to the external port.")
+	cmd.Flags().StringVar(&protocol, "protocol", "TCP", "The protocol to forward, either TCP or UDP.")
+	cmd.Flags().StringVar(&description, "description", "holepunch-cli", "A description of the mapping, for the router.")
+	cmd.Flags().StringVar(&remoteHost, "remote-host", "", "Only allow this remote IP to use the mapping.")
+	cmd.Flags().DurationVar(&leaseDuration, "lease-duration", time.Hour,
+		"How long the mapping should last for. Zero asks for a mapping that never expires.")
+	_ = cmd.MarkFlagRequired("external-port")
+	_ = cmd.MarkFlagRequired("internal-ip")
+	return cmd
+}
+
+func newDeleteCommand(pickRouter func() (controllers.RouterClient, error)) *cobra.Command {
+	var externalPort uint16
+	var protocol, remoteHost string
+
+	cmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Remove a port mapping from the router",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			router, err := pickRouter()
+			if err != nil {
+				return err
+			}
+			if err := router.DeletePortMapping(remoteHost, externalPort, strings.ToUpper(protocol)); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed %d/%s\n", externalPort, strings.ToUpper(protocol))
+			return nil
+		},
+	}
+	cmd.Flags().Uint16Var(&externalPort, "external-port", 0, "The port to close on the router.")
+	cmd.Flags().StringVar(&protocol, "protocol", "TCP", "The protocol of the mapping, either TCP or UDP.")
+	cmd.Flags().StringVar(&remoteHost, "remote-host", "", "The remote host the mapping was made for, if any.")
+	_ = cmd.MarkFlagRequired("external-port")
+	return cmd
+}
+
+func newListCommand(pickRouter func() (controllers.RouterClient, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the router's port mappings",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			router, err := pickRouter()
+			if err != nil {
+				return err
+			}
+			mappings, err := controllers.GetAllPortMappings(context.Background(), router)
+			if err != nil {
+				return err
+			}
+			printPortMappings(cmd.OutOrStdout(), mappings)
+			return nil
+		},
+	}
+}
+
+func newExternalIPCommand(pickRouter func() (controllers.RouterClient, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "external-ip",
+		Short: "Show the router's external IP address",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			router, err := pickRouter()
+			if err != nil {
+				return err
+			}
+			ip, err := router.GetExternalIPAddress()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), ip)
+			return nil
+		},
+	}
+}
+
+// printPortMappings writes out port mappings as a table.
+func printPortMappings(out io.Writer, mappings []controllers.PortMappingEntry) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "EXTERNAL PORT\tPROTOCOL\tINTERNAL CLIENT\tINTERNAL PORT\tENABLED\tLEASE\tREMOTE HOST\tDESCRIPTION")
+	for _, m := range mappings {
+		lease := "forever"
+		if m.LeaseDuration != 0 {
+			lease = (time.Duration(m.LeaseDuration) * time.Second).String()
+		}
+		remoteHost := m.RemoteHost
+		if remoteHost == "" {
+			remoteHost = "*"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%t\t%s\t%s\t%s\n", m.ExternalPort, m.Protocol, m.InternalClient,
+			m.InternalPort, m.Enabled, lease, remoteHost, m.Description)
+	}
+	_ = w.Flush()
+}
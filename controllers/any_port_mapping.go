@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errAnyPortMappingNotSupported is returned by AddAnyPortMapping when the router underneath doesn't support it, in which
+// case AddPortMapping should be used instead.
+var errAnyPortMappingNotSupported = errors.New("router does not support AddAnyPortMapping")
+
+// AnyPortMappingSupport is implemented by RouterClients for routers that can pick the external port themselves
+// (WANIPConnection2). The router tries to use the requested external port, but if it can't then it maps another one
+// and returns it, rather than failing.
+//
+// The RouterClients that wrap another one implement this too, returning errAnyPortMappingNotSupported if the router
+// they wrap doesn't.
+type AnyPortMappingSupport interface {
+	AddAnyPortMapping(
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+	) (NewReservedPort uint16, err error)
+}
+
+// addAnyPortMapping calls AddAnyPortMapping on a router if it supports it, or returns errAnyPortMappingNotSupported.
+func addAnyPortMapping(
+	router interface{},
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	am, ok := router.(AnyPortMappingSupport)
+	if !ok {
+		return 0, errAnyPortMappingNotSupported
+	}
+	return am.AddAnyPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient,
+		NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+// AddAnyPortMapping asks the router to map the requested external port or, failing that, any other. Only
+// WANIPConnection2 has this action.
+func (c *igdRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	return addAnyPortMapping(c.goupnpClient, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+// getAssignedPorts reads the external ports the router assigned in place of the ones we asked for, recorded on the
+// service by recordActiveMappings. They're in the same form as port mappings.
+func getAssignedPorts(service corev1.Service) (map[string]uint16, error) {
+	encoded, ok := service.Annotations[assignedPortsAnnotationName]
+	if !ok {
+		return nil, nil
+	}
+	assigned := make(map[string]uint16)
+	if err := json.Unmarshal([]byte(encoded), &assigned); err != nil {
+		return nil, permanentError(fmt.Errorf("unable to parse %s annotation: %w", assignedPortsAnnotationName, err))
+	}
+	return assigned, nil
+}
+
+// assignedPortChanges returns the mappings whose external port isn't the one that was requested, because the router
+// gave us a different one.
+func assignedPortChanges(requested, forwarded map[string]uint16) map[string]uint16 {
+	assigned := make(map[string]uint16)
+	for key, externalPort := range forwarded {
+		if requested[key] != externalPort {
+			assigned[key] = externalPort
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// anyPortRouterClient is a router that supports AddAnyPortMapping, and maps some external ports to others.
+type anyPortRouterClient struct {
+	*mockRouterClient
+	// reassigned are the external ports that the router won't give out, and what it gives out instead.
+	reassigned map[uint16]uint16
+	anyCalls   int
+}
+
+func (m *anyPortRouterClient) AddAnyPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) (uint16, error) {
+	m.anyCalls++
+	if port, ok := m.reassigned[externalPort]; ok {
+		externalPort = port
+	}
+	if err := m.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration); err != nil {
+		return 0, err
+	}
+	return externalPort, nil
+}
+
+func TestSyncPortMappingsUsesAssignedPort(t *testing.T) {
+	router := &anyPortRouterClient{mockRouterClient: &mockRouterClient{}, reassigned: map[uint16]uint16{80: 8080}}
+	desired := map[string]uint16{"80/TCP": 80, "443/TCP": 443}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		corev1.Service{}, "192.168.1.10", 600, nil, desired, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, router.anyCalls)
+	assert.ElementsMatch(t, []uint16{8080, 443}, router.addedExternalPorts())
+	assert.Equal(t, map[string]uint16{"80/TCP": 8080, "443/TCP": 443}, desired)
+}
+
+func TestSyncPortMappingsFallsBackWithoutAnyPortMapping(t *testing.T) {
+	router := &mockRouterClient{}
+	desired := map[string]uint16{"80/TCP": 80}
+	r := NewServiceReconciler(nil, nil)
+	// Wrapping the router mustn't make it look like it supports AddAnyPortMapping when it doesn't.
+	wrapped := r.withMappingCache(r.instrumentRouterClient(router), NewMappingCache(router, 0))
+	err := r.syncPortMappings(context.Background(), logf.NullLogger{}, wrapped, corev1.Service{}, "192.168.1.10", 600, nil,
+		desired, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	assert.Equal(t, map[string]uint16{"80/TCP": 80}, desired)
+}
+
+func TestSyncPortMappingsAssignedPortAlreadyClaimed(t *testing.T) {
+	router := &anyPortRouterClient{mockRouterClient: &mockRouterClient{}, reassigned: map[uint16]uint16{80: 8080}}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(nil, nil, WithEventRecorder(recorder))
+	r.portClaims.claim(types.NamespacedName{Namespace: "default", Name: "other"}, 8080, "TCP")
+
+	err := r.syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 600, nil,
+		map[string]uint16{"80/TCP": 80}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []portMappingCall{{ExternalPort: 8080, Protocol: "TCP"}}, router.deleteCalls)
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Contains(t, <-recorder.Events, "PortConflict")
+	}
+}
+
+func TestReconcileRecordsAssignedPorts(t *testing.T) {
+	service := holepunchedService()
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	router := &anyPortRouterClient{mockRouterClient: &mockRouterClient{}, reassigned: map[uint16]uint16{80: 8080}}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+	assert.Equal(t, `{"80/TCP":8080}`, updated.Annotations[assignedPortsAnnotationName])
+	assert.Equal(t, `{"80/TCP":8080}`, updated.Annotations[activeMappingsAnnotationName])
+
+	// When the lease is renewed we ask for the port we were given, rather than giving it up and asking for the
+	// original one again.
+	_, err = r.reconcileRequest(req, true)
+	assert.NoError(t, err)
+	assert.Empty(t, router.deleteCalls)
+	assert.Equal(t, []uint16{8080, 8080}, router.addedExternalPorts())
+
+	// Once the router gives us the port we asked for, there's nothing to record.
+	router.reassigned = nil
+	var current corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &current))
+	delete(current.Annotations, assignedPortsAnnotationName)
+	assert.NoError(t, c.Update(context.Background(), &current))
+	_, err = r.reconcileRequest(req, true)
+	assert.NoError(t, err)
+	var renewed corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &renewed))
+	assert.NotContains(t, renewed.Annotations, assignedPortsAnnotationName)
+	assert.Equal(t, `{"80/TCP":80}`, renewed.Annotations[activeMappingsAnnotationName])
+}
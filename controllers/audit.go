@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// StartAuditLoop reconciles every service with the holepunch annotation once per interval, until the context is
+// cancelled. Routers forget their port mappings when they reboot, and nothing in Kubernetes will tell us that's
+// happened, so this is how lost mappings get put back before their lease would have been renewed anyway. The
+// HolepunchConfig can change the interval, and setting it to zero disables auditing until it's changed again.
+//
+// Services are reconciled directly rather than through the controller's work queue, so this should only be run where
+// the controller is running (i.e., on the leader).
+func (r *ServiceReconciler) StartAuditLoop(ctx context.Context, interval time.Duration) error {
+	for {
+		configChanged := r.configUpdates()
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if d := r.auditInterval(interval); d > 0 {
+			timer = time.NewTimer(d)
+			tick = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			stopTimer(timer)
+			return nil
+		case <-configChanged:
+			// Start again with the new interval.
+			stopTimer(timer)
+		case <-tick:
+			if err := r.audit(ctx); err != nil {
+				r.Log.Error(err, "Failed to audit port mappings")
+			}
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// audit reconciles every service with the holepunch annotation once, and then records how many port mappings the router
+// has. Any cached copies of the router's port mappings are read again first.
+func (r *ServiceReconciler) audit(ctx context.Context) error {
+	// The point of the audit is to notice mappings the router has lost, which a cached copy of its mappings would hide.
+	r.refreshMappingCaches(ctx)
+	if _, _, err := r.ReconcileAll(ctx); err != nil {
+		return err
+	}
+	r.recordRouterPortMappings(ctx)
+	return nil
+}
+
+// ReconcileAll fully reconciles every service in scope with the holepunch annotation, or opted in by its namespace's
+// HolepunchPolicy, once, even if it hasn't changed. It returns how many services' ports were forwarded, and how many
+// couldn't be. Each reconcile logs any errors itself, and a service failing doesn't stop the rest being reconciled, so
+// only failing to list the services is returned as an error. Services are reconciled directly rather than through the
+// controller's work queue, so this should only be used where the controller is running (i.e., on the leader).
+func (r *ServiceReconciler) ReconcileAll(ctx context.Context) (succeeded, failed int, err error) {
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services); err != nil {
+		return 0, 0, fmt.Errorf("unable to list services to reconcile: %w", err)
+	}
+	for _, service := range services.Items {
+		if ctx.Err() != nil {
+			break
+		}
+		if !r.inScope(&service) || !HasHolepunchAnnotation(r.withHolepunchPolicy(ctx, r.Log, service)) ||
+			!service.DeletionTimestamp.IsZero() {
+			continue
+		}
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: service.Namespace, Name: service.Name}}
+		if _, failure, _ := r.reconcileRequestOutcome(req, true); failure != nil {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	return succeeded, failed, nil
+}
+
+// recordRouterPortMappings records how many port mappings the router has, if we're recording metrics. Routers that
+// can't tell us are asked for each mapping instead. Not being able to count them isn't worth failing the audit over.
+func (r *ServiceReconciler) recordRouterPortMappings(ctx context.Context) {
+	if r.Metrics == nil {
+		return
+	}
+	router, err := r.getRouterClient(ctx)
+	if err != nil {
+		r.Log.V(1).Info("Unable to count the router's port mappings", "error", err.Error())
+		return
+	}
+	count, err := router.GetPortMappingNumberOfEntries()
+	n := int(count)
+	if err != nil {
+		mappings, err := GetAllPortMappings(ctx, router)
+		if err != nil {
+			r.Log.V(1).Info("Unable to count the router's port mappings", "error", err.Error())
+			return
+		}
+		n = len(mappings)
+	}
+	r.Metrics.RecordRouterPortMappings(n)
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestAuditReestablishesMappingsAfterRouterReboot(t *testing.T) {
+	service := holepunchedService()
+	other := serviceWithMeta(nil)
+	other.Name = "not-holepunched"
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {
+			InternalPort:   80,
+			InternalClient: "192.168.1.10",
+			Enabled:        true,
+			Description:    "Mapping for my-service/default",
+			LeaseDuration:  leaseDurationSeconds,
+		},
+	}}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service, other), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	ctx := context.Background()
+
+	// While the router still has the mapping there's nothing to do
+	assert.NoError(t, r.audit(ctx))
+	assert.Empty(t, router.addCalls)
+
+	// The router reboots and forgets everything, so the next audit puts the mapping back
+	router.entries = nil
+	assert.NoError(t, r.audit(ctx))
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+}
+
+func TestAuditRecordsRouterPortMappings(t *testing.T) {
+	for name, numberOfEntriesErr := range map[string]error{
+		"counted by router": nil,
+		"listed":            upnpFault(401),
+	} {
+		t.Run(name, func(t *testing.T) {
+			router := &mockRouterClient{
+				entries: map[string]portMappingEntry{
+					"22/TCP":  {InternalPort: 22, InternalClient: "192.168.1.2"},
+					"443/TCP": {InternalPort: 443, InternalClient: "192.168.1.3"},
+				},
+				numberOfEntriesErr: numberOfEntriesErr,
+			}
+			calls := 0
+			m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+			assert.NoError(t, err)
+			r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme), scheme.Scheme,
+				WithLogger(logf.NullLogger{}),
+				WithEventRecorder(record.NewFakeRecorder(10)),
+				WithMetricsRecorder(m),
+				WithRouterClientFactory(countingPicker(router, &calls)),
+			)
+
+			assert.NoError(t, r.audit(context.Background()))
+			assert.Equal(t, float64(2), testutil.ToFloat64(m.routerMappings))
+		})
+	}
+}
+
+func TestStartAuditLoop(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.StartAuditLoop(ctx, 10*time.Millisecond)
+	}()
+
+	assert.Eventually(t, func() bool {
+		router.mu.Lock()
+		defer router.mu.Unlock()
+		return len(router.addCalls) >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("audit loop didn't stop when its context was cancelled")
+	}
+}
+
+func TestReconcileAll(t *testing.T) {
+	noIP := namedService("no-ip", nil)
+	noIP.Status.LoadBalancer.Ingress = nil
+	notHolepunched := serviceWithMeta(nil)
+	notHolepunched.Name = "not-holepunched"
+	other := namedService("other", nil)
+	other.Spec.Ports[0].Port = 443
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService(), noIP, notHolepunched, other),
+		scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	succeeded, failed, err := r.ReconcileAll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, succeeded)
+	assert.Equal(t, 1, failed)
+	assert.ElementsMatch(t, []uint16{80, 443}, router.addedExternalPorts())
+}
+
+func TestReconcileAllListFails(t *testing.T) {
+	r := NewServiceReconciler(failingListClient{}, scheme.Scheme, WithLogger(logf.NullLogger{}))
+	_, _, err := r.ReconcileAll(context.Background())
+	assert.Error(t, err)
+}
+
+func TestReconcileAllSkipsServicesOutOfScope(t *testing.T) {
+	elsewhere := holepunchedService()
+	elsewhere.Namespace = "elsewhere"
+	router := &mockRouterClient{}
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService(), elsewhere)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithServiceNamespaceSelector("default"),
+	)
+
+	succeeded, failed, err := r.ReconcileAll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, succeeded)
+	assert.Zero(t, failed)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+
+	// The service out of scope isn't touched at all, not even to add our finalizer.
+	var service corev1.Service
+	assert.NoError(t, c.Get(context.Background(), types.NamespacedName{Namespace: "elsewhere", Name: "my-service"}, &service))
+	assert.Empty(t, service.Finalizers)
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Cleanup removes the port mappings for every service with the holepunch annotation (or opted in by a HolepunchPolicy)
+// from the router, so that they don't outlive holepunch until their leases expire. Services themselves are left alone,
+// so their ports are forwarded again when holepunch next starts. Failing to remove one service's mappings doesn't stop
+// us trying the rest.
+//
+// This is meant to be called as holepunch shuts down, and only where the controller was running (i.e., on the leader),
+// as otherwise it would remove mappings that the leader is still looking after.
+func (r *ServiceReconciler) Cleanup(ctx context.Context) error {
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, service := range services.Items {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		// Services out of scope may belong to another instance of holepunch, which is still forwarding their ports.
+		if !r.inScope(&service) {
+			continue
+		}
+		name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+		log := r.Log.WithValues("service", name)
+		service := r.withHolepunchPolicy(ctx, log, service)
+		if !HasHolepunchAnnotation(service) {
+			continue
+		}
+		router, _, err := r.getServiceRouterClient(ctx, log, &service)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", name, err))
+			continue
+		}
+		settings := r.withResolvedRemoteHost(ctx, log, &service, service)
+		if err := deletePortMappings(log, r.withDryRun(log, router), settings, r.descriptionPrefix(settings)); err != nil {
+			log.Error(err, "Failed to remove port mappings on shutdown")
+			errs = append(errs, fmt.Errorf("service %s: %w", name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestCleanupRemovesEveryAnnotatedServicesMappings(t *testing.T) {
+	web := holepunchedService()
+	web.Annotations[activeMappingsAnnotationName] = `{"80/TCP":3000,"443/TCP":443}`
+	dns := holepunchedService()
+	dns.Name = "dns"
+	dns.Spec.Ports = []corev1.ServicePort{{Port: 53, Protocol: corev1.ProtocolUDP}}
+	other := holepunchedService()
+	other.Name = "not-holepunched"
+	other.Annotations = nil
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, web, dns, other), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithRouterClients(router),
+	)
+
+	assert.NoError(t, r.Cleanup(context.Background()))
+	assert.ElementsMatch(t, []portMappingCall{
+		{ExternalPort: 3000, Protocol: "TCP"},
+		{ExternalPort: 443, Protocol: "TCP"},
+		{ExternalPort: 53, Protocol: "UDP"},
+	}, router.deleteCalls)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestCleanupCarriesOnAfterErrors(t *testing.T) {
+	web := holepunchedService()
+	dns := holepunchedService()
+	dns.Name = "dns"
+	router := &mockRouterClient{deleteErr: errors.New("router unavailable")}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, web, dns), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithRouterClients(router),
+	)
+
+	err := r.Cleanup(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "default/my-service")
+	assert.Contains(t, err.Error(), "default/dns")
+	assert.Len(t, router.deleteCalls, 2)
+}
+
+func TestCleanupDryRun(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithRouterClients(router),
+		WithDryRun(true),
+	)
+
+	assert.NoError(t, r.Cleanup(context.Background()))
+	assert.Empty(t, router.deleteCalls)
+}
+
+func TestCleanupLeavesServicesOutOfScope(t *testing.T) {
+	web := holepunchedService()
+	web.Annotations[activeMappingsAnnotationName] = `{"80/TCP":80}`
+	sharded := holepunchedService()
+	sharded.Name = "sharded"
+	sharded.Labels = map[string]string{"shard": "b"}
+	sharded.Annotations[activeMappingsAnnotationName] = `{"8080/TCP":8080}`
+	web.Labels = map[string]string{"shard": "a"}
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, web, sharded), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithRouterClients(router),
+		WithServiceLabelSelector(labels.SelectorFromSet(labels.Set{"shard": "a"})),
+	)
+
+	// Another instance of holepunch looks after the other shard, so its mappings are left alone.
+	assert.NoError(t, r.Cleanup(context.Background()))
+	assert.Equal(t, []portMappingCall{{ExternalPort: 80, Protocol: "TCP"}}, router.deleteCalls)
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// conditionsAnnotationName holds the service's conditions, JSON-encoded. Services have no way for us to add our own
+// status conditions, so we keep them in an annotation instead.
+const conditionsAnnotationName = "holepunch.io/conditions"
+
+const (
+	// ConditionTypePortsMapped is whether all of the service's ports have been forwarded.
+	ConditionTypePortsMapped = "holepunch.io/PortsMapped"
+	// ConditionTypeRouterReachable is whether we could find a router to forward the service's ports on.
+	ConditionTypeRouterReachable = "holepunch.io/RouterReachable"
+)
+
+// Reasons for the service's conditions.
+const (
+	ReasonPortsMapped          = "PortsMapped"
+	ReasonPortMappingFailed    = "PortMappingFailed"
+	ReasonInvalidConfiguration = "InvalidConfiguration"
+	ReasonRouterFound          = "RouterFound"
+	ReasonRouterNotFound       = "RouterNotFound"
+)
+
+// Condition is the state of one aspect of a service's port mappings. It mirrors the conditions that Kubernetes
+// resources have in their status.
+type Condition struct {
+	Type   string                 `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// Reason is a CamelCase reason for the condition's last transition.
+	Reason string `json:"reason"`
+	// Message is a human-readable explanation of the condition.
+	Message string `json:"message,omitempty"`
+	// LastTransitionTime is when the condition's status last changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// GetConditions reads the conditions recorded on a service by holepunch.
+func GetConditions(service corev1.Service) ([]Condition, error) {
+	encoded, ok := service.Annotations[conditionsAnnotationName]
+	if !ok {
+		return nil, nil
+	}
+	var conditions []Condition
+	if err := json.Unmarshal([]byte(encoded), &conditions); err != nil {
+		return nil, fmt.Errorf("unable to parse %s annotation: %w", conditionsAnnotationName, err)
+	}
+	return conditions, nil
+}
+
+// setConditions updates the conditions recorded on a service, leaving any other conditions alone. A condition's
+// transition time is only changed when its status does. It returns true if anything changed, in which case the
+// service needs updating.
+func setConditions(service *corev1.Service, conditions ...Condition) bool {
+	// If the annotation has been mangled then we just start again.
+	existing, _ := GetConditions(*service)
+	changed := false
+	for _, condition := range conditions {
+		found := false
+		for i := range existing {
+			if existing[i].Type != condition.Type {
+				continue
+			}
+			found = true
+			if existing[i].Status != condition.Status {
+				existing[i].Status = condition.Status
+				existing[i].LastTransitionTime = metav1.Now()
+				changed = true
+			}
+			if existing[i].Reason != condition.Reason || existing[i].Message != condition.Message {
+				existing[i].Reason = condition.Reason
+				existing[i].Message = condition.Message
+				changed = true
+			}
+		}
+		if !found {
+			condition.LastTransitionTime = metav1.Now()
+			existing = append(existing, condition)
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	encoded, err := json.Marshal(existing)
+	if err != nil {
+		return false
+	}
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	service.Annotations[conditionsAnnotationName] = string(encoded)
+	return true
+}
+
+// updateConditions records conditions on a service after a failed reconcile. We're already failing, so an error here
+// is only logged. In dry-run mode the service is never changed.
+func (r *ServiceReconciler) updateConditions(ctx context.Context, log logr.Logger, service *corev1.Service, conditions ...Condition) {
+	if r.dryRun() || !setConditions(service, conditions...) {
+		return
+	}
+	if err := r.Update(ctx, service); err != nil {
+		log.Error(err, "Failed to update conditions")
+	}
+}
+
+func routerReachableCondition(err error) Condition {
+	if err != nil {
+		return Condition{Type: ConditionTypeRouterReachable, Status: corev1.ConditionFalse, Reason: ReasonRouterNotFound, Message: err.Error()}
+	}
+	return Condition{Type: ConditionTypeRouterReachable, Status: corev1.ConditionTrue, Reason: ReasonRouterFound}
+}
+
+func portsMappedCondition(reason string, err error) Condition {
+	if err != nil {
+		return Condition{Type: ConditionTypePortsMapped, Status: corev1.ConditionFalse, Reason: reason, Message: err.Error()}
+	}
+	return Condition{Type: ConditionTypePortsMapped, Status: corev1.ConditionTrue, Reason: reason}
+}
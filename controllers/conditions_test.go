@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// conditionsByType reads back the conditions on a service, keyed by their type.
+func conditionsByType(t *testing.T, service corev1.Service) map[string]Condition {
+	conditions, err := GetConditions(service)
+	assert.NoError(t, err)
+	byType := make(map[string]Condition)
+	for _, condition := range conditions {
+		byType[condition.Type] = condition
+	}
+	return byType
+}
+
+func TestSetConditions(t *testing.T) {
+	service := &corev1.Service{}
+	assert.True(t, setConditions(service, portsMappedCondition(ReasonPortMappingFailed, errors.New("router unavailable"))))
+	condition := conditionsByType(t, *service)[ConditionTypePortsMapped]
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, ReasonPortMappingFailed, condition.Reason)
+	assert.Equal(t, "router unavailable", condition.Message)
+	assert.False(t, condition.LastTransitionTime.IsZero())
+
+	// Setting the same condition again changes nothing
+	assert.False(t, setConditions(service, portsMappedCondition(ReasonPortMappingFailed, errors.New("router unavailable"))))
+
+	// A different reason with the same status doesn't count as a transition
+	anHourAgo := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	service.Annotations[conditionsAnnotationName] = `[{"type":"holepunch.io/PortsMapped","status":"False",` +
+		`"reason":"PortMappingFailed","lastTransitionTime":"` + anHourAgo.UTC().Format(time.RFC3339) + `"}]`
+	assert.True(t, setConditions(service, portsMappedCondition(ReasonRouterNotFound, errors.New("no router"))))
+	updated := conditionsByType(t, *service)[ConditionTypePortsMapped]
+	assert.Equal(t, ReasonRouterNotFound, updated.Reason)
+	assert.True(t, updated.LastTransitionTime.Equal(&anHourAgo))
+
+	// A different status does
+	assert.True(t, setConditions(service, portsMappedCondition(ReasonPortsMapped, nil)))
+	updated = conditionsByType(t, *service)[ConditionTypePortsMapped]
+	assert.Equal(t, corev1.ConditionTrue, updated.Status)
+	assert.Empty(t, updated.Message)
+	assert.True(t, updated.LastTransitionTime.After(anHourAgo.Time))
+
+	// Other conditions are left alone
+	assert.True(t, setConditions(service, routerReachableCondition(nil)))
+	assert.Len(t, conditionsByType(t, *service), 2)
+}
+
+func TestReconcileUpdatesConditions(t *testing.T) {
+	service := holepunchedService()
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	router := &mockRouterClient{addErr: errors.New("router unavailable")}
+	var pickErr error
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithHolepunchMode(HolepunchModeUPnP),
+		WithRouterClientFactory(func(context.Context, ...string) (RouterClient, error) {
+			if pickErr != nil {
+				return nil, pickErr
+			}
+			return router, nil
+		}),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	var stored corev1.Service
+
+	// No router to be found
+	pickErr = errors.New("No services found")
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	conditions := conditionsByType(t, stored)
+	assert.Equal(t, corev1.ConditionFalse, conditions[ConditionTypeRouterReachable].Status)
+	assert.Equal(t, ReasonRouterNotFound, conditions[ConditionTypeRouterReachable].Reason)
+	assert.Equal(t, corev1.ConditionFalse, conditions[ConditionTypePortsMapped].Status)
+
+	// The router turns up, but won't forward the port
+	pickErr = nil
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	conditions = conditionsByType(t, stored)
+	assert.Equal(t, corev1.ConditionTrue, conditions[ConditionTypeRouterReachable].Status)
+	assert.Equal(t, corev1.ConditionFalse, conditions[ConditionTypePortsMapped].Status)
+	assert.Equal(t, ReasonPortMappingFailed, conditions[ConditionTypePortsMapped].Reason)
+	assert.Equal(t, "router unavailable", conditions[ConditionTypePortsMapped].Message)
+
+	// Everything works
+	router.addErr = nil
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	conditions = conditionsByType(t, stored)
+	assert.Equal(t, corev1.ConditionTrue, conditions[ConditionTypeRouterReachable].Status)
+	assert.Equal(t, corev1.ConditionTrue, conditions[ConditionTypePortsMapped].Status)
+	assert.Equal(t, ReasonPortsMapped, conditions[ConditionTypePortsMapped].Reason)
+}
+
+func TestReconcileInvalidConfigurationCondition(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[leaseDurationAnnotationName] = "forever"
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	calls := 0
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	var stored corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	condition := conditionsByType(t, stored)[ConditionTypePortsMapped]
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, ReasonInvalidConfiguration, condition.Reason)
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+// holepunchConfigName is the name of the HolepunchConfig we use. Any others are ignored.
+const holepunchConfigName = "holepunch"
+
+// +kubebuilder:rbac:groups=holepunch.jameslaverack.com,resources=holepunchconfigs,verbs=get;list;watch
+
+// loadConfig reads the HolepunchConfig, if there is one, and starts using it if it has changed since we last read it.
+func (r *ServiceReconciler) loadConfig(ctx context.Context) error {
+	var config holepunchv1alpha1.HolepunchConfig
+	err := r.Get(ctx, types.NamespacedName{Name: holepunchConfigName}, &config)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	var spec *holepunchv1alpha1.HolepunchConfigSpec
+	if err == nil {
+		spec = config.Spec.DeepCopy()
+	}
+
+	r.configMu.Lock()
+	if r.configLoaded && config.ResourceVersion == r.configVersion {
+		r.configMu.Unlock()
+		return nil
+	}
+	hadConfig := r.holepunchConfig != nil
+	r.holepunchConfig = spec
+	r.configVersion = config.ResourceVersion
+	r.configLoaded = true
+	r.useConfigLocked()
+	r.configMu.Unlock()
+
+	if spec != nil {
+		r.Log.Info("Loaded HolepunchConfig", "resource-version", config.ResourceVersion)
+	} else if hadConfig {
+		r.Log.Info("HolepunchConfig removed, going back to the command line configuration")
+	}
+	r.flushConfigCaches()
+	return nil
+}
+
+// setConfigMapConfig starts using the settings from a ConfigMap, or stops using them if spec is nil. It returns false
+// if they're the same as before, in which case nothing changes.
+func (r *ServiceReconciler) setConfigMapConfig(spec *holepunchv1alpha1.HolepunchConfigSpec) bool {
+	r.configMu.Lock()
+	if reflect.DeepEqual(spec, r.configMapConfig) {
+		r.configMu.Unlock()
+		return false
+	}
+	r.configMapConfig = spec
+	r.useConfigLocked()
+	r.configMu.Unlock()
+
+	r.flushConfigCaches()
+	return true
+}
+
+// useConfigLocked works out the configuration to use from the HolepunchConfig and ConfigMap, and lets anyone waiting
+// know that it has changed. configMu must be held.
+func (r *ServiceReconciler) useConfigLocked() {
+	r.config = mergeConfigSpecs(r.holepunchConfig, r.configMapConfig)
+	if r.configChanged != nil {
+		close(r.configChanged)
+	}
+	r.configChanged = make(chan struct{})
+}
+
+// flushConfigCaches forgets everything that depends on the configuration. Services may now need different port
+// mappings, or be on a different router, so every service is fully reconciled next time and the router is discovered
+// again.
+func (r *ServiceReconciler) flushConfigCaches() {
+	r.routerCacheMu.Lock()
+	r.routerCache = nil
+	r.routerCacheMu.Unlock()
+	r.invalidateIPv6RouterClient()
+	r.FlushExternalIPCache()
+}
+
+// mergeConfigSpecs combines two configurations, using the settings from override where it has them. It returns nil if
+// neither has any.
+func mergeConfigSpecs(override, base *holepunchv1alpha1.HolepunchConfigSpec) *holepunchv1alpha1.HolepunchConfigSpec {
+	if override == nil {
+		return base
+	}
+	if base == nil {
+		return override
+	}
+	merged := base.DeepCopy()
+	if override.RouterURL != "" {
+		merged.RouterURL = override.RouterURL
+	}
+	if override.LeaseDurationSeconds != nil {
+		merged.LeaseDurationSeconds = override.LeaseDurationSeconds
+	}
+	if override.DryRun != nil {
+		merged.DryRun = override.DryRun
+	}
+	if override.AuditIntervalSeconds != nil {
+		merged.AuditIntervalSeconds = override.AuditIntervalSeconds
+	}
+	if override.CleanupOnShutdown != nil {
+		merged.CleanupOnShutdown = override.CleanupOnShutdown
+	}
+	return merged
+}
+
+// configUpdates returns a channel that is closed the next time the HolepunchConfig changes.
+func (r *ServiceReconciler) configUpdates() <-chan struct{} {
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+	if r.configChanged == nil {
+		r.configChanged = make(chan struct{})
+	}
+	return r.configChanged
+}
+
+// configSpec returns the configuration in use, from the HolepunchConfig and ConfigMap, or nil if there isn't any. It
+// must not be changed.
+func (r *ServiceReconciler) configSpec() *holepunchv1alpha1.HolepunchConfigSpec {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.config
+}
+
+// dryRun returns whether we're in dry-run mode, from the HolepunchConfig if it says, or DryRun otherwise.
+func (r *ServiceReconciler) dryRun() bool {
+	if config := r.configSpec(); config != nil && config.DryRun != nil {
+		return *config.DryRun
+	}
+	return r.DryRun
+}
+
+// routerRootDesc returns the root device descriptions of the routers to configure, from the HolepunchConfig if it
+// says, or RouterRootDesc otherwise.
+func (r *ServiceReconciler) routerRootDesc() []string {
+	if config := r.configSpec(); config != nil && config.RouterURL != "" {
+		return []string{config.RouterURL}
+	}
+	return r.RouterRootDesc
+}
+
+// routerCacheKey identifies the routers we've been told to configure, for caching them once found.
+func (r *ServiceReconciler) routerCacheKey() string {
+	return strings.Join(r.routerRootDesc(), ",")
+}
+
+// auditInterval returns how often to audit port mappings, from the HolepunchConfig if it says, or interval otherwise.
+func (r *ServiceReconciler) auditInterval(interval time.Duration) time.Duration {
+	if config := r.configSpec(); config != nil && config.AuditIntervalSeconds != nil {
+		return time.Duration(*config.AuditIntervalSeconds) * time.Second
+	}
+	return interval
+}
+
+// ShouldCleanupOnShutdown returns whether Cleanup should be called when holepunch stops, from the HolepunchConfig if it
+// says, or CleanupOnShutdown otherwise.
+func (r *ServiceReconciler) ShouldCleanupOnShutdown() bool {
+	if config := r.configSpec(); config != nil && config.CleanupOnShutdown != nil {
+		return *config.CleanupOnShutdown
+	}
+	return r.CleanupOnShutdown
+}
+
+// servicesForConfig maps a change to the HolepunchConfig to a reconcile of every service that holepunch looks after,
+// so that they all pick up the new configuration.
+func (r *ServiceReconciler) servicesForConfig(obj handler.MapObject) []reconcile.Request {
+	if obj.Meta.GetName() != holepunchConfigName {
+		return nil
+	}
+	var services corev1.ServiceList
+	if err := r.List(context.Background(), &services); err != nil {
+		r.Log.Error(err, "Failed to list services after HolepunchConfig changed")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, service := range services.Items {
+		if r.inScope(&service) && (isHolepunchService(&service) || r.namespaceOptedIn(&service)) {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: service.Namespace, Name: service.Name},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+func init() {
+	// Every reconcile looks for a HolepunchConfig, so the fake clients need to know about them.
+	utilruntime.Must(holepunchv1alpha1.AddToScheme(scheme.Scheme))
+}
+
+func int32Ptr(i int32) *int32    { return &i }
+func boolPtr(b bool) *bool       { return &b }
+func stringPtr(s string) *string { return &s }
+
+func holepunchConfig(spec holepunchv1alpha1.HolepunchConfigSpec) *holepunchv1alpha1.HolepunchConfig {
+	return &holepunchv1alpha1.HolepunchConfig{
+		ObjectMeta: v1.ObjectMeta{Name: holepunchConfigName},
+		Spec:       spec,
+	}
+}
+
+func TestConfigChangeReconcilesServicesAgain(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+
+	// Nothing has changed, so the service is left alone.
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+
+	// The new configuration is picked up, and the service's ports are forwarded again using it.
+	config := holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{LeaseDurationSeconds: int32Ptr(600)})
+	assert.NoError(t, c.Create(context.Background(), config))
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 570*time.Second, result.RequeueAfter)
+	if assert.Len(t, router.addCalls, 2) {
+		assert.Equal(t, uint32(600), router.addCalls[1].LeaseDuration)
+	}
+	assert.Equal(t, 2, calls, "the router should be found again, in case it has changed")
+
+	// Going back to the command line configuration counts as a change too.
+	assert.NoError(t, c.Delete(context.Background(), config))
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 3) {
+		assert.Equal(t, uint32(leaseDurationSeconds), router.addCalls[2].LeaseDuration)
+	}
+}
+
+func TestConfigDryRunStopsRouterChanges(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service,
+		holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{DryRun: boolPtr(true)}))
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestConfigOverridesSettings(t *testing.T) {
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme), scheme.Scheme,
+		WithRouterRootDesc("http://192.168.1.1:5000/rootDesc.xml"),
+		WithDryRun(true),
+		WithCleanupOnShutdown(false),
+	)
+	assert.True(t, r.dryRun())
+	assert.False(t, r.ShouldCleanupOnShutdown())
+	assert.Equal(t, []string{"http://192.168.1.1:5000/rootDesc.xml"}, r.routerRootDesc())
+	assert.Equal(t, 10*time.Minute, r.auditInterval(10*time.Minute))
+
+	// Only the fields that are set override anything.
+	r.config = &holepunchv1alpha1.HolepunchConfigSpec{CleanupOnShutdown: boolPtr(true)}
+	assert.True(t, r.dryRun())
+	assert.True(t, r.ShouldCleanupOnShutdown())
+	assert.Equal(t, []string{"http://192.168.1.1:5000/rootDesc.xml"}, r.routerRootDesc())
+
+	r.config = &holepunchv1alpha1.HolepunchConfigSpec{
+		RouterURL:            "http://10.0.0.1:49000/igd.xml",
+		DryRun:               boolPtr(false),
+		AuditIntervalSeconds: int32Ptr(0),
+	}
+	assert.False(t, r.dryRun())
+	assert.Equal(t, []string{"http://10.0.0.1:49000/igd.xml"}, r.routerRootDesc())
+	assert.Equal(t, time.Duration(0), r.auditInterval(10*time.Minute))
+}
+
+func TestServicesForConfig(t *testing.T) {
+	plain := holepunchedService()
+	plain.Name = "plain"
+	plain.Annotations = nil
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService(), plain), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+	)
+
+	config := holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{})
+	requests := r.servicesForConfig(handler.MapObject{Meta: config, Object: config})
+	assert.Equal(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}},
+	}, requests)
+
+	other := holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{})
+	other.Name = "something-else"
+	assert.Empty(t, r.servicesForConfig(handler.MapObject{Meta: other, Object: other}))
+}
+
+func TestServicesForConfigOnlyInScope(t *testing.T) {
+	elsewhere := holepunchedService()
+	elsewhere.Namespace = "elsewhere"
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService(), elsewhere), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithServiceNamespaceSelector("default"),
+	)
+
+	config := holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{})
+	assert.Equal(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}},
+	}, r.servicesForConfig(handler.MapObject{Meta: config, Object: config}))
+}
+
+func TestAuditLoopPicksUpNewInterval(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.StartAuditLoop(ctx, 0) }()
+
+	// Auditing is disabled until the configuration turns it on.
+	assert.NoError(t, c.Create(context.Background(), holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{
+		AuditIntervalSeconds: int32Ptr(1),
+	})))
+	assert.NoError(t, r.loadConfig(context.Background()))
+	assert.Eventually(t, func() bool {
+		router.mu.Lock()
+		defer router.mu.Unlock()
+		return len(router.addCalls) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+// DefaultConfigMapName is the name of the ConfigMap that holepunch reads its settings from, unless told otherwise.
+const DefaultConfigMapName = "holepunch-config"
+
+// Keys in the ConfigMap, each of which has the same meaning as the HolepunchConfigSpec field of the same name.
+const (
+	configMapRouterURLKey            = "routerURL"
+	configMapLeaseDurationSecondsKey = "leaseDurationSeconds"
+	configMapDryRunKey               = "dryRun"
+	configMapAuditIntervalSecondsKey = "auditIntervalSeconds"
+	configMapCleanupOnShutdownKey    = "cleanupOnShutdown"
+)
+
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+
+// ConfigMapReconciler changes the settings of a ServiceReconciler while it's running, from a ConfigMap. This is the
+// same as a HolepunchConfig, for clusters that don't have the CRD installed. If both set something then the
+// HolepunchConfig wins. Whenever the settings change, every service with the holepunch annotation is reconciled again
+// so that it picks them up.
+type ConfigMapReconciler struct {
+	client.Client
+	Log logr.Logger
+	// Namespace and Name identify the ConfigMap to use. Any others are ignored.
+	Namespace string
+	Name      string
+	// Services is the ServiceReconciler whose settings are changed.
+	Services *ServiceReconciler
+}
+
+// Reconcile reads the ConfigMap and, if its settings have changed, starts using them. Removing the ConfigMap goes
+// back to the command line configuration. A ConfigMap with invalid settings is ignored until it's fixed, leaving the
+// previous settings in place.
+func (r *ConfigMapReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	if req.Namespace != r.Namespace || req.Name != r.Name {
+		return ctrl.Result{}, nil
+	}
+	log := r.Log.WithValues("configmap", req.NamespacedName)
+
+	var configMap corev1.ConfigMap
+	var spec *holepunchv1alpha1.HolepunchConfigSpec
+	err := r.Get(ctx, req.NamespacedName, &configMap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		spec, err = parseConfigMap(configMap.Data)
+		if err != nil {
+			log.Error(err, "Invalid configuration, keeping the previous one")
+			return ctrl.Result{}, nil
+		}
+	}
+
+	if !r.Services.setConfigMapConfig(spec) {
+		return ctrl.Result{}, nil
+	}
+	if spec != nil {
+		log.Info("Loaded configuration from ConfigMap", "resource-version", configMap.ResourceVersion)
+	} else {
+		log.Info("ConfigMap removed, going back to the command line configuration")
+	}
+	// Services aren't changed by this, so the service controller wouldn't otherwise notice that they need their ports
+	// forwarding again.
+	_, _, err = r.Services.ReconcileAll(ctx)
+	return ctrl.Result{}, err
+}
+
+// parseConfigMap reads the settings from a ConfigMap's data. Keys that aren't set are left unset in the spec, and
+// unknown keys are ignored.
+func parseConfigMap(data map[string]string) (*holepunchv1alpha1.HolepunchConfigSpec, error) {
+	spec := &holepunchv1alpha1.HolepunchConfigSpec{}
+	if value, ok := data[configMapRouterURLKey]; ok {
+		value = strings.TrimSpace(value)
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s %q must be an http or https URL", configMapRouterURLKey, value)
+		}
+		spec.RouterURL = value
+	}
+	var err error
+	if spec.LeaseDurationSeconds, err = parseConfigMapSeconds(data, configMapLeaseDurationSecondsKey,
+		int64(minLeaseDuration/time.Second), int64(maxLeaseDuration/time.Second)); err != nil {
+		return nil, err
+	}
+	if spec.AuditIntervalSeconds, err = parseConfigMapSeconds(data, configMapAuditIntervalSecondsKey, 0, -1); err != nil {
+		return nil, err
+	}
+	if spec.DryRun, err = parseConfigMapBool(data, configMapDryRunKey); err != nil {
+		return nil, err
+	}
+	if spec.CleanupOnShutdown, err = parseConfigMapBool(data, configMapCleanupOnShutdownKey); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// parseConfigMapSeconds parses a number of seconds from the ConfigMap, which must be at least min and, unless max is
+// negative, at most max. It returns nil if the key isn't set.
+func parseConfigMapSeconds(data map[string]string, key string, min, max int64) (*int32, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s %q is not a whole number of seconds: %w", key, value, err)
+	}
+	if seconds < min || (max >= 0 && seconds > max) {
+		return nil, fmt.Errorf("%s %d is out of range", key, seconds)
+	}
+	s := int32(seconds)
+	return &s, nil
+}
+
+// parseConfigMapBool parses a boolean from the ConfigMap. It returns nil if the key isn't set.
+func parseConfigMapBool(data map[string]string, key string) (*bool, error) {
+	value, ok := data[key]
+	if !ok {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("%s %q is not true or false", key, value)
+	}
+	return &b, nil
+}
+
+// SetupWithManager watches the ConfigMap for changes.
+func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("configmap").
+		For(&corev1.ConfigMap{}).
+		WithEventFilter(r.isConfigMap()).
+		Complete(r)
+}
+
+// isConfigMap filters out events for every ConfigMap but ours.
+func (r *ConfigMapReconciler) isConfigMap() predicate.Predicate {
+	matches := func(meta metav1.Object) bool {
+		return meta != nil && meta.GetNamespace() == r.Namespace && meta.GetName() == r.Name
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return matches(e.Meta) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return matches(e.MetaNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return matches(e.Meta) },
+		GenericFunc: func(e event.GenericEvent) bool { return matches(e.Meta) },
+	}
+}
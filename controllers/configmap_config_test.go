@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+func holepunchConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: ctrl.ObjectMeta{Namespace: "holepunch-system", Name: DefaultConfigMapName},
+		Data:       data,
+	}
+}
+
+func TestConfigMapChangesLeaseDuration(t *testing.T) {
+	router := &mockRouterClient{}
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService())
+	services := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+	r := &ConfigMapReconciler{
+		Client:    c,
+		Log:       logf.NullLogger{},
+		Namespace: "holepunch-system",
+		Name:      DefaultConfigMapName,
+		Services:  services,
+	}
+	configReq := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "holepunch-system", Name: DefaultConfigMapName}}
+	serviceReq := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := services.Reconcile(serviceReq)
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint32(leaseDurationSeconds), router.addCalls[0].LeaseDuration)
+	}
+
+	// Changing the ConfigMap forwards the service's ports again straight away, with the new lease duration.
+	configMap := holepunchConfigMap(map[string]string{"leaseDurationSeconds": "600"})
+	assert.NoError(t, c.Create(context.Background(), configMap))
+	_, err = r.Reconcile(configReq)
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 2) {
+		assert.Equal(t, uint32(600), router.addCalls[1].LeaseDuration)
+	}
+
+	// Nothing has changed, so the services are left alone.
+	_, err = r.Reconcile(configReq)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 2)
+
+	// An invalid value leaves the previous configuration in place.
+	var current corev1.ConfigMap
+	assert.NoError(t, c.Get(context.Background(), configReq.NamespacedName, &current))
+	current.Data["leaseDurationSeconds"] = "forever"
+	assert.NoError(t, c.Update(context.Background(), &current))
+	_, err = r.Reconcile(configReq)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(600), services.defaultLeaseDuration())
+
+	// Removing the ConfigMap goes back to the command line configuration.
+	assert.NoError(t, c.Delete(context.Background(), &current))
+	_, err = r.Reconcile(configReq)
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 3) {
+		assert.Equal(t, uint32(leaseDurationSeconds), router.addCalls[2].LeaseDuration)
+	}
+}
+
+func TestConfigMapIgnoresOtherConfigMaps(t *testing.T) {
+	other := holepunchConfigMap(map[string]string{"dryRun": "true"})
+	other.Name = "something-else"
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, other)
+	services := NewServiceReconciler(c, scheme.Scheme, WithLogger(logf.NullLogger{}))
+	r := &ConfigMapReconciler{Client: c, Log: logf.NullLogger{}, Namespace: "holepunch-system", Name: DefaultConfigMapName, Services: services}
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "holepunch-system", Name: "something-else"}})
+	assert.NoError(t, err)
+	assert.False(t, services.dryRun())
+}
+
+func TestHolepunchConfigOverridesConfigMap(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme,
+		holepunchConfigMap(map[string]string{"dryRun": "true", "leaseDurationSeconds": "600"}),
+		holepunchConfig(holepunchv1alpha1.HolepunchConfigSpec{LeaseDurationSeconds: int32Ptr(900)}))
+	services := NewServiceReconciler(c, scheme.Scheme, WithLogger(logf.NullLogger{}))
+	r := &ConfigMapReconciler{Client: c, Log: logf.NullLogger{}, Namespace: "holepunch-system", Name: DefaultConfigMapName, Services: services}
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "holepunch-system", Name: DefaultConfigMapName}})
+	assert.NoError(t, err)
+	assert.NoError(t, services.loadConfig(context.Background()))
+	assert.True(t, services.dryRun())
+	assert.Equal(t, uint32(900), services.defaultLeaseDuration())
+}
+
+func TestParseConfigMap(t *testing.T) {
+	spec, err := parseConfigMap(map[string]string{
+		"routerURL":            "http://192.168.1.1:5000/rootDesc.xml",
+		"leaseDurationSeconds": "600",
+		"dryRun":               "true",
+		"auditIntervalSeconds": "0",
+		"cleanupOnShutdown":    "false",
+		"somethingElse":        "ignored",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &holepunchv1alpha1.HolepunchConfigSpec{
+		RouterURL:            "http://192.168.1.1:5000/rootDesc.xml",
+		LeaseDurationSeconds: int32Ptr(600),
+		DryRun:               boolPtr(true),
+		AuditIntervalSeconds: int32Ptr(0),
+		CleanupOnShutdown:    boolPtr(false),
+	}, spec)
+
+	spec, err = parseConfigMap(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &holepunchv1alpha1.HolepunchConfigSpec{}, spec)
+
+	for _, data := range []map[string]string{
+		{"routerURL": "192.168.1.1"},
+		{"leaseDurationSeconds": "30"},
+		{"leaseDurationSeconds": "100000"},
+		{"leaseDurationSeconds": "1h"},
+		{"auditIntervalSeconds": "-1"},
+		{"dryRun": "maybe"},
+		{"cleanupOnShutdown": ""},
+	} {
+		_, err := parseConfigMap(data)
+		assert.Error(t, err, "%v", data)
+	}
+}
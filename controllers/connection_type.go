@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// detectConnectionType asks a router we've just found how it connects to the internet (e.g., "IP_Routed" or
+// "PPPoE_Relay"), and logs it. Not every router will say, and NAT-PMP routers never do, so failing is only logged and
+// an empty connection type returned.
+func (r *ServiceReconciler) detectConnectionType(router RouterClient) string {
+	connectionType, possibleConnectionTypes, err := r.instrumentRouterClient(router).GetConnectionTypeInfo()
+	if err != nil {
+		r.Log.Info("Unable to find out the router's connection type", "error", err.Error())
+		return ""
+	}
+	r.Log.Info("Found router's connection type", "connection-type", connectionType,
+		"possible-connection-types", possibleConnectionTypes, "dynamic-ip", isDynamicConnectionType(connectionType))
+	return connectionType
+}
+
+// isDynamicConnectionType returns whether a router with the connection type gets its external IP over PPPoE or DHCP,
+// which may change it whenever the session or lease ends.
+func isDynamicConnectionType(connectionType string) bool {
+	connectionType = strings.ToUpper(connectionType)
+	return strings.Contains(connectionType, "PPP") || strings.Contains(connectionType, "DHCP")
+}
+
+// routerConnectionType returns the connection type of the router found for the service, as returned by
+// getServiceRouterClient, or an empty string if it's not known.
+func (r *ServiceReconciler) routerConnectionType(service corev1.Service, ownRouter bool) string {
+	if !ownRouter && len(r.RouterClients) > 0 {
+		return r.routerClientsConnectionType
+	}
+	cacheKey := r.routerCacheKey()
+	if ownRouter {
+		routerURL, _ := getServiceRouterURL(service)
+		cacheKey = serviceRouterCacheKey(routerURL)
+	}
+	r.routerCacheMu.RLock()
+	defer r.routerCacheMu.RUnlock()
+	return r.routerCache[cacheKey].connectionType
+}
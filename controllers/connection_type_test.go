@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestIsDynamicConnectionType(t *testing.T) {
+	for connectionType, expected := range map[string]bool{
+		"IP_Routed":     false,
+		"IP_Bridged":    false,
+		"Unconfigured":  false,
+		"":              false,
+		"PPPoE_Relay":   true,
+		"PPPoE_Bridged": true,
+		"DHCP_Spoofed":  true,
+		"ip_routed_ppp": true,
+	} {
+		assert.Equal(t, expected, isDynamicConnectionType(connectionType), connectionType)
+	}
+}
+
+func TestReconcileAdjustsForConnectionType(t *testing.T) {
+	for name, test := range map[string]struct {
+		connectionType    string
+		connectionTypeErr error
+		expectedLease     uint32
+		expectedAnnotated string
+	}{
+		"static IP":          {connectionType: "IP_Routed", expectedLease: leaseDurationSeconds, expectedAnnotated: "IP_Routed"},
+		"PPPoE":              {connectionType: "PPPoE_Relay", expectedLease: leaseDurationSeconds / 2, expectedAnnotated: "PPPoE_Relay"},
+		"DHCP":               {connectionType: "DHCP_Spoofed", expectedLease: leaseDurationSeconds / 2, expectedAnnotated: "DHCP_Spoofed"},
+		"router doesn't say": {connectionTypeErr: errors.New("Invalid Action"), expectedLease: leaseDurationSeconds},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := holepunchedService()
+			router := &mockRouterClient{connectionType: test.connectionType, connectionTypeErr: test.connectionTypeErr}
+			c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+			r := NewServiceReconciler(c, scheme.Scheme,
+				WithLogger(logf.NullLogger{}),
+				WithEventRecorder(record.NewFakeRecorder(10)),
+				WithRouterClients(router),
+			)
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+			result, err := r.Reconcile(req)
+			assert.NoError(t, err)
+			if assert.Len(t, router.addCalls, 1) {
+				assert.Equal(t, test.expectedLease, router.addCalls[0].LeaseDuration)
+			}
+			expectedInterval, err := getReconcileInterval(*service, leaseDurationSeconds)
+			assert.NoError(t, err)
+			if test.expectedLease != leaseDurationSeconds {
+				expectedInterval /= 2
+			}
+			assert.Equal(t, expectedInterval, result.RequeueAfter)
+
+			var updated corev1.Service
+			assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+			if test.expectedAnnotated == "" {
+				assert.NotContains(t, updated.Annotations, routerConnectionTypeAnnotationName)
+			} else {
+				assert.Equal(t, test.expectedAnnotated, updated.Annotations[routerConnectionTypeAnnotationName])
+			}
+
+			// The router is only asked once, not on every reconcile.
+			r.forgetProcessed(req.NamespacedName)
+			_, err = r.Reconcile(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, router.connectionTypeCalls)
+		})
+	}
+}
+
+func TestDiscoveredRouterConnectionType(t *testing.T) {
+	router := &mockRouterClient{connectionType: "PPPoE_Relay"}
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}))
+	r.RouterClientFactory = func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+		return router, nil
+	}
+
+	_, err := r.getRouterClient(context.Background())
+	assert.NoError(t, err)
+	_, err = r.getRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, router.connectionTypeCalls, "only asked when the router is discovered")
+	assert.Equal(t, "PPPoE_Relay", r.routerConnectionType(*holepunchedService(), false))
+}
@@ -0,0 +1,315 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+)
+
+// ContextualRouterClient is a RouterClient whose calls take a context, so that they can be cancelled when the
+// reconcile making them is (e.g., because the controller is shutting down). The UPnP routers we discover support this
+// directly, and the wrappers we put around routers pass the context on to them. Any other RouterClient can be made
+// into one with asContextual.
+type ContextualRouterClient interface {
+	RouterClient
+	igdContextClient
+
+	GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+		NewPortMappingNumberOfEntries uint16,
+		err error,
+	)
+}
+
+// asContextual returns router as a ContextualRouterClient, wrapping it in a contextualClientAdapter if it doesn't
+// support contexts itself.
+func asContextual(router RouterClient) ContextualRouterClient {
+	if c, ok := router.(ContextualRouterClient); ok {
+		return c
+	}
+	return &contextualClientAdapter{RouterClient: router}
+}
+
+// contextualClientAdapter makes any RouterClient into a ContextualRouterClient. The router client gives us no way to
+// cancel a call, so when the context is done the call carries on in the background until the router answers or the
+// connection fails. We just stop waiting for it.
+type contextualClientAdapter struct {
+	RouterClient
+}
+
+// call runs f, giving up if ctx is done first. See awaitCall.
+func (a *contextualClientAdapter) call(ctx context.Context, operation string, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("not calling %s on router: %w", operation, err)
+	}
+	if err := awaitCall(ctx, f); err != nil {
+		if ctx.Err() != nil && err == ctx.Err() {
+			return fmt.Errorf("stopped waiting for router to respond to %s: %w", operation, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (a *contextualClientAdapter) AddPortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return a.call(ctx, "AddPortMapping", func() error {
+		return a.RouterClient.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	})
+}
+
+func (a *contextualClientAdapter) DeletePortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return a.call(ctx, "DeletePortMapping", func() error {
+		return a.RouterClient.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+	})
+}
+
+func (a *contextualClientAdapter) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	var m PortMappingEntry
+	err = a.call(ctx, "GetSpecificPortMappingEntry", func() error {
+		var err error
+		m.InternalPort, m.InternalClient, m.Enabled, m.Description, m.LeaseDuration, err =
+			a.RouterClient.GetSpecificPortMappingEntry(NewRemoteHost, NewExternalPort, NewProtocol)
+		return err
+	})
+	if err != nil {
+		return 0, "", false, "", 0, err
+	}
+	return m.InternalPort, m.InternalClient, m.Enabled, m.Description, m.LeaseDuration, nil
+}
+
+func (a *contextualClientAdapter) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	var m PortMappingEntry
+	err = a.call(ctx, "GetGenericPortMappingEntry", func() error {
+		var err error
+		m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description,
+			m.LeaseDuration, err = a.RouterClient.GetGenericPortMappingEntry(NewPortMappingIndex)
+		return err
+	})
+	if err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+	return m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description,
+		m.LeaseDuration, nil
+}
+
+func (a *contextualClientAdapter) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	var ip string
+	err = a.call(ctx, "GetExternalIPAddress", func() error {
+		var err error
+		ip, err = a.RouterClient.GetExternalIPAddress()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return ip, nil
+}
+
+func (a *contextualClientAdapter) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	var connectionType, possibleConnectionTypes string
+	err = a.call(ctx, "GetConnectionTypeInfo", func() error {
+		var err error
+		connectionType, possibleConnectionTypes, err = a.RouterClient.GetConnectionTypeInfo()
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return connectionType, possibleConnectionTypes, nil
+}
+
+func (a *contextualClientAdapter) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	var n uint16
+	err = a.call(ctx, "GetPortMappingNumberOfEntries", func() error {
+		var err error
+		n, err = a.RouterClient.GetPortMappingNumberOfEntries()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// AddAnyPortMapping passes through to the router we wrap, so that wrapping a router doesn't hide its support for it.
+func (a *contextualClientAdapter) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	return addAnyPortMapping(a.RouterClient, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+// contextRouterClient makes the calls of a plain RouterClient with a context, so that code written against
+// RouterClient stops calling the router once the context is done.
+type contextRouterClient struct {
+	router ContextualRouterClient
+	ctx    context.Context
+}
+
+// withContext returns a RouterClient that makes every call to router with ctx.
+func withContext(ctx context.Context, router RouterClient) RouterClient {
+	return &contextRouterClient{router: asContextual(router), ctx: ctx}
+}
+
+func (c *contextRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return c.router.AddPortMappingCtx(c.ctx, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (c *contextRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return c.router.DeletePortMappingCtx(c.ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (c *contextRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return c.router.GetSpecificPortMappingEntryCtx(c.ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (c *contextRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return c.router.GetGenericPortMappingEntryCtx(c.ctx, NewPortMappingIndex)
+}
+
+func (c *contextRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	return c.router.GetExternalIPAddressCtx(c.ctx)
+}
+
+func (c *contextRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	return c.router.GetConnectionTypeInfoCtx(c.ctx)
+}
+
+func (c *contextRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	return c.router.GetPortMappingNumberOfEntriesCtx(c.ctx)
+}
+
+// AddAnyPortMapping has no version taking a context, so we stop waiting for it like contextualClientAdapter does.
+func (c *contextRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	var port uint16
+	err = awaitCall(c.ctx, func() error {
+		var err error
+		port, err = addAnyPortMapping(c.router, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+// shutdownContext returns ShutdownContext, or a context that's never done if it isn't set.
+func (r *ServiceReconciler) shutdownContext() context.Context {
+	if r.ShutdownContext == nil {
+		return context.Background()
+	}
+	return r.ShutdownContext
+}
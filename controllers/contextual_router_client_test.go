@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestContextualClientAdapterStopsWaitingWhenCancelled(t *testing.T) {
+	hung := &hungRouterClient{mockRouterClient: &mockRouterClient{}, release: make(chan struct{})}
+	defer close(hung.release)
+	router := asContextual(hung)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := router.AddPortMappingCtx(ctx, "", 80, "TCP", 80, "192.168.1.10", true, "", 3600)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// Once the context is done, we don't call the router at all.
+	ip, err := router.GetExternalIPAddressCtx(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Empty(t, ip)
+}
+
+func TestContextualClientAdapterPassesThroughResults(t *testing.T) {
+	mock := &mockRouterClient{
+		externalIP: "203.0.113.5",
+		deleteErr:  errors.New("NoSuchEntryInArray"),
+		entries: map[string]portMappingEntry{
+			"80/TCP": {InternalPort: 8080, InternalClient: "192.168.1.10", Enabled: true, Description: "web", LeaseDuration: 600},
+		},
+	}
+	router := asContextual(mock)
+	ctx := context.Background()
+
+	assert.NoError(t, router.AddPortMappingCtx(ctx, "", 443, "TCP", 443, "192.168.1.10", true, "", 3600))
+	assert.Len(t, mock.addCalls, 1)
+	assert.EqualError(t, router.DeletePortMappingCtx(ctx, "", 443, "TCP"), "NoSuchEntryInArray")
+
+	internalPort, internalClient, enabled, description, leaseDuration, err :=
+		router.GetSpecificPortMappingEntryCtx(ctx, "", 80, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(8080), internalPort)
+	assert.Equal(t, "192.168.1.10", internalClient)
+	assert.True(t, enabled)
+	assert.Equal(t, "web", description)
+	assert.Equal(t, uint32(600), leaseDuration)
+
+	ip, err := router.GetExternalIPAddressCtx(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.5", ip)
+}
+
+func TestAsContextualKeepsContextualRouters(t *testing.T) {
+	igd := &igdRouterClient{}
+	assert.Same(t, igd, asContextual(igd))
+
+	mock := &mockRouterClient{}
+	assert.Same(t, mock, asContextual(mock).(*contextualClientAdapter).RouterClient)
+}
+
+func TestReconcileStopsCallingRouterOnShutdown(t *testing.T) {
+	hung := &hungRouterClient{mockRouterClient: &mockRouterClient{}, release: make(chan struct{})}
+	defer close(hung.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(hung),
+		WithShutdownContext(ctx),
+	)
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	// The service is retried later, as it would be after any other failure to reach the router.
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Greater(t, int64(result.RequeueAfter), int64(0))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+// contextRecordingRouterClient is a ContextualRouterClient that records the contexts its calls are made with. Asking it
+// for the external IP address waits until the context is done, like a router that never answers.
+type contextRecordingRouterClient struct {
+	*mockRouterClient
+	contexts []context.Context
+}
+
+func (c *contextRecordingRouterClient) AddPortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	c.contexts = append(c.contexts, ctx)
+	return c.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration)
+}
+
+func (c *contextRecordingRouterClient) DeletePortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	c.contexts = append(c.contexts, ctx)
+	return c.DeletePortMapping(remoteHost, externalPort, protocol)
+}
+
+func (c *contextRecordingRouterClient) GetSpecificPortMappingEntryCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string) (uint16, string, bool, string, uint32, error) {
+	c.contexts = append(c.contexts, ctx)
+	return c.GetSpecificPortMappingEntry(remoteHost, externalPort, protocol)
+}
+
+func (c *contextRecordingRouterClient) GetGenericPortMappingEntryCtx(ctx context.Context, index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	c.contexts = append(c.contexts, ctx)
+	return c.GetGenericPortMappingEntry(index)
+}
+
+func (c *contextRecordingRouterClient) GetExternalIPAddressCtx(ctx context.Context) (string, error) {
+	c.contexts = append(c.contexts, ctx)
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (c *contextRecordingRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (string, string, error) {
+	c.contexts = append(c.contexts, ctx)
+	return c.GetConnectionTypeInfo()
+}
+
+func (c *contextRecordingRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (uint16, error) {
+	c.contexts = append(c.contexts, ctx)
+	return c.GetPortMappingNumberOfEntries()
+}
+
+type testContextKey struct{}
+
+func TestInstrumentedRouterPassesContextsThrough(t *testing.T) {
+	inner := &contextRecordingRouterClient{mockRouterClient: &mockRouterClient{}}
+	metrics := &recordingMetricsRecorder{}
+	r := NewServiceReconciler(nil, nil,
+		WithLogger(logf.NullLogger{}),
+		WithMetricsRecorder(metrics),
+		WithRouterCallLogging(true),
+		WithRouterCallRetries(3, time.Millisecond),
+		WithUPnPCallTimeout(50*time.Millisecond),
+	)
+	router := r.withMappingCache(r.instrumentRouterClient(inner), NewMappingCache(inner, time.Hour))
+	ctx := context.WithValue(context.Background(), testContextKey{}, "reconcile")
+
+	assert.NoError(t, withContext(ctx, router).AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.Len(t, inner.addCalls, 1)
+
+	// The router is given the timeout as part of the context, so the call is stopped rather than left running, and
+	// isn't retried once the time is up.
+	start := time.Now()
+	_, err := withContext(ctx, router).GetExternalIPAddress()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(), "router did not respond to GetExternalIPAddress within 50ms")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	if assert.Len(t, inner.contexts, 2) {
+		for _, c := range inner.contexts {
+			assert.Equal(t, "reconcile", c.Value(testContextKey{}))
+			_, hasDeadline := c.Deadline()
+			assert.True(t, hasDeadline)
+		}
+	}
+	assert.Equal(t, []string{"AddPortMapping", "GetExternalIPAddress"}, metrics.operations)
+}
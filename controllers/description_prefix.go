@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getDescriptionPrefix returns what the descriptions of the service's port mappings start with, which is how we tell
+// our mappings apart from those made by other software on the same network. This is the description-prefix annotation
+// if the service has one (even if it's empty), otherwise defaultPrefix.
+func getDescriptionPrefix(service corev1.Service, defaultPrefix string) string {
+	if prefix, ok := service.Annotations[descriptionPrefixAnnotationName]; ok {
+		return prefix
+	}
+	return defaultPrefix
+}
+
+// descriptionPrefix returns the description prefix for the service's port mappings, defaulting to DescriptionPrefix.
+func (r *ServiceReconciler) descriptionPrefix(service corev1.Service) string {
+	return getDescriptionPrefix(service, r.DescriptionPrefix)
+}
+
+// withDescriptionPrefix puts prefix at the start of description, unless it's already there. The result is cut down to
+// the maxDescriptionLength characters that routers have to accept, keeping the prefix so that it's still ours.
+func withDescriptionPrefix(prefix string, description string) string {
+	if strings.HasPrefix(description, prefix) {
+		return description
+	}
+	description = prefix + description
+	if runes := []rune(description); len(runes) > maxDescriptionLength {
+		return string(runes[:maxDescriptionLength])
+	}
+	return description
+}
+
+// unprefixedDescription returns the description that versions of holepunch from before description prefixes gave the
+// service's port mappings. Mappings with it are still ours, so that they're renewed and removed as usual after
+// upgrading rather than being mistaken for another program's.
+func unprefixedDescription(service corev1.Service) string {
+	description, _ := getMappingDescription(service)
+	return description
+}
+
+// ownsDescription returns true if a port mapping with the given description is one of ours, because it starts with
+// prefix or is the unprefixed description from an earlier version.
+func ownsDescription(prefix string, unprefixed string, description string) bool {
+	return strings.HasPrefix(description, prefix) || description == unprefixed
+}
+
+// deleteOwnedPortMapping removes a port mapping from the router in the same way as deletePortMapping, but only if
+// ownsDescription says that it's ours. A mapping with any other description belongs to other software, such as if it
+// took the port over after our mapping expired, so it's left alone. If the router can't tell us what the mapping is
+// then we assume that it's gone, and try removing it anyway. An empty prefix matches any mapping.
+func deleteOwnedPortMapping(log logr.Logger, router RouterClient, prefix string, unprefixed string, remoteHost string, externalPort uint16, protocol string) error {
+	if prefix != "" {
+		_, existingClient, _, existingDescription, _, err := router.GetSpecificPortMappingEntry(remoteHost, externalPort,
+			protocol)
+		if err != nil && remoteHost != "" {
+			_, existingClient, _, existingDescription, _, err = router.GetSpecificPortMappingEntry("", externalPort,
+				protocol)
+		}
+		if err == nil && !ownsDescription(prefix, unprefixed, existingDescription) {
+			log.Info("Leaving port mapping that isn't ours", "external-port", externalPort,
+				"protocol", protocol, "existing-client", existingClient, "existing-description", existingDescription)
+			return nil
+		}
+	}
+	return deletePortMapping(router, remoteHost, externalPort, protocol)
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/JamesLaverack/holepunch/pkg/testutil/mockupnp"
+)
+
+func TestWithDescriptionPrefix(t *testing.T) {
+	assert.Equal(t, "Mapping for my-service/default", withDescriptionPrefix("", "Mapping for my-service/default"))
+	assert.Equal(t, "holepunch:Mapping for my-service/default",
+		withDescriptionPrefix("holepunch:", "Mapping for my-service/default"))
+	assert.Equal(t, "holepunch:My Game Server", withDescriptionPrefix("holepunch:", "holepunch:My Game Server"))
+
+	description := withDescriptionPrefix("holepunch:", strings.Repeat("a", maxDescriptionLength))
+	assert.Len(t, description, maxDescriptionLength)
+	assert.True(t, strings.HasPrefix(description, "holepunch:"))
+}
+
+func TestGetDescriptionPrefix(t *testing.T) {
+	service := corev1.Service{}
+	assert.Equal(t, "holepunch:", getDescriptionPrefix(service, "holepunch:"))
+
+	service.Annotations = map[string]string{descriptionPrefixAnnotationName: "cluster-a:"}
+	assert.Equal(t, "cluster-a:", getDescriptionPrefix(service, "holepunch:"))
+
+	service.Annotations[descriptionPrefixAnnotationName] = ""
+	assert.Equal(t, "", getDescriptionPrefix(service, "holepunch:"))
+}
+
+// otherSoftwareRouter returns a router with port mappings made by other software on ports that a service used to have,
+// or wants, alongside one of ours.
+func otherSoftwareRouter() *mockRouterClient {
+	return &mockRouterClient{entries: map[string]portMappingEntry{
+		"3000/TCP": {InternalPort: 32400, InternalClient: "192.168.1.50", Enabled: true, Description: "Plex Media Server"},
+		"8080/TCP": {InternalPort: 8080, InternalClient: "192.168.1.10", Enabled: true,
+			Description: "holepunch:Mapping for my-service/default"},
+		"443/TCP": {InternalPort: 443, InternalClient: "192.168.1.10", Enabled: true, Description: "Xbox"},
+	}}
+}
+
+func TestSyncPortMappingsLeavesOtherSoftwaresMappings(t *testing.T) {
+	router := otherSoftwareRouter()
+	r := NewServiceReconciler(nil, nil, WithEventRecorder(record.NewFakeRecorder(10)),
+		WithDescriptionPrefix("holepunch:"))
+	service := corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"}}
+
+	err := r.syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.10", 600, nil,
+		map[string]uint16{"80/TCP": 5000, "443/TCP": 443},
+		map[string]uint16{"80/TCP": 3000, "8080/TCP": 8080})
+	// Port 443 is already forwarded to the same place, but by something else, so we refuse to take it over.
+	assert.Error(t, err)
+	assert.Equal(t, []portMappingCall{{ExternalPort: 8080, Protocol: "TCP"}}, router.deleteCalls)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint16(5000), router.addCalls[0].ExternalPort)
+		assert.Equal(t, "holepunch:Mapping for my-service/default", router.addCalls[0].Description)
+	}
+}
+
+func TestDeletePortMappingsLeavesOtherSoftwaresMappings(t *testing.T) {
+	router := otherSoftwareRouter()
+	service := corev1.Service{ObjectMeta: v1.ObjectMeta{
+		Name:        "my-service",
+		Namespace:   "default",
+		Annotations: map[string]string{activeMappingsAnnotationName: `{"80/TCP":3000,"8080/TCP":8080,"53/UDP":53}`},
+	}}
+
+	assert.NoError(t, deletePortMappings(logf.NullLogger{}, router, service, "holepunch:"))
+	// 53/UDP isn't on the router at all, so it's removed in case the router just won't say.
+	assert.ElementsMatch(t, []portMappingCall{
+		{ExternalPort: 8080, Protocol: "TCP"},
+		{ExternalPort: 53, Protocol: "UDP"},
+	}, router.deleteCalls)
+
+	// Without a prefix every mapping we recorded is ours.
+	router = otherSoftwareRouter()
+	assert.NoError(t, deletePortMappings(logf.NullLogger{}, router, service, ""))
+	assert.Len(t, router.deleteCalls, 3)
+}
+
+func TestSweepStaleMappingsWithDescriptionPrefix(t *testing.T) {
+	services, router := staleSweepFixtures()
+	router.entries["7000/TCP"] = portMappingEntry{InternalPort: 80, InternalClient: "192.168.1.11",
+		Description: "holepunch:Mapping for gone/default"}
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, services[0], services[1], services[2])
+	r := NewServiceReconciler(c, scheme.Scheme, WithLogger(logf.NullLogger{}), WithRouterClients(router),
+		WithDescriptionPrefix("holepunch:"))
+
+	// The fixtures' mappings have no prefix, as if an earlier version made them, but they're still ours.
+	removed, updated, err := r.SweepStaleMappings(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+	assert.Equal(t, 1, updated)
+	assert.ElementsMatch(t, []portMappingCall{
+		{ExternalPort: 7000, Protocol: "TCP"},
+		{ExternalPort: 8081, Protocol: "TCP"},
+		{ExternalPort: 8082, Protocol: "TCP"},
+		{ExternalPort: 8083, Protocol: "TCP"},
+		{ExternalPort: 8084, Protocol: "UDP"},
+	}, router.deleteCalls)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, "holepunch:Mapping for moved/default", router.addCalls[0].Description)
+	}
+}
+
+func TestSyncPortMappingsReplacesConflictingMappingWeOwn(t *testing.T) {
+	for _, existingDescription := range []string{
+		// Made by an earlier version, before description prefixes.
+		"Mapping for my-service/default",
+		// Made by us with a description the service has since changed.
+		"holepunch:Old description",
+	} {
+		t.Run(existingDescription, func(t *testing.T) {
+			router := conflictingRouterClient{&mockRouterClient{entries: map[string]portMappingEntry{
+				"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true,
+					Description: existingDescription, LeaseDuration: 10},
+			}}}
+			recorder := record.NewFakeRecorder(10)
+			r := NewServiceReconciler(nil, nil, WithEventRecorder(recorder), WithDescriptionPrefix("holepunch:"))
+			desired := map[string]uint16{"80/TCP": 80}
+
+			err := r.syncPortMappings(context.Background(), logf.NullLogger{}, router, *holepunchedService(),
+				"192.168.1.10", 600, nil, desired, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, []portMappingCall{{ExternalPort: 80, Protocol: "TCP"}}, router.deleteCalls)
+			assert.Equal(t, []uint16{80, 80}, router.addedExternalPorts())
+			assert.Equal(t, map[string]uint16{"80/TCP": 80}, desired)
+			assert.Empty(t, drainEvents(recorder))
+		})
+	}
+}
+
+func TestReconcileUpgradesUnprefixedMappings(t *testing.T) {
+	for _, existingClient := range []string{"192.168.1.10", "192.168.1.99"} {
+		t.Run(existingClient, func(t *testing.T) {
+			srv := mockupnp.NewServer(t)
+			srv.AddMapping(mockupnp.Mapping{ExternalPort: 80, Protocol: "TCP", InternalPort: 80,
+				InternalClient: existingClient, Enabled: true, Description: "Mapping for my-service/default",
+				LeaseDuration: leaseDurationSeconds})
+			service := holepunchedService()
+			r, recorder := mockUPnPReconciler(t, srv, service)
+			r.DescriptionPrefix = "holepunch:"
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+			// A mapping made by an earlier version is ours, so it's taken over and given our prefix.
+			_, err := r.Reconcile(req)
+			assert.NoError(t, err)
+			assert.Empty(t, drainEvents(recorder))
+			if mappings := srv.Mappings(); assert.Len(t, mappings, 1) {
+				assert.Equal(t, "192.168.1.10", mappings[0].InternalClient)
+				assert.Equal(t, "holepunch:Mapping for my-service/default", mappings[0].Description)
+			}
+		})
+	}
+}
+
+func TestDeletePortMappingsRemovesUnprefixedMappings(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Description: "Mapping for my-service/default"},
+	}}
+	service := holepunchedService()
+	service.Annotations[activeMappingsAnnotationName] = `{"80/TCP":80}`
+
+	assert.NoError(t, deletePortMappings(logf.NullLogger{}, router, *service, "holepunch:"))
+	assert.Equal(t, []portMappingCall{{ExternalPort: 80, Protocol: "TCP"}}, router.deleteCalls)
+}
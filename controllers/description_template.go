@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PortMappingContext is what a description template annotation can refer to, such as {{.Namespace}}/{{.Name}}.
+type PortMappingContext struct {
+	// Name and Namespace are the service's.
+	Name      string
+	Namespace string
+	// Port is the service port being forwarded, and Protocol is its protocol (e.g., "TCP").
+	Port     string
+	Protocol string
+	// ExternalPort is the port on the router that's forwarded to it.
+	ExternalPort string
+	// ClusterName is the name given to Holepunch with --cluster-name, or empty if it wasn't.
+	ClusterName string
+}
+
+// parseDescriptionTemplate parses tmpl as a Go template for port mapping descriptions. As well as its syntax, it checks
+// that it only refers to fields of PortMappingContext, so that mistakes are caught before any ports are forwarded.
+func parseDescriptionTemplate(tmpl string) (*template.Template, error) {
+	parsed, err := template.New("description").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	sample := PortMappingContext{Name: "name", Namespace: "namespace", Port: "80", Protocol: "TCP", ExternalPort: "80"}
+	if err := parsed.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// renderDescription renders the description template tmpl for a port mapping, cutting it short at
+// maxDescriptionLength characters, as routers have limited room for descriptions.
+func renderDescription(tmpl string, ctx PortMappingContext) (string, error) {
+	parsed, err := parseDescriptionTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return executeDescriptionTemplate(parsed, ctx)
+}
+
+// executeDescriptionTemplate is renderDescription for a template that's already been parsed.
+func executeDescriptionTemplate(tmpl *template.Template, ctx PortMappingContext) (string, error) {
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, ctx); err != nil {
+		return "", err
+	}
+	description := rendered.String()
+	if runes := []rune(description); len(runes) > maxDescriptionLength {
+		description = string(runes[:maxDescriptionLength])
+	}
+	return description, nil
+}
+
+// getDescriptionTemplate parses the service's description template annotation, returning nil if it doesn't have one.
+func getDescriptionTemplate(service corev1.Service) (*template.Template, error) {
+	value, ok := service.Annotations[descriptionTemplateAnnotationName]
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	tmpl, err := parseDescriptionTemplate(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation %q: %w", descriptionTemplateAnnotationName, value, err)
+	}
+	return tmpl, nil
+}
+
+// mappingDescriptions returns how to describe each of the service's port mappings to the router, given its mapping key
+// and external port. If the service has a valid description template annotation then that's rendered for each port,
+// otherwise every port gets the description from getMappingDescription. A template that fails to render for a port
+// falls back to that too. Every description starts with prefix. The error is for an invalid template, which callers
+// should warn about.
+func mappingDescriptions(service corev1.Service, clusterName string, prefix string) (describe func(key string, externalPort uint16) string, err error) {
+	fallback, _ := getMappingDescription(service)
+	fallback = withDescriptionPrefix(prefix, fallback)
+	tmpl, err := getDescriptionTemplate(service)
+	if tmpl == nil {
+		return func(string, uint16) string { return fallback }, err
+	}
+	return func(key string, externalPort uint16) string {
+		port, protocol, err := parseMappingKey(key)
+		if err != nil {
+			return fallback
+		}
+		description, err := executeDescriptionTemplate(tmpl, PortMappingContext{
+			Name:         service.Name,
+			Namespace:    service.Namespace,
+			Port:         strconv.Itoa(int(port)),
+			Protocol:     protocol,
+			ExternalPort: strconv.Itoa(int(externalPort)),
+			ClusterName:  clusterName,
+		})
+		if err != nil || strings.TrimSpace(description) == "" {
+			return fallback
+		}
+		return withDescriptionPrefix(prefix, description)
+	}, nil
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestRenderDescription(t *testing.T) {
+	ctx := PortMappingContext{Name: "web", Namespace: "default", Port: "80", Protocol: "TCP", ExternalPort: "8080",
+		ClusterName: "home"}
+	for name, tc := range map[string]struct {
+		template    string
+		expected    string
+		expectedErr string
+	}{
+		"every field": {
+			template: "{{.ClusterName}}: {{.Namespace}}/{{.Name}} port {{.Port}}/{{.Protocol}} on {{.ExternalPort}}",
+			expected: "home: default/web port 80/TCP on 8080",
+		},
+		"functions": {
+			template: `{{printf "%s-%s" .Name .Port | js}}`,
+			expected: "web-80",
+		},
+		"invalid syntax": {
+			template:    "{{.Name",
+			expectedErr: "template: description:1: unclosed action",
+		},
+		"unknown field": {
+			template:    "{{.Service}}",
+			expectedErr: `template: description:1:2: executing "description" at <.Service>: can't evaluate field Service in type controllers.PortMappingContext`,
+		},
+		"rendering error": {
+			template:    `{{index .Name 10}}`,
+			expectedErr: `template: description:1:2: executing "description" at <index .Name 10>: error calling index: index out of range: 10`,
+		},
+		"too long": {
+			template: strings.Repeat("{{.Name}}", 50),
+			expected: strings.Repeat("web", 50)[:maxDescriptionLength],
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			description, err := renderDescription(tc.template, ctx)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, description)
+		})
+	}
+}
+
+func TestMappingDescriptions(t *testing.T) {
+	service := holepunchedService()
+	describe, err := mappingDescriptions(*service, "home", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Mapping for my-service/default", describe("80/TCP", 8080))
+
+	service.Annotations[descriptionTemplateAnnotationName] = "{{.ClusterName}} {{.Name}} {{.Port}}->{{.ExternalPort}}"
+	describe, err = mappingDescriptions(*service, "home", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "home my-service 80->8080", describe("80/TCP", 8080))
+	assert.Equal(t, "home my-service 53->53", describe("53/UDP", 53))
+
+	// A template that renders nothing isn't any use as a description.
+	service.Annotations[descriptionTemplateAnnotationName] = "{{if .ClusterName}}{{.ClusterName}}{{end}}"
+	describe, err = mappingDescriptions(*service, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Mapping for my-service/default", describe("80/TCP", 80))
+
+	service.Annotations[descriptionTemplateAnnotationName] = "{{.Name"
+	describe, err = mappingDescriptions(*service, "home", "")
+	assert.EqualError(t, err, `invalid holepunch.io/description-template annotation "{{.Name": template: description:1: unclosed action`)
+	assert.Equal(t, "Mapping for my-service/default", describe("80/TCP", 80))
+}
+
+func TestSyncPortMappingsUsesDescriptionTemplate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		template            string
+		expectedDescription string
+		expectedEvents      []string
+	}{
+		"valid": {
+			template:            "{{.Namespace}}/{{.Name}} port {{.Port}}",
+			expectedDescription: "default/my-service port 80",
+		},
+		"invalid": {
+			template:            "{{.Port",
+			expectedDescription: "Mapping for my-service/default",
+			expectedEvents: []string{`Warning InvalidDescriptionTemplate invalid holepunch.io/description-template ` +
+				`annotation "{{.Port": template: description:1: unclosed action`},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := holepunchedService()
+			service.Annotations[descriptionTemplateAnnotationName] = tc.template
+			router := &mockRouterClient{}
+			recorder := record.NewFakeRecorder(10)
+			r := NewServiceReconciler(nil, nil, WithEventRecorder(recorder))
+
+			err := r.syncPortMappings(context.Background(), logf.NullLogger{}, router, *service, "192.168.1.10", 600, nil,
+				map[string]uint16{"80/TCP": 80}, nil)
+			assert.NoError(t, err)
+			if assert.Len(t, router.addCalls, 1) {
+				assert.Equal(t, tc.expectedDescription, router.addCalls[0].Description)
+			}
+			assert.Equal(t, tc.expectedEvents, drainEvents(recorder))
+		})
+	}
+}
+
+func TestValidateServiceAnnotationsDescriptionTemplate(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[descriptionTemplateAnnotationName] = "{{.Nope}}"
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}), WithEventRecorder(recorder))
+
+	problems, forwardable := r.validateServiceAnnotations(service, *service)
+	assert.Equal(t, 1, problems)
+	assert.True(t, forwardable, "the usual description is used instead")
+	events := drainEvents(recorder)
+	if assert.Len(t, events, 1) {
+		assert.True(t, strings.HasPrefix(events[0], "Warning InvalidDescriptionTemplate "), events[0])
+	}
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/huin/goupnp/soap"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	defaultRetryBaseDelay = 5 * time.Second
+	defaultRetryMaxDelay  = 10 * time.Minute
+)
+
+// UPnP error codes that we know how to work around, from the WANIPConnection service specification.
+const (
+	// ErrCodeActionFailed means the router couldn't do what we asked, for a reason it won't tell us.
+	ErrCodeActionFailed = 501
+	// ErrCodeSpecifiedArrayIndexInvalid means we've asked for a port mapping past the end of the router's list.
+	ErrCodeSpecifiedArrayIndexInvalid = 713
+	// ErrCodeNoSuchEntryInArray means the router has no port mapping for the external port we asked about.
+	ErrCodeNoSuchEntryInArray = 714
+	// ErrCodeWildCardNotPermittedInSrcIP means the router can't restrict a port mapping to a single remote host.
+	ErrCodeWildCardNotPermittedInSrcIP = 715
+	// ErrCodeConflictInMappingEntry means the external port is already mapped to a different internal client.
+	ErrCodeConflictInMappingEntry = 718
+	// ErrCodeSamePortValuesRequired means the router can't forward a port to a different internal port.
+	ErrCodeSamePortValuesRequired = 725
+)
+
+// Errors returned while reconciling a service are wrapped with fmt.Errorf's %w at each step, so the error from a
+// reconcile reads from the outside in, e.g. "unable to forward ports of service default/web: UPnP error 501: Action
+// Failed". Whatever caused it can be found with errors.Is and errors.As, which is how we tell:
+//   - what kind of error it is (see errorKind), as permanentError wraps the cause in a kindError;
+//   - what the router said, as its SOAP faults are turned into a UPnPError, which matches any UPnPError with the same
+//     code;
+//   - why the service couldn't be forwarded, from sentinel errors such as ErrNoServiceIP, ErrProtocolNotSupported and
+//     ErrRouterNotFound.
+
+// ErrRouterNotFound is matched by the error returned when no router can be found to configure, whatever the reason.
+var ErrRouterNotFound = errors.New("no router found")
+
+// routerNotFoundError is the error returned when discovering a router fails. It reads the same as the error from
+// discovery, which it wraps, but also matches ErrRouterNotFound.
+type routerNotFoundError struct {
+	err error
+}
+
+func (e *routerNotFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e *routerNotFoundError) Unwrap() error {
+	return e.err
+}
+
+func (e *routerNotFoundError) Is(target error) bool {
+	return target == ErrRouterNotFound
+}
+
+// errPortMappingSkipped means a port wasn't forwarded because something other than holepunch has already forwarded
+// its external port. It's been reported, and shouldn't stop the service's other ports from being forwarded.
+var errPortMappingSkipped = errors.New("external port is already forwarded by something else")
+
+// ErrorKind says whether it's worth retrying after an error.
+type ErrorKind int
+
+const (
+	// Transient errors might go away on their own, such as the router being unreachable while it reboots. We retry
+	// these with an exponential backoff.
+	Transient ErrorKind = iota
+	// Permanent errors won't go away until someone changes something, such as an annotation that can't be parsed.
+	// We don't retry these, as the change will trigger another reconcile anyway.
+	Permanent
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case Transient:
+		return "Transient"
+	case Permanent:
+		return "Permanent"
+	default:
+		return "Unknown"
+	}
+}
+
+// kindError is an error that knows what kind of error it is.
+type kindError struct {
+	kind ErrorKind
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// permanentError marks an error as not being worth retrying.
+func permanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: Permanent, err: err}
+}
+
+// errorKind returns what kind of error err is. Errors that haven't been marked otherwise are assumed to be Transient.
+func errorKind(err error) ErrorKind {
+	var kErr *kindError
+	if errors.As(err, &kErr) {
+		return kErr.kind
+	}
+	return Transient
+}
+
+// newRetryRateLimiter creates the rate limiter we use to back off from retrying transient errors.
+func newRetryRateLimiter() workqueue.RateLimiter {
+	return workqueue.NewItemExponentialFailureRateLimiter(defaultRetryBaseDelay, defaultRetryMaxDelay)
+}
+
+// UPnPError is an error response from the router, with the UPnP error code it gave. The codes we know how to work
+// around are the ErrCode constants.
+type UPnPError struct {
+	Code        int
+	Description string
+	// fault is the SOAP fault it was parsed from, if any.
+	fault error
+}
+
+func (e *UPnPError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("UPnP error %d", e.Code)
+	}
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+func (e *UPnPError) Unwrap() error {
+	return e.fault
+}
+
+// Is reports whether target is a UPnPError with the same code, so that errors.Is(err, &UPnPError{Code: ...}) works.
+func (e *UPnPError) Is(target error) bool {
+	t, ok := target.(*UPnPError)
+	return ok && t.Code == e.Code
+}
+
+// parseUPnPError extracts the UPnP error from an error returned by the router, which goupnp gives us as a SOAP fault.
+// It returns false if the error isn't a UPnP error, or the router didn't say what went wrong.
+func parseUPnPError(err error) (*UPnPError, bool) {
+	var upnpErr *UPnPError
+	if errors.As(err, &upnpErr) {
+		return upnpErr, true
+	}
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) {
+		return nil, false
+	}
+	var detail struct {
+		ErrorCode        int    `xml:"errorCode"`
+		ErrorDescription string `xml:"errorDescription"`
+	}
+	if err := xml.Unmarshal(fault.Detail.Raw, &detail); err != nil || detail.ErrorCode == 0 {
+		return nil, false
+	}
+	return &UPnPError{Code: detail.ErrorCode, Description: strings.TrimSpace(detail.ErrorDescription), fault: fault}, true
+}
+
+// isUPnPError returns whether err is a UPnP error with the given code.
+func isUPnPError(err error, code int) bool {
+	upnpErr, ok := parseUPnPError(err)
+	return ok && upnpErr.Code == code
+}
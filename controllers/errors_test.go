@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/huin/goupnp/soap"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestErrorKind(t *testing.T) {
+	assert.Equal(t, Transient, errorKind(errors.New("connection refused")))
+	assert.Equal(t, Permanent, errorKind(permanentError(errors.New("bad annotation"))))
+	// Wrapping a permanent error doesn't make it transient
+	assert.Equal(t, Permanent, errorKind(fmt.Errorf("reconciling: %w", permanentError(errors.New("bad annotation")))))
+	assert.Nil(t, permanentError(nil))
+}
+
+func TestHelperErrorKinds(t *testing.T) {
+	_, err := toUPnPProtocol(corev1.ProtocolSCTP)
+	assert.Equal(t, Permanent, errorKind(err))
+
+	_, err = GetHolepunchPortMapping(corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{holepunchPortMapAnnotationPrefix + "80": "http"}},
+	})
+	assert.Equal(t, Permanent, errorKind(err))
+
+	_, err = getLeaseDuration(serviceWithLeaseDuration("forever"), leaseDurationSeconds)
+	assert.Equal(t, Permanent, errorKind(err))
+
+	_, err = getRemoteHost(serviceWithRemoteHost("not a host"))
+	assert.Equal(t, Permanent, errorKind(err))
+}
+
+// upnpFault creates the error that goupnp returns when the router responds with a UPnP error code.
+func upnpFault(code int) error {
+	fault := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	fault.Detail.Raw = []byte(fmt.Sprintf(`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+		<errorCode>%d</errorCode><errorDescription>Something went wrong</errorDescription></UPnPError>`, code))
+	return fault
+}
+
+func TestParseUPnPError(t *testing.T) {
+	upnpErr, ok := parseUPnPError(upnpFault(ErrCodeWildCardNotPermittedInSrcIP))
+	if assert.True(t, ok) {
+		assert.Equal(t, ErrCodeWildCardNotPermittedInSrcIP, upnpErr.Code)
+		assert.Equal(t, "Something went wrong", upnpErr.Description)
+		assert.EqualError(t, upnpErr, "UPnP error 715: Something went wrong")
+		// The original fault is still there for anyone who wants it.
+		var fault *soap.SOAPFaultError
+		assert.True(t, errors.As(upnpErr, &fault))
+	}
+
+	// goupnp doesn't wrap the fault, but we might
+	upnpErr, ok = parseUPnPError(fmt.Errorf("adding port mapping: %w", upnpFault(ErrCodeConflictInMappingEntry)))
+	if assert.True(t, ok) {
+		assert.Equal(t, ErrCodeConflictInMappingEntry, upnpErr.Code)
+	}
+
+	// Errors we've already parsed are returned as they are.
+	parsed := &UPnPError{Code: ErrCodeSamePortValuesRequired, Description: "SamePortValuesRequired"}
+	upnpErr, ok = parseUPnPError(fmt.Errorf("adding port mapping: %w", parsed))
+	assert.True(t, ok)
+	assert.Same(t, parsed, upnpErr)
+
+	_, ok = parseUPnPError(errors.New("connection refused"))
+	assert.False(t, ok)
+	_, ok = parseUPnPError(&soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"})
+	assert.False(t, ok)
+	_, ok = parseUPnPError(nil)
+	assert.False(t, ok)
+}
+
+func TestParseUPnPErrorFormats(t *testing.T) {
+	for name, test := range map[string]struct {
+		detail      string
+		code        int
+		description string
+	}{
+		"no namespace": {
+			detail: `<UPnPError><errorCode>714</errorCode><errorDescription>NoSuchEntryInArray</errorDescription></UPnPError>`,
+			code:   714, description: "NoSuchEntryInArray",
+		},
+		"no description": {
+			detail: `<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>501</errorCode></UPnPError>`,
+			code:   501,
+		},
+		"whitespace": {
+			detail: `<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+				<errorCode> 725 </errorCode>
+				<errorDescription>
+					OnlyPermanentLeasesSupported
+				</errorDescription>
+			</UPnPError>`,
+			code: 725, description: "OnlyPermanentLeasesSupported",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fault := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+			fault.Detail.Raw = []byte(test.detail)
+			upnpErr, ok := parseUPnPError(fault)
+			if assert.True(t, ok) {
+				assert.Equal(t, test.code, upnpErr.Code)
+				assert.Equal(t, test.description, upnpErr.Description)
+			}
+		})
+	}
+}
+
+func TestUPnPErrorIs(t *testing.T) {
+	err := fmt.Errorf("adding port mapping: %w", &UPnPError{Code: ErrCodeConflictInMappingEntry, Description: "ConflictInMappingEntry"})
+	assert.True(t, errors.Is(err, &UPnPError{Code: ErrCodeConflictInMappingEntry}))
+	assert.False(t, errors.Is(err, &UPnPError{Code: ErrCodeSamePortValuesRequired}))
+
+	var upnpErr *UPnPError
+	assert.True(t, errors.As(err, &upnpErr))
+	assert.Equal(t, ErrCodeConflictInMappingEntry, upnpErr.Code)
+}
+
+// flakyRouterClient is a mockRouterClient that fails to add mappings a number of times before it starts working.
+type flakyRouterClient struct {
+	*mockRouterClient
+	failures int
+}
+
+func (f *flakyRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	f.mu.Lock()
+	fail := f.failures > 0
+	f.failures--
+	f.mu.Unlock()
+	if fail {
+		return errors.New("router is rebooting")
+	}
+	return f.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration)
+}
+
+func holepunchedService() *corev1.Service {
+	service := serviceWithIngress(corev1.LoadBalancerIngress{IP: "192.168.1.10"})
+	service.ObjectMeta = v1.ObjectMeta{
+		Name:        "my-service",
+		Namespace:   "default",
+		Annotations: map[string]string{holepunchAnnotationName: "true"},
+	}
+	service.Spec.Ports = []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}}
+	return &service
+}
+
+func TestReconcileBacksOffTransientErrors(t *testing.T) {
+	service := holepunchedService()
+	router := &flakyRouterClient{mockRouterClient: &mockRouterClient{}, failures: 3}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	for _, expected := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		result, err := r.Reconcile(req)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result.RequeueAfter)
+	}
+
+	// The router has come back, so we go back to renewing the lease as usual
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(leaseDurationSeconds-30)*time.Second, result.RequeueAfter)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+
+	// Succeeding resets the backoff
+	router.failures = 1
+	r.forgetProcessed(req.NamespacedName)
+	result, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, result.RequeueAfter)
+}
+
+func TestReconcileDoesNotRetryPermanentErrors(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[holepunchPortMapAnnotationPrefix+"80"] = "http"
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestCleanupFailedGivesUpOnPermanentErrors(t *testing.T) {
+	service := holepunchedService()
+	service.Finalizers = []string{portMappingCleanupFinalizer}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service.DeepCopy()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+	)
+
+	_, err := r.cleanupFailed(context.Background(), logf.NullLogger{}, service, permanentError(errors.New("bad annotation")))
+	assert.NoError(t, err)
+	assert.False(t, hasFinalizer(*service, portMappingCleanupFinalizer))
+}
+
+func TestReconcileErrorsUnwrap(t *testing.T) {
+	withoutIP := holepunchedService()
+	withoutIP.Status.LoadBalancer.Ingress = nil
+	invalidSkipPorts := holepunchedService()
+	invalidSkipPorts.Annotations[skipPortsAnnotationName] = "not-a-port"
+
+	for name, test := range map[string]struct {
+		service *corev1.Service
+		router  *mockRouterClient
+		pickErr error
+		check   func(t *testing.T, err error)
+	}{
+		"no service IP": {
+			service: withoutIP,
+			router:  &mockRouterClient{},
+			check: func(t *testing.T, err error) {
+				assert.True(t, errors.Is(err, ErrNoServiceIP))
+			},
+		},
+		"no router": {
+			service: holepunchedService(),
+			pickErr: errors.New("No services found"),
+			check: func(t *testing.T, err error) {
+				assert.True(t, errors.Is(err, ErrRouterNotFound))
+				assert.Contains(t, err.Error(), "No services found")
+			},
+		},
+		"router error": {
+			service: holepunchedService(),
+			router:  &mockRouterClient{addErr: upnpFault(ErrCodeActionFailed)},
+			check: func(t *testing.T, err error) {
+				assert.True(t, errors.Is(err, &UPnPError{Code: ErrCodeActionFailed}))
+				var fault *soap.SOAPFaultError
+				assert.True(t, errors.As(err, &fault), "the router's fault can still be found")
+			},
+		},
+		"invalid annotation": {
+			service: invalidSkipPorts,
+			router:  &mockRouterClient{},
+			check: func(t *testing.T, err error) {
+				assert.Equal(t, Permanent, errorKind(err))
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, test.service), scheme.Scheme,
+				WithLogger(logf.NullLogger{}),
+				WithEventRecorder(record.NewFakeRecorder(10)),
+				WithHolepunchMode(HolepunchModeUPnP),
+				WithRouterClientFactory(func(context.Context, ...string) (RouterClient, error) {
+					if test.pickErr != nil {
+						return nil, test.pickErr
+					}
+					return test.router, nil
+				}),
+			)
+			_, err := r.reconcile(context.Background(), logf.NullLogger{},
+				ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}, false)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "service default/my-service", "errors say which service they're for")
+				test.check(t, err)
+			}
+		})
+	}
+}
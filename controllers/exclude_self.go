@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// isSelfService returns true if the service is for the pod self: either its selector picks the pod, or it's owned by
+// the pod or by whatever owns the pod (such as its ReplicaSet). If the pod can't be found then we can't tell, so false
+// is returned.
+func isSelfService(ctx context.Context, c client.Reader, self types.NamespacedName, service corev1.Service) bool {
+	if self.Name == "" || service.Namespace != self.Namespace {
+		return false
+	}
+	var pod corev1.Pod
+	if err := c.Get(ctx, self, &pod); err != nil {
+		return false
+	}
+	if len(service.Spec.Selector) > 0 && labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+		return true
+	}
+	owners := map[types.UID]bool{pod.UID: true}
+	for _, ref := range pod.OwnerReferences {
+		owners[ref.UID] = true
+	}
+	for _, ref := range service.OwnerReferences {
+		if owners[ref.UID] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var selfPod = types.NamespacedName{Namespace: "default", Name: "holepunch-7d9c5-x2k8p"}
+
+func holepunchPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: selfPod.Namespace,
+			Name:      selfPod.Name,
+			UID:       "pod-uid",
+			Labels:    map[string]string{"control-plane": "controller-manager"},
+			OwnerReferences: []v1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "holepunch-7d9c5", UID: "replicaset-uid"},
+			},
+		},
+	}
+}
+
+func TestIsSelfService(t *testing.T) {
+	selecting := holepunchedService()
+	selecting.Spec.Selector = map[string]string{"control-plane": "controller-manager"}
+	ownedByReplicaSet := holepunchedService()
+	ownedByReplicaSet.OwnerReferences = []v1.OwnerReference{{Kind: "ReplicaSet", Name: "holepunch-7d9c5", UID: "replicaset-uid"}}
+	otherApp := holepunchedService()
+	otherApp.Spec.Selector = map[string]string{"app": "web"}
+	otherNamespace := selecting.DeepCopy()
+	otherNamespace.Namespace = "other"
+
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, holepunchPod())
+	ctx := context.Background()
+	assert.True(t, isSelfService(ctx, c, selfPod, *selecting))
+	assert.True(t, isSelfService(ctx, c, selfPod, *ownedByReplicaSet))
+	assert.False(t, isSelfService(ctx, c, selfPod, *otherApp))
+	assert.False(t, isSelfService(ctx, c, selfPod, *otherNamespace))
+	// Without knowing which pod we are, nothing is ours.
+	assert.False(t, isSelfService(ctx, c, types.NamespacedName{}, *selecting))
+	assert.False(t, isSelfService(ctx, c, types.NamespacedName{Namespace: "default", Name: "gone"}, *selecting))
+}
+
+func TestReconcileExcludeSelf(t *testing.T) {
+	for name, excludeSelf := range map[string]bool{"excluded": true, "not excluded": false} {
+		t.Run(name, func(t *testing.T) {
+			service := holepunchedService()
+			service.Spec.Selector = map[string]string{"control-plane": "controller-manager"}
+			router := &mockRouterClient{}
+			opts := []Option{
+				WithLogger(logf.NullLogger{}),
+				WithEventRecorder(record.NewFakeRecorder(10)),
+				WithRouterClients(router),
+			}
+			if excludeSelf {
+				opts = append(opts, WithExcludeSelf(true), WithSelfPod(selfPod))
+			}
+			r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service, holepunchPod()), scheme.Scheme,
+				opts...)
+
+			_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+			assert.NoError(t, err)
+			if excludeSelf {
+				assert.Empty(t, router.addCalls)
+			} else {
+				assert.Len(t, router.addCalls, 1)
+			}
+		})
+	}
+}
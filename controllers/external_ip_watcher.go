@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// StartExternalIPWatcher asks the router for its external IP once per interval, until the context is cancelled. ISPs
+// can give a router a new external IP whenever they like. Its port mappings still work when that happens, as they
+// only say where to send traffic inside the network, but the external IP recorded on each service would otherwise be
+// out of date until its lease was next renewed. A zero interval disables watching.
+//
+// Like the audit loop, this should only be run where the controller is running (i.e., on the leader).
+func (r *ServiceReconciler) StartExternalIPWatcher(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.checkExternalIP(ctx); err != nil {
+				r.Log.Info("Unable to check the router's external IP", "error", err.Error())
+			}
+		}
+	}
+}
+
+// checkExternalIP asks the router for its external IP, bypassing the cache, and records it on every service with the
+// holepunch annotation that has a different one. Services with their own router are left alone, as it's that router's
+// external IP they record.
+func (r *ServiceReconciler) checkExternalIP(ctx context.Context) error {
+	router, err := r.getRouterClient(ctx)
+	if err != nil {
+		return err
+	}
+	externalIP, err := withContext(ctx, router).GetExternalIPAddress()
+	if err != nil {
+		return err
+	}
+	r.cacheExternalIP(externalIP)
+
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services); err != nil {
+		return err
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		previousIP, ok := service.Annotations[externalIPAnnotationName]
+		if !ok || previousIP == externalIP || !r.inScope(service) || !service.DeletionTimestamp.IsZero() {
+			continue
+		}
+		settings := r.withHolepunchPolicy(ctx, r.Log, *service)
+		if !HasHolepunchAnnotation(settings) || settings.Annotations[routerURLAnnotationName] != "" {
+			continue
+		}
+
+		log := r.Log.WithValues("service", types.NamespacedName{Namespace: service.Namespace, Name: service.Name},
+			"previous-external-ip", previousIP, "external-ip", externalIP)
+		if r.dryRun() {
+			log.Info("[DRY-RUN] Not recording router's new external IP")
+			continue
+		}
+		service.Annotations[externalIPAnnotationName] = externalIP
+		if err := r.Update(ctx, service); err != nil {
+			// The service will get the new IP when it's next reconciled anyway.
+			log.Info("Unable to record router's new external IP", "error", err.Error())
+			continue
+		}
+		log.Info("Router's external IP changed")
+		r.Recorder.Eventf(service, corev1.EventTypeNormal, "ExternalIPChanged",
+			"Router's external IP changed from %s to %s", previousIP, externalIP)
+	}
+	return nil
+}
+
+// cacheExternalIP remembers the router's external IP, as if getExternalIPAddress had just asked for it.
+func (r *ServiceReconciler) cacheExternalIP(externalIP string) {
+	r.externalIPMu.Lock()
+	defer r.externalIPMu.Unlock()
+	r.cachedExternalIP = externalIP
+	r.externalIPExpiry = time.Now().Add(r.externalIPCacheTTL())
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// externalIPSequenceRouter returns each of its IPs in turn from GetExternalIPAddress, and then keeps returning the
+// last one.
+type externalIPSequenceRouter struct {
+	*mockRouterClient
+	ips []string
+}
+
+func (s *externalIPSequenceRouter) GetExternalIPAddress() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ip := s.ips[0]
+	if len(s.ips) > 1 {
+		s.ips = s.ips[1:]
+	}
+	return ip, nil
+}
+
+func TestCheckExternalIPUpdatesServices(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[externalIPAnnotationName] = "203.0.113.1"
+	ownRouter := namedService("own-router", map[string]string{
+		externalIPAnnotationName: "198.51.100.1",
+		routerURLAnnotationName:  "http://192.168.1.2:5000/rootDesc.xml",
+	})
+	notForwarded := namedService("not-forwarded", nil)
+	router := &externalIPSequenceRouter{mockRouterClient: &mockRouterClient{},
+		ips: []string{"203.0.113.1", "203.0.113.2"}}
+	recorder := record.NewFakeRecorder(10)
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service, ownRouter, notForwarded)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+	ctx := context.Background()
+
+	// Nothing has changed yet.
+	assert.NoError(t, r.checkExternalIP(ctx))
+	assert.Empty(t, drainEvents(recorder))
+
+	assert.NoError(t, r.checkExternalIP(ctx))
+	assert.Equal(t, []string{"Normal ExternalIPChanged Router's external IP changed from 203.0.113.1 to 203.0.113.2"},
+		drainEvents(recorder))
+	var stored corev1.Service
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "my-service"}, &stored))
+	assert.Equal(t, "203.0.113.2", stored.Annotations[externalIPAnnotationName])
+	// Reconciles use the new IP without asking the router again.
+	ip, err := r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.2", ip)
+
+	// Services with their own router, or that haven't had their ports forwarded yet, are left alone.
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "own-router"}, &stored))
+	assert.Equal(t, "198.51.100.1", stored.Annotations[externalIPAnnotationName])
+	var notForwardedStored corev1.Service
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "not-forwarded"}, &notForwardedStored))
+	assert.NotContains(t, notForwardedStored.Annotations, externalIPAnnotationName)
+}
+
+func TestCheckExternalIPDryRun(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[externalIPAnnotationName] = "203.0.113.1"
+	recorder := record.NewFakeRecorder(10)
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(&mockRouterClient{externalIP: "203.0.113.2"}),
+		WithDryRun(true),
+	)
+
+	assert.NoError(t, r.checkExternalIP(context.Background()))
+	assert.Empty(t, drainEvents(recorder))
+	var stored corev1.Service
+	assert.NoError(t, c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "my-service"}, &stored))
+	assert.Equal(t, "203.0.113.1", stored.Annotations[externalIPAnnotationName])
+}
+
+func TestStartExternalIPWatcher(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[externalIPAnnotationName] = "203.0.113.1"
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(&externalIPSequenceRouter{mockRouterClient: &mockRouterClient{},
+			ips: []string{"203.0.113.1", "203.0.113.2"}}),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.StartExternalIPWatcher(ctx, 10*time.Millisecond)
+	}()
+
+	assert.Eventually(t, func() bool {
+		var stored corev1.Service
+		err := c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "my-service"}, &stored)
+		return err == nil && stored.Annotations[externalIPAnnotationName] == "203.0.113.2"
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("external IP watcher didn't stop when its context was cancelled")
+	}
+}
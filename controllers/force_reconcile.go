@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ForceReconcileStatus is how the most recent forced reconcile of every service went.
+type ForceReconcileStatus struct {
+	// Running is true while the services are still being reconciled.
+	Running bool `json:"running"`
+	// StartTime is when the services started being reconciled.
+	StartTime *time.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the last service was reconciled.
+	CompletionTime *time.Time `json:"completionTime,omitempty"`
+	// Reconciled is how many services have been reconciled so far.
+	Reconciled int `json:"reconciled"`
+	// Errors is how many of those services couldn't be reconciled.
+	Errors int `json:"errors"`
+	// Error is why the services couldn't be listed, if they couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// ForceReconciler reconciles every service with the holepunch annotation when asked to over HTTP, even if it hasn't
+// changed, so that an operator can put back port mappings that a router has lost (e.g., after a firmware update)
+// without restarting Holepunch. Like the audit loop, services are reconciled directly rather than through the
+// controller's work queue, so it should only be used on the leader.
+//
+// POST starts reconciling the services in the background, and responds with 202 Accepted straight away, or with 409
+// Conflict if they're already being reconciled. GET responds with how the most recent run went. Both respond with a
+// ForceReconcileStatus as JSON.
+type ForceReconciler struct {
+	reconciler *ServiceReconciler
+	// ctx stops the services being reconciled when it's cancelled.
+	ctx context.Context
+
+	mu     sync.Mutex
+	status ForceReconcileStatus
+	// done is closed when the current run finishes.
+	done chan struct{}
+}
+
+// NewForceReconciler makes a ForceReconciler that reconciles services with r until ctx is cancelled.
+func NewForceReconciler(ctx context.Context, r *ServiceReconciler) *ForceReconciler {
+	return &ForceReconciler{reconciler: r, ctx: ctx}
+}
+
+// Start starts reconciling every service in the background. It returns false, and does nothing, if they're already
+// being reconciled.
+func (f *ForceReconciler) Start() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status.Running {
+		return false
+	}
+	now := time.Now()
+	f.status = ForceReconcileStatus{Running: true, StartTime: &now}
+	f.done = make(chan struct{})
+	go f.run(f.done)
+	return true
+}
+
+func (f *ForceReconciler) run(done chan struct{}) {
+	defer close(done)
+	r := f.reconciler
+	r.Log.Info("Reconciling every service, as asked to")
+	// The router may have lost mappings that a cached copy of its mappings would hide, just as for an audit.
+	r.refreshMappingCaches(f.ctx)
+	succeeded, failed, err := r.ReconcileAll(f.ctx)
+	if err != nil {
+		r.Log.Error(err, "Failed to reconcile every service")
+	} else {
+		r.Log.Info("Reconciled every service", "succeeded", succeeded, "failed", failed)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	f.status.Running = false
+	f.status.CompletionTime = &now
+	f.status.Reconciled = succeeded + failed
+	f.status.Errors = failed
+	if err != nil {
+		f.status.Error = err.Error()
+	}
+}
+
+// Status returns how the most recent run went.
+func (f *ForceReconciler) Status() ForceReconcileStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// wait waits for the current run, if there is one, to finish.
+func (f *ForceReconciler) wait() {
+	f.mu.Lock()
+	done := f.done
+	f.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+func (f *ForceReconciler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	code := http.StatusOK
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		code = http.StatusAccepted
+		if !f.Start() {
+			code = http.StatusConflict
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(f.Status())
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func serveForceReconciler(t *testing.T, f *ForceReconciler, method string) (int, ForceReconcileStatus) {
+	recorder := httptest.NewRecorder()
+	f.ServeHTTP(recorder, httptest.NewRequest(method, "/api/v1/reconcile", nil))
+	var status ForceReconcileStatus
+	if recorder.Code != http.StatusMethodNotAllowed {
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&status))
+	}
+	return recorder.Code, status
+}
+
+func TestForceReconcilerReconcilesEveryService(t *testing.T) {
+	noIP := holepunchedService()
+	noIP.Name = "no-ip"
+	noIP.Status.LoadBalancer.Ingress = nil
+	notHolepunched := serviceWithMeta(nil)
+	notHolepunched.Name = "not-holepunched"
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService(), noIP, notHolepunched),
+		scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	ctx := context.Background()
+	// Its ports have already been forwarded, so the controller wouldn't otherwise touch it again for a while.
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	router.addCalls = nil
+	f := NewForceReconciler(ctx, r)
+
+	code, status := serveForceReconciler(t, f, http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Running)
+	assert.Nil(t, status.StartTime)
+
+	code, status = serveForceReconciler(t, f, http.MethodPost)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.NotNil(t, status.StartTime)
+	f.wait()
+
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	code, status = serveForceReconciler(t, f, http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Running)
+	assert.NotNil(t, status.CompletionTime)
+	assert.Equal(t, 2, status.Reconciled)
+	assert.Equal(t, 1, status.Errors)
+	assert.Empty(t, status.Error)
+}
+
+func TestForceReconcilerOnlyRunsOnce(t *testing.T) {
+	f := NewForceReconciler(context.Background(), NewServiceReconciler(
+		fake.NewFakeClientWithScheme(scheme.Scheme), scheme.Scheme, WithLogger(logf.NullLogger{})))
+	// Pretend a run is already under way.
+	f.status.Running = true
+
+	code, status := serveForceReconciler(t, f, http.MethodPost)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.True(t, status.Running)
+}
+
+func TestForceReconcilerRejectsOtherMethods(t *testing.T) {
+	f := NewForceReconciler(context.Background(), NewServiceReconciler(
+		fake.NewFakeClientWithScheme(scheme.Scheme), scheme.Scheme, WithLogger(logf.NullLogger{})))
+	code, _ := serveForceReconciler(t, f, http.MethodDelete)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
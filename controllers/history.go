@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultReconcileHistorySize is how many reconciles ReconcileHistory remembers by default.
+const DefaultReconcileHistorySize = 100
+
+// ReconcileRecord is what happened when a service was reconciled.
+type ReconcileRecord struct {
+	// Time is when the reconcile finished.
+	Time time.Time `json:"time"`
+	// ServiceKey is the namespace and name of the service, e.g. "default/my-service".
+	ServiceKey string `json:"serviceKey"`
+	// Success is true if the service's ports were forwarded.
+	Success bool `json:"success"`
+	// Error is why the reconcile failed, if it did.
+	Error string `json:"error,omitempty"`
+	// MappedPorts are the external ports that were forwarded, in order.
+	MappedPorts []uint16 `json:"mappedPorts,omitempty"`
+}
+
+// ReconcileHistory remembers the most recent reconciles, so that we can look back at what happened when Holepunch
+// misbehaves. Once it's full, each new record replaces the oldest one. It's safe to use from multiple goroutines, and
+// serves its records as JSON.
+type ReconcileHistory struct {
+	mu      sync.RWMutex
+	records []ReconcileRecord
+	// next is where the next record goes.
+	next int
+	full bool
+}
+
+// NewReconcileHistory makes a ReconcileHistory that remembers the last size reconciles. If size isn't positive then
+// DefaultReconcileHistorySize is used.
+func NewReconcileHistory(size int) *ReconcileHistory {
+	if size <= 0 {
+		size = DefaultReconcileHistorySize
+	}
+	return &ReconcileHistory{records: make([]ReconcileRecord, size)}
+}
+
+// Record remembers a reconcile, forgetting the oldest one if the history is full.
+func (h *ReconcileHistory) Record(record ReconcileRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Records returns the reconciles that are remembered, oldest first.
+func (h *ReconcileHistory) Records() []ReconcileRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.full {
+		return append([]ReconcileRecord{}, h.records[:h.next]...)
+	}
+	return append(append([]ReconcileRecord{}, h.records[h.next:]...), h.records[:h.next]...)
+}
+
+// ServeHTTP responds with the remembered reconciles as a JSON array, oldest first.
+func (h *ReconcileHistory) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Records()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// history returns the ReconcileHistory reconciles are recorded in.
+func (r *ServiceReconciler) history() *ReconcileHistory {
+	r.historyOnce.Do(func() {
+		if r.History == nil {
+			r.History = NewReconcileHistory(DefaultReconcileHistorySize)
+		}
+	})
+	return r.History
+}
+
+// recordHistory records the outcome of reconciling a service. mappings are the service's port mappings, in the form
+// produced by getSpecMappings, if they were forwarded.
+func (r *ServiceReconciler) recordHistory(key string, err error, mappings map[string]uint16) {
+	record := ReconcileRecord{Time: time.Now(), ServiceKey: key, Success: err == nil}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	// A TCP and a UDP mapping can share an external port, which only needs listing once.
+	seen := make(map[uint16]bool, len(mappings))
+	for _, externalPort := range mappings {
+		if !seen[externalPort] {
+			seen[externalPort] = true
+			record.MappedPorts = append(record.MappedPorts, externalPort)
+		}
+	}
+	sort.Slice(record.MappedPorts, func(i, j int) bool { return record.MappedPorts[i] < record.MappedPorts[j] })
+	r.history().Record(record)
+}
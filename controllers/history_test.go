@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func serviceKeys(records []ReconcileRecord) []string {
+	var keys []string
+	for _, record := range records {
+		keys = append(keys, record.ServiceKey)
+	}
+	return keys
+}
+
+func TestReconcileHistoryWrapsAround(t *testing.T) {
+	history := NewReconcileHistory(3)
+	assert.Empty(t, history.Records())
+
+	history.Record(ReconcileRecord{ServiceKey: "a"})
+	history.Record(ReconcileRecord{ServiceKey: "b"})
+	assert.Equal(t, []string{"a", "b"}, serviceKeys(history.Records()))
+
+	history.Record(ReconcileRecord{ServiceKey: "c"})
+	assert.Equal(t, []string{"a", "b", "c"}, serviceKeys(history.Records()))
+
+	// The oldest record is replaced once it's full.
+	history.Record(ReconcileRecord{ServiceKey: "d"})
+	history.Record(ReconcileRecord{ServiceKey: "e"})
+	assert.Equal(t, []string{"c", "d", "e"}, serviceKeys(history.Records()))
+
+	history.Record(ReconcileRecord{ServiceKey: "f"})
+	assert.Equal(t, []string{"d", "e", "f"}, serviceKeys(history.Records()))
+}
+
+func TestNewReconcileHistoryDefaultSize(t *testing.T) {
+	history := NewReconcileHistory(0)
+	for i := 0; i < DefaultReconcileHistorySize+10; i++ {
+		history.Record(ReconcileRecord{})
+	}
+	assert.Len(t, history.Records(), DefaultReconcileHistorySize)
+}
+
+func TestReconcileHistoryServesJSON(t *testing.T) {
+	history := NewReconcileHistory(10)
+	history.Record(ReconcileRecord{ServiceKey: "default/my-service", Success: true, MappedPorts: []uint16{80, 443}})
+	history.Record(ReconcileRecord{ServiceKey: "default/other", Error: "router not found"})
+
+	recorder := httptest.NewRecorder()
+	history.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/history", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var records []ReconcileRecord
+	if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &records)) {
+		assert.Equal(t, history.Records(), records)
+	}
+}
+
+func TestReconcileRecordsHistory(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(
+		fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()),
+		scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	records := r.history().Records()
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "default/my-service", records[0].ServiceKey)
+		assert.True(t, records[0].Success)
+		assert.Empty(t, records[0].Error)
+		assert.Equal(t, []uint16{80}, records[0].MappedPorts)
+		assert.False(t, records[0].Time.IsZero())
+	}
+
+	// Failures are recorded too.
+	router.addErr = errors.New("router rejected mapping")
+	_, err = r.reconcileRequest(req, true)
+	assert.NoError(t, err)
+	records = r.history().Records()
+	if assert.Len(t, records, 2) {
+		assert.False(t, records[1].Success)
+		assert.Contains(t, records[1].Error, "router rejected mapping")
+		assert.Empty(t, records[1].MappedPorts)
+	}
+}
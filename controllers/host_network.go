@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// getUseNodeIP parses the use-node-ip annotation, which asks for ports to be forwarded to the node that one of the
+// service's pods is running on, for pods that use the host's network. Without the annotation the LoadBalancer IP is
+// used.
+func getUseNodeIP(service corev1.Service) (bool, error) {
+	value, ok := service.Annotations[useNodeIPAnnotationName]
+	if !ok {
+		return false, nil
+	}
+	useNodeIP, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, permanentError(fmt.Errorf("annotation %s must be \"true\" or \"false\", not %q",
+			useNodeIPAnnotationName, value))
+	}
+	return useNodeIP, nil
+}
+
+// getNodeIPForService finds the internal IP of a Ready node that's running one of the pods the service selects. Pods
+// with hostNetwork set listen on their node's own IP, so that's where the router has to send traffic for them. Nodes
+// are tried in name order, so that the same one is picked every time while it's still running a pod.
+func getNodeIPForService(ctx context.Context, c client.Client, service corev1.Service) (string, error) {
+	if len(service.Spec.Selector) == 0 {
+		return "", permanentError(fmt.Errorf("%s is set, but the service has no selector to find its pods with",
+			useNodeIPAnnotationName))
+	}
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(service.Namespace),
+		client.MatchingLabels(service.Spec.Selector)); err != nil {
+		return "", fmt.Errorf("unable to list pods selected by the service: %w", err)
+	}
+	nodeNames := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase != corev1.PodRunning || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		nodeNames[pod.Spec.NodeName] = true
+	}
+	var names []string
+	for name := range nodeNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var node corev1.Node
+		if err := c.Get(ctx, types.NamespacedName{Name: name}, &node); err != nil {
+			// The node may have just gone away, in which case another could still do.
+			continue
+		}
+		if !isNodeReady(node) {
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == corev1.NodeInternalIP && address.Address != "" {
+				return address.Address, nil
+			}
+		}
+	}
+	return "", errors.New("no Ready node with an internal IP is running a pod selected by the service")
+}
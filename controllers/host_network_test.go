@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// hostNetworkPod is a pod for hostNetworkService, running on nodeName.
+func hostNetworkPod(name string, nodeName string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"app": "dns"}},
+		Spec:       corev1.PodSpec{NodeName: nodeName, HostNetwork: true},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+// hostNetworkService is a ClusterIP service for pods on the host's network, that wants its ports forwarded to their
+// node.
+func hostNetworkService() *corev1.Service {
+	service := holepunchedService()
+	service.Annotations[useNodeIPAnnotationName] = "true"
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	service.Spec.Selector = map[string]string{"app": "dns"}
+	service.Status = corev1.ServiceStatus{}
+	return service
+}
+
+func TestGetNodeIPForService(t *testing.T) {
+	otherApp := hostNetworkPod("other-app", "node-a", corev1.PodRunning)
+	otherApp.Labels["app"] = "web"
+	for name, test := range map[string]struct {
+		objects []runtime.Object
+		ip      string
+	}{
+		"pod's node": {
+			objects: []runtime.Object{
+				node("node-a", true, "192.168.1.11"),
+				node("node-b", true, "192.168.1.12"),
+				hostNetworkPod("dns-1", "node-b", corev1.PodRunning),
+			},
+			ip: "192.168.1.12",
+		},
+		"first Ready node with a pod": {
+			objects: []runtime.Object{
+				node("node-a", false, "192.168.1.11"),
+				node("node-b", true, "192.168.1.12"),
+				node("node-c", true, "192.168.1.13"),
+				hostNetworkPod("dns-1", "node-c", corev1.PodRunning),
+				hostNetworkPod("dns-2", "node-a", corev1.PodRunning),
+				hostNetworkPod("dns-3", "node-b", corev1.PodRunning),
+			},
+			ip: "192.168.1.12",
+		},
+		"pods not running": {
+			objects: []runtime.Object{
+				node("node-a", true, "192.168.1.11"),
+				hostNetworkPod("dns-1", "node-a", corev1.PodPending),
+				hostNetworkPod("dns-2", "", corev1.PodPending),
+				otherApp,
+			},
+		},
+		"node gone": {
+			objects: []runtime.Object{hostNetworkPod("dns-1", "node-a", corev1.PodRunning)},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := fake.NewFakeClientWithScheme(scheme.Scheme, test.objects...)
+			ip, err := getNodeIPForService(context.Background(), c, *hostNetworkService())
+			if test.ip != "" {
+				assert.NoError(t, err)
+				assert.Equal(t, test.ip, ip)
+				return
+			}
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGetNodeIPForServiceWithoutSelector(t *testing.T) {
+	service := hostNetworkService()
+	service.Spec.Selector = nil
+	_, err := getNodeIPForService(context.Background(), fake.NewFakeClientWithScheme(scheme.Scheme), *service)
+	if assert.Error(t, err) {
+		assert.Equal(t, Permanent, errorKind(err))
+	}
+}
+
+func TestGetServiceIPUseNodeIPAndClusterIP(t *testing.T) {
+	service := hostNetworkService()
+	service.Annotations[useClusterIPAnnotationName] = "true"
+	service.Spec.ClusterIP = "10.96.0.20"
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme), scheme.Scheme)
+	_, err := r.getServiceIP(context.Background(), *service)
+	if assert.Error(t, err) {
+		assert.Equal(t, Permanent, errorKind(err))
+	}
+
+	service.Annotations[useNodeIPAnnotationName] = "maybe"
+	delete(service.Annotations, useClusterIPAnnotationName)
+	_, err = r.getServiceIP(context.Background(), *service)
+	if assert.Error(t, err) {
+		assert.Equal(t, Permanent, errorKind(err))
+	}
+}
+
+func TestReconcileUseNodeIP(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme,
+		hostNetworkService(),
+		node("node-a", true, "192.168.1.11"),
+		hostNetworkPod("dns-1", "node-a", corev1.PodRunning),
+	), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, "192.168.1.11", router.addCalls[0].InternalClient)
+		assert.Equal(t, uint16(80), router.addCalls[0].InternalPort)
+	}
+}
+
+func TestReconcileInvalidUseNodeIP(t *testing.T) {
+	service := hostNetworkService()
+	service.Annotations[useNodeIPAnnotationName] = "maybe"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+
+	// The annotation won't fix itself, so the service is left alone until it's changed.
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Zero(t, result.RequeueAfter)
+	assert.Empty(t, router.addCalls)
+	events := drainEvents(recorder)
+	if assert.Len(t, events, 1) {
+		assert.Contains(t, events[0], "InvalidUseNodeIP")
+	}
+}
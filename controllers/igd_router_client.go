@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/soap"
+)
+
+// igdRouterClient makes one of goupnp's Internet Gateway Device service clients into a RouterClient, by adding the
+// actions that goupnp doesn't generate code for. These aren't part of the IGD spec, but some routers offer them anyway.
+type igdRouterClient struct {
+	goupnpClient
+	service goupnp.ServiceClient
+}
+
+func newIGDRouterClient(client goupnpClient, service goupnp.ServiceClient) *igdRouterClient {
+	return &igdRouterClient{goupnpClient: client, service: service}
+}
+
+// FriendlyName returns the name the router gives itself in its root device description, which is usually its make and
+// model. It's empty if the router didn't give one.
+func (c *igdRouterClient) FriendlyName() string {
+	if c.service.RootDevice == nil {
+		return ""
+	}
+	return c.service.RootDevice.Device.FriendlyName
+}
+
+// GetPortMappingNumberOfEntries asks the router how many port mappings it has. Routers without this action will
+// return an error.
+func (c *igdRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	return c.GetPortMappingNumberOfEntriesCtx(context.Background())
+}
+
+func (c *igdRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	request := &struct{}{}
+	response := &struct {
+		NewPortMappingNumberOfEntries string
+	}{}
+	err = c.service.SOAPClient.PerformActionCtx(ctx, c.service.Service.ServiceType, "GetPortMappingNumberOfEntries",
+		request, response)
+	if err != nil {
+		return 0, err
+	}
+	return soap.UnmarshalUi2(response.NewPortMappingNumberOfEntries)
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// IPVersionPreference controls which of a dual-stack LoadBalancer's addresses we open ports up on. IPv4 addresses are
+// forwarded to with port mappings, and IPv6 addresses are opened up with pinholes in the router's firewall.
+type IPVersionPreference string
+
+const (
+	// IPVersionIPv4Only only makes port mappings to the service's IPv4 address.
+	IPVersionIPv4Only IPVersionPreference = "ipv4-only"
+	// IPVersionIPv6Only only opens pinholes to the service's IPv6 address.
+	IPVersionIPv6Only IPVersionPreference = "ipv6-only"
+	// IPVersionDualStack makes port mappings to the service's IPv4 address, and opens pinholes to its IPv6 address too
+	// if it has one.
+	IPVersionDualStack IPVersionPreference = "dual-stack"
+	// IPVersionAuto uses the same IP version as the router's external IP, so that ports are only opened up on the
+	// address that the internet can reach.
+	IPVersionAuto IPVersionPreference = "auto"
+)
+
+// ipVersions returns which IP versions to open ports up on, given the router's external IP. In IPVersionAuto mode an
+// external IP that isn't known is taken to be IPv4, which is what almost every router has, so that failing to ask the
+// router for it doesn't remove every port mapping.
+func (r *ServiceReconciler) ipVersions(externalIP string) (ipv4, ipv6 bool) {
+	switch r.IPVersionPreference {
+	case IPVersionIPv4Only:
+		return true, false
+	case IPVersionIPv6Only:
+		return false, true
+	case IPVersionAuto:
+		if ip := net.ParseIP(externalIP); ip != nil && ip.To4() == nil {
+			return false, true
+		}
+		return true, false
+	default:
+		return true, true
+	}
+}
+
+// getServiceIPs finds the service's IPv4 and IPv6 addresses to open ports up on, going by IPVersionPreference and the
+// router's external IP. Either is empty if it isn't wanted, or if the service has no IPv6 address. The IPv4 address is
+// found with getServiceIP, and is an error if it's wanted but the service doesn't have one, as is an IPv6 address if
+// that's the only one that's wanted.
+func (r *ServiceReconciler) getServiceIPs(ctx context.Context, service corev1.Service, externalIP string) (ipv4, ipv6 string, err error) {
+	wantIPv4, wantIPv6 := r.ipVersions(externalIP)
+	if wantIPv6 {
+		ipv6 = getServiceIPv6(service)
+	}
+	if !wantIPv4 {
+		if ipv6 == "" {
+			return "", "", ErrNoServiceIPv6
+		}
+		return "", ipv6, nil
+	}
+	ipv4, err = r.getServiceIP(ctx, service)
+	if err != nil {
+		return "", "", err
+	}
+	return ipv4, ipv6, nil
+}
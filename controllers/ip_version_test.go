@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestGetServiceIPs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		preference IPVersionPreference
+		externalIP string
+		ipv4, ipv6 string
+	}{
+		"default":                  {ipv4: "192.168.1.10", ipv6: "2001:db8::10"},
+		"dual-stack":               {preference: IPVersionDualStack, ipv4: "192.168.1.10", ipv6: "2001:db8::10"},
+		"IPv4 only":                {preference: IPVersionIPv4Only, ipv4: "192.168.1.10"},
+		"IPv6 only":                {preference: IPVersionIPv6Only, ipv6: "2001:db8::10"},
+		"auto with IPv4 router":    {preference: IPVersionAuto, externalIP: "203.0.113.1", ipv4: "192.168.1.10"},
+		"auto with IPv6 router":    {preference: IPVersionAuto, externalIP: "2001:db8::1", ipv6: "2001:db8::10"},
+		"auto with unknown router": {preference: IPVersionAuto, ipv4: "192.168.1.10"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewServiceReconciler(nil, nil, WithIPVersionPreference(tc.preference))
+			ipv4, ipv6, err := r.getServiceIPs(context.Background(), *dualStackService(), tc.externalIP)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.ipv4, ipv4)
+			assert.Equal(t, tc.ipv6, ipv6)
+		})
+	}
+}
+
+func TestGetServiceIPsMissingAddress(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, WithIPVersionPreference(IPVersionIPv6Only))
+	_, _, err := r.getServiceIPs(context.Background(), *holepunchedService(), "")
+	assert.ErrorIs(t, err, ErrNoServiceIPv6)
+
+	// Only an IPv6 address is fine, as long as that's all that's wanted.
+	ipv6Only := dualStackService()
+	ipv6Only.Status.LoadBalancer.Ingress = ipv6Only.Status.LoadBalancer.Ingress[:1]
+	_, ipv6, err := r.getServiceIPs(context.Background(), *ipv6Only, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::10", ipv6)
+
+	r = NewServiceReconciler(nil, nil, WithIPVersionPreference(IPVersionDualStack))
+	_, _, err = r.getServiceIPs(context.Background(), *ipv6Only, "")
+	assert.ErrorIs(t, err, ErrNoServiceIP)
+}
+
+func TestReconcileIPVersionPreference(t *testing.T) {
+	for name, tc := range map[string]struct {
+		preference IPVersionPreference
+		externalIP string
+		mappings   int
+		pinholes   int
+	}{
+		"dual-stack":            {preference: IPVersionDualStack, mappings: 2, pinholes: 2},
+		"IPv4 only":             {preference: IPVersionIPv4Only, mappings: 2},
+		"IPv6 only":             {preference: IPVersionIPv6Only, pinholes: 2},
+		"auto with IPv4 router": {preference: IPVersionAuto, externalIP: "203.0.113.1", mappings: 2},
+		"auto with IPv6 router": {preference: IPVersionAuto, externalIP: "2001:db8::1", pinholes: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			router := &mockRouterClient{externalIP: tc.externalIP}
+			firewall := &mockIPv6RouterClient{}
+			r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, dualStackService()), scheme.Scheme,
+				WithLogger(logf.NullLogger{}),
+				WithEventRecorder(record.NewFakeRecorder(10)),
+				WithRouterClients(router),
+				WithIPv6RouterClientFactory(ipv6Picker(firewall, nil)),
+				WithIPVersionPreference(tc.preference),
+			)
+
+			_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+			assert.NoError(t, err)
+			assert.Len(t, router.addCalls, tc.mappings)
+			assert.Len(t, firewall.addCalls, tc.pinholes)
+		})
+	}
+}
+
+func TestReconcileSwitchingIPVersionRemovesUnwanted(t *testing.T) {
+	service := dualStackService()
+	service.Annotations[activePinholesAnnotationName] = `{"53/UDP":7,"80/TCP":8}`
+	service.Annotations[activeMappingsAnnotationName] = `{"53/UDP":53,"80/TCP":80}`
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	router := &mockRouterClient{}
+	firewall := &mockIPv6RouterClient{}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithIPv6RouterClientFactory(ipv6Picker(firewall, nil)),
+		WithIPVersionPreference(IPVersionIPv4Only),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{7, 8}, firewall.deleteCalls)
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+	assert.Equal(t, `{}`, updated.Annotations[activePinholesAnnotationName])
+
+	// Going the other way removes the port mappings.
+	r.IPVersionPreference = IPVersionIPv6Only
+	r.forgetProcessed(req.NamespacedName)
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.deleteCalls, 2)
+	assert.Len(t, firewall.addCalls, 2)
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// IANA protocol numbers, which is how WANIPv6FirewallControl identifies protocols.
+	ianaProtocolTCP = 6
+	ianaProtocolUDP = 17
+)
+
+// IPv6RouterClient opens "pinholes" in a router's IPv6 firewall. Unlike IPv4 port mappings there's no address
+// translation: traffic to a port on the internal client's own (public) address is let through, so the external and
+// internal ports are always the same. Each pinhole is identified by the unique ID the router gives it.
+type IPv6RouterClient interface {
+	// AddPinholeWithLeaseTime lets traffic through to a port on internalClient, until leaseTime seconds have passed.
+	// An empty remoteHost, or a remotePort of zero, lets traffic from any remote host or port through.
+	AddPinholeWithLeaseTime(
+		remoteHost string,
+		remotePort uint16,
+		internalClient string,
+		internalPort uint16,
+		protocol string,
+		leaseTime uint32,
+	) (uniqueID uint16, err error)
+
+	// UpdatePinhole renews the lease on a pinhole.
+	UpdatePinhole(uniqueID uint16, leaseTime uint32) error
+
+	// DeletePinhole closes a pinhole.
+	DeletePinhole(uniqueID uint16) error
+}
+
+// WANIPv6RouterClient is an IPv6RouterClient for routers that implement the WANIPv6FirewallControl service from
+// version 2 of the Internet Gateway Device spec.
+type WANIPv6RouterClient struct {
+	client *internetgateway2.WANIPv6FirewallControl1
+}
+
+var _ IPv6RouterClient = &WANIPv6RouterClient{}
+
+func (c *WANIPv6RouterClient) AddPinholeWithLeaseTime(
+	remoteHost string,
+	remotePort uint16,
+	internalClient string,
+	internalPort uint16,
+	protocol string,
+	leaseTime uint32,
+) (uint16, error) {
+	var protocolNumber uint16
+	switch protocol {
+	case "TCP":
+		protocolNumber = ianaProtocolTCP
+	case "UDP":
+		protocolNumber = ianaProtocolUDP
+	default:
+		return 0, permanentError(fmt.Errorf("%w: %s", ErrProtocolNotSupported, protocol))
+	}
+	return c.client.AddPinhole(remoteHost, remotePort, internalClient, internalPort, protocolNumber, leaseTime)
+}
+
+func (c *WANIPv6RouterClient) UpdatePinhole(uniqueID uint16, leaseTime uint32) error {
+	return c.client.UpdatePinhole(uniqueID, leaseTime)
+}
+
+func (c *WANIPv6RouterClient) DeletePinhole(uniqueID uint16) error {
+	return c.client.DeletePinhole(uniqueID)
+}
+
+// PickIPv6RouterClient finds a router whose IPv6 firewall we can open pinholes in. If root device description URLs are
+// given then the first of those routers to offer the WANIPv6FirewallControl service is used, otherwise we discover one
+// on the local network.
+func PickIPv6RouterClient(ctx context.Context, rootDesc ...string) (IPv6RouterClient, error) {
+	var clients []*internetgateway2.WANIPv6FirewallControl1
+	if len(rootDesc) == 0 || (len(rootDesc) == 1 && rootDesc[0] == "") {
+		var err error
+		clients, _, err = internetgateway2.NewWANIPv6FirewallControl1Clients()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, desc := range rootDesc {
+		if desc == "" {
+			continue
+		}
+		loc, err := url.Parse(desc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid router root device description URL %q: %w", desc, err)
+		}
+		root, err := goupnp.DeviceByURL(loc)
+		if err != nil {
+			return nil, err
+		}
+		clients, _ = internetgateway2.NewWANIPv6FirewallControl1ClientsFromRootDevice(root, loc)
+		if len(clients) > 0 {
+			break
+		}
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("no router with an IPv6 firewall found")
+	}
+	return &WANIPv6RouterClient{client: clients[0]}, nil
+}
+
+type cachedIPv6RouterClient struct {
+	client IPv6RouterClient
+	err    error
+	expiry time.Time
+}
+
+// getIPv6RouterClient returns a client for the router's IPv6 firewall. Most routers don't have one that we can
+// configure, so we remember not finding one for as long as we'd remember finding one.
+func (r *ServiceReconciler) getIPv6RouterClient(ctx context.Context) (IPv6RouterClient, error) {
+	r.ipv6RouterCacheMu.Lock()
+	defer r.ipv6RouterCacheMu.Unlock()
+	if r.ipv6RouterCache != nil && time.Now().Before(r.ipv6RouterCache.expiry) {
+		return r.ipv6RouterCache.client, r.ipv6RouterCache.err
+	}
+
+	pick := r.IPv6RouterClientFactory
+	if pick == nil {
+		pick = PickIPv6RouterClient
+	}
+	client, err := pick(ctx, r.routerRootDesc()...)
+	ttl := r.RouterCacheTTL
+	if ttl <= 0 {
+		ttl = defaultRouterCacheTTL
+	}
+	r.ipv6RouterCache = &cachedIPv6RouterClient{client: client, err: err, expiry: time.Now().Add(ttl)}
+	return client, err
+}
+
+// invalidateIPv6RouterClient forgets about the cached IPv6 firewall, so that we look for it again next time.
+func (r *ServiceReconciler) invalidateIPv6RouterClient() {
+	r.ipv6RouterCacheMu.Lock()
+	r.ipv6RouterCache = nil
+	r.ipv6RouterCacheMu.Unlock()
+}
+
+// getServiceIPv6 returns the first IPv6 address of a LoadBalancer service, or "" if it doesn't have one.
+func getServiceIPv6(service corev1.Service) string {
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return ""
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ip := net.ParseIP(ingress.IP); ip != nil && ip.To4() == nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// getActivePinholes reads the pinholes we've opened for a service from its annotation, as a map from the same keys
+// as port mappings to the pinholes' unique IDs.
+func getActivePinholes(service corev1.Service) (map[string]uint16, error) {
+	encoded, ok := service.Annotations[activePinholesAnnotationName]
+	if !ok {
+		return nil, nil
+	}
+	pinholes := make(map[string]uint16)
+	if err := json.Unmarshal([]byte(encoded), &pinholes); err != nil {
+		return nil, permanentError(fmt.Errorf("unable to parse %s annotation: %w", activePinholesAnnotationName, err))
+	}
+	return pinholes, nil
+}
+
+// syncPinholes opens a pinhole in the router's IPv6 firewall for each of the service's desired mappings, to its IPv6
+// address, and closes any that are no longer wanted. Existing pinholes have their leases renewed. The pinholes we end up
+// with are recorded on the service, even if we fail part way through. If the router doesn't have an IPv6 firewall that
+// we can configure then there's nothing to do.
+func (r *ServiceReconciler) syncPinholes(ctx context.Context, log logr.Logger, service *corev1.Service, ipv6 string, desired map[string]uint16, leaseDuration uint32) error {
+	existing, err := getActivePinholes(*service)
+	if err != nil {
+		return err
+	}
+	log = log.WithValues("service-ipv6", ipv6)
+	if r.dryRun() {
+		log.Info("[DRY-RUN] Would open IPv6 pinholes", "pinholes", sortedMappingKeys(desired))
+		return nil
+	}
+	firewall, err := r.getIPv6RouterClient(ctx)
+	if err != nil {
+		if len(existing) == 0 {
+			log.V(1).Info("Not opening IPv6 pinholes, as no IPv6 firewall was found", "error", err.Error())
+			return nil
+		}
+		return fmt.Errorf("unable to find IPv6 firewall to renew pinholes on: %w", err)
+	}
+
+	active := make(map[string]uint16)
+	var syncErr error
+	for _, key := range sortedMappingKeys(existing) {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := firewall.DeletePinhole(existing[key]); err != nil {
+			log.Error(err, "Failed to close IPv6 pinhole", "pinhole", key)
+			active[key] = existing[key]
+			syncErr = err
+			continue
+		}
+		log.Info("Closed IPv6 pinhole", "pinhole", key)
+	}
+	for _, key := range sortedMappingKeys(desired) {
+		port, protocol, err := parseMappingKey(key)
+		if err != nil {
+			syncErr = err
+			continue
+		}
+		if id, ok := existing[key]; ok {
+			if err := firewall.UpdatePinhole(id, leaseDuration); err == nil {
+				active[key] = id
+				continue
+			}
+			// The router may have forgotten about it, e.g. after rebooting, so open it again.
+		}
+		id, err := firewall.AddPinholeWithLeaseTime("", 0, ipv6, port, protocol, leaseDuration)
+		if err != nil {
+			log.Error(err, "Failed to open IPv6 pinhole", "pinhole", key)
+			syncErr = err
+			continue
+		}
+		active[key] = id
+	}
+
+	encoded, err := json.Marshal(active)
+	if err != nil {
+		return err
+	}
+	if service.Annotations[activePinholesAnnotationName] != string(encoded) {
+		if err := updateServiceAnnotations(ctx, r.Client, service, map[string]string{
+			activePinholesAnnotationName: string(encoded),
+		}); err != nil {
+			return err
+		}
+	}
+	if syncErr != nil {
+		r.invalidateIPv6RouterClient()
+		return syncErr
+	}
+	return nil
+}
+
+// deletePinholes closes every pinhole we've opened for the service.
+func (r *ServiceReconciler) deletePinholes(ctx context.Context, log logr.Logger, service corev1.Service) error {
+	pinholes, err := getActivePinholes(service)
+	if err != nil || len(pinholes) == 0 {
+		return err
+	}
+	if r.dryRun() {
+		log.Info("[DRY-RUN] Would close IPv6 pinholes", "pinholes", sortedMappingKeys(pinholes))
+		return nil
+	}
+	firewall, err := r.getIPv6RouterClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to find IPv6 firewall to close pinholes on: %w", err)
+	}
+	for _, key := range sortedMappingKeys(pinholes) {
+		if err := firewall.DeletePinhole(pinholes[key]); err != nil {
+			r.invalidateIPv6RouterClient()
+			return fmt.Errorf("unable to close IPv6 pinhole %s: %w", key, err)
+		}
+		log.Info("Closed IPv6 pinhole", "pinhole", key)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type addPinholeCall struct {
+	InternalClient string
+	InternalPort   uint16
+	Protocol       string
+	LeaseTime      uint32
+}
+
+type mockIPv6RouterClient struct {
+	mu          sync.Mutex
+	nextID      uint16
+	addCalls    []addPinholeCall
+	addErr      error
+	updateCalls []uint16
+	updateErr   error
+	deleteCalls []uint16
+}
+
+func (m *mockIPv6RouterClient) AddPinholeWithLeaseTime(remoteHost string, remotePort uint16, internalClient string, internalPort uint16, protocol string, leaseTime uint32) (uint16, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addCalls = append(m.addCalls, addPinholeCall{
+		InternalClient: internalClient,
+		InternalPort:   internalPort,
+		Protocol:       protocol,
+		LeaseTime:      leaseTime,
+	})
+	if m.addErr != nil {
+		return 0, m.addErr
+	}
+	m.nextID++
+	return m.nextID, nil
+}
+
+func (m *mockIPv6RouterClient) UpdatePinhole(uniqueID uint16, leaseTime uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateCalls = append(m.updateCalls, uniqueID)
+	return m.updateErr
+}
+
+func (m *mockIPv6RouterClient) DeletePinhole(uniqueID uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteCalls = append(m.deleteCalls, uniqueID)
+	return nil
+}
+
+func ipv6Picker(client IPv6RouterClient, err error) func(ctx context.Context, rootDesc ...string) (IPv6RouterClient, error) {
+	return func(ctx context.Context, rootDesc ...string) (IPv6RouterClient, error) {
+		return client, err
+	}
+}
+
+func dualStackService() *corev1.Service {
+	service := holepunchedService()
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
+		{IP: "2001:db8::10"},
+		{IP: "192.168.1.10"},
+	}
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 53, Protocol: corev1.ProtocolUDP})
+	return service
+}
+
+func TestGetServiceIPv6(t *testing.T) {
+	assert.Equal(t, "2001:db8::10", getServiceIPv6(*dualStackService()))
+	assert.Equal(t, "", getServiceIPv6(*holepunchedService()))
+
+	nodePort := dualStackService()
+	nodePort.Spec.Type = corev1.ServiceTypeNodePort
+	assert.Equal(t, "", getServiceIPv6(*nodePort))
+}
+
+func TestGetServiceIPSkipsIPv6(t *testing.T) {
+	r := NewServiceReconciler(nil, nil)
+	ip, err := r.getServiceIP(context.Background(), *dualStackService())
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", ip)
+}
+
+func TestReconcileOpensIPv6Pinholes(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, dualStackService())
+	router := &mockRouterClient{}
+	firewall := &mockIPv6RouterClient{}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithIPv6RouterClientFactory(ipv6Picker(firewall, nil)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 2, "IPv4 ports should still be forwarded")
+	assert.Equal(t, []addPinholeCall{
+		{InternalClient: "2001:db8::10", InternalPort: 53, Protocol: "UDP", LeaseTime: leaseDurationSeconds},
+		{InternalClient: "2001:db8::10", InternalPort: 80, Protocol: "TCP", LeaseTime: leaseDurationSeconds},
+	}, firewall.addCalls)
+
+	var service corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &service))
+	assert.Equal(t, `{"53/UDP":1,"80/TCP":2}`, service.Annotations[activePinholesAnnotationName])
+
+	// Renewing the lease keeps the same pinholes, and closes any that are no longer wanted.
+	service.Spec.Ports = service.Spec.Ports[:1]
+	assert.NoError(t, c.Update(context.Background(), &service))
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, firewall.addCalls, 2)
+	assert.Equal(t, []uint16{2}, firewall.updateCalls)
+	assert.Equal(t, []uint16{1}, firewall.deleteCalls)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &service))
+	assert.Equal(t, `{"80/TCP":2}`, service.Annotations[activePinholesAnnotationName])
+}
+
+func TestReconcileReopensForgottenPinholes(t *testing.T) {
+	service := dualStackService()
+	service.Annotations[activePinholesAnnotationName] = `{"53/UDP":7,"80/TCP":8}`
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	firewall := &mockIPv6RouterClient{nextID: 20, updateErr: errors.New("no such pinhole")}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(&mockRouterClient{}),
+		WithIPv6RouterClientFactory(ipv6Picker(firewall, nil)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{7, 8}, firewall.updateCalls)
+	assert.Len(t, firewall.addCalls, 2)
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+	assert.Equal(t, `{"53/UDP":21,"80/TCP":22}`, updated.Annotations[activePinholesAnnotationName])
+}
+
+func TestReconcileWithoutIPv6Firewall(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, dualStackService())
+	router := &mockRouterClient{}
+	pickCalls := 0
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithIPv6RouterClientFactory(func(ctx context.Context, rootDesc ...string) (IPv6RouterClient, error) {
+			pickCalls++
+			return nil, errors.New("no router with an IPv6 firewall found")
+		}),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	// Most routers can't open pinholes, which mustn't stop IPv4 ports being forwarded.
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 2)
+
+	// Nor do we keep looking for one.
+	r.forgetProcessed(req.NamespacedName)
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pickCalls)
+}
+
+func TestReconcileFailsWhenPinholeCannotBeOpened(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, dualStackService())
+	firewall := &mockIPv6RouterClient{addErr: errors.New("firewall is disabled")}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(&mockRouterClient{}),
+		WithIPv6RouterClientFactory(ipv6Picker(firewall, nil)),
+	)
+
+	_, err := r.reconcile(context.Background(), logf.NullLogger{},
+		ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}, false)
+	assert.Error(t, err)
+}
+
+func TestReconcileDeleteClosesPinholes(t *testing.T) {
+	service := dualStackService()
+	service.Annotations[activePinholesAnnotationName] = `{"53/UDP":7,"80/TCP":8}`
+	service.Annotations[holepunchAnnotationName] = "false"
+	service.Finalizers = []string{portMappingCleanupFinalizer}
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	firewall := &mockIPv6RouterClient{}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(&mockRouterClient{}),
+		WithIPv6RouterClientFactory(ipv6Picker(firewall, nil)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{7, 8}, firewall.deleteCalls)
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+	assert.NotContains(t, updated.Annotations, activePinholesAnnotationName)
+}
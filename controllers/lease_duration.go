@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxRouterLeaseDuration is the longest lease, in seconds, that the IGD2 spec lets a router grant (one week). Routers
+// that follow it cut anything longer short, and some older ones reject it outright.
+const maxRouterLeaseDuration = 604800
+
+// ValidateLeaseDuration returns the lease duration, in seconds, to ask router for when we'd like requested. UPnP gives
+// us no way to ask a router which leases it will accept, so we go by what we can find out: leases are capped at the
+// IGD2 spec's maximum, and if GetConnectionTypeInfo says that the router gets its external IP over PPPoE or DHCP then
+// the lease is halved, as its mappings may be lost whenever that IP changes. Not every router will say what its
+// connection type is, so that isn't an error unless ctx has been cancelled. A lease of zero, which never expires, is
+// left alone.
+func ValidateLeaseDuration(ctx context.Context, router RouterClient, requested uint32) (uint32, error) {
+	if requested == 0 {
+		return 0, nil
+	}
+	connectionType, _, err := asContextual(router).GetConnectionTypeInfoCtx(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		connectionType = ""
+	}
+	return fitLeaseDuration(connectionType, requested), nil
+}
+
+// fitLeaseDuration is ValidateLeaseDuration for a router whose connection type we already know, or an empty string
+// if we don't.
+func fitLeaseDuration(connectionType string, requested uint32) uint32 {
+	lease := requested
+	if lease > maxRouterLeaseDuration {
+		lease = maxRouterLeaseDuration
+	}
+	if isDynamicConnectionType(connectionType) && lease > 1 {
+		lease /= 2
+	}
+	return lease
+}
+
+// scaleReconcileInterval shortens how long to wait before renewing port mappings in proportion to their lease being
+// cut from requested to actual seconds, so that they're still renewed the same fraction of the way through the lease.
+func scaleReconcileInterval(interval time.Duration, requested, actual uint32) time.Duration {
+	if requested == 0 || actual >= requested {
+		return interval
+	}
+	return time.Duration(float64(interval) * float64(actual) / float64(requested))
+}
+
+// confirmLeaseDuration asks the router how long is left on one of the port mappings we've just made, to find out if it
+// granted a shorter lease than the requested one. Some routers quietly cut leases short rather than rejecting them,
+// and we'd otherwise not renew the mappings until after they'd gone. It returns the lease the router granted, or
+// requested if the router wouldn't say or didn't change it.
+func confirmLeaseDuration(router RouterClient, remoteHost string, mappings map[string]uint16, requested uint32) uint32 {
+	// The mapping cache only knows what we asked for, so ask the router itself.
+	if cached, ok := router.(*mappingCacheRouterClient); ok {
+		router = cached.RouterClient
+	}
+	keys := sortedMappingKeys(mappings)
+	if requested == 0 || len(keys) == 0 {
+		return requested
+	}
+	_, protocol, err := parseMappingKey(keys[0])
+	if err != nil {
+		return requested
+	}
+	_, _, _, _, remaining, err := router.GetSpecificPortMappingEntry(remoteHost, mappings[keys[0]], protocol)
+	if err != nil || remaining == 0 || remaining+leaseRenewalSlackSeconds >= requested {
+		return requested
+	}
+	return remaining
+}
+
+// getPortLeaseDurations returns the lease duration, in seconds, for each of a service's port mappings, keyed in the same
+// way as mappings, using getPortLeaseDuration. Every per-port lease annotation is checked, not only those for ports in
+// mappings, so that a mistake is caught before the port it's for is forwarded.
+func getPortLeaseDurations(service corev1.Service, mappings map[string]uint16, defaultSeconds uint32) (map[string]uint32, error) {
+	for name := range service.Annotations {
+		if !strings.HasPrefix(name, portLeaseAnnotationPrefix) {
+			continue
+		}
+		port, err := strconv.ParseUint(strings.TrimPrefix(name, portLeaseAnnotationPrefix), 10, 16)
+		if err != nil {
+			return nil, permanentError(fmt.Errorf("invalid port in annotation %s: %w", name, err))
+		}
+		if _, err := getPortLeaseDuration(service, uint16(port), defaultSeconds); err != nil {
+			return nil, err
+		}
+	}
+	leases := make(map[string]uint32, len(mappings))
+	for key := range mappings {
+		port, _, err := parseMappingKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if leases[key], err = getPortLeaseDuration(service, port, defaultSeconds); err != nil {
+			return nil, err
+		}
+	}
+	return leases, nil
+}
+
+// shortestLease returns the shortest of leases, which is how often a service's port mappings have to be renewed as
+// they're all renewed together. Leases of zero never expire, so are only returned if there's nothing shorter. If leases
+// is empty then fallback is returned.
+func shortestLease(leases map[string]uint32, fallback uint32) uint32 {
+	shortest, found := uint32(0), false
+	for _, lease := range leases {
+		if !found || (lease != 0 && (shortest == 0 || lease < shortest)) {
+			shortest, found = lease, true
+		}
+	}
+	if !found {
+		return fallback
+	}
+	return shortest
+}
+
+// mappingsWithLease returns the mappings whose lease in leases is lease. Mappings that aren't in leases are taken to
+// have it.
+func mappingsWithLease(mappings map[string]uint16, leases map[string]uint32, lease uint32) map[string]uint16 {
+	matching := make(map[string]uint16, len(mappings))
+	for key, externalPort := range mappings {
+		if portLease, ok := leases[key]; !ok || portLease == lease {
+			matching[key] = externalPort
+		}
+	}
+	return matching
+}
@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestValidateLeaseDuration(t *testing.T) {
+	for name, tc := range map[string]struct {
+		router    *mockRouterClient
+		requested uint32
+		expected  uint32
+	}{
+		"static IP":           {router: &mockRouterClient{}, requested: 3600, expected: 3600},
+		"dynamic IP":          {router: &mockRouterClient{connectionType: "PPPoE_Relay"}, requested: 3600, expected: 1800},
+		"longer than allowed": {router: &mockRouterClient{}, requested: 2 * 604800, expected: 604800},
+		"never expires":       {router: &mockRouterClient{connectionType: "PPPoE_Relay"}, requested: 0, expected: 0},
+		"unknown connection type": {
+			router:    &mockRouterClient{connectionTypeErr: upnpFault(401)},
+			requested: 3600,
+			expected:  3600,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			lease, err := ValidateLeaseDuration(context.Background(), tc.router, tc.requested)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, lease)
+		})
+	}
+}
+
+func TestValidateLeaseDurationCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ValidateLeaseDuration(ctx, &mockRouterClient{connectionTypeErr: errors.New("timed out")}, 3600)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestScaleReconcileInterval(t *testing.T) {
+	assert.Equal(t, 30*time.Minute, scaleReconcileInterval(time.Hour, 3600, 1800))
+	assert.Equal(t, time.Hour, scaleReconcileInterval(time.Hour, 3600, 3600))
+	assert.Equal(t, time.Hour, scaleReconcileInterval(time.Hour, 0, 600))
+}
+
+func TestConfirmLeaseDuration(t *testing.T) {
+	mappings := map[string]uint16{"80/TCP": 8080}
+	for name, tc := range map[string]struct {
+		remaining uint32
+		expected  uint32
+	}{
+		"cut short":     {remaining: 600, expected: 600},
+		"as requested":  {remaining: 3600, expected: 3600},
+		"nearly as":     {remaining: 3595, expected: 3600},
+		"never expires": {remaining: 0, expected: 3600},
+	} {
+		t.Run(name, func(t *testing.T) {
+			router := &mockRouterClient{entries: map[string]portMappingEntry{
+				"8080/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, LeaseDuration: tc.remaining},
+			}}
+			assert.Equal(t, tc.expected, confirmLeaseDuration(router, "", mappings, 3600))
+		})
+	}
+
+	// A router that won't say is assumed to have granted what we asked for.
+	assert.Equal(t, uint32(3600), confirmLeaseDuration(&mockRouterClient{}, "", mappings, 3600))
+}
+
+func TestConfirmLeaseDurationBypassesMappingCache(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"8080/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, LeaseDuration: 600},
+	}}
+	cache := NewMappingCache(router, time.Hour)
+	assert.NoError(t, cache.Refresh(context.Background()))
+	cached := &mappingCacheRouterClient{RouterClient: router, cache: cache}
+	cache.store(PortMappingEntry{ExternalPort: 8080, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10",
+		Enabled: true, LeaseDuration: 3600})
+
+	assert.Equal(t, uint32(600), confirmLeaseDuration(cached, "", map[string]uint16{"80/TCP": 8080}, 3600))
+}
+
+func TestReconcileRouterShortensLease(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService())
+	store := NewConfigMapMappingStore(c, "holepunch-system", "holepunch-mappings")
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, LeaseDuration: 600},
+	}}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithMappingStore(store),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	// The mappings are renewed the same fraction of the way through the shorter lease.
+	assert.Equal(t, scaleReconcileInterval(time.Hour-30*time.Second, leaseDurationSeconds, 600), result.RequeueAfter)
+	mappings, err := store.Load(context.Background(), req.NamespacedName)
+	assert.NoError(t, err)
+	if assert.Len(t, mappings, 1) {
+		assert.Equal(t, uint32(leaseDurationSeconds), mappings[0].LeaseDuration)
+		assert.Equal(t, uint32(600), mappings[0].ActualLeaseDuration)
+	}
+}
+
+func serviceWithPortLeases(annotations map[string]string) corev1.Service {
+	service := *holepunchedService()
+	for name, value := range annotations {
+		service.Annotations[name] = value
+	}
+	return service
+}
+
+func TestGetPortLeaseDuration(t *testing.T) {
+	service := serviceWithPortLeases(map[string]string{
+		leaseDurationAnnotationName:         "2h",
+		portLeaseAnnotationPrefix + "27015": "10m",
+	})
+	lease, err := getPortLeaseDuration(service, 27015, leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(600), lease)
+
+	// Other ports fall back to the service's lease, and then to the default.
+	lease, err = getPortLeaseDuration(service, 80, leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7200), lease)
+	lease, err = getPortLeaseDuration(corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "my-service"}}, 80, 1234)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1234), lease)
+
+	for _, value := range []string{"10 minutes", "59s", "24h1s"} {
+		_, err := getPortLeaseDuration(serviceWithPortLeases(map[string]string{portLeaseAnnotationPrefix + "80": value}),
+			80, leaseDurationSeconds)
+		assert.Error(t, err, value)
+		assert.Equal(t, Permanent, errorKind(err), value)
+	}
+}
+
+func TestGetPortLeaseDurations(t *testing.T) {
+	service := serviceWithPortLeases(map[string]string{portLeaseAnnotationPrefix + "27015": "10m"})
+	leases, err := getPortLeaseDurations(service, map[string]uint16{"80/TCP": 80, "27015/UDP": 27015},
+		leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"80/TCP": leaseDurationSeconds, "27015/UDP": 600}, leases)
+
+	// Annotations are checked even for ports that aren't being forwarded.
+	for name, value := range map[string]string{
+		portLeaseAnnotationPrefix + "http": "10m",
+		portLeaseAnnotationPrefix + "443":  "forever",
+	} {
+		_, err := getPortLeaseDurations(serviceWithPortLeases(map[string]string{name: value}),
+			map[string]uint16{"80/TCP": 80}, leaseDurationSeconds)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestShortestLease(t *testing.T) {
+	assert.Equal(t, uint32(600), shortestLease(map[string]uint32{"80/TCP": 3600, "27015/UDP": 600}, 3600))
+	assert.Equal(t, uint32(600), shortestLease(map[string]uint32{"80/TCP": 0, "27015/UDP": 600}, 3600))
+	assert.Equal(t, uint32(0), shortestLease(map[string]uint32{"80/TCP": 0}, 3600))
+	assert.Equal(t, uint32(3600), shortestLease(nil, 3600))
+}
+
+func TestReconcilePortLeases(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[portLeaseAnnotationPrefix+"27015"] = "10m"
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 27015, Protocol: corev1.ProtocolUDP})
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	leases := make(map[uint16]uint32)
+	for _, call := range router.addCalls {
+		leases[call.ExternalPort] = call.LeaseDuration
+	}
+	assert.Equal(t, map[uint16]uint32{80: leaseDurationSeconds, 27015: 600}, leases)
+	// Both ports are renewed before the shorter lease runs out.
+	assert.Equal(t, 10*time.Minute-30*time.Second, result.RequeueAfter)
+}
+
+func TestReconcileInvalidPortLease(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[portLeaseAnnotationPrefix+"80"] = "forever"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err, "there's no point retrying until the annotation is fixed")
+	assert.Empty(t, router.addCalls)
+	events := drainEvents(recorder)
+	if assert.Len(t, events, 1) {
+		assert.Contains(t, events[0], "Warning InvalidLeaseDuration unable to parse holepunch.port.lease/80 annotation")
+	}
+}
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+)
+
+// maxLoggedDescriptionLength is how much of a port mapping's description is logged. Descriptions come from an
+// annotation, so they could be anything, and they're rarely what's wrong.
+const maxLoggedDescriptionLength = 32
+
+// loggingRouterClient wraps a RouterClient so that every call to the router, along with its response, is logged at
+// V(2). This is for debugging problems with a router, and is far too noisy for anything else.
+type loggingRouterClient struct {
+	RouterClient
+	log logr.Logger
+}
+
+// NewLoggingRouterClient wraps inner so that every call to it is logged to log at V(2), with all of its parameters and
+// results.
+func NewLoggingRouterClient(inner RouterClient, log logr.Logger) RouterClient {
+	return &loggingRouterClient{RouterClient: inner, log: log}
+}
+
+// call logs that a call is being made, with the given parameters as key/value pairs. The returned function logs the
+// response, with the results as key/value pairs.
+func (l *loggingRouterClient) call(method string, params ...interface{}) func(err error, results ...interface{}) {
+	log := l.log.WithValues("method", method)
+	log.V(2).Info("Calling router", params...)
+	return func(err error, results ...interface{}) {
+		if err != nil {
+			log.V(2).Info("Router returned an error", "error", err.Error())
+			return
+		}
+		log.V(2).Info("Router responded", results...)
+	}
+}
+
+// loggedDescription truncates a port mapping description that's too long to be worth logging.
+func loggedDescription(description string) string {
+	if runes := []rune(description); len(runes) > maxLoggedDescriptionLength {
+		return string(runes[:maxLoggedDescriptionLength]) + "..."
+	}
+	return description
+}
+
+func (l *loggingRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	done := l.call("AddPortMapping",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol,
+		"internal-port", NewInternalPort,
+		"internal-client", NewInternalClient,
+		"enabled", NewEnabled,
+		"upnp-description", loggedDescription(NewPortMappingDescription),
+		"lease-duration", NewLeaseDuration)
+	defer func() { done(err) }()
+	return l.RouterClient.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (l *loggingRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	done := l.call("AddAnyPortMapping",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol,
+		"internal-port", NewInternalPort,
+		"internal-client", NewInternalClient,
+		"enabled", NewEnabled,
+		"upnp-description", loggedDescription(NewPortMappingDescription),
+		"lease-duration", NewLeaseDuration)
+	defer func() { done(err, "reserved-port", NewReservedPort) }()
+	return addAnyPortMapping(l.RouterClient, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (l *loggingRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	done := l.call("DeletePortMapping",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol)
+	defer func() { done(err) }()
+	return l.RouterClient.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (l *loggingRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	done := l.call("GetSpecificPortMappingEntry",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol)
+	defer func() {
+		done(err,
+			"internal-port", NewInternalPort,
+			"internal-client", NewInternalClient,
+			"enabled", NewEnabled,
+			"upnp-description", loggedDescription(NewPortMappingDescription),
+			"lease-duration", NewLeaseDuration)
+	}()
+	return l.RouterClient.GetSpecificPortMappingEntry(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (l *loggingRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	done := l.call("GetGenericPortMappingEntry", "index", NewPortMappingIndex)
+	defer func() {
+		done(err,
+			"remote-host", NewRemoteHost,
+			"external-port", NewExternalPort,
+			"protocol", NewProtocol,
+			"internal-port", NewInternalPort,
+			"internal-client", NewInternalClient,
+			"enabled", NewEnabled,
+			"upnp-description", loggedDescription(NewPortMappingDescription),
+			"lease-duration", NewLeaseDuration)
+	}()
+	return l.RouterClient.GetGenericPortMappingEntry(NewPortMappingIndex)
+}
+
+func (l *loggingRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	done := l.call("GetExternalIPAddress")
+	defer func() { done(err, "external-ip", NewExternalIPAddress) }()
+	return l.RouterClient.GetExternalIPAddress()
+}
+
+func (l *loggingRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	done := l.call("GetConnectionTypeInfo")
+	defer func() {
+		done(err, "connection-type", NewConnectionType, "possible-connection-types", NewPossibleConnectionTypes)
+	}()
+	return l.RouterClient.GetConnectionTypeInfo()
+}
+
+func (l *loggingRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	done := l.call("GetPortMappingNumberOfEntries")
+	defer func() { done(err, "entries", NewPortMappingNumberOfEntries) }()
+	return l.RouterClient.GetPortMappingNumberOfEntries()
+}
+
+func (l *loggingRouterClient) AddPortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	done := l.call("AddPortMapping",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol,
+		"internal-port", NewInternalPort,
+		"internal-client", NewInternalClient,
+		"enabled", NewEnabled,
+		"upnp-description", loggedDescription(NewPortMappingDescription),
+		"lease-duration", NewLeaseDuration)
+	defer func() { done(err) }()
+	return asContextual(l.RouterClient).AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol,
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (l *loggingRouterClient) DeletePortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	done := l.call("DeletePortMapping",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol)
+	defer func() { done(err) }()
+	return asContextual(l.RouterClient).DeletePortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (l *loggingRouterClient) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	done := l.call("GetSpecificPortMappingEntry",
+		"remote-host", NewRemoteHost,
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol)
+	defer func() {
+		done(err,
+			"internal-port", NewInternalPort,
+			"internal-client", NewInternalClient,
+			"enabled", NewEnabled,
+			"upnp-description", loggedDescription(NewPortMappingDescription),
+			"lease-duration", NewLeaseDuration)
+	}()
+	return asContextual(l.RouterClient).GetSpecificPortMappingEntryCtx(ctx, NewRemoteHost, NewExternalPort,
+		NewProtocol)
+}
+
+func (l *loggingRouterClient) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	done := l.call("GetGenericPortMappingEntry", "index", NewPortMappingIndex)
+	defer func() {
+		done(err,
+			"remote-host", NewRemoteHost,
+			"external-port", NewExternalPort,
+			"protocol", NewProtocol,
+			"internal-port", NewInternalPort,
+			"internal-client", NewInternalClient,
+			"enabled", NewEnabled,
+			"upnp-description", loggedDescription(NewPortMappingDescription),
+			"lease-duration", NewLeaseDuration)
+	}()
+	return asContextual(l.RouterClient).GetGenericPortMappingEntryCtx(ctx, NewPortMappingIndex)
+}
+
+func (l *loggingRouterClient) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	done := l.call("GetExternalIPAddress")
+	defer func() { done(err, "external-ip", NewExternalIPAddress) }()
+	return asContextual(l.RouterClient).GetExternalIPAddressCtx(ctx)
+}
+
+func (l *loggingRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	done := l.call("GetConnectionTypeInfo")
+	defer func() {
+		done(err, "connection-type", NewConnectionType, "possible-connection-types", NewPossibleConnectionTypes)
+	}()
+	return asContextual(l.RouterClient).GetConnectionTypeInfoCtx(ctx)
+}
+
+func (l *loggingRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	done := l.call("GetPortMappingNumberOfEntries")
+	defer func() { done(err, "entries", NewPortMappingNumberOfEntries) }()
+	return asContextual(l.RouterClient).GetPortMappingNumberOfEntriesCtx(ctx)
+}
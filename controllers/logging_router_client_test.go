@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingLogger is a logr.Logger that records every line logged at or below its verbosity, with its key/value pairs
+// formatted into it.
+type recordingLogger struct {
+	lines     *[]string
+	verbosity int
+	level     int
+	values    []interface{}
+}
+
+func newRecordingLogger(verbosity int) recordingLogger {
+	return recordingLogger{lines: &[]string{}, verbosity: verbosity}
+}
+
+func (l recordingLogger) record(msg string, keysAndValues []interface{}) {
+	line := msg
+	all := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i+1 < len(all); i += 2 {
+		line += fmt.Sprintf(" %v=%v", all[i], all[i+1])
+	}
+	*l.lines = append(*l.lines, line)
+}
+
+func (l recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	if l.Enabled() {
+		l.record(msg, keysAndValues)
+	}
+}
+
+func (l recordingLogger) Enabled() bool {
+	return l.level <= l.verbosity
+}
+
+func (l recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.record(msg, append([]interface{}{"error", err}, keysAndValues...))
+}
+
+func (l recordingLogger) V(level int) logr.InfoLogger {
+	l.level += level
+	return l
+}
+
+func (l recordingLogger) WithName(string) logr.Logger {
+	return l
+}
+
+func (l recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	l.values = append(append([]interface{}{}, l.values...), keysAndValues...)
+	return l
+}
+
+func TestLoggingRouterClientLogsCalls(t *testing.T) {
+	log := newRecordingLogger(2)
+	inner := &mockRouterClient{externalIP: "203.0.113.1"}
+	router := NewLoggingRouterClient(inner, log)
+
+	assert.NoError(t, router.AddPortMapping("", 8080, "TCP", 80, "192.168.1.10", true, "Mapping for my-service/default", 3600))
+	ip, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.1", ip)
+
+	assert.Len(t, inner.addCalls, 1, "calls are passed through")
+	assert.Equal(t, []string{
+		"Calling router method=AddPortMapping remote-host= external-port=8080 protocol=TCP internal-port=80 " +
+			"internal-client=192.168.1.10 enabled=true upnp-description=Mapping for my-service/default lease-duration=3600",
+		"Router responded method=AddPortMapping",
+		"Calling router method=GetExternalIPAddress",
+		"Router responded method=GetExternalIPAddress external-ip=203.0.113.1",
+	}, *log.lines)
+}
+
+func TestLoggingRouterClientLogsErrors(t *testing.T) {
+	log := newRecordingLogger(2)
+	router := NewLoggingRouterClient(&mockRouterClient{deleteErr: errors.New("no such entry")}, log)
+
+	assert.Error(t, router.DeletePortMapping("", 8080, "UDP"))
+	assert.Equal(t, []string{
+		"Calling router method=DeletePortMapping remote-host= external-port=8080 protocol=UDP",
+		"Router returned an error method=DeletePortMapping error=no such entry",
+	}, *log.lines)
+}
+
+func TestLoggingRouterClientTruncatesDescriptions(t *testing.T) {
+	log := newRecordingLogger(2)
+	router := NewLoggingRouterClient(&mockRouterClient{}, log)
+
+	description := strings.Repeat("x", 100)
+	assert.NoError(t, router.AddPortMapping("", 8080, "TCP", 80, "192.168.1.10", true, description, 3600))
+	if assert.NotEmpty(t, *log.lines) {
+		assert.Contains(t, (*log.lines)[0], "upnp-description="+strings.Repeat("x", maxLoggedDescriptionLength)+"... ")
+		assert.NotContains(t, (*log.lines)[0], description)
+	}
+}
+
+func TestLoggingRouterClientOnlyLogsAtV2(t *testing.T) {
+	log := newRecordingLogger(1)
+	router := NewLoggingRouterClient(&mockRouterClient{}, log)
+
+	assert.NoError(t, router.AddPortMapping("", 8080, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.Empty(t, *log.lines)
+}
+
+func TestInstrumentRouterClientLogsCallsWhenEnabled(t *testing.T) {
+	log := newRecordingLogger(2)
+	r := NewServiceReconciler(nil, nil, WithLogger(log), WithRouterCallLogging(true))
+
+	_, err := r.instrumentRouterClient(&mockRouterClient{}).GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Contains(t, *log.lines, "Calling router method=GetExternalIPAddress")
+
+	*log.lines = nil
+	r = NewServiceReconciler(nil, nil, WithLogger(log))
+	_, err = r.instrumentRouterClient(&mockRouterClient{}).GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Empty(t, *log.lines)
+}
@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errNotInMappingCache is returned in place of the router's own error when a MappingCache shows that the router has no
+// such port mapping.
+var errNotInMappingCache = errors.New("no such port mapping in the router's mapping table")
+
+// MappingCache is a copy of a router's whole port mapping table, so that we can check for existing mappings without
+// asking the router about each port in turn. The table is read from the router with Refresh, which replaces the cached
+// copy all at once so that a lookup never sees a half-read table.
+type MappingCache struct {
+	router          RouterClient
+	refreshInterval time.Duration
+	// now returns the current time. If nil then time.Now is used.
+	now func() time.Time
+
+	// refreshMu stops the table from being read from the router more than once at a time. It also guards failedAt,
+	// which is when we last failed to read it.
+	refreshMu sync.Mutex
+	failedAt  time.Time
+
+	mu          sync.RWMutex
+	entries     map[string]cachedMapping
+	refreshedAt time.Time
+}
+
+// cachedMapping is a port mapping, along with when we found out about it so that we can tell how much of its lease is
+// left.
+type cachedMapping struct {
+	entry PortMappingEntry
+	seen  time.Time
+}
+
+// NewMappingCache caches the port mappings of router. The cache is empty until Refresh is called, and is stale once
+// refreshInterval has passed since then.
+func NewMappingCache(router RouterClient, refreshInterval time.Duration) *MappingCache {
+	return &MappingCache{router: router, refreshInterval: refreshInterval}
+}
+
+// Lookup returns the cached port mapping for an external port, if the router had one when the cache was last refreshed.
+// Its lease duration is however much of the lease should be left by now, and mappings whose lease should have expired
+// aren't returned.
+func (c *MappingCache) Lookup(proto string, externalPort uint16) (*PortMappingEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cached, ok := c.entries[mappingCacheKey(proto, externalPort)]
+	if !ok {
+		return nil, false
+	}
+	entry := cached.entry
+	if entry.LeaseDuration > 0 {
+		// A lease duration of zero means that the mapping never expires.
+		elapsed := uint32(c.currentTime().Sub(cached.seen) / time.Second)
+		if elapsed >= entry.LeaseDuration {
+			return nil, false
+		}
+		entry.LeaseDuration -= elapsed
+	}
+	return &entry, true
+}
+
+// Refresh reads the router's whole port mapping table, and replaces the cached copy with it. If the table can't be
+// read in full then the cached copy is left alone.
+func (c *MappingCache) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	return c.refresh(ctx)
+}
+
+func (c *MappingCache) refresh(ctx context.Context) error {
+	mappings, err := GetAllPortMappings(ctx, c.router)
+	if err != nil {
+		return err
+	}
+	now := c.currentTime()
+	entries := make(map[string]cachedMapping, len(mappings))
+	for _, m := range mappings {
+		entries[mappingCacheKey(m.Protocol, m.ExternalPort)] = cachedMapping{entry: m, seen: now}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = entries
+	c.refreshedAt = now
+	return nil
+}
+
+// refreshIfStale refreshes the cache if it has never been refreshed, or if refreshInterval has passed since it was. It
+// returns whether the cache can be used. Some routers can't list their mappings at all, so after failing to refresh
+// we don't try again until refreshInterval has passed.
+func (c *MappingCache) refreshIfStale(ctx context.Context) bool {
+	if !c.stale() {
+		return true
+	}
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	// Someone else may have refreshed it while we were waiting.
+	if !c.stale() {
+		return true
+	}
+	if !c.failedAt.IsZero() && c.currentTime().Before(c.failedAt.Add(c.refreshInterval)) {
+		return false
+	}
+	if err := c.refresh(ctx); err != nil {
+		c.failedAt = c.currentTime()
+		return false
+	}
+	c.failedAt = time.Time{}
+	return true
+}
+
+func (c *MappingCache) stale() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries == nil || !c.currentTime().Before(c.refreshedAt.Add(c.refreshInterval))
+}
+
+// store records a port mapping that we've just made, so that the cache doesn't go out of date until the next refresh.
+func (c *MappingCache) store(entry PortMappingEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries != nil {
+		c.entries[mappingCacheKey(entry.Protocol, entry.ExternalPort)] = cachedMapping{entry: entry, seen: c.currentTime()}
+	}
+}
+
+// forget records that we've just removed a port mapping.
+func (c *MappingCache) forget(proto string, externalPort uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, mappingCacheKey(proto, externalPort))
+}
+
+func (c *MappingCache) currentTime() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+func mappingCacheKey(proto string, externalPort uint16) string {
+	return fmt.Sprintf("%s:%d", proto, externalPort)
+}
+
+// mappingCacheRouterClient wraps a RouterClient so that questions about a single port mapping are answered from a
+// MappingCache, refreshing it first if it's stale. If the cache can't be refreshed then the router is asked instead.
+// Changes we make to the router's mappings are written through to the cache.
+type mappingCacheRouterClient struct {
+	RouterClient
+	cache *MappingCache
+}
+
+func (m *mappingCacheRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	err = m.RouterClient.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	return m.added(PortMappingEntry{
+		RemoteHost:     NewRemoteHost,
+		ExternalPort:   NewExternalPort,
+		Protocol:       NewProtocol,
+		InternalPort:   NewInternalPort,
+		InternalClient: NewInternalClient,
+		Enabled:        NewEnabled,
+		Description:    NewPortMappingDescription,
+		LeaseDuration:  NewLeaseDuration,
+	}, err)
+}
+
+// added writes a port mapping that we've just tried to add through to the cache, and returns err. If adding it failed
+// then we don't know what state the router has been left in, so we stop trusting the cache for that port.
+func (m *mappingCacheRouterClient) added(entry PortMappingEntry, err error) error {
+	if err != nil {
+		m.cache.forget(entry.Protocol, entry.ExternalPort)
+		return err
+	}
+	m.cache.store(entry)
+	return nil
+}
+
+func (m *mappingCacheRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	NewReservedPort, err = addAnyPortMapping(m.RouterClient, NewRemoteHost, NewExternalPort, NewProtocol,
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	if errors.Is(err, errAnyPortMappingNotSupported) {
+		return 0, err
+	}
+	if err != nil {
+		m.cache.forget(NewProtocol, NewExternalPort)
+		return 0, err
+	}
+	m.cache.store(PortMappingEntry{
+		RemoteHost:     NewRemoteHost,
+		ExternalPort:   NewReservedPort,
+		Protocol:       NewProtocol,
+		InternalPort:   NewInternalPort,
+		InternalClient: NewInternalClient,
+		Enabled:        NewEnabled,
+		Description:    NewPortMappingDescription,
+		LeaseDuration:  NewLeaseDuration,
+	})
+	return NewReservedPort, nil
+}
+
+func (m *mappingCacheRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	err = m.RouterClient.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+	m.cache.forget(NewProtocol, NewExternalPort)
+	return err
+}
+
+func (m *mappingCacheRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	if entry, answered, err := m.lookup(context.Background(), NewRemoteHost, NewExternalPort, NewProtocol); answered {
+		return entry.InternalPort, entry.InternalClient, entry.Enabled, entry.Description, entry.LeaseDuration, err
+	}
+	return m.RouterClient.GetSpecificPortMappingEntry(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+// lookup answers a question about a single port mapping from the cache, refreshing it first if it's stale. If answered
+// is false then the router needs to be asked instead.
+func (m *mappingCacheRouterClient) lookup(
+	ctx context.Context,
+	remoteHost string,
+	externalPort uint16,
+	protocol string,
+) (entry PortMappingEntry, answered bool, err error) {
+	if !m.cache.refreshIfStale(ctx) {
+		return PortMappingEntry{}, false, nil
+	}
+	cached, ok := m.cache.Lookup(protocol, externalPort)
+	if !ok {
+		return PortMappingEntry{}, true, errNotInMappingCache
+	}
+	// If the router has a mapping for this port, but for a different remote host, then ask. Routers differ in whether
+	// that counts as the same mapping.
+	return *cached, cached.RemoteHost == remoteHost, nil
+}
+
+func (m *mappingCacheRouterClient) AddPortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	err = asContextual(m.RouterClient).AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol,
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	return m.added(PortMappingEntry{
+		RemoteHost:     NewRemoteHost,
+		ExternalPort:   NewExternalPort,
+		Protocol:       NewProtocol,
+		InternalPort:   NewInternalPort,
+		InternalClient: NewInternalClient,
+		Enabled:        NewEnabled,
+		Description:    NewPortMappingDescription,
+		LeaseDuration:  NewLeaseDuration,
+	}, err)
+}
+
+func (m *mappingCacheRouterClient) DeletePortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	err = asContextual(m.RouterClient).DeletePortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+	m.cache.forget(NewProtocol, NewExternalPort)
+	return err
+}
+
+func (m *mappingCacheRouterClient) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	if entry, answered, err := m.lookup(ctx, NewRemoteHost, NewExternalPort, NewProtocol); answered {
+		return entry.InternalPort, entry.InternalClient, entry.Enabled, entry.Description, entry.LeaseDuration, err
+	}
+	return asContextual(m.RouterClient).GetSpecificPortMappingEntryCtx(ctx, NewRemoteHost, NewExternalPort,
+		NewProtocol)
+}
+
+func (m *mappingCacheRouterClient) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return asContextual(m.RouterClient).GetGenericPortMappingEntryCtx(ctx, NewPortMappingIndex)
+}
+
+func (m *mappingCacheRouterClient) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	return asContextual(m.RouterClient).GetExternalIPAddressCtx(ctx)
+}
+
+func (m *mappingCacheRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	return asContextual(m.RouterClient).GetConnectionTypeInfoCtx(ctx)
+}
+
+func (m *mappingCacheRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	return asContextual(m.RouterClient).GetPortMappingNumberOfEntriesCtx(ctx)
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// countingGetSpecificRouterClient counts the calls to GetSpecificPortMappingEntry, so we can tell when the router was
+// asked rather than the cache.
+type countingGetSpecificRouterClient struct {
+	*mockRouterClient
+	getSpecificCalls int
+	// genericErr is returned by GetGenericPortMappingEntry, so that the router's mappings can't be listed.
+	genericErr error
+}
+
+func (c *countingGetSpecificRouterClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	if c.genericErr != nil {
+		return "", 0, "", 0, "", false, "", 0, c.genericErr
+	}
+	return c.mockRouterClient.GetGenericPortMappingEntry(index)
+}
+
+func (c *countingGetSpecificRouterClient) GetSpecificPortMappingEntry(remoteHost string, externalPort uint16, protocol string) (uint16, string, bool, string, uint32, error) {
+	c.getSpecificCalls++
+	return c.mockRouterClient.GetSpecificPortMappingEntry(remoteHost, externalPort, protocol)
+}
+
+// fakeClock is a time that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestMappingCacheRefresh(t *testing.T) {
+	router := &countingGetSpecificRouterClient{mockRouterClient: &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP":  {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "web"},
+		"53/UDP":  {InternalPort: 53, InternalClient: "192.168.1.11", Enabled: true, Description: "dns"},
+		"443/TCP": {InternalPort: 443, InternalClient: "192.168.1.10", Enabled: true, Description: "web"},
+	}}}
+	cache := NewMappingCache(router, time.Minute)
+
+	_, ok := cache.Lookup("TCP", 80)
+	assert.False(t, ok, "the cache should be empty until it's refreshed")
+
+	assert.NoError(t, cache.Refresh(context.Background()))
+	entry, ok := cache.Lookup("TCP", 80)
+	if assert.True(t, ok) {
+		assert.Equal(t, "192.168.1.10", entry.InternalClient)
+		assert.Equal(t, "web", entry.Description)
+	}
+	entry, ok = cache.Lookup("UDP", 53)
+	if assert.True(t, ok) {
+		assert.Equal(t, "192.168.1.11", entry.InternalClient)
+	}
+	_, ok = cache.Lookup("UDP", 80)
+	assert.False(t, ok)
+
+	// Mappings that have gone from the router go from the cache too.
+	delete(router.entries, "80/TCP")
+	assert.NoError(t, cache.Refresh(context.Background()))
+	_, ok = cache.Lookup("TCP", 80)
+	assert.False(t, ok)
+	_, ok = cache.Lookup("TCP", 443)
+	assert.True(t, ok)
+
+	// A failed refresh leaves the cache alone.
+	router.genericErr = upnpFault(ErrCodeActionFailed)
+	assert.Error(t, cache.Refresh(context.Background()))
+	_, ok = cache.Lookup("TCP", 443)
+	assert.True(t, ok)
+}
+
+func TestMappingCacheLookupCountsDownLease(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP":  {InternalPort: 80, InternalClient: "192.168.1.10", LeaseDuration: 3600},
+		"443/TCP": {InternalPort: 443, InternalClient: "192.168.1.10"},
+	}}
+	clock := newFakeClock()
+	cache := NewMappingCache(router, time.Hour)
+	cache.now = clock.now
+	assert.NoError(t, cache.Refresh(context.Background()))
+
+	clock.t = clock.t.Add(10 * time.Minute)
+	entry, ok := cache.Lookup("TCP", 80)
+	if assert.True(t, ok) {
+		assert.Equal(t, uint32(3000), entry.LeaseDuration)
+	}
+
+	clock.t = clock.t.Add(50 * time.Minute)
+	_, ok = cache.Lookup("TCP", 80)
+	assert.False(t, ok, "the mapping's lease should have expired")
+	entry, ok = cache.Lookup("TCP", 443)
+	if assert.True(t, ok, "mappings without a lease never expire") {
+		assert.Equal(t, uint32(0), entry.LeaseDuration)
+	}
+}
+
+func TestMappingCacheRouterClient(t *testing.T) {
+	router := &countingGetSpecificRouterClient{mockRouterClient: &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "web"},
+	}}}
+	clock := newFakeClock()
+	cache := NewMappingCache(router, time.Minute)
+	cache.now = clock.now
+	client := &mappingCacheRouterClient{RouterClient: router, cache: cache}
+
+	// The first lookup reads the whole table, and then answers from it.
+	internalPort, internalClient, _, description, _, err := client.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(80), internalPort)
+	assert.Equal(t, "192.168.1.10", internalClient)
+	assert.Equal(t, "web", description)
+	_, _, _, _, _, err = client.GetSpecificPortMappingEntry("", 8080, "TCP")
+	assert.Equal(t, errNotInMappingCache, err)
+	assert.Equal(t, 0, router.getSpecificCalls)
+
+	// Mappings we add or delete are written through.
+	assert.NoError(t, client.AddPortMapping("", 8080, "TCP", 80, "192.168.1.20", true, "other", 0))
+	_, internalClient, _, _, _, err = client.GetSpecificPortMappingEntry("", 8080, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.20", internalClient)
+	assert.NoError(t, client.DeletePortMapping("", 80, "TCP"))
+	_, _, _, _, _, err = client.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.Equal(t, errNotInMappingCache, err)
+	assert.Equal(t, 0, router.getSpecificCalls)
+
+	// A mapping for a different remote host is checked with the router.
+	_, _, _, _, _, err = client.GetSpecificPortMappingEntry("198.51.100.1", 8080, "TCP")
+	assert.Error(t, err)
+	assert.Equal(t, 1, router.getSpecificCalls)
+
+	// Once the interval has passed the table is read again.
+	router.entries = map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.30", Enabled: true, Description: "web"},
+	}
+	clock.t = clock.t.Add(time.Minute)
+	_, internalClient, _, _, _, err = client.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.30", internalClient)
+	assert.Equal(t, 1, router.getSpecificCalls)
+}
+
+func TestMappingCacheRouterClientFallsBackWhenTableUnreadable(t *testing.T) {
+	router := &countingGetSpecificRouterClient{
+		mockRouterClient: &mockRouterClient{entries: map[string]portMappingEntry{
+			"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "web"},
+		}},
+		genericErr: errors.New("router unavailable"),
+	}
+	clock := newFakeClock()
+	cache := NewMappingCache(router, time.Minute)
+	cache.now = clock.now
+	client := &mappingCacheRouterClient{RouterClient: router, cache: cache}
+
+	_, internalClient, _, _, _, err := client.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", internalClient)
+	assert.Equal(t, 1, router.getSpecificCalls)
+
+	// We don't try to read the table again straight away, but do once the interval has passed.
+	router.genericErr = nil
+	router.entries["443/TCP"] = portMappingEntry{InternalPort: 443, InternalClient: "192.168.1.10"}
+	_, _, _, _, _, err = client.GetSpecificPortMappingEntry("", 443, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, router.getSpecificCalls)
+	clock.t = clock.t.Add(time.Minute)
+	_, _, _, _, _, err = client.GetSpecificPortMappingEntry("", 443, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, router.getSpecificCalls)
+}
+
+func TestReconcileWithMappingCache(t *testing.T) {
+	service := holepunchedService()
+	router := &countingGetSpecificRouterClient{mockRouterClient: &mockRouterClient{}}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithMappingCacheRefreshInterval(time.Hour),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, 0, router.getSpecificCalls)
+
+	// The router loses the mapping, but the cache still has it. An audit reads the table again and puts it back.
+	assert.NoError(t, r.audit(context.Background()))
+	assert.Len(t, router.addCalls, 2)
+	assert.Equal(t, 0, router.getSpecificCalls)
+}
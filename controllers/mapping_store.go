@@ -0,0 +1,293 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MappingStore remembers the port mappings we've made for each service somewhere that outlives holepunch, so that after
+// a restart (or a crash) we still know what we left on the router.
+type MappingStore interface {
+	// Save records the port mappings we've made for a service, replacing any that were saved before. Saving no
+	// mappings forgets the service.
+	Save(ctx context.Context, svc types.NamespacedName, mappings []PortMappingEntry) error
+	// Load returns the port mappings last saved for a service, or nil if there aren't any.
+	Load(ctx context.Context, svc types.NamespacedName) ([]PortMappingEntry, error)
+	// List returns the port mappings saved for every service.
+	List(ctx context.Context) (map[types.NamespacedName][]PortMappingEntry, error)
+}
+
+// configMapMappingStore is a MappingStore that keeps every service's port mappings in a single ConfigMap. Each service
+// has a key of the form "<namespace>/<name>", whose value is its JSON-encoded port mappings.
+type configMapMappingStore struct {
+	client    client.Client
+	namespace string
+	name      string
+}
+
+// NewConfigMapMappingStore stores port mappings in the named ConfigMap, which is created when the first service's
+// mappings are saved.
+func NewConfigMapMappingStore(client client.Client, namespace, name string) MappingStore {
+	return &configMapMappingStore{client: client, namespace: namespace, name: name}
+}
+
+func (s *configMapMappingStore) Save(ctx context.Context, svc types.NamespacedName, mappings []PortMappingEntry) error {
+	var encoded []byte
+	if len(mappings) > 0 {
+		var err error
+		if encoded, err = json.Marshal(mappings); err != nil {
+			return err
+		}
+	}
+	// Every service shares the ConfigMap, so we can lose a race with another service's save.
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var configMap corev1.ConfigMap
+		err := s.client.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: s.name}, &configMap)
+		if apierrors.IsNotFound(err) {
+			if encoded == nil {
+				return nil
+			}
+			configMap = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name},
+				Data:       map[string]string{svc.String(): string(encoded)},
+			}
+			return s.client.Create(ctx, &configMap)
+		}
+		if err != nil {
+			return err
+		}
+		current, ok := configMap.Data[svc.String()]
+		if encoded == nil {
+			if !ok {
+				return nil
+			}
+			delete(configMap.Data, svc.String())
+		} else {
+			if ok && current == string(encoded) {
+				return nil
+			}
+			if configMap.Data == nil {
+				configMap.Data = make(map[string]string)
+			}
+			configMap.Data[svc.String()] = string(encoded)
+		}
+		return s.client.Update(ctx, &configMap)
+	})
+}
+
+func (s *configMapMappingStore) Load(ctx context.Context, svc types.NamespacedName) ([]PortMappingEntry, error) {
+	configMap, err := s.get(ctx)
+	if err != nil || configMap == nil {
+		return nil, err
+	}
+	encoded, ok := configMap.Data[svc.String()]
+	if !ok {
+		return nil, nil
+	}
+	return decodeStoredMappings(svc.String(), encoded)
+}
+
+func (s *configMapMappingStore) List(ctx context.Context) (map[types.NamespacedName][]PortMappingEntry, error) {
+	configMap, err := s.get(ctx)
+	if err != nil || configMap == nil {
+		return nil, err
+	}
+	saved := make(map[types.NamespacedName][]PortMappingEntry, len(configMap.Data))
+	for key, encoded := range configMap.Data {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid service %q in ConfigMap %s/%s", key, s.namespace, s.name)
+		}
+		mappings, err := decodeStoredMappings(key, encoded)
+		if err != nil {
+			return nil, err
+		}
+		saved[types.NamespacedName{Namespace: parts[0], Name: parts[1]}] = mappings
+	}
+	return saved, nil
+}
+
+// get reads the ConfigMap, or returns nil if it hasn't been created yet.
+func (s *configMapMappingStore) get(ctx context.Context) (*corev1.ConfigMap, error) {
+	var configMap corev1.ConfigMap
+	err := s.client.Get(ctx, types.NamespacedName{Namespace: s.namespace, Name: s.name}, &configMap)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &configMap, nil
+}
+
+func decodeStoredMappings(key, encoded string) ([]PortMappingEntry, error) {
+	var mappings []PortMappingEntry
+	if err := json.Unmarshal([]byte(encoded), &mappings); err != nil {
+		return nil, fmt.Errorf("unable to parse saved port mappings for %s: %w", key, err)
+	}
+	return mappings, nil
+}
+
+// storedMappings describes the port mappings we've made for a service, in the form they're saved to a MappingStore.
+// mappings is in the form produced by getSpecMappings.
+func storedMappings(service corev1.Service, mappings map[string]uint16, serviceIP string, leaseDuration uint32, actualLeaseDuration uint32, clusterName string, prefix string) ([]PortMappingEntry, error) {
+	remoteHost, err := getRemoteHost(service)
+	if err != nil {
+		return nil, err
+	}
+	// An invalid template has already been warned about when the ports were forwarded.
+	describe, _ := mappingDescriptions(service, clusterName, prefix)
+	if actualLeaseDuration == leaseDuration {
+		actualLeaseDuration = 0
+	}
+	entries := make([]PortMappingEntry, 0, len(mappings))
+	for key, externalPort := range mappings {
+		internalPort, protocol, err := parseMappingKey(key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, PortMappingEntry{
+			RemoteHost:          remoteHost,
+			ExternalPort:        externalPort,
+			Protocol:            protocol,
+			InternalPort:        internalPort,
+			InternalClient:      serviceIP,
+			Enabled:             true,
+			Description:         describe(key, externalPort),
+			LeaseDuration:       leaseDuration,
+			ActualLeaseDuration: actualLeaseDuration,
+		})
+	}
+	// Keep the order stable, so that saving the same mappings again doesn't change anything.
+	sortPortMappingEntries(entries)
+	return entries, nil
+}
+
+func sortPortMappingEntries(entries []PortMappingEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Protocol != entries[j].Protocol {
+			return entries[i].Protocol < entries[j].Protocol
+		}
+		return entries[i].ExternalPort < entries[j].ExternalPort
+	})
+}
+
+// saveMappings saves a service's port mappings to the MappingStore, if there is one.
+func (r *ServiceReconciler) saveMappings(ctx context.Context, svc types.NamespacedName, mappings []PortMappingEntry) error {
+	if r.MappingStore == nil {
+		return nil
+	}
+	return r.MappingStore.Save(ctx, svc, mappings)
+}
+
+// saveServiceMappings saves the port mappings we've forwarded for a service to the MappingStore, if there is one.
+func (r *ServiceReconciler) saveServiceMappings(ctx context.Context, service corev1.Service, mappings map[string]uint16, serviceIP string, leaseDuration uint32, actualLeaseDuration uint32) error {
+	if r.MappingStore == nil {
+		return nil
+	}
+	entries, err := storedMappings(service, mappings, serviceIP, leaseDuration, actualLeaseDuration, r.ClusterName,
+		r.descriptionPrefix(service))
+	if err != nil {
+		return err
+	}
+	return r.saveMappings(ctx, types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, entries)
+}
+
+// MappingDrift is a port mapping we saved for a service that the router doesn't have any more, or that no longer
+// belongs to a service.
+type MappingDrift struct {
+	Service types.NamespacedName
+	Saved   PortMappingEntry
+	// Actual is the router's mapping for the same external port, or nil if it doesn't have one.
+	Actual *PortMappingEntry
+	// Orphaned is true if the service has been deleted, or no longer has the holepunch annotation, so nothing will
+	// remove the mapping.
+	Orphaned bool
+}
+
+// CheckMappingDrift compares the port mappings saved in the MappingStore with the router's, and returns the ones that
+// differ. These are the mappings that changed while holepunch wasn't running, such as because the router rebooted or
+// a service was deleted. Services that have their own router aren't checked.
+func (r *ServiceReconciler) CheckMappingDrift(ctx context.Context) ([]MappingDrift, error) {
+	if r.MappingStore == nil {
+		return nil, nil
+	}
+	saved, err := r.MappingStore.List(ctx)
+	if err != nil || len(saved) == 0 {
+		return nil, err
+	}
+	router, err := r.getRouterClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := GetAllPortMappings(ctx, router)
+	if err != nil {
+		return nil, err
+	}
+	routerMappings := make(map[string]PortMappingEntry, len(actual))
+	for _, m := range actual {
+		routerMappings[mappingCacheKey(m.Protocol, m.ExternalPort)] = m
+	}
+
+	var drift []MappingDrift
+	for name, mappings := range saved {
+		var service corev1.Service
+		orphaned := false
+		if err := r.Get(ctx, name, &service); apierrors.IsNotFound(err) {
+			orphaned = true
+		} else if err != nil {
+			return nil, err
+		} else if routerURL, _ := getServiceRouterURL(service); routerURL != "" {
+			continue
+		} else {
+			orphaned = !HasHolepunchAnnotation(service)
+		}
+		for _, m := range mappings {
+			current, ok := routerMappings[mappingCacheKey(m.Protocol, m.ExternalPort)]
+			switch {
+			case ok && (current.InternalClient != m.InternalClient || current.InternalPort != m.InternalPort):
+				drift = append(drift, MappingDrift{Service: name, Saved: m, Actual: &current, Orphaned: orphaned})
+			case !ok:
+				drift = append(drift, MappingDrift{Service: name, Saved: m, Orphaned: orphaned})
+			case orphaned:
+				drift = append(drift, MappingDrift{Service: name, Saved: m, Actual: &current, Orphaned: true})
+			}
+		}
+	}
+	return drift, nil
+}
+
+// checkMappingDriftOnStart logs any drift between the saved port mappings and the router's, the first time it's
+// called. It's called before the first reconcile, so that we see what the router looked like before we change it.
+func (r *ServiceReconciler) checkMappingDriftOnStart(ctx context.Context) {
+	r.driftCheckOnce.Do(func() {
+		if r.MappingStore == nil {
+			return
+		}
+		drift, err := r.CheckMappingDrift(ctx)
+		if err != nil {
+			r.Log.Error(err, "Unable to compare saved port mappings with the router's")
+			return
+		}
+		for _, d := range drift {
+			log := r.Log.WithValues("service", d.Service, "external-port", d.Saved.ExternalPort,
+				"protocol", d.Saved.Protocol, "orphaned", d.Orphaned)
+			if d.Actual == nil {
+				log.Info("Saved port mapping is missing from the router")
+			} else {
+				log.Info("Saved port mapping differs from the router's", "internal-client", d.Actual.InternalClient,
+					"internal-port", d.Actual.InternalPort)
+			}
+		}
+	})
+}
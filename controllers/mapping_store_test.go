@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestConfigMapMappingStore(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme)
+	store := NewConfigMapMappingStore(c, "holepunch-system", "holepunch-mappings")
+	ctx := context.Background()
+	web := types.NamespacedName{Namespace: "default", Name: "web"}
+	dns := types.NamespacedName{Namespace: "kube-system", Name: "dns"}
+
+	// Nothing has been saved yet, so there's no ConfigMap.
+	mappings, err := store.Load(ctx, web)
+	assert.NoError(t, err)
+	assert.Nil(t, mappings)
+	assert.NoError(t, store.Save(ctx, web, nil))
+
+	webMappings := []PortMappingEntry{
+		{ExternalPort: 80, Protocol: "TCP", InternalPort: 8080, InternalClient: "192.168.1.10", Enabled: true, Description: "web", LeaseDuration: 3600},
+	}
+	dnsMappings := []PortMappingEntry{
+		{ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: "192.168.1.11", Enabled: true, LeaseDuration: 3600},
+	}
+	assert.NoError(t, store.Save(ctx, web, webMappings))
+	assert.NoError(t, store.Save(ctx, dns, dnsMappings))
+
+	var configMap corev1.ConfigMap
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "holepunch-system", Name: "holepunch-mappings"}, &configMap))
+	assert.JSONEq(t,
+		`[{"externalPort":80,"protocol":"TCP","internalPort":8080,"internalClient":"192.168.1.10","enabled":true,"description":"web","leaseDuration":3600}]`,
+		configMap.Data["default/web"])
+
+	mappings, err = store.Load(ctx, web)
+	assert.NoError(t, err)
+	assert.Equal(t, webMappings, mappings)
+	all, err := store.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[types.NamespacedName][]PortMappingEntry{web: webMappings, dns: dnsMappings}, all)
+
+	// Saving no mappings forgets the service, without touching the others.
+	assert.NoError(t, store.Save(ctx, web, nil))
+	mappings, err = store.Load(ctx, web)
+	assert.NoError(t, err)
+	assert.Nil(t, mappings)
+	mappings, err = store.Load(ctx, dns)
+	assert.NoError(t, err)
+	assert.Equal(t, dnsMappings, mappings)
+}
+
+func TestConfigMapMappingStoreInvalidData(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, &corev1.ConfigMap{
+		ObjectMeta: ctrl.ObjectMeta{Namespace: "holepunch-system", Name: "holepunch-mappings"},
+		Data:       map[string]string{"default/web": "not json"},
+	})
+	store := NewConfigMapMappingStore(c, "holepunch-system", "holepunch-mappings")
+	_, err := store.Load(context.Background(), types.NamespacedName{Namespace: "default", Name: "web"})
+	assert.Error(t, err)
+	_, err = store.List(context.Background())
+	assert.Error(t, err)
+}
+
+func TestReconcileSavesMappings(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService())
+	store := NewConfigMapMappingStore(c, "holepunch-system", "holepunch-mappings")
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(&mockRouterClient{}),
+		WithMappingStore(store),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	mappings, err := store.Load(context.Background(), req.NamespacedName)
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMappingEntry{{
+		ExternalPort:   80,
+		Protocol:       "TCP",
+		InternalPort:   80,
+		InternalClient: "192.168.1.10",
+		Enabled:        true,
+		Description:    "Mapping for my-service/default",
+		LeaseDuration:  leaseDurationSeconds,
+	}}, mappings)
+
+	// Once the mappings are removed there's nothing to remember.
+	var service corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &service))
+	service.Annotations[holepunchAnnotationName] = "false"
+	assert.NoError(t, c.Update(context.Background(), &service))
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	mappings, err = store.Load(context.Background(), req.NamespacedName)
+	assert.NoError(t, err)
+	assert.Nil(t, mappings)
+}
+
+func TestCheckMappingDrift(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService())
+	store := NewConfigMapMappingStore(c, "holepunch-system", "holepunch-mappings")
+	ctx := context.Background()
+	kept := PortMappingEntry{ExternalPort: 80, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true}
+	lost := PortMappingEntry{ExternalPort: 443, Protocol: "TCP", InternalPort: 443, InternalClient: "192.168.1.10", Enabled: true}
+	taken := PortMappingEntry{ExternalPort: 8080, Protocol: "TCP", InternalPort: 8080, InternalClient: "192.168.1.10", Enabled: true}
+	orphan := PortMappingEntry{ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: "192.168.1.11", Enabled: true}
+	myService := types.NamespacedName{Namespace: "default", Name: "my-service"}
+	deleted := types.NamespacedName{Namespace: "default", Name: "deleted"}
+	assert.NoError(t, store.Save(ctx, myService, []PortMappingEntry{kept, lost, taken}))
+	assert.NoError(t, store.Save(ctx, deleted, []PortMappingEntry{orphan}))
+
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP":   {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true},
+		"8080/TCP": {InternalPort: 8080, InternalClient: "192.168.1.99", Enabled: true},
+		"53/UDP":   {InternalPort: 53, InternalClient: "192.168.1.11", Enabled: true},
+	}}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithRouterClients(router),
+		WithMappingStore(store),
+	)
+
+	drift, err := r.CheckMappingDrift(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []MappingDrift{
+		{Service: myService, Saved: lost},
+		{Service: myService, Saved: taken, Actual: &PortMappingEntry{
+			ExternalPort: 8080, Protocol: "TCP", InternalPort: 8080, InternalClient: "192.168.1.99", Enabled: true,
+		}},
+		{Service: deleted, Saved: orphan, Orphaned: true, Actual: &PortMappingEntry{
+			ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: "192.168.1.11", Enabled: true,
+		}},
+	}, drift)
+}
+
+func TestCheckMappingDriftWithoutStore(t *testing.T) {
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme), scheme.Scheme,
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+	)
+	drift, err := r.CheckMappingDrift(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, drift)
+	assert.Zero(t, calls, "there's no need to ask the router when nothing was saved")
+}
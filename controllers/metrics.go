@@ -0,0 +1,455 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// MetricsRecorder records metrics about what the controller is doing to the router.
+type MetricsRecorder interface {
+	// RecordPortMapping records the result of trying to forward a single port for a service.
+	RecordPortMapping(service types.NamespacedName, port uint16, protocol string, err error)
+
+	// RecordUPnPCall records how long a single call to the router took.
+	RecordUPnPCall(operation string, duration time.Duration)
+
+	// RecordActiveMappings records how many port mappings are active on a router for a service. A count of zero means
+	// the service no longer has any mappings, in which case routerIP is ignored.
+	RecordActiveMappings(routerIP string, service types.NamespacedName, count int)
+
+	// RecordRouterPortMappings records how many port mappings the router has in total, including ones that weren't
+	// made by holepunch.
+	RecordRouterPortMappings(count int)
+
+	// RecordReconcilePanic records that reconciling a service panicked.
+	RecordReconcilePanic()
+}
+
+// PrometheusMetricsRecorder is a MetricsRecorder that exposes metrics to Prometheus.
+type PrometheusMetricsRecorder struct {
+	portMappings     *prometheus.CounterVec
+	upnpCallDuration *prometheus.HistogramVec
+	routerCalls      *routerCallMetrics
+	activeMappings   *prometheus.GaugeVec
+	routerMappings   prometheus.Gauge
+	reconcilePanics  prometheus.Counter
+
+	// The active mappings gauge is per-router, but we find out about active mappings per-service, so we need to keep
+	// track of which services have how many mappings on which router.
+	activeMappingsMu sync.Mutex
+	serviceMappings  map[types.NamespacedName]activeMappingCount
+}
+
+type activeMappingCount struct {
+	routerIP string
+	count    int
+}
+
+// NewPrometheusMetricsRecorder creates holepunch's metrics and registers them with the given registry.
+func NewPrometheusMetricsRecorder(reg prometheus.Registerer) (*PrometheusMetricsRecorder, error) {
+	m := &PrometheusMetricsRecorder{
+		portMappings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_port_mapping_total",
+			Help: "Number of attempts to forward a port with UPnP, by result.",
+		}, []string{"namespace", "service", "port", "protocol", "result"}),
+		upnpCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "holepunch_upnp_call_duration_seconds",
+			Help: "How long calls to the router over UPnP take.",
+		}, []string{"operation"}),
+		activeMappings: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "holepunch_active_mappings",
+			Help: "Number of port mappings holepunch currently has active on a router.",
+		}, []string{"router_ip"}),
+		routerMappings: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "holepunch_router_total_port_mappings",
+			Help: "Number of port mappings on the router, including ones not made by holepunch, as of the last audit.",
+		}),
+		reconcilePanics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "holepunch_reconcile_panics_total",
+			Help: "Number of times reconciling a service has panicked.",
+		}),
+		serviceMappings: make(map[types.NamespacedName]activeMappingCount),
+	}
+	for _, c := range []prometheus.Collector{m.portMappings, m.upnpCallDuration, m.activeMappings, m.routerMappings, m.reconcilePanics} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	routerCalls, err := registerRouterCallMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
+	m.routerCalls = routerCalls
+	return m, nil
+}
+
+var (
+	registerMetricsOnce sync.Once
+	registeredMetrics   *PrometheusMetricsRecorder
+	registerMetricsErr  error
+)
+
+// RegisterMetrics creates holepunch's metrics and registers them with the given registry, or
+// prometheus.DefaultRegisterer if it is nil. The metrics are only ever registered once, and later calls return the
+// same recorder.
+func RegisterMetrics(reg prometheus.Registerer) (*PrometheusMetricsRecorder, error) {
+	registerMetricsOnce.Do(func() {
+		if reg == nil {
+			reg = prometheus.DefaultRegisterer
+		}
+		registeredMetrics, registerMetricsErr = NewPrometheusMetricsRecorder(reg)
+	})
+	return registeredMetrics, registerMetricsErr
+}
+
+// resultLabel is the value of the "result" label for an operation that returned err.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func (m *PrometheusMetricsRecorder) RecordPortMapping(service types.NamespacedName, port uint16, protocol string, err error) {
+	m.portMappings.WithLabelValues(service.Namespace, service.Name, strconv.Itoa(int(port)), protocol, resultLabel(err)).Inc()
+}
+
+func (m *PrometheusMetricsRecorder) RecordUPnPCall(operation string, duration time.Duration) {
+	m.upnpCallDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+func (m *PrometheusMetricsRecorder) RecordRouterCall(method string, duration time.Duration, err error) {
+	m.routerCalls.RecordRouterCall(method, duration, err)
+}
+
+func (m *PrometheusMetricsRecorder) RecordActiveMappings(routerIP string, service types.NamespacedName, count int) {
+	m.activeMappingsMu.Lock()
+	defer m.activeMappingsMu.Unlock()
+
+	previous, hadPrevious := m.serviceMappings[service]
+	if count == 0 {
+		delete(m.serviceMappings, service)
+	} else {
+		m.serviceMappings[service] = activeMappingCount{routerIP: routerIP, count: count}
+	}
+
+	// Recalculate the totals for any router this service was, or is now, on.
+	if hadPrevious {
+		m.updateActiveMappingsGauge(previous.routerIP)
+	}
+	if count != 0 && (!hadPrevious || previous.routerIP != routerIP) {
+		m.updateActiveMappingsGauge(routerIP)
+	}
+}
+
+func (m *PrometheusMetricsRecorder) updateActiveMappingsGauge(routerIP string) {
+	total := 0
+	for _, c := range m.serviceMappings {
+		if c.routerIP == routerIP {
+			total += c.count
+		}
+	}
+	m.activeMappings.WithLabelValues(routerIP).Set(float64(total))
+}
+
+func (m *PrometheusMetricsRecorder) RecordRouterPortMappings(count int) {
+	m.routerMappings.Set(float64(count))
+}
+
+func (m *PrometheusMetricsRecorder) RecordReconcilePanic() {
+	m.reconcilePanics.Inc()
+}
+
+// noopMetricsRecorder is used when the reconciler hasn't been given a MetricsRecorder.
+type noopMetricsRecorder struct{}
+
+func (noopMetricsRecorder) RecordPortMapping(types.NamespacedName, uint16, string, error) {}
+func (noopMetricsRecorder) RecordUPnPCall(string, time.Duration)                          {}
+func (noopMetricsRecorder) RecordActiveMappings(string, types.NamespacedName, int)        {}
+func (noopMetricsRecorder) RecordRouterPortMappings(int)                                  {}
+func (noopMetricsRecorder) RecordReconcilePanic()                                         {}
+
+// routerCallRecorder is implemented by MetricsRecorders that also record whether each call to the router failed.
+type routerCallRecorder interface {
+	RecordRouterCall(method string, duration time.Duration, err error)
+}
+
+// routerCallMetrics records every call to the router by method and result.
+type routerCallMetrics struct {
+	noopMetricsRecorder
+	duration *prometheus.HistogramVec
+	calls    *prometheus.CounterVec
+}
+
+// registerRouterCallMetrics creates the router call metrics and registers them with reg. If they're already registered
+// (e.g., because more than one router is instrumented) then the existing metrics are used.
+func registerRouterCallMetrics(reg prometheus.Registerer) (*routerCallMetrics, error) {
+	m := &routerCallMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "holepunch_router_call_duration_seconds",
+			Help: "How long calls to the router take, by method and result.",
+		}, []string{"method", "result"}),
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "holepunch_router_calls_total",
+			Help: "Number of calls to the router, by method and result.",
+		}, []string{"method", "result"}),
+	}
+	if err := reg.Register(m.duration); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		m.duration = existing.ExistingCollector.(*prometheus.HistogramVec)
+	}
+	if err := reg.Register(m.calls); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		m.calls = existing.ExistingCollector.(*prometheus.CounterVec)
+	}
+	return m, nil
+}
+
+func (m *routerCallMetrics) RecordRouterCall(method string, duration time.Duration, err error) {
+	m.duration.WithLabelValues(method, resultLabel(err)).Observe(duration.Seconds())
+	m.calls.WithLabelValues(method, resultLabel(err)).Inc()
+}
+
+// NewInstrumentedRouterClient wraps a router so that every call to it is recorded in the
+// holepunch_router_call_duration_seconds and holepunch_router_calls_total metrics, registered with reg. Like
+// prometheus.MustRegister, it panics if the metrics can't be registered.
+func NewInstrumentedRouterClient(inner RouterClient, reg prometheus.Registerer) RouterClient {
+	m, err := registerRouterCallMetrics(reg)
+	if err != nil {
+		panic(err)
+	}
+	return &timedRouterClient{RouterClient: inner, metrics: m}
+}
+
+// timedRouterClient wraps a RouterClient to record how long each call to the router takes. If its MetricsRecorder is
+// a routerCallRecorder then whether each call failed is recorded too.
+type timedRouterClient struct {
+	RouterClient
+	metrics MetricsRecorder
+}
+
+func (t *timedRouterClient) observe(operation string, start time.Time, err error) {
+	duration := time.Since(start)
+	t.metrics.RecordUPnPCall(operation, duration)
+	if calls, ok := t.metrics.(routerCallRecorder); ok {
+		calls.RecordRouterCall(operation, duration, err)
+	}
+}
+
+func (t *timedRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	start := time.Now()
+	defer func() { t.observe("AddPortMapping", start, err) }()
+	return t.RouterClient.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (t *timedRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	start := time.Now()
+	defer func() { t.observe("DeletePortMapping", start, err) }()
+	return t.RouterClient.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (t *timedRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetSpecificPortMappingEntry", start, err) }()
+	return t.RouterClient.GetSpecificPortMappingEntry(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (t *timedRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetGenericPortMappingEntry", start, err) }()
+	return t.RouterClient.GetGenericPortMappingEntry(NewPortMappingIndex)
+}
+
+func (t *timedRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetExternalIPAddress", start, err) }()
+	return t.RouterClient.GetExternalIPAddress()
+}
+
+func (t *timedRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetConnectionTypeInfo", start, err) }()
+	return t.RouterClient.GetConnectionTypeInfo()
+}
+
+func (t *timedRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetPortMappingNumberOfEntries", start, err) }()
+	return t.RouterClient.GetPortMappingNumberOfEntries()
+}
+
+func (t *timedRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (
+	NewReservedPort uint16,
+	err error,
+) {
+	start := time.Now()
+	defer func() {
+		if !errors.Is(err, errAnyPortMappingNotSupported) {
+			t.observe("AddAnyPortMapping", start, err)
+		}
+	}()
+	return addAnyPortMapping(t.RouterClient, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+		NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (t *timedRouterClient) AddPortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	start := time.Now()
+	defer func() { t.observe("AddPortMapping", start, err) }()
+	return asContextual(t.RouterClient).AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol,
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (t *timedRouterClient) DeletePortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	start := time.Now()
+	defer func() { t.observe("DeletePortMapping", start, err) }()
+	return asContextual(t.RouterClient).DeletePortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (t *timedRouterClient) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetSpecificPortMappingEntry", start, err) }()
+	return asContextual(t.RouterClient).GetSpecificPortMappingEntryCtx(ctx, NewRemoteHost, NewExternalPort,
+		NewProtocol)
+}
+
+func (t *timedRouterClient) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetGenericPortMappingEntry", start, err) }()
+	return asContextual(t.RouterClient).GetGenericPortMappingEntryCtx(ctx, NewPortMappingIndex)
+}
+
+func (t *timedRouterClient) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetExternalIPAddress", start, err) }()
+	return asContextual(t.RouterClient).GetExternalIPAddressCtx(ctx)
+}
+
+func (t *timedRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetConnectionTypeInfo", start, err) }()
+	return asContextual(t.RouterClient).GetConnectionTypeInfoCtx(ctx)
+}
+
+func (t *timedRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	start := time.Now()
+	defer func() { t.observe("GetPortMappingNumberOfEntries", start, err) }()
+	return asContextual(t.RouterClient).GetPortMappingNumberOfEntriesCtx(ctx)
+}
@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestPrometheusRecordPortMapping(t *testing.T) {
+	m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+	service := types.NamespacedName{Namespace: "default", Name: "my-service"}
+
+	m.RecordPortMapping(service, 80, "TCP", nil)
+	m.RecordPortMapping(service, 80, "TCP", nil)
+	m.RecordPortMapping(service, 80, "TCP", errors.New("router unavailable"))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.portMappings.WithLabelValues("default", "my-service", "80", "TCP", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.portMappings.WithLabelValues("default", "my-service", "80", "TCP", "error")))
+}
+
+func TestPrometheusRecordActiveMappings(t *testing.T) {
+	m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+	a := types.NamespacedName{Namespace: "default", Name: "a"}
+	b := types.NamespacedName{Namespace: "default", Name: "b"}
+
+	m.RecordActiveMappings("203.0.113.1", a, 2)
+	m.RecordActiveMappings("203.0.113.1", b, 3)
+	assert.Equal(t, float64(5), testutil.ToFloat64(m.activeMappings.WithLabelValues("203.0.113.1")))
+
+	// Re-recording the same service replaces rather than adds to its count
+	m.RecordActiveMappings("203.0.113.1", a, 1)
+	assert.Equal(t, float64(4), testutil.ToFloat64(m.activeMappings.WithLabelValues("203.0.113.1")))
+
+	// The router's IP changing moves the service's mappings over
+	m.RecordActiveMappings("203.0.113.2", b, 3)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.activeMappings.WithLabelValues("203.0.113.1")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.activeMappings.WithLabelValues("203.0.113.2")))
+
+	// Removing a service's mappings doesn't need the router IP
+	m.RecordActiveMappings("", b, 0)
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.activeMappings.WithLabelValues("203.0.113.2")))
+}
+
+func TestNewPrometheusMetricsRecorderRegisterTwiceErrors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	_, err := NewPrometheusMetricsRecorder(reg)
+	assert.NoError(t, err)
+	_, err = NewPrometheusMetricsRecorder(reg)
+	assert.Error(t, err)
+}
+
+// recordingMetricsRecorder is a MetricsRecorder that remembers which UPnP operations it was told about.
+type recordingMetricsRecorder struct {
+	noopMetricsRecorder
+	operations []string
+}
+
+func (m *recordingMetricsRecorder) RecordUPnPCall(operation string, _ time.Duration) {
+	m.operations = append(m.operations, operation)
+}
+
+func TestTimedRouterClientRecordsCalls(t *testing.T) {
+	m := &recordingMetricsRecorder{}
+	router := &timedRouterClient{RouterClient: &mockRouterClient{}, metrics: m}
+
+	assert.NoError(t, router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.NoError(t, router.DeletePortMapping("", 80, "TCP"))
+	_, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"AddPortMapping", "DeletePortMapping", "GetExternalIPAddress"}, m.operations)
+}
+
+func TestInstrumentedRouterClient(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner := &mockRouterClient{deleteErr: errors.New("router unavailable")}
+	router := NewInstrumentedRouterClient(inner, reg)
+
+	assert.NoError(t, router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.NoError(t, router.AddPortMapping("", 443, "TCP", 443, "192.168.1.10", true, "", 3600))
+	assert.Error(t, router.DeletePortMapping("", 80, "TCP"))
+	_, _, _, _, _, err := router.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.Error(t, err)
+
+	// Instrumenting another router with the same registry adds to the same metrics.
+	_, err = NewInstrumentedRouterClient(&mockRouterClient{}, reg).GetExternalIPAddress()
+	assert.NoError(t, err)
+
+	m, err := registerRouterCallMetrics(reg)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.calls.WithLabelValues("AddPortMapping", "success")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.calls.WithLabelValues("AddPortMapping", "error")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.calls.WithLabelValues("DeletePortMapping", "error")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.calls.WithLabelValues("GetSpecificPortMappingEntry", "error")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.calls.WithLabelValues("GetExternalIPAddress", "success")))
+
+	// Every call is timed too
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	timed := uint64(0)
+	for _, family := range families {
+		if family.GetName() != "holepunch_router_call_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			timed += metric.GetHistogram().GetSampleCount()
+		}
+	}
+	assert.Equal(t, uint64(5), timed)
+}
+
+func TestPrometheusMetricsRecorderRecordsRouterCalls(t *testing.T) {
+	m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+	router := &timedRouterClient{RouterClient: &mockRouterClient{addErr: errors.New("router unavailable")}, metrics: m}
+
+	assert.Error(t, router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.routerCalls.calls.WithLabelValues("AddPortMapping", "error")))
+}
+
+func TestSyncPortMappingsRecordsMetrics(t *testing.T) {
+	m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+	r := NewServiceReconciler(nil, nil, WithMetricsRecorder(m))
+	service := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"},
+	}
+
+	err = r.syncPortMappings(context.Background(), logf.NullLogger{}, &mockRouterClient{}, service, "192.168.1.10",
+		leaseDurationSeconds, nil, map[string]uint16{"80/TCP": 3000, "53/UDP": 53}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.portMappings.WithLabelValues("default", "my-service", "80", "TCP", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.portMappings.WithLabelValues("default", "my-service", "53", "UDP", "success")))
+}
+
+func TestGetRouterClientInstrumentsRouter(t *testing.T) {
+	m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+	calls := 0
+	r := NewServiceReconciler(nil, nil,
+		WithMetricsRecorder(m),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+		WithRouterCacheTTL(time.Minute),
+	)
+
+	router, err := r.getRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.IsType(t, &timedRouterClient{}, router)
+}
+
+func TestPrometheusRecordRouterPortMappings(t *testing.T) {
+	m, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+
+	m.RecordRouterPortMappings(7)
+	assert.Equal(t, float64(7), testutil.ToFloat64(m.routerMappings))
+	m.RecordRouterPortMappings(3)
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.routerMappings))
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/JamesLaverack/holepunch/pkg/testutil/mockupnp"
+)
+
+// mockUPnPReconciler returns a reconciler for the objects that talks UPnP to srv, along with its event recorder.
+func mockUPnPReconciler(t *testing.T, srv *mockupnp.Server, objs ...runtime.Object) (*ServiceReconciler, *record.FakeRecorder) {
+	router, err := PickRouterClient(context.Background(), srv.RootDescURL())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	recorder := record.NewFakeRecorder(10)
+	return NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, objs...), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	), recorder
+}
+
+func TestReconcileWithMockUPnPServer(t *testing.T) {
+	srv := mockupnp.NewServer(t)
+	defer srv.Close()
+	service := holepunchedService()
+	r, _ := mockUPnPReconciler(t, srv, service)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []mockupnp.Mapping{{
+		ExternalPort:   80,
+		Protocol:       "TCP",
+		InternalPort:   80,
+		InternalClient: "192.168.1.10",
+		Enabled:        true,
+		Description:    "Mapping for my-service/default",
+		LeaseDuration:  leaseDurationSeconds,
+	}}, srv.Mappings())
+
+	// Turning holepunch off for the service removes its mapping from the router.
+	assert.NoError(t, r.Get(context.Background(), req.NamespacedName, service))
+	service.Annotations[holepunchAnnotationName] = "false"
+	assert.NoError(t, r.Update(context.Background(), service))
+	r.forgetProcessed(req.NamespacedName)
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Empty(t, srv.Mappings())
+}
+
+func TestReconcileWithMockUPnPServerConflict(t *testing.T) {
+	srv := mockupnp.NewServer(t)
+	plex := mockupnp.Mapping{ExternalPort: 80, Protocol: "TCP", InternalPort: 32400, InternalClient: "192.168.1.50",
+		Enabled: true, Description: "Plex Media Server"}
+	srv.AddMapping(plex)
+	r, recorder := mockUPnPReconciler(t, srv, holepunchedService())
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []mockupnp.Mapping{plex}, srv.Mappings())
+	assert.Zero(t, srv.Calls("DeletePortMapping"))
+	events := drainEvents(recorder)
+	if assert.NotEmpty(t, events) {
+		assert.Contains(t, events[0], "PortMappingConflict")
+	}
+}
+
+func TestReconcileWithMockUPnPServerSamePortsRequired(t *testing.T) {
+	srv := mockupnp.NewServer(t)
+	srv.RequireSamePorts(true)
+	service := holepunchedService()
+	service.Annotations[holepunchPortMapAnnotationPrefix+"80"] = "3000"
+	r, recorder := mockUPnPReconciler(t, srv, service)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	// The router won't forward port 3000 to port 80, so port 80 is forwarded as-is instead.
+	if mappings := srv.Mappings(); assert.Len(t, mappings, 1) {
+		assert.Equal(t, uint16(80), mappings[0].ExternalPort)
+		assert.Equal(t, uint16(80), mappings[0].InternalPort)
+	}
+	events := drainEvents(recorder)
+	if assert.NotEmpty(t, events) {
+		assert.Contains(t, events[0], "SamePortValuesRequired")
+	}
+}
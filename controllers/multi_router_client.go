@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"errors"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// multiRouterClient is a RouterClient that configures several routers at once, such as when there's both an ISP's
+// router and a VPN router on the network. Changes are made to every router, and any errors are aggregated. The first
+// router is the one that's reported as our external IP.
+type multiRouterClient struct {
+	routers []RouterClient
+}
+
+func (m *multiRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	var errs []error
+	for _, router := range m.routers {
+		if err := router.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (m *multiRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	var errs []error
+	for _, router := range m.routers {
+		if err := router.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// GetSpecificPortMappingEntry only returns a mapping if every router has exactly the same one. Otherwise we'd skip
+// renewing the mapping on routers that don't have it.
+func (m *multiRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	for i, router := range m.routers {
+		internalPort, internalClient, enabled, description, leaseDuration, err := router.GetSpecificPortMappingEntry(
+			NewRemoteHost, NewExternalPort, NewProtocol)
+		if err != nil {
+			return 0, "", false, "", 0, err
+		}
+		if i > 0 && (internalPort != NewInternalPort || internalClient != NewInternalClient || enabled != NewEnabled ||
+			description != NewPortMappingDescription) {
+			return 0, "", false, "", 0, errors.New("routers have different port mappings")
+		}
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription = internalPort, internalClient, enabled, description
+		// Report the lease that will run out first. A lease duration of zero means that the mapping never expires.
+		if i == 0 || (leaseDuration != 0 && (NewLeaseDuration == 0 || leaseDuration < NewLeaseDuration)) {
+			NewLeaseDuration = leaseDuration
+		}
+	}
+	return NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration, nil
+}
+
+// GetGenericPortMappingEntry lists the mappings on the first router, as the routers' lists won't line up.
+func (m *multiRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return m.routers[0].GetGenericPortMappingEntry(NewPortMappingIndex)
+}
+
+// GetPortMappingNumberOfEntries counts the mappings on the first router, to match GetGenericPortMappingEntry.
+func (m *multiRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	return m.routers[0].GetPortMappingNumberOfEntries()
+}
+
+func (m *multiRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	return m.routers[0].GetExternalIPAddress()
+}
+
+func (m *multiRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	return m.routers[0].GetConnectionTypeInfo()
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiRouterClientAddsToEveryRouter(t *testing.T) {
+	a, b := &mockRouterClient{}, &mockRouterClient{}
+	router := &multiRouterClient{routers: []RouterClient{a, b}}
+
+	assert.NoError(t, router.AddPortMapping("", 3000, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.NoError(t, router.DeletePortMapping("", 4000, "TCP"))
+	for _, r := range []*mockRouterClient{a, b} {
+		assert.Equal(t, []uint16{3000}, r.addedExternalPorts())
+		assert.Equal(t, []portMappingCall{{ExternalPort: 4000, Protocol: "TCP"}}, r.deleteCalls)
+	}
+}
+
+func TestMultiRouterClientAggregatesErrors(t *testing.T) {
+	a := &mockRouterClient{addErr: errors.New("router a unavailable"), deleteErr: errors.New("router a unavailable")}
+	b := &mockRouterClient{}
+	c := &mockRouterClient{addErr: errors.New("router c unavailable")}
+	router := &multiRouterClient{routers: []RouterClient{a, b, c}}
+
+	err := router.AddPortMapping("", 3000, "TCP", 80, "192.168.1.10", true, "", 3600)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "router a unavailable")
+	assert.Contains(t, err.Error(), "router c unavailable")
+	// A router failing doesn't stop the others from being configured
+	assert.Equal(t, []uint16{3000}, b.addedExternalPorts())
+	assert.Len(t, c.addCalls, 1)
+
+	assert.Error(t, router.DeletePortMapping("", 3000, "TCP"))
+	assert.Len(t, c.deleteCalls, 1)
+}
+
+func TestMultiRouterClientGetSpecificPortMappingEntry(t *testing.T) {
+	entry := portMappingEntry{InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "Mapping for my-service/default"}
+	a := &mockRouterClient{entries: map[string]portMappingEntry{"3000/TCP": entry}}
+	shorterLease := entry
+	shorterLease.LeaseDuration = 60
+	b := &mockRouterClient{entries: map[string]portMappingEntry{"3000/TCP": shorterLease}}
+	router := &multiRouterClient{routers: []RouterClient{a, b}}
+
+	internalPort, internalClient, enabled, description, leaseDuration, err := router.GetSpecificPortMappingEntry("", 3000, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(80), internalPort)
+	assert.Equal(t, "192.168.1.10", internalClient)
+	assert.True(t, enabled)
+	assert.Equal(t, entry.Description, description)
+	assert.Equal(t, uint32(60), leaseDuration)
+
+	// Routers that disagree, or where one doesn't have the mapping, don't count as having it
+	different := entry
+	different.InternalClient = "192.168.1.20"
+	b.entries["3000/TCP"] = different
+	_, _, _, _, _, err = router.GetSpecificPortMappingEntry("", 3000, "TCP")
+	assert.Error(t, err)
+
+	delete(b.entries, "3000/TCP")
+	_, _, _, _, _, err = router.GetSpecificPortMappingEntry("", 3000, "TCP")
+	assert.Error(t, err)
+}
+
+func TestMultiRouterClientExternalIPFromFirstRouter(t *testing.T) {
+	router := &multiRouterClient{routers: []RouterClient{
+		&mockRouterClient{externalIP: "198.51.100.7"},
+		&mockRouterClient{},
+	}}
+	ip, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", ip)
+}
+
+func TestGetRouterClientUsesGivenRouters(t *testing.T) {
+	a, b := &mockRouterClient{}, &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(nil, nil, WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)))
+
+	r.RouterClients = []RouterClient{a}
+	router, err := r.getRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, a, withoutTimeout(router))
+
+	r.RouterClients = []RouterClient{a, b}
+	router, err = r.getRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &multiRouterClient{routers: []RouterClient{a, b}}, withoutTimeout(router))
+
+	// We never go looking for a router of our own
+	assert.Equal(t, 0, calls)
+}
+
+func TestRouterClientSetIgnoresDuplicates(t *testing.T) {
+	a, b := &mockRouterClient{}, &mockRouterClient{}
+	var clients routerClientSet
+	clients.add(url.URL{Scheme: "http", Host: "192.168.1.1:5000", Path: "/ctl/IPConn"}, a)
+	clients.add(url.URL{Scheme: "http", Host: "192.168.1.1:5000", Path: "/ctl/IPConn"}, b)
+	clients.add(url.URL{Scheme: "http", Host: "192.168.1.2:5000", Path: "/ctl/IPConn"}, b)
+	assert.Len(t, clients.clients, 2)
+	assert.Same(t, a, clients.clients[0])
+	assert.Same(t, b, clients.clients[1])
+}
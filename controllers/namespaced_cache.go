@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// MultiNamespacedCacheBuilder returns a cache for a manager that only watches objects in the given namespaces, so that
+// several copies of Holepunch can each look after their own namespaces. Namespaced objects are cached as by
+// controller-runtime's cache.MultiNamespacedCacheBuilder. That can't hold cluster-scoped objects (such as the
+// HolepunchConfig, or the nodes that NodePort services are forwarded to), so those are cached across the whole cluster
+// instead.
+func MultiNamespacedCacheBuilder(namespaces []string) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		if opts.Scheme == nil {
+			opts.Scheme = scheme.Scheme
+		}
+		if opts.Mapper == nil {
+			mapper, err := apiutil.NewDiscoveryRESTMapper(config)
+			if err != nil {
+				return nil, err
+			}
+			opts.Mapper = mapper
+		}
+		namespaced, err := cache.MultiNamespacedCacheBuilder(namespaces)(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Namespace = ""
+		cluster, err := cache.New(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &scopedCache{namespaced: namespaced, cluster: cluster, scheme: opts.Scheme, mapper: opts.Mapper}, nil
+	}
+}
+
+// scopedCache reads namespaced objects from one cache and cluster-scoped objects from another.
+type scopedCache struct {
+	namespaced cache.Cache
+	cluster    cache.Cache
+	scheme     *runtime.Scheme
+	mapper     meta.RESTMapper
+}
+
+var _ cache.Cache = &scopedCache{}
+
+// forKind returns the cache that holds objects of the kind. Lists are held by the same cache as their items.
+func (c *scopedCache) forKind(gvk schema.GroupVersionKind) (cache.Cache, error) {
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return c.cluster, nil
+	}
+	return c.namespaced, nil
+}
+
+func (c *scopedCache) forObject(obj runtime.Object) (cache.Cache, error) {
+	gvk, err := apiutil.GVKForObject(obj, c.scheme)
+	if err != nil {
+		return nil, err
+	}
+	return c.forKind(gvk)
+}
+
+func (c *scopedCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	target, err := c.forObject(obj)
+	if err != nil {
+		return err
+	}
+	return target.Get(ctx, key, obj)
+}
+
+func (c *scopedCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	target, err := c.forObject(list)
+	if err != nil {
+		return err
+	}
+	return target.List(ctx, list, opts...)
+}
+
+func (c *scopedCache) GetInformer(obj runtime.Object) (cache.Informer, error) {
+	target, err := c.forObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return target.GetInformer(obj)
+}
+
+func (c *scopedCache) GetInformerForKind(gvk schema.GroupVersionKind) (cache.Informer, error) {
+	target, err := c.forKind(gvk)
+	if err != nil {
+		return nil, err
+	}
+	return target.GetInformerForKind(gvk)
+}
+
+func (c *scopedCache) IndexField(obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	target, err := c.forObject(obj)
+	if err != nil {
+		return err
+	}
+	return target.IndexField(obj, field, extractValue)
+}
+
+// Start runs both caches until stopCh is closed.
+func (c *scopedCache) Start(stopCh <-chan struct{}) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.cluster.Start(stopCh)
+	}()
+	if err := c.namespaced.Start(stopCh); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+func (c *scopedCache) WaitForCacheSync(stop <-chan struct{}) bool {
+	namespacedSynced := c.namespaced.WaitForCacheSync(stop)
+	return c.cluster.WaitForCacheSync(stop) && namespacedSynced
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// readerCache is a cache that only supports reading, from a fake client.
+type readerCache struct {
+	client.Reader
+	cache.Informers
+}
+
+func testRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Service"), meta.RESTScopeNamespace)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Node"), meta.RESTScopeRoot)
+	return mapper
+}
+
+func TestScopedCacheReadsClusterScopedObjectsFromTheWholeCluster(t *testing.T) {
+	watched := holepunchedService()
+	watched.Namespace = "watched"
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	c := &scopedCache{
+		namespaced: readerCache{Reader: fake.NewFakeClientWithScheme(scheme.Scheme, watched)},
+		cluster:    readerCache{Reader: fake.NewFakeClientWithScheme(scheme.Scheme, node)},
+		scheme:     scheme.Scheme,
+		mapper:     testRESTMapper(),
+	}
+	ctx := context.Background()
+
+	var service corev1.Service
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "watched", Name: "my-service"}, &service))
+	var services corev1.ServiceList
+	assert.NoError(t, c.List(ctx, &services))
+	assert.Len(t, services.Items, 1)
+
+	var nodes corev1.NodeList
+	assert.NoError(t, c.List(ctx, &nodes))
+	assert.Len(t, nodes.Items, 1)
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "node-1"}, &corev1.Node{}))
+}
+
+func TestMultiNamespacedCacheBuilderIgnoresOtherNamespaces(t *testing.T) {
+	// Nothing is listening here, but nothing should need to be to turn down a namespace we aren't watching.
+	c, err := MultiNamespacedCacheBuilder([]string{"watched"})(&rest.Config{Host: "http://127.0.0.1:1"},
+		cache.Options{Scheme: scheme.Scheme, Mapper: testRESTMapper()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var service corev1.Service
+	err = c.Get(context.Background(), types.NamespacedName{Namespace: "other", Name: "my-service"}, &service)
+	assert.Error(t, err)
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// HolepunchMode controls which protocols we use to find and configure a router.
+type HolepunchMode string
+
+const (
+	// HolepunchModeUPnP only uses UPnP.
+	HolepunchModeUPnP HolepunchMode = "upnp"
+	// HolepunchModeNATPMP only uses NAT-PMP.
+	HolepunchModeNATPMP HolepunchMode = "natpmp"
+	// HolepunchModeAuto tries UPnP first, and falls back to NAT-PMP if no UPnP router can be found.
+	HolepunchModeAuto HolepunchMode = "auto"
+)
+
+const (
+	natPMPTimeout = 5 * time.Second
+	procNetRoute  = "/proc/net/route"
+)
+
+// natPMPClient is the subset of the NAT-PMP client we use, so that it can be stubbed out in tests.
+type natPMPClient interface {
+	GetExternalAddress() (*natpmp.GetExternalAddressResult, error)
+	AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime int) (*natpmp.AddPortMappingResult, error)
+}
+
+// NatPMPRouterClient is a RouterClient for routers that support NAT-PMP rather than UPnP IGD.
+//
+// NAT-PMP is much more limited than UPnP. Mappings always forward to the host that asked for them, so the internal
+// client is ignored, and we can't restrict which remote hosts may use a mapping either. Mappings are also removed by
+// their internal port rather than their external one, so we remember the mappings we've made in order to remove them.
+// If we're asked to remove a mapping we don't remember making, we assume that the internal and external ports are the
+// same.
+type NatPMPRouterClient struct {
+	client natPMPClient
+
+	mu       sync.Mutex
+	internal map[string]uint16
+}
+
+// NewNatPMPRouterClient creates a NAT-PMP client for the router at the given gateway address.
+func NewNatPMPRouterClient(gateway net.IP) *NatPMPRouterClient {
+	return &NatPMPRouterClient{
+		client:   natpmp.NewClientWithTimeout(gateway, natPMPTimeout),
+		internal: make(map[string]uint16),
+	}
+}
+
+// PickNatPMPRouterClient finds a NAT-PMP router at the default gateway. The router is asked for its external IP, to
+// make sure that it actually speaks NAT-PMP.
+func PickNatPMPRouterClient(ctx context.Context) (RouterClient, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	router := NewNatPMPRouterClient(gateway)
+	if _, err := router.GetExternalIPAddress(); err != nil {
+		return nil, fmt.Errorf("no NAT-PMP router found at default gateway %s: %w", gateway, err)
+	}
+	return router, nil
+}
+
+func toNATPMPProtocol(protocol string) (string, error) {
+	switch protocol {
+	case "TCP":
+		return "tcp", nil
+	case "UDP":
+		return "udp", nil
+	default:
+		return "", fmt.Errorf("protocol type %s: %w", protocol, ErrProtocolNotSupported)
+	}
+}
+
+// natPMPMappingKey is the key we remember mappings by, in the form "<external port>/<protocol>".
+func natPMPMappingKey(externalPort uint16, protocol string) string {
+	return fmt.Sprintf("%d/%s", externalPort, protocol)
+}
+
+func (n *NatPMPRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	protocol, err := toNATPMPProtocol(NewProtocol)
+	if err != nil {
+		return err
+	}
+	result, err := n.client.AddPortMapping(protocol, int(NewInternalPort), int(NewExternalPort), int(NewLeaseDuration))
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.internal[natPMPMappingKey(NewExternalPort, NewProtocol)] = NewInternalPort
+	n.mu.Unlock()
+
+	// NAT-PMP routers are allowed to give us a different external port to the one we asked for. That's no good to us,
+	// so give it back.
+	if result.MappedExternalPort != NewExternalPort {
+		if err := n.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol); err != nil {
+			return err
+		}
+		return fmt.Errorf("NAT-PMP router mapped external port %d instead of the requested %d",
+			result.MappedExternalPort, NewExternalPort)
+	}
+	return nil
+}
+
+func (n *NatPMPRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	protocol, err := toNATPMPProtocol(NewProtocol)
+	if err != nil {
+		return err
+	}
+
+	key := natPMPMappingKey(NewExternalPort, NewProtocol)
+	n.mu.Lock()
+	internalPort, ok := n.internal[key]
+	n.mu.Unlock()
+	if !ok {
+		internalPort = NewExternalPort
+	}
+
+	// A lifetime and external port of zero removes the mapping.
+	if _, err := n.client.AddPortMapping(protocol, int(internalPort), 0, 0); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	delete(n.internal, key)
+	n.mu.Unlock()
+	return nil
+}
+
+// GetSpecificPortMappingEntry always fails, as NAT-PMP has no way to ask a router about its existing mappings.
+func (n *NatPMPRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return 0, "", false, "", 0, errors.New("NAT-PMP does not support looking up port mappings")
+}
+
+// GetGenericPortMappingEntry always fails, as NAT-PMP has no way to ask a router about its existing mappings.
+func (n *NatPMPRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return "", 0, "", 0, "", false, "", 0, errors.New("NAT-PMP does not support listing port mappings")
+}
+
+// GetPortMappingNumberOfEntries always fails, as NAT-PMP has no way to ask a router about its existing mappings.
+func (n *NatPMPRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	return 0, errors.New("NAT-PMP does not support counting port mappings")
+}
+
+func (n *NatPMPRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	result, err := n.client.GetExternalAddress()
+	if err != nil {
+		return "", err
+	}
+	return net.IP(result.ExternalIPAddress[:]).String(), nil
+}
+
+// GetConnectionTypeInfo always fails, as NAT-PMP has no way to ask a router how it connects to the internet.
+func (n *NatPMPRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	return "", "", errors.New("NAT-PMP does not support looking up the connection type")
+}
+
+// defaultGateway finds the IPv4 default gateway from the kernel's routing table.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDefaultGateway(f)
+}
+
+// parseDefaultGateway parses the default gateway out of a routing table in the format of /proc/net/route. Addresses in
+// this file are hex-encoded in host byte order (i.e., little-endian on most machines).
+func parseDefaultGateway(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	// The first line is a header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			return nil, fmt.Errorf("invalid gateway address %q in routing table", fields[2])
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		return ip, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default gateway found in routing table")
+}
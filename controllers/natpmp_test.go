@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+	"github.com/stretchr/testify/assert"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type natPMPAddCall struct {
+	protocol              string
+	internalPort          int
+	requestedExternalPort int
+	lifetime              int
+}
+
+// stubNatPMPClient is a natPMPClient that maps whatever external port it's asked for, unless mappedPort is set.
+type stubNatPMPClient struct {
+	calls      []natPMPAddCall
+	mappedPort uint16
+}
+
+func (s *stubNatPMPClient) GetExternalAddress() (*natpmp.GetExternalAddressResult, error) {
+	return &natpmp.GetExternalAddressResult{ExternalIPAddress: [4]byte{203, 0, 113, 1}}, nil
+}
+
+func (s *stubNatPMPClient) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime int) (*natpmp.AddPortMappingResult, error) {
+	s.calls = append(s.calls, natPMPAddCall{protocol, internalPort, requestedExternalPort, lifetime})
+	mapped := uint16(requestedExternalPort)
+	if s.mappedPort != 0 && requestedExternalPort != 0 {
+		mapped = s.mappedPort
+	}
+	return &natpmp.AddPortMappingResult{InternalPort: uint16(internalPort), MappedExternalPort: mapped}, nil
+}
+
+func newStubNatPMPRouterClient(stub *stubNatPMPClient) *NatPMPRouterClient {
+	return &NatPMPRouterClient{client: stub, internal: make(map[string]uint16)}
+}
+
+func TestNatPMPAddAndDeletePortMapping(t *testing.T) {
+	stub := &stubNatPMPClient{}
+	router := newStubNatPMPRouterClient(stub)
+
+	assert.NoError(t, router.AddPortMapping("", 3000, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.NoError(t, router.DeletePortMapping("", 3000, "TCP"))
+
+	// Deleting uses the internal port we remembered from adding the mapping
+	assert.Equal(t, []natPMPAddCall{
+		{protocol: "tcp", internalPort: 80, requestedExternalPort: 3000, lifetime: 3600},
+		{protocol: "tcp", internalPort: 80, requestedExternalPort: 0, lifetime: 0},
+	}, stub.calls)
+}
+
+func TestNatPMPDeleteUnknownPortMappingAssumesSamePort(t *testing.T) {
+	stub := &stubNatPMPClient{}
+	router := newStubNatPMPRouterClient(stub)
+
+	assert.NoError(t, router.DeletePortMapping("", 53, "UDP"))
+	assert.Equal(t, []natPMPAddCall{{protocol: "udp", internalPort: 53}}, stub.calls)
+}
+
+func TestNatPMPAddPortMappingWrongExternalPort(t *testing.T) {
+	stub := &stubNatPMPClient{mappedPort: 4000}
+	router := newStubNatPMPRouterClient(stub)
+
+	err := router.AddPortMapping("", 3000, "TCP", 80, "192.168.1.10", true, "", 3600)
+	assert.Error(t, err)
+	// The mapping we didn't want is given back to the router
+	assert.Len(t, stub.calls, 2)
+	assert.Equal(t, natPMPAddCall{protocol: "tcp", internalPort: 80}, stub.calls[1])
+}
+
+func TestNatPMPUnsupportedProtocol(t *testing.T) {
+	router := newStubNatPMPRouterClient(&stubNatPMPClient{})
+	assert.Error(t, router.AddPortMapping("", 3000, "SCTP", 80, "192.168.1.10", true, "", 3600))
+}
+
+func TestNatPMPGetExternalIPAddress(t *testing.T) {
+	router := newStubNatPMPRouterClient(&stubNatPMPClient{})
+	ip, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.1", ip)
+}
+
+func TestParseDefaultGateway(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0001A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+`
+	ip, err := parseDefaultGateway(strings.NewReader(routes))
+	assert.NoError(t, err)
+	assert.Equal(t, net.IPv4(192, 168, 1, 1).To4(), ip)
+}
+
+func TestParseDefaultGatewayMissing(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0001A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+`
+	_, err := parseDefaultGateway(strings.NewReader(routes))
+	assert.Error(t, err)
+}
+
+func stubPickers(r *ServiceReconciler, upnp RouterClient, upnpErr error, natPMP RouterClient, natPMPErr error) {
+	r.RouterClientFactory = func(context.Context, ...string) (RouterClient, error) { return upnp, upnpErr }
+	r.pickNatPMPRouterClient = func(context.Context) (RouterClient, error) { return natPMP, natPMPErr }
+}
+
+func TestDiscoverRouterClientAutoPrefersUPnP(t *testing.T) {
+	upnp, natPMP := &mockRouterClient{}, &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}))
+	stubPickers(r, upnp, nil, natPMP, nil)
+
+	router, err := r.discoverRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, upnp, router)
+}
+
+func TestDiscoverRouterClientAutoFallsBackToNatPMP(t *testing.T) {
+	natPMP := &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}), WithHolepunchMode(HolepunchModeAuto))
+	stubPickers(r, nil, errors.New("No services found"), natPMP, nil)
+
+	router, err := r.discoverRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, natPMP, router)
+
+	stubPickers(r, nil, errors.New("No services found"), nil, errors.New("timed out"))
+	_, err = r.discoverRouterClient(context.Background())
+	assert.Error(t, err)
+}
+
+func TestDiscoverRouterClientSingleMode(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}), WithHolepunchMode(HolepunchModeUPnP))
+	stubPickers(r, nil, errors.New("No services found"), &mockRouterClient{}, nil)
+	_, err := r.discoverRouterClient(context.Background())
+	assert.Error(t, err)
+
+	natPMP := &mockRouterClient{}
+	r.HolepunchMode = HolepunchModeNATPMP
+	stubPickers(r, &mockRouterClient{}, nil, natPMP, nil)
+	router, err := r.discoverRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, natPMP, router)
+}
+
+func TestDiscoverRouterClientUnknownMode(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}), WithHolepunchMode("carrier-pigeon"))
+	stubPickers(r, &mockRouterClient{}, nil, &mockRouterClient{}, nil)
+	_, err := r.discoverRouterClient(context.Background())
+	assert.Error(t, err)
+}
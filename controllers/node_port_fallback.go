@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// getNodePortFallback works out how to forward a LoadBalancer service's ports to its node ports instead, for when its
+// LoadBalancer IP hasn't been allocated yet. It returns the IP of a Ready node to forward to, and a copy of the service
+// that's forwarded like a NodePort service: each port is forwarded to its node port, and unless the service has a
+// description or description template annotation its port mappings are described as a NodePort fallback. As with
+// applyHolepunchPolicy, the copy must never be written back.
+//
+// Every port must have a node port for this to work, which isn't the case if the service has asked for them not to be
+// allocated.
+func getNodePortFallback(ctx context.Context, c client.Client, service corev1.Service) (ip string, fallback corev1.Service, err error) {
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.NodePort == 0 {
+			return "", service, fmt.Errorf("no node port allocated for port %d", servicePort.Port)
+		}
+	}
+	ip, err = getNodeIP(ctx, c)
+	if err != nil {
+		return "", service, err
+	}
+
+	fallback = *service.DeepCopy()
+	fallback.Spec.Type = corev1.ServiceTypeNodePort
+	_, hasDescription := fallback.Annotations[descriptionAnnotationName]
+	_, hasTemplate := fallback.Annotations[descriptionTemplateAnnotationName]
+	if !hasDescription && !hasTemplate {
+		if fallback.Annotations == nil {
+			fallback.Annotations = make(map[string]string)
+		}
+		fallback.Annotations[descriptionAnnotationName] = fmt.Sprintf("NodePort fallback mapping for %s/%s",
+			service.Name, service.Namespace)
+	}
+	return ip, fallback, nil
+}
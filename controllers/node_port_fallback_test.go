@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// unallocatedService is a holepunched LoadBalancer service that has node ports, but hasn't been given an IP yet.
+func unallocatedService() *corev1.Service {
+	service := holepunchedService()
+	service.Status.LoadBalancer.Ingress = nil
+	service.Spec.Ports[0].NodePort = 30080
+	return service
+}
+
+func TestGetNodePortFallback(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, node("node-a", true, "192.168.1.11"))
+	service := *unallocatedService()
+
+	ip, fallback, err := getNodePortFallback(context.Background(), c, service)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.11", ip)
+	assert.Equal(t, corev1.ServiceTypeNodePort, fallback.Spec.Type)
+	description, _ := getMappingDescription(fallback)
+	assert.Equal(t, "NodePort fallback mapping for my-service/default", description)
+	mappings, err := getSpecMappings(fallback)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint16{"30080/TCP": 80}, mappings)
+	assert.Equal(t, corev1.ServiceTypeLoadBalancer, service.Spec.Type, "the service itself is left alone")
+	assert.NotContains(t, service.Annotations, descriptionAnnotationName)
+
+	// A description the service asks for is still used.
+	service.Annotations[descriptionAnnotationName] = "My Game Server"
+	_, fallback, err = getNodePortFallback(context.Background(), c, service)
+	assert.NoError(t, err)
+	description, _ = getMappingDescription(fallback)
+	assert.Equal(t, "My Game Server", description)
+
+	// So is a description template.
+	delete(service.Annotations, descriptionAnnotationName)
+	service.Annotations[descriptionTemplateAnnotationName] = "{{.Name}} port {{.Port}}"
+	_, fallback, err = getNodePortFallback(context.Background(), c, service)
+	assert.NoError(t, err)
+	describe, err := mappingDescriptions(fallback, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "my-service port 30080", describe("30080/TCP", 80))
+}
+
+func TestGetNodePortFallbackErrors(t *testing.T) {
+	// Without node ports there's nothing to forward to.
+	service := *unallocatedService()
+	service.Spec.Ports[0].NodePort = 0
+	_, _, err := getNodePortFallback(context.Background(),
+		fake.NewFakeClientWithScheme(scheme.Scheme, node("node-a", true, "192.168.1.11")), service)
+	assert.Error(t, err)
+
+	// Likewise without a node.
+	_, _, err = getNodePortFallback(context.Background(),
+		fake.NewFakeClientWithScheme(scheme.Scheme, node("node-a", false, "192.168.1.11")), *unallocatedService())
+	assert.Error(t, err)
+}
+
+func TestReconcileFallsBackToNodePortUntilIPAllocated(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, unallocatedService(), node("node-a", true, "192.168.1.11"))
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+		WithFallbackToNodePort(true),
+	)
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint16(80), router.addCalls[0].ExternalPort)
+		assert.Equal(t, uint16(30080), router.addCalls[0].InternalPort)
+		assert.Equal(t, "192.168.1.11", router.addCalls[0].InternalClient)
+		assert.Equal(t, "NodePort fallback mapping for my-service/default", router.addCalls[0].Description)
+	}
+	assert.Contains(t, drainEvents(recorder),
+		"Normal NodePortFallback LoadBalancer IP not available, forwarding to node ports on 192.168.1.11 instead")
+
+	// Once the IP is allocated we switch over to it, removing the node port mapping first.
+	var service corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &service))
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+	assert.NoError(t, c.Update(context.Background(), &service))
+	router.addCalls = nil
+
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []portMappingCall{{ExternalPort: 80, Protocol: "TCP"}}, router.deleteCalls)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint16(80), router.addCalls[0].InternalPort)
+		assert.Equal(t, "192.168.1.10", router.addCalls[0].InternalClient)
+		assert.Equal(t, "Mapping for my-service/default", router.addCalls[0].Description)
+	}
+}
+
+func TestReconcileWithoutNodePortFallbackWaitsForIP(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(
+		fake.NewFakeClientWithScheme(scheme.Scheme, unallocatedService(), node("node-a", true, "192.168.1.11")),
+		scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Greater(t, int64(result.RequeueAfter), int64(0))
+	assert.Empty(t, router.addCalls)
+}
@@ -0,0 +1,320 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Option configures a ServiceReconciler created with NewServiceReconciler.
+type Option func(*ServiceReconciler)
+
+// NewServiceReconciler creates a ServiceReconciler that uses the given client to read and update services. Anything
+// that isn't set with an option is left at its default. If no event recorder is given then one is taken from the
+// manager in SetupWithManager.
+func NewServiceReconciler(client client.Client, scheme *runtime.Scheme, opts ...Option) *ServiceReconciler {
+	r := &ServiceReconciler{
+		Client: client,
+		Scheme: scheme,
+		Log:    ctrl.Log.WithName("controllers").WithName("Service"),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// WithLogger sets the logger to use.
+func WithLogger(log logr.Logger) Option {
+	return func(r *ServiceReconciler) {
+		r.Log = log
+	}
+}
+
+// WithEventRecorder sets where events about services are sent.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(r *ServiceReconciler) {
+		r.Recorder = recorder
+	}
+}
+
+// WithMetricsRecorder sets where metrics about the router are recorded.
+func WithMetricsRecorder(metrics MetricsRecorder) Option {
+	return func(r *ServiceReconciler) {
+		r.Metrics = metrics
+	}
+}
+
+// WithTracerProvider sets where traces of each reconcile are recorded.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(r *ServiceReconciler) {
+		r.TracerProvider = provider
+	}
+}
+
+// WithRouterRootDesc sets the URLs of the root device descriptions of the routers to configure.
+func WithRouterRootDesc(desc ...string) Option {
+	return func(r *ServiceReconciler) {
+		r.RouterRootDesc = desc
+	}
+}
+
+// WithRouterClients sets the routers to configure, rather than finding one.
+func WithRouterClients(routers ...RouterClient) Option {
+	return func(r *ServiceReconciler) {
+		r.RouterClients = routers
+	}
+}
+
+// WithRouterClientFactory sets how a UPnP router is found, rather than using RouterDiscovery.
+func WithRouterClientFactory(factory func(ctx context.Context, rootDesc ...string) (RouterClient, error)) Option {
+	return func(r *ServiceReconciler) {
+		r.RouterClientFactory = factory
+	}
+}
+
+// WithRouterDiscovery sets how UPnP routers are found, rather than using RouterRootDesc or discovering one on the local
+// network.
+func WithRouterDiscovery(discovery RouterDiscovery) Option {
+	return func(r *ServiceReconciler) {
+		r.RouterDiscovery = discovery
+	}
+}
+
+// WithIPv6RouterClientFactory sets how a router is found for opening IPv6 pinholes, instead of PickIPv6RouterClient.
+func WithIPv6RouterClientFactory(factory func(ctx context.Context, rootDesc ...string) (IPv6RouterClient, error)) Option {
+	return func(r *ServiceReconciler) {
+		r.IPv6RouterClientFactory = factory
+	}
+}
+
+// WithHolepunchMode sets which protocols are used to find and configure a router.
+func WithHolepunchMode(mode HolepunchMode) Option {
+	return func(r *ServiceReconciler) {
+		r.HolepunchMode = mode
+	}
+}
+
+// WithPortMappingAnnotationFormat sets which style of port mapping annotation is read from services.
+func WithPortMappingAnnotationFormat(format PortMappingAnnotationFormat) Option {
+	return func(r *ServiceReconciler) {
+		r.PortMappingAnnotationFormat = format
+	}
+}
+
+// WithLeaseDuration sets how long port mapping leases last for, for services that don't say otherwise.
+func WithLeaseDuration(d time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.LeaseDuration = d
+	}
+}
+
+// WithMaxCleanupAttempts sets how many times to try and remove a deleted service's port mappings before giving up.
+func WithMaxCleanupAttempts(attempts int) Option {
+	return func(r *ServiceReconciler) {
+		r.MaxCleanupAttempts = attempts
+	}
+}
+
+// WithRouterCacheTTL sets how long a discovered router is used before discovering it again.
+func WithRouterCacheTTL(ttl time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.RouterCacheTTL = ttl
+	}
+}
+
+// WithExternalIPCacheTTL sets how long the router's external IP is remembered for.
+func WithExternalIPCacheTTL(ttl time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.ExternalIPCacheTTL = ttl
+	}
+}
+
+// WithIPVersionPreference sets which of a LoadBalancer's IPv4 and IPv6 addresses ports are opened up on.
+func WithIPVersionPreference(preference IPVersionPreference) Option {
+	return func(r *ServiceReconciler) {
+		r.IPVersionPreference = preference
+	}
+}
+
+// WithServiceIPSelector sets how one of a LoadBalancer's IPs is chosen to forward ports to.
+func WithServiceIPSelector(selector ServiceIPSelector) Option {
+	return func(r *ServiceReconciler) {
+		r.ServiceIPSelector = selector
+	}
+}
+
+// WithMappingCacheRefreshInterval sets how often the router's port mapping table is read again, when it's being cached.
+func WithMappingCacheRefreshInterval(interval time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.MappingCacheRefreshInterval = interval
+	}
+}
+
+// WithDNSTimeout sets how long to wait when resolving the hostname of a LoadBalancer.
+func WithDNSTimeout(timeout time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.DNSTimeout = timeout
+	}
+}
+
+// WithMaxConcurrentMappings sets how many port mappings for a single service are asked for at once.
+func WithMaxConcurrentMappings(n int) Option {
+	return func(r *ServiceReconciler) {
+		r.MaxConcurrentMappings = n
+	}
+}
+
+// WithUPnPCallTimeout sets how long to wait for the router to answer a single request.
+func WithUPnPCallTimeout(timeout time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.UPnPCallTimeout = timeout
+	}
+}
+
+// WithRouterCallRetries sets how many times to try a call to the router that fails because of what could be a network
+// problem, and how long to wait before the first retry.
+func WithRouterCallRetries(attempts int, backoff time.Duration) Option {
+	return func(r *ServiceReconciler) {
+		r.RouterCallAttempts = attempts
+		r.RouterCallBackoff = backoff
+	}
+}
+
+// WithUPnPInterface sets the network interface to discover UPnP routers on.
+func WithUPnPInterface(iface string) Option {
+	return func(r *ServiceReconciler) {
+		r.UPnPInterface = iface
+	}
+}
+
+// WithServiceLabelSelector limits the services we look after to those whose labels match selector.
+func WithServiceLabelSelector(selector labels.Selector) Option {
+	return func(r *ServiceReconciler) {
+		r.ServiceLabelSelector = selector
+	}
+}
+
+// WithServiceNamespaceSelector limits the services we look after to those in the given namespaces. With no namespaces,
+// services in every namespace are looked after.
+func WithServiceNamespaceSelector(namespaces ...string) Option {
+	return func(r *ServiceReconciler) {
+		r.ServiceNamespaceSelector = namespaces
+	}
+}
+
+// WithReconcileHistorySize sets how many of the most recent reconciles are remembered for diagnosing problems.
+func WithReconcileHistorySize(size int) Option {
+	return func(r *ServiceReconciler) {
+		r.History = NewReconcileHistory(size)
+	}
+}
+
+// WithRouterCallLogging sets whether every call made to the router is logged at V(2), for debugging.
+func WithRouterCallLogging(enabled bool) Option {
+	return func(r *ServiceReconciler) {
+		r.LogRouterCalls = enabled
+	}
+}
+
+// WithVerboseErrors sets whether errors from the router are logged with everything it said about them, for debugging.
+func WithVerboseErrors(enabled bool) Option {
+	return func(r *ServiceReconciler) {
+		r.VerboseErrors = enabled
+	}
+}
+
+// WithClusterName sets the name of the cluster, which description templates can refer to as {{.ClusterName}}.
+func WithClusterName(name string) Option {
+	return func(r *ServiceReconciler) {
+		r.ClusterName = name
+	}
+}
+
+// WithDescriptionPrefix sets what the descriptions of our port mappings start with, so that they can be told apart
+// from those made by other software.
+func WithDescriptionPrefix(prefix string) Option {
+	return func(r *ServiceReconciler) {
+		r.DescriptionPrefix = prefix
+	}
+}
+
+// WithDryRun stops any changes being made to the router, and logs them instead.
+func WithDryRun(dryRun bool) Option {
+	return func(r *ServiceReconciler) {
+		r.DryRun = dryRun
+	}
+}
+
+// WithSweepStaleOnStart sets whether port mappings left by an earlier run that no longer belong to a service are removed
+// before the first service is reconciled.
+func WithSweepStaleOnStart(sweep bool) Option {
+	return func(r *ServiceReconciler) {
+		r.SweepStaleOnStart = sweep
+	}
+}
+
+// WithCleanupOnShutdown sets whether every service's port mappings are removed when holepunch stops.
+func WithCleanupOnShutdown(cleanup bool) Option {
+	return func(r *ServiceReconciler) {
+		r.CleanupOnShutdown = cleanup
+	}
+}
+
+// WithMappingStore saves the port mappings of each service to store, so that they're known about after a restart.
+func WithMappingStore(store MappingStore) Option {
+	return func(r *ServiceReconciler) {
+		r.MappingStore = store
+	}
+}
+
+// WithFallbackToNodePort forwards the ports of LoadBalancer services to their node ports until they're given an IP.
+func WithFallbackToNodePort(fallback bool) Option {
+	return func(r *ServiceReconciler) {
+		r.FallbackToNodePort = fallback
+	}
+}
+
+// WithExcludeSelf leaves alone any service for the pod we're running in, which is set with WithSelfPod.
+func WithExcludeSelf(exclude bool) Option {
+	return func(r *ServiceReconciler) {
+		r.ExcludeSelf = exclude
+	}
+}
+
+// WithSelfPod sets the namespace and name of the pod we're running in.
+func WithSelfPod(pod types.NamespacedName) Option {
+	return func(r *ServiceReconciler) {
+		r.SelfPod = pod
+	}
+}
+
+// WithRateLimit limits port mappings to being added at limit a second, in bursts of up to burst at once.
+func WithRateLimit(limit rate.Limit, burst int) Option {
+	return func(r *ServiceReconciler) {
+		r.UPnPRateLimiter = rate.NewLimiter(limit, burst)
+	}
+}
+
+// WithShutdownContext cancels any calls to the router that reconciles are making when ctx is done.
+func WithShutdownContext(ctx context.Context) Option {
+	return func(r *ServiceReconciler) {
+		r.ShutdownContext = ctx
+	}
+}
+
+// WithAPIReader sets a reader that reads straight from the API server, for use before the manager's cache has started.
+func WithAPIReader(reader client.Reader) Option {
+	return func(r *ServiceReconciler) {
+		r.APIReader = reader
+	}
+}
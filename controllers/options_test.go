@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestNewServiceReconcilerDefaults(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme)
+	r := NewServiceReconciler(c, scheme.Scheme)
+	assert.Equal(t, c, r.Client)
+	assert.Equal(t, scheme.Scheme, r.Scheme)
+	assert.NotNil(t, r.Log)
+	assert.Nil(t, r.Recorder)
+	assert.False(t, r.DryRun)
+	assert.Equal(t, uint32(leaseDurationSeconds), r.defaultLeaseDuration())
+}
+
+func TestNewServiceReconcilerOptions(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	metrics := &recordingMetricsRecorder{}
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithMetricsRecorder(metrics),
+		WithRouterRootDesc("http://192.168.1.1:5000/rootDesc.xml"),
+		WithRouterClients(router),
+		WithHolepunchMode(HolepunchModeNATPMP),
+		WithLeaseDuration(30*time.Minute),
+		WithMaxCleanupAttempts(3),
+		WithRouterCacheTTL(time.Minute),
+		WithExternalIPCacheTTL(2*time.Minute),
+		WithDNSTimeout(time.Second),
+		WithMaxConcurrentMappings(10),
+		WithUPnPCallTimeout(5*time.Second),
+		WithRouterCallRetries(4, time.Second),
+		WithUPnPInterface("eth0"),
+		WithDryRun(true),
+		WithCleanupOnShutdown(true),
+	)
+	assert.Equal(t, logf.NullLogger{}, r.Log)
+	assert.Equal(t, recorder, r.Recorder)
+	assert.Equal(t, metrics, r.Metrics)
+	assert.Equal(t, []string{"http://192.168.1.1:5000/rootDesc.xml"}, r.RouterRootDesc)
+	assert.Equal(t, []RouterClient{router}, r.RouterClients)
+	assert.Equal(t, HolepunchModeNATPMP, r.HolepunchMode)
+	assert.Equal(t, uint32(1800), r.defaultLeaseDuration())
+	assert.Equal(t, 3, r.MaxCleanupAttempts)
+	assert.Equal(t, time.Minute, r.RouterCacheTTL)
+	assert.Equal(t, 2*time.Minute, r.ExternalIPCacheTTL)
+	assert.Equal(t, time.Second, r.DNSTimeout)
+	assert.Equal(t, 10, r.MaxConcurrentMappings)
+	assert.Equal(t, 5*time.Second, r.UPnPCallTimeout)
+	assert.Equal(t, 4, r.RouterCallAttempts)
+	assert.Equal(t, time.Second, r.RouterCallBackoff)
+	assert.Equal(t, "eth0", r.UPnPInterface)
+	assert.True(t, r.DryRun)
+	assert.True(t, r.CleanupOnShutdown)
+}
+
+func TestReconcileUsesDefaultLeaseDuration(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithLeaseDuration(10*time.Minute),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 570*time.Second, result.RequeueAfter)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, uint32(600), router.addCalls[0].LeaseDuration)
+}
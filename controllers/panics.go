@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// goroutinePanic is a panic recovered on one goroutine, along with that goroutine's stack, so that it can be raised
+// again on another.
+type goroutinePanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p goroutinePanic) String() string {
+	return fmt.Sprintf("%v\n%s", p.value, p.stack)
+}
+
+// panicCatcher collects a panic from any of the goroutines we start, so that it can be raised again on the goroutine
+// that started them. Otherwise a panic on a goroutine of our own would crash the whole process, as there's nothing to
+// recover it.
+type panicCatcher struct {
+	mu sync.Mutex
+	p  *goroutinePanic
+}
+
+// catch recovers a panic, if there is one. It must be deferred directly at the top of the goroutine.
+func (c *panicCatcher) catch() {
+	p := recover()
+	if p == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// If more than one goroutine panics then we only need to hear about the first.
+	if c.p == nil {
+		c.p = &goroutinePanic{value: p, stack: debug.Stack()}
+	}
+}
+
+// repanic raises the panic that was caught, if there was one. It must only be called once the goroutines have
+// finished.
+func (c *panicCatcher) repanic() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.p != nil {
+		panic(*c.p)
+	}
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=holepunch.jameslaverack.com,resources=holepunchpolicies,verbs=get;list;watch
+
+// getHolepunchPolicy returns the defaults set by the HolepunchPolicies in a namespace, or nil if there aren't any.
+// There's normally only one, but if there are several then they're combined, with policies whose names sort first
+// winning where they both set something.
+func (r *ServiceReconciler) getHolepunchPolicy(ctx context.Context, namespace string) (*holepunchv1alpha1.HolepunchPolicySpec, error) {
+	return readHolepunchPolicy(ctx, r.Client, namespace)
+}
+
+// readHolepunchPolicy is getHolepunchPolicy, reading the HolepunchPolicies with reader.
+func readHolepunchPolicy(ctx context.Context, reader client.Reader, namespace string) (*holepunchv1alpha1.HolepunchPolicySpec, error) {
+	var policies holepunchv1alpha1.HolepunchPolicyList
+	if err := reader.List(ctx, &policies, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+	sort.Slice(policies.Items, func(i, j int) bool { return policies.Items[i].Name < policies.Items[j].Name })
+
+	policy := &holepunchv1alpha1.HolepunchPolicySpec{}
+	for i := len(policies.Items) - 1; i >= 0; i-- {
+		spec := policies.Items[i].Spec.DeepCopy()
+		if spec.DefaultLeaseDuration != nil {
+			policy.DefaultLeaseDuration = spec.DefaultLeaseDuration
+		}
+		if spec.DefaultRemoteHost != "" {
+			policy.DefaultRemoteHost = spec.DefaultRemoteHost
+		}
+		if spec.SkipPorts != nil {
+			policy.SkipPorts = spec.SkipPorts
+		}
+	}
+	// Services are only opted in if every policy agrees, so that a policy that's only there to set defaults can't
+	// expose services that never asked to be.
+	policy.ForwardUnannotatedServices = true
+	for _, p := range policies.Items {
+		policy.ForwardUnannotatedServices = policy.ForwardUnannotatedServices && p.Spec.ForwardUnannotatedServices
+	}
+	return policy, nil
+}
+
+// applyHolepunchPolicy fills in the annotations that a service doesn't have with the defaults from its namespace's
+// HolepunchPolicy, so that they're picked up in the same way as the service's own annotations. The service's own
+// annotations always win. Services are only opted in by the policy if it sets ForwardUnannotatedServices, and they're a
+// LoadBalancer or NodePort, as there's nothing we can forward to otherwise. The copy returned is only for working out how to forward the service's ports,
+// and must never be written back.
+func applyHolepunchPolicy(service corev1.Service, policy *holepunchv1alpha1.HolepunchPolicySpec) corev1.Service {
+	if policy == nil {
+		return service
+	}
+	annotations := make(map[string]string, len(service.Annotations)+4)
+	for key, value := range service.Annotations {
+		annotations[key] = value
+	}
+	setDefault := func(key, value string) {
+		if _, ok := annotations[key]; !ok && value != "" {
+			annotations[key] = value
+		}
+	}
+
+	if policy.ForwardUnannotatedServices &&
+		(service.Spec.Type == corev1.ServiceTypeLoadBalancer || service.Spec.Type == corev1.ServiceTypeNodePort) {
+		setDefault(holepunchAnnotationName, "true")
+	}
+	if policy.DefaultLeaseDuration != nil {
+		setDefault(leaseDurationAnnotationName, policy.DefaultLeaseDuration.Duration.String())
+	}
+	setDefault(remoteHostAnnotationName, policy.DefaultRemoteHost)
+	if len(policy.SkipPorts) > 0 {
+		ports := make([]string, len(policy.SkipPorts))
+		for i, port := range policy.SkipPorts {
+			ports[i] = strconv.Itoa(int(port))
+		}
+		setDefault(skipPortsAnnotationName, strings.Join(ports, ","))
+	}
+
+	settings := *service.DeepCopy()
+	settings.Annotations = annotations
+	return settings
+}
+
+// withHolepunchPolicy applies the service's HolepunchPolicy to it, as applyHolepunchPolicy does. This is for removing
+// port mappings, which should go ahead even if we can't read the policy, so that's only logged.
+func (r *ServiceReconciler) withHolepunchPolicy(ctx context.Context, log logr.Logger, service corev1.Service) corev1.Service {
+	policy, err := r.getHolepunchPolicy(ctx, service.Namespace)
+	if err != nil {
+		log.Info("Unable to read HolepunchPolicy, ignoring it", "error", err.Error())
+		return service
+	}
+	return applyHolepunchPolicy(service, policy)
+}
+
+// namespaceOptedIn returns whether a HolepunchPolicy forwards the ports of services in the object's namespace without
+// the holepunch annotation. This is read from the cache, so it's cheap enough to check on every event.
+func (r *ServiceReconciler) namespaceOptedIn(meta metav1.Object) bool {
+	if meta == nil {
+		return false
+	}
+	policy, err := r.getHolepunchPolicy(context.Background(), meta.GetNamespace())
+	return err == nil && policy != nil && policy.ForwardUnannotatedServices
+}
+
+// servicesForPolicy maps a change to a HolepunchPolicy to a reconcile of every service in its namespace that it could
+// apply to, so that they pick up the new defaults.
+func (r *ServiceReconciler) servicesForPolicy(obj handler.MapObject) []reconcile.Request {
+	var services corev1.ServiceList
+	if err := r.List(context.Background(), &services, client.InNamespace(obj.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "Failed to list services after HolepunchPolicy changed", "namespace", obj.Meta.GetNamespace())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, service := range services.Items {
+		if !r.inScope(&service) {
+			continue
+		}
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer && service.Spec.Type != corev1.ServiceTypeNodePort &&
+			!isHolepunchService(&service) {
+			continue
+		}
+		name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+		// The service itself hasn't changed, so make sure it isn't skipped as already done.
+		r.forgetProcessed(name)
+		requests = append(requests, reconcile.Request{NamespacedName: name})
+	}
+	return requests
+}
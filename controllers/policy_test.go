@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+func holepunchPolicy(name string, spec holepunchv1alpha1.HolepunchPolicySpec) *holepunchv1alpha1.HolepunchPolicy {
+	return &holepunchv1alpha1.HolepunchPolicy{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestApplyHolepunchPolicy(t *testing.T) {
+	policy := &holepunchv1alpha1.HolepunchPolicySpec{
+		DefaultLeaseDuration: &v1.Duration{Duration: 30 * time.Minute},
+		DefaultRemoteHost:    "203.0.113.7",
+		SkipPorts:            []int32{9090, 9091},
+	}
+
+	for name, tc := range map[string]struct {
+		serviceType corev1.ServiceType
+		annotations map[string]string
+		policy      *holepunchv1alpha1.HolepunchPolicySpec
+		expected    map[string]string
+	}{
+		"policy fills gaps": {
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{holepunchAnnotationName: "tcp"},
+			policy:      policy,
+			expected: map[string]string{
+				holepunchAnnotationName:     "tcp",
+				leaseDurationAnnotationName: "30m0s",
+				remoteHostAnnotationName:    "203.0.113.7",
+				skipPortsAnnotationName:     "9090,9091",
+			},
+		},
+		"service annotations override policy": {
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{
+				holepunchAnnotationName:     "false",
+				leaseDurationAnnotationName: "2h",
+				remoteHostAnnotationName:    "198.51.100.1",
+				skipPortsAnnotationName:     "8080",
+			},
+			policy: policy,
+			expected: map[string]string{
+				holepunchAnnotationName:     "false",
+				leaseDurationAnnotationName: "2h",
+				remoteHostAnnotationName:    "198.51.100.1",
+				skipPortsAnnotationName:     "8080",
+			},
+		},
+		"policy opts services in": {
+			serviceType: corev1.ServiceTypeNodePort,
+			policy:      &holepunchv1alpha1.HolepunchPolicySpec{ForwardUnannotatedServices: true},
+			expected:    map[string]string{holepunchAnnotationName: "true"},
+		},
+		"policy only sets defaults": {
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			policy:      &holepunchv1alpha1.HolepunchPolicySpec{DefaultRemoteHost: "198.51.100.1"},
+			expected:    map[string]string{remoteHostAnnotationName: "198.51.100.1"},
+		},
+		"nothing to forward to": {
+			serviceType: corev1.ServiceTypeClusterIP,
+			policy:      &holepunchv1alpha1.HolepunchPolicySpec{ForwardUnannotatedServices: true},
+			expected:    map[string]string{},
+		},
+		"missing policy": {
+			serviceType: corev1.ServiceTypeLoadBalancer,
+			annotations: map[string]string{holepunchAnnotationName: "true"},
+			expected:    map[string]string{holepunchAnnotationName: "true"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := corev1.Service{
+				ObjectMeta: v1.ObjectMeta{Annotations: tc.annotations},
+				Spec:       corev1.ServiceSpec{Type: tc.serviceType},
+			}
+			settings := applyHolepunchPolicy(service, tc.policy)
+			if tc.policy == nil {
+				assert.Equal(t, service, settings)
+				return
+			}
+			assert.Equal(t, tc.expected, settings.Annotations)
+			assert.Equal(t, tc.annotations, service.Annotations, "the service itself is left alone")
+		})
+	}
+}
+
+func TestGetHolepunchPolicyCombinesPolicies(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme,
+		holepunchPolicy("b", holepunchv1alpha1.HolepunchPolicySpec{
+			DefaultLeaseDuration:       &v1.Duration{Duration: time.Hour},
+			DefaultRemoteHost:          "203.0.113.7",
+			ForwardUnannotatedServices: true,
+		}),
+		holepunchPolicy("a", holepunchv1alpha1.HolepunchPolicySpec{
+			DefaultLeaseDuration: &v1.Duration{Duration: 30 * time.Minute},
+		}),
+	)
+	other := holepunchPolicy("c", holepunchv1alpha1.HolepunchPolicySpec{SkipPorts: []int32{9090}})
+	other.Namespace = "other"
+	assert.NoError(t, c.Create(context.Background(), other))
+	r := NewServiceReconciler(c, scheme.Scheme, WithLogger(logf.NullLogger{}))
+
+	policy, err := r.getHolepunchPolicy(context.Background(), "default")
+	assert.NoError(t, err)
+	assert.Equal(t, &holepunchv1alpha1.HolepunchPolicySpec{
+		DefaultLeaseDuration: &v1.Duration{Duration: 30 * time.Minute},
+		DefaultRemoteHost:    "203.0.113.7",
+	}, policy)
+
+	policy, err = r.getHolepunchPolicy(context.Background(), "empty")
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+}
+
+func TestReconcileUsesHolepunchPolicy(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	reconcileWith := func(service *corev1.Service, objs ...runtime.Object) (*mockRouterClient, *corev1.Service) {
+		router := &mockRouterClient{}
+		c := fake.NewFakeClientWithScheme(scheme.Scheme, append(objs, service)...)
+		r := NewServiceReconciler(c, scheme.Scheme,
+			WithLogger(logf.NullLogger{}),
+			WithEventRecorder(record.NewFakeRecorder(10)),
+			WithRouterClients(router),
+		)
+		_, err := r.Reconcile(req)
+		assert.NoError(t, err)
+		var updated corev1.Service
+		assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+		return router, &updated
+	}
+	policy := holepunchPolicy("holepunch", holepunchv1alpha1.HolepunchPolicySpec{
+		DefaultLeaseDuration: &v1.Duration{Duration: 30 * time.Minute},
+		DefaultRemoteHost:    "203.0.113.7",
+		SkipPorts:            []int32{9090},
+	})
+	withMetricsPort := func(service *corev1.Service) *corev1.Service {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 9090, Protocol: corev1.ProtocolTCP})
+		return service
+	}
+
+	// The policy fills in what the service doesn't say, without adding anything to the service itself.
+	router, service := reconcileWith(withMetricsPort(holepunchedService()), policy)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint16(80), router.addCalls[0].ExternalPort)
+		assert.Equal(t, "203.0.113.7", router.addCalls[0].RemoteHost)
+		assert.Equal(t, uint32(1800), router.addCalls[0].LeaseDuration)
+	}
+	assert.NotContains(t, service.Annotations, leaseDurationAnnotationName)
+	assert.NotContains(t, service.Annotations, remoteHostAnnotationName)
+
+	// The service's own annotations win.
+	annotated := withMetricsPort(holepunchedService())
+	annotated.Annotations[leaseDurationAnnotationName] = "2h"
+	annotated.Annotations[remoteHostAnnotationName] = "198.51.100.1"
+	annotated.Annotations[skipPortsAnnotationName] = "80"
+	router, _ = reconcileWith(annotated, policy)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint16(9090), router.addCalls[0].ExternalPort)
+		assert.Equal(t, "198.51.100.1", router.addCalls[0].RemoteHost)
+		assert.Equal(t, uint32(7200), router.addCalls[0].LeaseDuration)
+	}
+
+	// Without a policy we use our own defaults.
+	router, _ = reconcileWith(holepunchedService())
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, "", router.addCalls[0].RemoteHost)
+		assert.Equal(t, uint32(leaseDurationSeconds), router.addCalls[0].LeaseDuration)
+	}
+
+	// A policy can forward the ports of services without the annotation, but only if it says so.
+	unannotated := holepunchedService()
+	unannotated.Annotations = nil
+	router, service = reconcileWith(unannotated,
+		holepunchPolicy("holepunch", holepunchv1alpha1.HolepunchPolicySpec{ForwardUnannotatedServices: true}))
+	assert.Len(t, router.addCalls, 1)
+	assert.NotContains(t, service.Annotations, holepunchAnnotationName)
+	assert.Contains(t, service.Finalizers, portMappingCleanupFinalizer)
+
+	unannotated = holepunchedService()
+	unannotated.Annotations = nil
+	router, _ = reconcileWith(unannotated, holepunchPolicy("holepunch", holepunchv1alpha1.HolepunchPolicySpec{
+		DefaultLeaseDuration: &v1.Duration{Duration: time.Hour},
+	}))
+	assert.Empty(t, router.addCalls)
+}
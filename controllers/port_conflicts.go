@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// externalPortsIndexField indexes services by the external ports they ask for, as port claim keys (e.g., "TCP:80").
+const externalPortsIndexField = "holepunch.externalPorts"
+
+// portConflictTracker remembers which service has claimed each external port, so that two services asking for the
+// same one don't silently replace each other's mapping on the router. Claims only last as long as the controller does,
+// so after a restart whichever service is reconciled first gets the port.
+type portConflictTracker struct {
+	mu     sync.Mutex
+	claims map[string]types.NamespacedName
+}
+
+func portClaimKey(externalPort uint16, protocol string) string {
+	return fmt.Sprintf("%s:%d", protocol, externalPort)
+}
+
+// claim records that the service is using an external port. If a different service has already claimed it then that
+// service is returned, and ok is false.
+func (t *portConflictTracker) claim(service types.NamespacedName, externalPort uint16, protocol string) (owner types.NamespacedName, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := portClaimKey(externalPort, protocol)
+	if owner, claimed := t.claims[key]; claimed && owner != service {
+		return owner, false
+	}
+	if t.claims == nil {
+		t.claims = make(map[string]types.NamespacedName)
+	}
+	t.claims[key] = service
+	return service, true
+}
+
+// release gives up the service's claim on an external port. Claims held by other services are left alone.
+func (t *portConflictTracker) release(service types.NamespacedName, externalPort uint16, protocol string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := portClaimKey(externalPort, protocol)
+	if t.claims[key] == service {
+		delete(t.claims, key)
+	}
+}
+
+// releaseAll gives up every claim the service has.
+func (t *portConflictTracker) releaseAll(service types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, owner := range t.claims {
+		if owner == service {
+			delete(t.claims, key)
+		}
+	}
+}
+
+// indexExternalPorts is the indexer for externalPortsIndexField. Whether a service's ports are forwarded at all, and
+// which of them, can depend on its namespace's HolepunchPolicy, which we can't see here. So every port a service could
+// ask for is indexed, taking into account the port mapping annotations, and findPortOwner checks the rest.
+func indexExternalPorts(obj runtime.Object) []string {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil
+	}
+	mappings, err := getSpecMappings(*service)
+	if err != nil {
+		return nil
+	}
+	var keys []string
+	for key, externalPort := range mappings {
+		if _, protocol, err := parseMappingKey(key); err == nil {
+			keys = append(keys, portClaimKey(externalPort, protocol))
+		}
+	}
+	return keys
+}
+
+// effectiveExternalPorts returns the external ports that a service has its ports forwarded on, as port claim keys,
+// once its protocol filter and skipped ports are taken into account. Services that haven't asked for their ports to be
+// forwarded, or whose annotations are invalid, don't have any.
+func effectiveExternalPorts(service corev1.Service) map[string]bool {
+	forwardTCP, forwardUDP, err := getHolepunchProtocolFilter(service)
+	if err != nil || !HasHolepunchAnnotation(service) {
+		return nil
+	}
+	mappings, err := getSpecMappings(service)
+	if err != nil {
+		return nil
+	}
+	log := logf.NullLogger{}
+	mappings = filterMappingsByProtocol(log, mappings, forwardTCP, forwardUDP)
+	skippedPorts, err := getSkippedPorts(service)
+	if err != nil {
+		return nil
+	}
+	enabledPorts, err := getPortEnabledMap(service)
+	if err != nil {
+		return nil
+	}
+	for port, enabled := range enabledPorts {
+		if !enabled {
+			skippedPorts[port] = true
+		}
+	}
+	keys := make(map[string]bool)
+	for key, externalPort := range filterSkippedPorts(log, service, mappings, skippedPorts) {
+		if _, protocol, err := parseMappingKey(key); err == nil {
+			keys[portClaimKey(externalPort, protocol)] = true
+		}
+	}
+	return keys
+}
+
+// findPortOwner looks for another service that asks for the same external port, using the external ports index. This
+// catches conflicts that portConflictTracker can't, such as after a restart. Both services would otherwise refuse to
+// use the port, so it belongs to whichever was created first, with the name breaking ties. If the port is ours then
+// ok is true.
+func (r *ServiceReconciler) findPortOwner(ctx context.Context, service corev1.Service, externalPort uint16, protocol string) (owner types.NamespacedName, ok bool, err error) {
+	key := portClaimKey(externalPort, protocol)
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services, client.MatchingFields{externalPortsIndexField: key}); err != nil {
+		return types.NamespacedName{}, false, fmt.Errorf("unable to list services using external port %d/%s: %w",
+			externalPort, protocol, err)
+	}
+	name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	for _, other := range services.Items {
+		otherName := types.NamespacedName{Namespace: other.Namespace, Name: other.Name}
+		if otherName == name || !other.DeletionTimestamp.IsZero() || !createdBefore(other, service) {
+			continue
+		}
+		settings := applyPortMappingAnnotationFormat(r.withHolepunchPolicy(ctx, r.Log, other), r.PortMappingAnnotationFormat)
+		if effectiveExternalPorts(settings)[key] {
+			return otherName, false, nil
+		}
+	}
+	return name, true, nil
+}
+
+// createdBefore returns whether service a was created before service b, comparing their names if they were created
+// at the same time.
+func createdBefore(a, b corev1.Service) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return types.NamespacedName{Namespace: a.Namespace, Name: a.Name}.String() <
+		types.NamespacedName{Namespace: b.Namespace, Name: b.Name}.String()
+}
+
+// checkExternalPortConflicts makes sure that no other service owns any of the external ports in desired, which is in
+// the form produced by getSpecMappings. If one does then we warn about it and return an error, so that we try again
+// later in case the other service goes away.
+func (r *ServiceReconciler) checkExternalPortConflicts(ctx context.Context, log logr.Logger, service corev1.Service, desired map[string]uint16) error {
+	for _, key := range sortedMappingKeys(desired) {
+		_, protocol, err := parseMappingKey(key)
+		if err != nil {
+			return err
+		}
+		externalPort := desired[key]
+		owner, ok, err := r.findPortOwner(ctx, service, externalPort, protocol)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			err := fmt.Errorf("external port %d/%s is already claimed by service %s", externalPort, protocol, owner)
+			log.Error(err, "Refusing to replace port mapping", "external-port", externalPort)
+			r.Recorder.Eventf(&service, corev1.EventTypeWarning, "PortConflict",
+				"External port %d/%s is already claimed by service %s", externalPort, protocol, owner)
+			return err
+		}
+	}
+	return nil
+}
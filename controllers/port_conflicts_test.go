@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestPortConflictTracker(t *testing.T) {
+	web := types.NamespacedName{Namespace: "default", Name: "web"}
+	other := types.NamespacedName{Namespace: "default", Name: "other"}
+	var tracker portConflictTracker
+
+	_, ok := tracker.claim(web, 80, "TCP")
+	assert.True(t, ok)
+	// Claiming the same port again is fine, as is claiming it for another protocol
+	_, ok = tracker.claim(web, 80, "TCP")
+	assert.True(t, ok)
+	_, ok = tracker.claim(other, 80, "UDP")
+	assert.True(t, ok)
+
+	owner, ok := tracker.claim(other, 80, "TCP")
+	assert.False(t, ok)
+	assert.Equal(t, web, owner)
+
+	// Only the owner can give up a claim
+	tracker.release(other, 80, "TCP")
+	_, ok = tracker.claim(other, 80, "TCP")
+	assert.False(t, ok)
+
+	tracker.release(web, 80, "TCP")
+	_, ok = tracker.claim(other, 80, "TCP")
+	assert.True(t, ok)
+
+	tracker.releaseAll(other)
+	assert.Empty(t, tracker.claims)
+}
+
+func TestReconcileWarnsOnConflictingExternalPorts(t *testing.T) {
+	first := holepunchedService()
+	second := holepunchedService()
+	second.Name = "other-service"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, first, second), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+
+	// The second service wants the same port, so it mustn't take it over
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other-service"}})
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	assert.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning PortConflict External port 80/TCP is already claimed by service default/my-service", <-recorder.Events)
+
+	// Once the first service has gone, the port is free
+	assert.NoError(t, r.Delete(context.Background(), first))
+	_, err = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	_, err = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80, 80}, router.addedExternalPorts())
+}
+
+func TestReconcileWarnsOnConflictWithUnreconciledService(t *testing.T) {
+	older := holepunchedService()
+	older.CreationTimestamp = v1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	// This one maps a different internal port onto the same external port.
+	newer := holepunchedService()
+	newer.Name = "a-newer-service"
+	newer.CreationTimestamp = v1.NewTime(older.CreationTimestamp.Add(time.Hour))
+	newer.Spec.Ports = []corev1.ServicePort{{Port: 8080, Protocol: corev1.ProtocolTCP}}
+	newer.Annotations["holepunch.port/8080"] = "80"
+	// These want the same port, but aren't forwarding it.
+	disabled := holepunchedService()
+	disabled.Name = "disabled"
+	disabled.Annotations[holepunchAnnotationName] = "false"
+	udpOnly := holepunchedService()
+	udpOnly.Name = "udp-only"
+	udpOnly.Annotations[holepunchAnnotationName] = "udp"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, older, newer, disabled, udpOnly), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+
+	// We haven't reconciled the older service yet (e.g., we've just restarted), but the newer one still can't have its
+	// port.
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "a-newer-service"}})
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	assert.Empty(t, router.addCalls)
+	assert.Equal(t, []string{"Warning PortConflict External port 80/TCP is already claimed by service default/my-service"},
+		drainEvents(recorder))
+
+	// The older service is free to use it, as the others that want it aren't forwarding it.
+	_, err = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	assert.Empty(t, drainEvents(recorder))
+}
+
+func TestIndexExternalPorts(t *testing.T) {
+	service := holepunchedService()
+	service.Spec.Ports = []corev1.ServicePort{
+		{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		{Port: 53, Protocol: corev1.ProtocolUDP},
+		{Port: 9000, Protocol: corev1.ProtocolSCTP},
+	}
+	service.Annotations["holepunch.port/http"] = "80"
+	assert.ElementsMatch(t, []string{"TCP:80", "UDP:53"}, indexExternalPorts(service))
+
+	service.Annotations["holepunch.port/http"] = "not-a-port"
+	assert.Empty(t, indexExternalPorts(service))
+	assert.Empty(t, indexExternalPorts(&corev1.ConfigMap{}))
+}
@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PortMappingAnnotationFormat says which style of port mapping annotation is read from services.
+type PortMappingAnnotationFormat string
+
+const (
+	// PortMappingAnnotationFormatKeyBased only reads one annotation per port, like "holepunch.port/80: 3000".
+	PortMappingAnnotationFormatKeyBased PortMappingAnnotationFormat = "key-based"
+	// PortMappingAnnotationFormatJSON only reads the JSON list in the holepunch.io/port-mappings annotation.
+	PortMappingAnnotationFormatJSON PortMappingAnnotationFormat = "json"
+	// PortMappingAnnotationFormatAuto reads both, with the per-port annotations winning if they disagree.
+	PortMappingAnnotationFormatAuto PortMappingAnnotationFormat = "auto"
+)
+
+// jsonPortMapping is an entry in the holepunch.io/port-mappings annotation.
+type jsonPortMapping struct {
+	Internal uint16 `json:"internal"`
+	External uint16 `json:"external"`
+}
+
+// parseJSONPortMappings parses the holepunch.io/port-mappings annotation into a map of internal port to external port.
+// The annotation is a JSON list, e.g. `[{"internal":80,"external":3000},{"internal":443,"external":4000}]`. A service
+// without the annotation has no mappings.
+func parseJSONPortMappings(service corev1.Service) (map[uint16]uint16, error) {
+	portMapping := make(map[uint16]uint16)
+	value, ok := service.Annotations[portMappingsAnnotationName]
+	if !ok {
+		return portMapping, nil
+	}
+	var entries []jsonPortMapping
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, permanentError(fmt.Errorf("unable to parse %s annotation: %w", portMappingsAnnotationName, err))
+	}
+	for _, entry := range entries {
+		if entry.Internal == 0 || entry.External == 0 {
+			return nil, permanentError(fmt.Errorf("%s annotation has an entry without both an internal and an external port",
+				portMappingsAnnotationName))
+		}
+		if _, ok := portMapping[entry.Internal]; ok {
+			return nil, permanentError(fmt.Errorf("%s annotation maps internal port %d more than once",
+				portMappingsAnnotationName, entry.Internal))
+		}
+		portMapping[entry.Internal] = entry.External
+	}
+	return portMapping, nil
+}
+
+// GetPortMappings parses every port mapping annotation on a service into a map of internal port to external port. Both
+// the per-port annotations read by GetHolepunchPortMapping and the JSON list in the holepunch.io/port-mappings
+// annotation are read, and where they both map the same internal port the per-port annotation wins.
+func GetPortMappings(service corev1.Service) (map[uint16]uint16, error) {
+	portMapping, err := parseJSONPortMappings(service)
+	if err != nil {
+		return nil, err
+	}
+	keyBased, err := GetHolepunchPortMapping(service)
+	if err != nil {
+		return nil, err
+	}
+	for internalPort, externalPort := range keyBased {
+		portMapping[internalPort] = externalPort
+	}
+	return portMapping, nil
+}
+
+// applyPortMappingAnnotationFormat removes the port mapping annotations that aren't in the given format from a copy of
+// the service. As with applyHolepunchPolicy, the copy returned is only for working out how to forward the service's
+// ports, and must never be written back.
+func applyPortMappingAnnotationFormat(service corev1.Service, format PortMappingAnnotationFormat) corev1.Service {
+	if format != PortMappingAnnotationFormatKeyBased && format != PortMappingAnnotationFormatJSON {
+		return service
+	}
+	annotations := make(map[string]string, len(service.Annotations))
+	for key, value := range service.Annotations {
+		if format == PortMappingAnnotationFormatKeyBased && key == portMappingsAnnotationName {
+			continue
+		}
+		if format == PortMappingAnnotationFormatJSON && strings.HasPrefix(key, holepunchPortMapAnnotationPrefix) {
+			continue
+		}
+		annotations[key] = value
+	}
+	settings := *service.DeepCopy()
+	settings.Annotations = annotations
+	return settings
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func serviceWithPortMappingAnnotations(annotations map[string]string) corev1.Service {
+	service := *holepunchedService()
+	for key, value := range annotations {
+		service.Annotations[key] = value
+	}
+	return service
+}
+
+func TestParseJSONPortMappings(t *testing.T) {
+	for name, test := range map[string]struct {
+		annotation string
+		expected   map[uint16]uint16
+	}{
+		"two ports": {
+			annotation: `[{"internal":80,"external":3000},{"internal":443,"external":4000}]`,
+			expected:   map[uint16]uint16{80: 3000, 443: 4000},
+		},
+		"empty list":          {annotation: `[]`, expected: map[uint16]uint16{}},
+		"not JSON":            {annotation: `80:3000`},
+		"not a list":          {annotation: `{"internal":80,"external":3000}`},
+		"missing external":    {annotation: `[{"internal":80}]`},
+		"port out of range":   {annotation: `[{"internal":80,"external":70000}]`},
+		"internal port twice": {annotation: `[{"internal":80,"external":3000},{"internal":80,"external":4000}]`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mappings, err := parseJSONPortMappings(serviceWithPortMappingAnnotations(map[string]string{
+				portMappingsAnnotationName: test.annotation,
+			}))
+			if test.expected == nil {
+				if assert.Error(t, err) {
+					assert.Equal(t, Permanent, errorKind(err))
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, mappings)
+		})
+	}
+
+	mappings, err := parseJSONPortMappings(*holepunchedService())
+	assert.NoError(t, err)
+	assert.Empty(t, mappings, "no annotation means no mappings")
+}
+
+func TestGetPortMappingsPrefersPerPortAnnotations(t *testing.T) {
+	mappings, err := GetPortMappings(serviceWithPortMappingAnnotations(map[string]string{
+		portMappingsAnnotationName:              `[{"internal":80,"external":3000},{"internal":443,"external":4000}]`,
+		holepunchPortMapAnnotationPrefix + "80": "8080",
+		holepunchPortMapAnnotationPrefix + "22": "2222",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint16{80: 8080, 443: 4000, 22: 2222}, mappings)
+
+	// Either style being invalid is an error.
+	_, err = GetPortMappings(serviceWithPortMappingAnnotations(map[string]string{
+		portMappingsAnnotationName:              `not JSON`,
+		holepunchPortMapAnnotationPrefix + "80": "8080",
+	}))
+	assert.Error(t, err)
+	_, err = GetPortMappings(serviceWithPortMappingAnnotations(map[string]string{
+		portMappingsAnnotationName:              `[{"internal":80,"external":3000}]`,
+		holepunchPortMapAnnotationPrefix + "80": "not a port",
+	}))
+	assert.Error(t, err)
+}
+
+func TestApplyPortMappingAnnotationFormat(t *testing.T) {
+	service := serviceWithPortMappingAnnotations(map[string]string{
+		portMappingsAnnotationName:              `[{"internal":80,"external":3000}]`,
+		holepunchPortMapAnnotationPrefix + "80": "8080",
+	})
+
+	for format, expected := range map[PortMappingAnnotationFormat]uint16{
+		PortMappingAnnotationFormatAuto:     8080,
+		"":                                  8080,
+		PortMappingAnnotationFormatKeyBased: 8080,
+		PortMappingAnnotationFormatJSON:     3000,
+	} {
+		mappings, err := getSpecMappings(applyPortMappingAnnotationFormat(service, format))
+		assert.NoError(t, err, format)
+		assert.Equal(t, map[string]uint16{"80/TCP": expected}, mappings, format)
+	}
+
+	// Only the JSON annotation is read, so without it the port isn't remapped.
+	service = serviceWithPortMappingAnnotations(map[string]string{holepunchPortMapAnnotationPrefix + "80": "8080"})
+	mappings, err := getSpecMappings(applyPortMappingAnnotationFormat(service, PortMappingAnnotationFormatJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint16{"80/TCP": 80}, mappings)
+	assert.Contains(t, service.Annotations, holepunchPortMapAnnotationPrefix+"80", "the service itself is left alone")
+}
+
+func TestReconcileUsesJSONPortMappings(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[portMappingsAnnotationName] = `[{"internal":80,"external":3000}]`
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithPortMappingAnnotationFormat(PortMappingAnnotationFormatJSON),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{3000}, router.addedExternalPorts())
+}
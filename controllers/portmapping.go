@@ -0,0 +1,55 @@
+package controllers
+
+import "context"
+
+// PortMappingEntry is a port mapping that a router has, as returned by GetAllPortMappings.
+type PortMappingEntry struct {
+	RemoteHost     string `json:"remoteHost,omitempty"`
+	ExternalPort   uint16 `json:"externalPort"`
+	Protocol       string `json:"protocol"`
+	InternalPort   uint16 `json:"internalPort"`
+	InternalClient string `json:"internalClient"`
+	Enabled        bool   `json:"enabled"`
+	Description    string `json:"description,omitempty"`
+	// LeaseDuration is how many seconds the mapping has left, or zero if it never expires.
+	LeaseDuration uint32 `json:"leaseDuration"`
+	// ActualLeaseDuration is how many seconds the router actually granted, for the mappings we save, if it's less than
+	// the LeaseDuration we asked for. Otherwise it's zero.
+	ActualLeaseDuration uint32 `json:"actualLeaseDuration,omitempty"`
+}
+
+// GetAllPortMappings asks the router for every port mapping it has, including ones that weren't made by holepunch.
+// Routers only let us ask for mappings one at a time by index. If the router tells us how many it has then we ask for
+// that many, otherwise we keep going until the router says that there are no more. If the context is cancelled part way
+// through then the mappings found so far are returned, along with the context's error.
+func GetAllPortMappings(ctx context.Context, router RouterClient) ([]PortMappingEntry, error) {
+	var mappings []PortMappingEntry
+	count, countErr := router.GetPortMappingNumberOfEntries()
+	if countErr == nil {
+		if count == 0 {
+			return nil, nil
+		}
+		mappings = make([]PortMappingEntry, 0, count)
+	}
+	for index := uint16(0); ; index++ {
+		if err := ctx.Err(); err != nil {
+			return mappings, err
+		}
+		var m PortMappingEntry
+		var err error
+		m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description,
+			m.LeaseDuration, err = router.GetGenericPortMappingEntry(index)
+		if isUPnPError(err, ErrCodeSpecifiedArrayIndexInvalid) {
+			// We've gone past the last mapping. The count can be out of date if a mapping is removed (or expires)
+			// while we're listing them.
+			return mappings, nil
+		}
+		if err != nil {
+			return mappings, err
+		}
+		mappings = append(mappings, m)
+		if (countErr == nil && index == count-1) || index == ^uint16(0) {
+			return mappings, nil
+		}
+	}
+}
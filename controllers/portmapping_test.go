@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAllPortMappings(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"3000/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "Mapping for my-service/default", LeaseDuration: 1800},
+		"53/UDP":   {InternalPort: 53, InternalClient: "192.168.1.20", Enabled: true, Description: "DNS"},
+	}}
+
+	mappings, err := GetAllPortMappings(context.Background(), router)
+	assert.NoError(t, err)
+	assert.Equal(t, []PortMappingEntry{
+		{ExternalPort: 3000, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "Mapping for my-service/default", LeaseDuration: 1800},
+		{ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: "192.168.1.20", Enabled: true, Description: "DNS"},
+	}, mappings)
+
+	mappings, err = GetAllPortMappings(context.Background(), &mockRouterClient{})
+	assert.NoError(t, err)
+	assert.Empty(t, mappings)
+}
+
+func TestGetAllPortMappingsStopsAtLastEntry(t *testing.T) {
+	for _, n := range []int{1, 10, 100} {
+		t.Run(fmt.Sprintf("%d entries", n), func(t *testing.T) {
+			entries := make(map[string]portMappingEntry)
+			for i := 0; i < n; i++ {
+				entries[mappingKey(uint16(10000+i), "TCP")] = portMappingEntry{InternalPort: uint16(i), InternalClient: "192.168.1.10"}
+			}
+			mappings, err := GetAllPortMappings(context.Background(), &mockRouterClient{entries: entries})
+			assert.NoError(t, err)
+			assert.Len(t, mappings, n)
+		})
+	}
+}
+
+func TestGetAllPortMappingsError(t *testing.T) {
+	_, err := GetAllPortMappings(context.Background(), NewNatPMPRouterClient(net.IPv4(192, 168, 1, 1)))
+	assert.Error(t, err)
+}
+
+func TestGetAllPortMappingsCancelled(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10"},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mappings, err := GetAllPortMappings(ctx, router)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Empty(t, mappings)
+}
+
+// listCountingRouterClient counts how many times the router is asked for a mapping by index.
+type listCountingRouterClient struct {
+	*mockRouterClient
+	listCalls int
+}
+
+func (l *listCountingRouterClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	l.listCalls++
+	return l.mockRouterClient.GetGenericPortMappingEntry(index)
+}
+
+func TestGetAllPortMappingsUsesCount(t *testing.T) {
+	router := &listCountingRouterClient{mockRouterClient: &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP":  {InternalPort: 80, InternalClient: "192.168.1.10"},
+		"443/TCP": {InternalPort: 443, InternalClient: "192.168.1.10"},
+		"53/UDP":  {InternalPort: 53, InternalClient: "192.168.1.20"},
+	}}}
+
+	mappings, err := GetAllPortMappings(context.Background(), router)
+	assert.NoError(t, err)
+	assert.Len(t, mappings, 3)
+	assert.Equal(t, 3, cap(mappings))
+	// Knowing how many there are, we don't need to ask for one past the end.
+	assert.Equal(t, 3, router.listCalls)
+}
+
+func TestGetAllPortMappingsFallsBackWithoutCount(t *testing.T) {
+	router := &listCountingRouterClient{mockRouterClient: &mockRouterClient{
+		entries: map[string]portMappingEntry{
+			"80/TCP":  {InternalPort: 80, InternalClient: "192.168.1.10"},
+			"443/TCP": {InternalPort: 443, InternalClient: "192.168.1.10"},
+		},
+		numberOfEntriesErr: upnpFault(401),
+	}}
+
+	mappings, err := GetAllPortMappings(context.Background(), router)
+	assert.NoError(t, err)
+	assert.Len(t, mappings, 2)
+	assert.Equal(t, 3, router.listCalls)
+}
+
+func TestGetAllPortMappingsCountOutOfDate(t *testing.T) {
+	// The router says it has more mappings than it does, e.g. because one expired while we were listing them.
+	router := &overcountingRouterClient{mockRouterClient: &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10"},
+	}}}
+
+	mappings, err := GetAllPortMappings(context.Background(), router)
+	assert.NoError(t, err)
+	assert.Len(t, mappings, 1)
+}
+
+type overcountingRouterClient struct {
+	*mockRouterClient
+}
+
+func (o *overcountingRouterClient) GetPortMappingNumberOfEntries() (uint16, error) {
+	return uint16(len(o.entries) + 1), nil
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// annotationPredicate filters out events for services that have nothing to do with holepunch, so that we don't
+// reconcile every service in the cluster. A service is interesting if it has the holepunch annotation (with any value,
+// as turning it off needs the mappings to be removed), or if it still has our finalizer and so might have mappings
+// that need removing. Updates that only record the reconcile status are ignored, as they're ours.
+var annotationPredicate = servicePredicate(isHolepunchService)
+
+// servicePredicate filters out events for services that aren't interesting, in the same way as annotationPredicate.
+func servicePredicate(interesting func(meta metav1.Object) bool) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return interesting(e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return (interesting(e.MetaOld) || interesting(e.MetaNew)) &&
+				!onlyReconcileStatusChanged(e.ObjectOld, e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return interesting(e.Meta)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return interesting(e.Meta)
+		},
+	}
+}
+
+func isHolepunchService(meta metav1.Object) bool {
+	if meta == nil {
+		return false
+	}
+	if _, ok := meta.GetAnnotations()[holepunchAnnotationName]; ok {
+		return true
+	}
+	for _, finalizer := range meta.GetFinalizers() {
+		if finalizer == portMappingCleanupFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope returns whether a service is one this controller looks after at all: it must be in one of
+// ServiceNamespaceSelector's namespaces, and match ServiceLabelSelector. Services outside this scope are ignored
+// entirely, even if they ask for their ports to be forwarded.
+func (r *ServiceReconciler) inScope(meta metav1.Object) bool {
+	if meta == nil {
+		return false
+	}
+	if len(r.ServiceNamespaceSelector) > 0 {
+		found := false
+		for _, namespace := range r.ServiceNamespaceSelector {
+			if namespace == meta.GetNamespace() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.ServiceLabelSelector == nil || r.ServiceLabelSelector.Matches(labels.Set(meta.GetLabels()))
+}
+
+// HolepunchChangePredicate filters out updates to services that can't change their port mappings, such as the
+// resource version being bumped. An update is only interesting if it changes:
+//   - a holepunch annotation, other than the ones we only write to report what we've done;
+//   - the service's ports;
+//   - the service's type, cluster IP, or selector, which decide where its ports are forwarded to;
+//   - the service's LoadBalancer IPs, as a new IP may let forwarding go ahead;
+//   - whether the service is being deleted, or its finalizers.
+//
+// Other events are let through.
+var HolepunchChangePredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldService, ok := e.ObjectOld.(*corev1.Service)
+		if !ok {
+			return true
+		}
+		newService, ok := e.ObjectNew.(*corev1.Service)
+		if !ok {
+			return true
+		}
+		return holepunchChanged(oldService, newService)
+	},
+}
+
+// reportAnnotations are the holepunch annotations that we write to show users what happened, but never read back.
+var reportAnnotations = map[string]bool{
+	externalIPAnnotationName:           true,
+	routerConnectionTypeAnnotationName: true,
+	conditionsAnnotationName:           true,
+	lastReconcileAnnotationName:        true,
+	lastStatusAnnotationName:           true,
+}
+
+// holepunchChanged returns true if the difference between two versions of a service might change its port mappings.
+func holepunchChanged(oldService, newService *corev1.Service) bool {
+	if !equality.Semantic.DeepEqual(holepunchAnnotations(oldService), holepunchAnnotations(newService)) {
+		return true
+	}
+	if !equality.Semantic.DeepEqual(oldService.Spec.Ports, newService.Spec.Ports) {
+		return true
+	}
+	if oldService.Spec.Type != newService.Spec.Type || oldService.Spec.ClusterIP != newService.Spec.ClusterIP ||
+		!equality.Semantic.DeepEqual(oldService.Spec.Selector, newService.Spec.Selector) {
+		return true
+	}
+	if !equality.Semantic.DeepEqual(oldService.Status.LoadBalancer.Ingress, newService.Status.LoadBalancer.Ingress) {
+		return true
+	}
+	return !oldService.DeletionTimestamp.Equal(newService.DeletionTimestamp) ||
+		!equality.Semantic.DeepEqual(oldService.Finalizers, newService.Finalizers)
+}
+
+// holepunchAnnotations returns the service's holepunch annotations, apart from reportAnnotations.
+func holepunchAnnotations(service *corev1.Service) map[string]string {
+	annotations := make(map[string]string)
+	for key, value := range service.Annotations {
+		if strings.HasPrefix(key, "holepunch") && !reportAnnotations[key] {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
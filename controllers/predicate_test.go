@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func serviceWithMeta(annotations map[string]string, finalizers ...string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "my-service",
+			Namespace:   "default",
+			Annotations: annotations,
+			Finalizers:  finalizers,
+		},
+	}
+}
+
+func TestAnnotationPredicate(t *testing.T) {
+	plain := serviceWithMeta(nil)
+	annotated := serviceWithMeta(map[string]string{holepunchAnnotationName: "true"})
+	disabled := serviceWithMeta(map[string]string{holepunchAnnotationName: "false"})
+	finalized := serviceWithMeta(nil, portMappingCleanupFinalizer)
+
+	assert.False(t, annotationPredicate.Create(event.CreateEvent{Meta: plain, Object: plain}))
+	assert.True(t, annotationPredicate.Create(event.CreateEvent{Meta: annotated, Object: annotated}))
+	assert.True(t, annotationPredicate.Create(event.CreateEvent{Meta: disabled, Object: disabled}))
+
+	assert.False(t, annotationPredicate.Update(event.UpdateEvent{MetaOld: plain, ObjectOld: plain, MetaNew: plain, ObjectNew: plain}))
+	// Adding or removing the annotation both need a reconcile
+	assert.True(t, annotationPredicate.Update(event.UpdateEvent{MetaOld: plain, ObjectOld: plain, MetaNew: annotated, ObjectNew: annotated}))
+	assert.True(t, annotationPredicate.Update(event.UpdateEvent{MetaOld: annotated, ObjectOld: annotated, MetaNew: plain, ObjectNew: plain}))
+	// As does a service we might still have mappings for
+	assert.True(t, annotationPredicate.Update(event.UpdateEvent{MetaOld: finalized, ObjectOld: finalized, MetaNew: finalized, ObjectNew: finalized}))
+
+	assert.False(t, annotationPredicate.Delete(event.DeleteEvent{Meta: plain, Object: plain}))
+	assert.True(t, annotationPredicate.Delete(event.DeleteEvent{Meta: annotated, Object: annotated}))
+
+	assert.False(t, annotationPredicate.Generic(event.GenericEvent{Meta: plain, Object: plain}))
+	assert.True(t, annotationPredicate.Generic(event.GenericEvent{Meta: finalized, Object: finalized}))
+}
+
+func TestHolepunchChangePredicate(t *testing.T) {
+	base := holepunchedService()
+	base.Annotations[activeMappingsAnnotationName] = `{"80/TCP":80}`
+	now := v1.Now()
+
+	for name, test := range map[string]struct {
+		change    func(service *corev1.Service)
+		reconcile bool
+	}{
+		"nothing but the resource version": {
+			change:    func(service *corev1.Service) { service.ResourceVersion = "2" },
+			reconcile: false,
+		},
+		"other annotation": {
+			change:    func(service *corev1.Service) { service.Annotations["example.com/owner"] = "me" },
+			reconcile: false,
+		},
+		"labels": {
+			change:    func(service *corev1.Service) { service.Labels = map[string]string{"app": "web"} },
+			reconcile: false,
+		},
+		"reported external IP": {
+			change:    func(service *corev1.Service) { service.Annotations[externalIPAnnotationName] = "203.0.113.1" },
+			reconcile: false,
+		},
+		"reconcile status": {
+			change:    func(service *corev1.Service) { service.Annotations[lastStatusAnnotationName] = "Success" },
+			reconcile: false,
+		},
+		"other spec field": {
+			change:    func(service *corev1.Service) { service.Spec.SessionAffinity = corev1.ServiceAffinityClientIP },
+			reconcile: false,
+		},
+		"holepunch annotation": {
+			change:    func(service *corev1.Service) { service.Annotations[holepunchAnnotationName] = "false" },
+			reconcile: true,
+		},
+		"port mapping annotation": {
+			change:    func(service *corev1.Service) { service.Annotations[holepunchPortMapAnnotationPrefix+"80"] = "8080" },
+			reconcile: true,
+		},
+		"active mappings removed": {
+			change:    func(service *corev1.Service) { delete(service.Annotations, activeMappingsAnnotationName) },
+			reconcile: true,
+		},
+		"ports": {
+			change: func(service *corev1.Service) {
+				service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 443, Protocol: corev1.ProtocolTCP})
+			},
+			reconcile: true,
+		},
+		"type": {
+			change:    func(service *corev1.Service) { service.Spec.Type = corev1.ServiceTypeNodePort },
+			reconcile: true,
+		},
+		"cluster IP": {
+			change:    func(service *corev1.Service) { service.Spec.ClusterIP = "10.96.0.20" },
+			reconcile: true,
+		},
+		"selector": {
+			change:    func(service *corev1.Service) { service.Spec.Selector = map[string]string{"app": "web"} },
+			reconcile: true,
+		},
+		"LoadBalancer IP": {
+			change: func(service *corev1.Service) {
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.20"}}
+			},
+			reconcile: true,
+		},
+		"deleted": {
+			change:    func(service *corev1.Service) { service.DeletionTimestamp = &now },
+			reconcile: true,
+		},
+		"finalizer removed": {
+			change:    func(service *corev1.Service) { service.Finalizers = nil },
+			reconcile: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			old := base.DeepCopy()
+			old.Finalizers = []string{portMappingCleanupFinalizer}
+			updated := old.DeepCopy()
+			test.change(updated)
+			assert.Equal(t, test.reconcile, HolepunchChangePredicate.Update(event.UpdateEvent{
+				MetaOld: old, ObjectOld: old, MetaNew: updated, ObjectNew: updated,
+			}))
+		})
+	}
+
+	// Only updates are filtered.
+	assert.True(t, HolepunchChangePredicate.Create(event.CreateEvent{Meta: base, Object: base}))
+	assert.True(t, HolepunchChangePredicate.Delete(event.DeleteEvent{Meta: base, Object: base}))
+	assert.True(t, HolepunchChangePredicate.Generic(event.GenericEvent{Meta: base, Object: base}))
+}
+
+func TestInScopePredicate(t *testing.T) {
+	selector, err := labels.Parse("app=myapp")
+	if !assert.NoError(t, err) {
+		return
+	}
+	matching := holepunchedService()
+	matching.Labels = map[string]string{"app": "myapp"}
+	otherLabels := holepunchedService()
+	otherLabels.Labels = map[string]string{"app": "other"}
+	otherNamespace := matching.DeepCopy()
+	otherNamespace.Namespace = "elsewhere"
+
+	for name, test := range map[string]struct {
+		reconciler *ServiceReconciler
+		inScope    map[*corev1.Service]bool
+	}{
+		"no selectors": {
+			reconciler: NewServiceReconciler(nil, nil),
+			inScope:    map[*corev1.Service]bool{matching: true, otherLabels: true, otherNamespace: true},
+		},
+		"label selector": {
+			reconciler: NewServiceReconciler(nil, nil, WithServiceLabelSelector(selector)),
+			inScope:    map[*corev1.Service]bool{matching: true, otherLabels: false, otherNamespace: true},
+		},
+		"namespace selector": {
+			reconciler: NewServiceReconciler(nil, nil, WithServiceNamespaceSelector("kube-system", "default")),
+			inScope:    map[*corev1.Service]bool{matching: true, otherLabels: true, otherNamespace: false},
+		},
+		"both selectors": {
+			reconciler: NewServiceReconciler(nil, nil,
+				WithServiceLabelSelector(selector), WithServiceNamespaceSelector("default")),
+			inScope: map[*corev1.Service]bool{matching: true, otherLabels: false, otherNamespace: false},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := servicePredicate(test.reconciler.inScope)
+			for service, inScope := range test.inScope {
+				assert.Equal(t, inScope, p.Create(event.CreateEvent{Meta: service, Object: service}), service.Namespace, service.Labels)
+				assert.Equal(t, inScope, p.Delete(event.DeleteEvent{Meta: service, Object: service}))
+				assert.Equal(t, inScope, p.Generic(event.GenericEvent{Meta: service, Object: service}))
+			}
+		})
+	}
+
+	// A service that stops matching is reconciled one last time.
+	p := servicePredicate(NewServiceReconciler(nil, nil, WithServiceLabelSelector(selector)).inScope)
+	assert.True(t, p.Update(event.UpdateEvent{MetaOld: matching, ObjectOld: matching, MetaNew: otherLabels, ObjectNew: otherLabels}))
+	assert.False(t, p.Update(event.UpdateEvent{MetaOld: otherLabels, ObjectOld: otherLabels, MetaNew: otherLabels, ObjectNew: otherLabels}))
+}
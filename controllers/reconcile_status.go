@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=core,resources=services,verbs=patch
+
+// maxStatusErrorLength is how much of an error is kept in the last-status annotation. Router errors can carry whole
+// SOAP responses, which don't belong on the service. The full error is still logged.
+const maxStatusErrorLength = 256
+
+// recordReconcileStatus records when we last reconciled the service, and whether it worked, as annotations on the
+// service so that users can see them. We've already finished with the service by now, so an error here is only logged.
+func (r *ServiceReconciler) recordReconcileStatus(ctx context.Context, log logr.Logger, service *corev1.Service, reconcileErr error) {
+	status := "success"
+	if reconcileErr != nil {
+		status = "error: " + statusError(reconcileErr)
+	}
+	err := updateServiceAnnotations(ctx, r.Client, service, map[string]string{
+		lastReconcileAnnotationName: time.Now().UTC().Format(time.RFC3339),
+		lastStatusAnnotationName:    status,
+	})
+	if err != nil {
+		log.Error(err, "Failed to record reconcile status")
+	}
+}
+
+// statusError returns the first line of err, cut short if it's longer than maxStatusErrorLength.
+func statusError(err error) string {
+	message := err.Error()
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		message = message[:i]
+	}
+	if runes := []rune(message); len(runes) > maxStatusErrorLength {
+		return string(runes[:maxStatusErrorLength]) + "..."
+	}
+	return message
+}
+
+// updateServiceAnnotations sets the given annotations on the service, leaving any others alone. This is done with a
+// patch rather than an update, so that it can't conflict with changes made to the service since we read it. The
+// service is updated to match the result.
+func updateServiceAnnotations(ctx context.Context, c client.Client, service *corev1.Service, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return c.Patch(ctx, service, client.RawPatch(types.StrategicMergePatchType, patch))
+}
+
+// onlyReconcileStatusChanged returns true if the only difference between two versions of a service is the reconcile
+// status recorded by recordReconcileStatus. Recording it mustn't cause another reconcile, as that would record it again.
+func onlyReconcileStatusChanged(oldObj, newObj runtime.Object) bool {
+	oldService, ok := oldObj.(*corev1.Service)
+	if !ok {
+		return false
+	}
+	newService, ok := newObj.(*corev1.Service)
+	if !ok {
+		return false
+	}
+	if oldService.Annotations[lastReconcileAnnotationName] == newService.Annotations[lastReconcileAnnotationName] &&
+		oldService.Annotations[lastStatusAnnotationName] == newService.Annotations[lastStatusAnnotationName] {
+		return false
+	}
+	return equality.Semantic.DeepEqual(withoutReconcileStatus(oldService), withoutReconcileStatus(newService))
+}
+
+// withoutReconcileStatus returns a copy of the service without the reconcile status, or anything else that changes
+// whenever the service is written to.
+func withoutReconcileStatus(service *corev1.Service) *corev1.Service {
+	service = service.DeepCopy()
+	delete(service.Annotations, lastReconcileAnnotationName)
+	delete(service.Annotations, lastStatusAnnotationName)
+	if len(service.Annotations) == 0 {
+		service.Annotations = nil
+	}
+	service.ResourceVersion = ""
+	service.ManagedFields = nil
+	return service
+}
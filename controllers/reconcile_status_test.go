@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestReconcileRecordsSuccess(t *testing.T) {
+	service := holepunchedService()
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+	)
+	key := types.NamespacedName{Namespace: "default", Name: "my-service"}
+
+	before := time.Now().Add(-time.Second)
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+	assert.NoError(t, err)
+
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), key, &updated))
+	assert.Equal(t, "success", updated.Annotations[lastStatusAnnotationName])
+	reconciledAt, err := time.Parse(time.RFC3339, updated.Annotations[lastReconcileAnnotationName])
+	assert.NoError(t, err)
+	assert.True(t, reconciledAt.After(before), "last reconcile %s should be after %s", reconciledAt, before)
+	// The other annotations are left alone.
+	assert.Equal(t, "true", updated.Annotations[holepunchAnnotationName])
+	assert.NotEmpty(t, updated.Annotations[activeMappingsAnnotationName])
+}
+
+func TestReconcileRecordsError(t *testing.T) {
+	service := holepunchedService()
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{addErr: errors.New("router unavailable")}, &calls)),
+	)
+	key := types.NamespacedName{Namespace: "default", Name: "my-service"}
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+	assert.NoError(t, err)
+
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), key, &updated))
+	assert.Contains(t, updated.Annotations[lastStatusAnnotationName], "error: ")
+	assert.Contains(t, updated.Annotations[lastStatusAnnotationName], "router unavailable")
+	_, err = time.Parse(time.RFC3339, updated.Annotations[lastReconcileAnnotationName])
+	assert.NoError(t, err)
+}
+
+func TestStatusError(t *testing.T) {
+	assert.Equal(t, "router unavailable", statusError(errors.New("router unavailable")))
+	assert.Equal(t, "bad response", statusError(errors.New("bad response\n<html><body>Error</body></html>")))
+
+	long := statusError(errors.New(strings.Repeat("x", maxStatusErrorLength+100)))
+	assert.Equal(t, strings.Repeat("x", maxStatusErrorLength)+"...", long)
+}
+
+func TestReconcileDoesNotRecordStatusInDryRun(t *testing.T) {
+	service := holepunchedService()
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+		WithDryRun(true),
+	)
+	key := types.NamespacedName{Namespace: "default", Name: "my-service"}
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: key})
+	assert.NoError(t, err)
+
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), key, &updated))
+	assert.NotContains(t, updated.Annotations, lastStatusAnnotationName)
+	assert.NotContains(t, updated.Annotations, lastReconcileAnnotationName)
+}
+
+func TestAnnotationPredicateIgnoresReconcileStatus(t *testing.T) {
+	old := serviceWithMeta(map[string]string{holepunchAnnotationName: "true"})
+	recorded := old.DeepCopy()
+	recorded.ResourceVersion = "2"
+	recorded.Annotations[lastReconcileAnnotationName] = "2024-01-15T10:30:00Z"
+	recorded.Annotations[lastStatusAnnotationName] = "success"
+	assert.False(t, annotationPredicate.Update(event.UpdateEvent{MetaOld: old, ObjectOld: old, MetaNew: recorded, ObjectNew: recorded}))
+
+	// Anything else changing at the same time still needs a reconcile.
+	changed := recorded.DeepCopy()
+	changed.Annotations[skipPortsAnnotationName] = "80"
+	assert.True(t, annotationPredicate.Update(event.UpdateEvent{MetaOld: old, ObjectOld: old, MetaNew: changed, ObjectNew: changed}))
+}
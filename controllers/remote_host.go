@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// remoteHostCacheTTL is how long a remote host's hostname is remembered to resolve to the same IP.
+const remoteHostCacheTTL = 5 * time.Minute
+
+// HostLookupFn resolves a hostname to its addresses, like net.Resolver's LookupHost.
+type HostLookupFn func(ctx context.Context, host string) ([]string, error)
+
+// resolvedRemoteHost is the IP a remote host's hostname resolved to, and when to look it up again.
+type resolvedRemoteHost struct {
+	ip     string
+	expiry time.Time
+}
+
+// resolveRemoteHost returns host if it's an IP address, otherwise it looks it up with lookupFn and returns the first
+// IPv4 address, or the first address if there are no IPv4 ones.
+func resolveRemoteHost(ctx context.Context, host string, lookupFn HostLookupFn) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	if lookupFn == nil {
+		lookupFn = net.DefaultResolver.LookupHost
+	}
+	addresses, err := lookupFn(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve remote host %q: %w", host, err)
+	}
+	var first string
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+		if first == "" {
+			first = ip.String()
+		}
+	}
+	if first == "" {
+		return "", fmt.Errorf("remote host %q did not resolve to any IP addresses", host)
+	}
+	return first, nil
+}
+
+// withResolvedRemoteHost returns a copy of settings with the hostname in its remote host annotation, if it has one,
+// replaced by the IP it resolves to, as routers only accept IPs. Hostnames can be pointed somewhere else at any time,
+// so they're looked up again once remoteHostCacheTTL has passed. If the lookup fails then a Warning event is recorded
+// on the service and the annotation is removed, so that its ports are still forwarded, but from any remote host. An
+// invalid annotation is left for getRemoteHost to complain about. As with applyHolepunchPolicy, the copy must never be
+// written back.
+func (r *ServiceReconciler) withResolvedRemoteHost(ctx context.Context, log logr.Logger, service *corev1.Service, settings corev1.Service) corev1.Service {
+	host, err := getRemoteHost(settings)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return settings
+	}
+
+	ip, err := r.lookupRemoteHost(ctx, host)
+	annotations := make(map[string]string, len(settings.Annotations))
+	for key, value := range settings.Annotations {
+		annotations[key] = value
+	}
+	settings.Annotations = annotations
+	if err != nil {
+		log.Info("Unable to resolve remote host, allowing any remote host", "remote-host", host, "error", err.Error())
+		r.Recorder.Eventf(service, corev1.EventTypeWarning, "RemoteHostUnresolvable",
+			"%s; forwarding ports from any remote host instead", err.Error())
+		delete(settings.Annotations, remoteHostAnnotationName)
+		return settings
+	}
+	settings.Annotations[remoteHostAnnotationName] = ip
+	return settings
+}
+
+// lookupRemoteHost resolves a remote host's hostname, using the last IP it resolved to if that was recent enough.
+// Failed lookups aren't remembered, so they're tried again next time.
+func (r *ServiceReconciler) lookupRemoteHost(ctx context.Context, host string) (string, error) {
+	r.remoteHostsMu.Lock()
+	cached, ok := r.remoteHosts[host]
+	r.remoteHostsMu.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.ip, nil
+	}
+
+	timeout := r.DNSTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ip, err := resolveRemoteHost(ctx, host, r.lookupHostFn)
+	if err != nil {
+		return "", err
+	}
+
+	r.remoteHostsMu.Lock()
+	defer r.remoteHostsMu.Unlock()
+	if r.remoteHosts == nil {
+		r.remoteHosts = make(map[string]resolvedRemoteHost)
+	}
+	r.remoteHosts[host] = resolvedRemoteHost{ip: ip, expiry: time.Now().Add(remoteHostCacheTTL)}
+	return ip, nil
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestResolveRemoteHost(t *testing.T) {
+	lookup := staticLookup(map[string][]string{
+		"home.example.com":   {"2001:db8::5", "203.0.113.5", "203.0.113.6"},
+		"ipv6.example.com":   {"2001:db8::5", "2001:db8::6"},
+		"broken.example.com": {"not an address"},
+	})
+	for name, test := range map[string]struct {
+		host string
+		want string
+	}{
+		"IP isn't looked up":  {host: "198.51.100.1", want: "198.51.100.1"},
+		"IPv4 preferred":      {host: "home.example.com", want: "203.0.113.5"},
+		"IPv6 if that's all":  {host: "ipv6.example.com", want: "2001:db8::5"},
+		"no such host":        {host: "nowhere.example.com"},
+		"no usable addresses": {host: "broken.example.com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := resolveRemoteHost(context.Background(), test.host, lookup)
+			if test.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestLookupRemoteHostCaches(t *testing.T) {
+	lookups := 0
+	ip := "203.0.113.5"
+	r := NewServiceReconciler(nil, nil, withLookupHost(func(context.Context, string) ([]string, error) {
+		lookups++
+		return []string{ip}, nil
+	}))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		got, err := r.lookupRemoteHost(ctx, "home.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "203.0.113.5", got)
+	}
+	assert.Equal(t, 1, lookups)
+
+	// Once it's been a while the hostname is looked up again, in case it's moved.
+	r.remoteHosts["home.example.com"] = resolvedRemoteHost{ip: "203.0.113.5", expiry: time.Now().Add(-time.Second)}
+	ip = "203.0.113.6"
+	got, err := r.lookupRemoteHost(ctx, "home.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.6", got)
+	assert.Equal(t, 2, lookups)
+}
+
+func TestReconcileRemoteHostname(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[remoteHostAnnotationName] = "home.example.com"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+		withLookupHost(staticLookup(map[string][]string{"home.example.com": {"203.0.113.5"}})),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, "203.0.113.5", router.addCalls[0].RemoteHost)
+	}
+	assert.Empty(t, drainEvents(recorder))
+}
+
+func TestReconcileUnresolvableRemoteHost(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[remoteHostAnnotationName] = "home.example.com"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+		withLookupHost(func(context.Context, string) ([]string, error) {
+			return nil, errors.New("DNS server unavailable")
+		}),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	// The ports are still forwarded, just not restricted to the remote host.
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, "", router.addCalls[0].RemoteHost)
+	}
+	events := drainEvents(recorder)
+	if assert.Len(t, events, 1) {
+		assert.Contains(t, events[0], "Warning RemoteHostUnresolvable")
+	}
+}
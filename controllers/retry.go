@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// retryingRouterClient wraps a RouterClient so that calls that fail are retried a few times, with an exponential
+// backoff, before the error is returned. This smooths over network hiccups that would otherwise fail a whole reconcile.
+// Errors that are the router's considered answer, rather than a failure to get one, aren't retried.
+type retryingRouterClient struct {
+	RouterClient
+	maxAttempts int
+	backoff     time.Duration
+	// sleep waits between attempts, returning early with an error if the context is done. It's replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetryingRouterClient wraps a router so that each call is tried up to maxAttempts times. The first retry happens
+// after backoff, and the wait doubles after each attempt. Calls made with a context stop waiting to retry once it's
+// done.
+func NewRetryingRouterClient(inner RouterClient, maxAttempts int, backoff time.Duration) RouterClient {
+	return &retryingRouterClient{
+		RouterClient: inner,
+		maxAttempts:  maxAttempts,
+		backoff:      backoff,
+		sleep:        realClock{}.sleep,
+	}
+}
+
+// isRetryableRouterError returns false for UPnP errors that will just happen again if we retry, because the router is
+// telling us that it won't do what we've asked. Likewise for asking a router to do something it doesn't support.
+func isRetryableRouterError(err error) bool {
+	if errors.Is(err, errAnyPortMappingNotSupported) {
+		return false
+	}
+	upnpErr, ok := parseUPnPError(err)
+	if !ok {
+		return true
+	}
+	switch upnpErr.Code {
+	case ErrCodeActionFailed,
+		ErrCodeSpecifiedArrayIndexInvalid,
+		ErrCodeNoSuchEntryInArray,
+		ErrCodeWildCardNotPermittedInSrcIP,
+		ErrCodeConflictInMappingEntry,
+		ErrCodeSamePortValuesRequired:
+		return false
+	default:
+		return true
+	}
+}
+
+// withRetry calls f until it succeeds, returns an error that isn't worth retrying, we run out of attempts, or ctx is
+// done. The last error f returned is returned.
+func (r *retryingRouterClient) withRetry(ctx context.Context, f func() error) error {
+	delay := r.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= r.maxAttempts || !isRetryableRouterError(err) {
+			return err
+		}
+		if r.sleep(ctx, delay) != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// contextual returns the router we wrap as a ContextualRouterClient, for making calls with a context.
+func (r *retryingRouterClient) contextual() ContextualRouterClient {
+	return asContextual(r.RouterClient)
+}
+
+func (r *retryingRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return r.withRetry(context.Background(), func() error {
+		return r.RouterClient.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	})
+}
+
+func (r *retryingRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return r.withRetry(context.Background(), func() error {
+		return r.RouterClient.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+	})
+}
+
+func (r *retryingRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	err = r.withRetry(context.Background(), func() error {
+		var err error
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration, err =
+			r.RouterClient.GetSpecificPortMappingEntry(NewRemoteHost, NewExternalPort, NewProtocol)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	err = r.withRetry(context.Background(), func() error {
+		var err error
+		NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled,
+			NewPortMappingDescription, NewLeaseDuration, err = r.RouterClient.GetGenericPortMappingEntry(NewPortMappingIndex)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	err = r.withRetry(context.Background(), func() error {
+		var err error
+		NewExternalIPAddress, err = r.RouterClient.GetExternalIPAddress()
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	err = r.withRetry(context.Background(), func() error {
+		var err error
+		NewConnectionType, NewPossibleConnectionTypes, err = r.RouterClient.GetConnectionTypeInfo()
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	err = r.withRetry(context.Background(), func() error {
+		var err error
+		NewPortMappingNumberOfEntries, err = r.RouterClient.GetPortMappingNumberOfEntries()
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (
+	NewReservedPort uint16,
+	err error,
+) {
+	err = r.withRetry(context.Background(), func() error {
+		var err error
+		NewReservedPort, err = addAnyPortMapping(r.RouterClient, NewRemoteHost, NewExternalPort, NewProtocol,
+			NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) AddPortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return r.withRetry(ctx, func() error {
+		return r.contextual().AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	})
+}
+
+func (r *retryingRouterClient) DeletePortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return r.withRetry(ctx, func() error {
+		return r.contextual().DeletePortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+	})
+}
+
+func (r *retryingRouterClient) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	err = r.withRetry(ctx, func() error {
+		var err error
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration, err =
+			r.contextual().GetSpecificPortMappingEntryCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	err = r.withRetry(ctx, func() error {
+		var err error
+		NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled,
+			NewPortMappingDescription, NewLeaseDuration, err =
+			r.contextual().GetGenericPortMappingEntryCtx(ctx, NewPortMappingIndex)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	err = r.withRetry(ctx, func() error {
+		var err error
+		NewExternalIPAddress, err = r.contextual().GetExternalIPAddressCtx(ctx)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	err = r.withRetry(ctx, func() error {
+		var err error
+		NewConnectionType, NewPossibleConnectionTypes, err = r.contextual().GetConnectionTypeInfoCtx(ctx)
+		return err
+	})
+	return
+}
+
+func (r *retryingRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	err = r.withRetry(ctx, func() error {
+		var err error
+		NewPortMappingNumberOfEntries, err = r.contextual().GetPortMappingNumberOfEntriesCtx(ctx)
+		return err
+	})
+	return
+}
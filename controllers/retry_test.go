@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRetryingRouterClient creates a retrying router that records how long it would have slept for, rather than
+// sleeping.
+func newTestRetryingRouterClient(inner RouterClient, maxAttempts int, backoff time.Duration) (*retryingRouterClient, *[]time.Duration) {
+	var slept []time.Duration
+	router := NewRetryingRouterClient(inner, maxAttempts, backoff).(*retryingRouterClient)
+	router.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return ctx.Err()
+	}
+	return router, &slept
+}
+
+func TestRetryingRouterClientRetriesUntilSuccess(t *testing.T) {
+	inner := &flakyRouterClient{mockRouterClient: &mockRouterClient{}, failures: 2}
+	router, slept := newTestRetryingRouterClient(inner, 5, time.Second)
+
+	assert.NoError(t, router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.Equal(t, []uint16{80}, inner.addedExternalPorts())
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *slept)
+}
+
+func TestRetryingRouterClientGivesUpAfterMaxAttempts(t *testing.T) {
+	inner := &flakyRouterClient{mockRouterClient: &mockRouterClient{}, failures: 10}
+	router, slept := newTestRetryingRouterClient(inner, 4, 100*time.Millisecond)
+
+	assert.EqualError(t, router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600), "router is rebooting")
+	assert.Equal(t, 6, inner.failures)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}, *slept)
+}
+
+func TestRetryingRouterClientDoesNotRetryPermanentErrors(t *testing.T) {
+	for _, code := range []int{ErrCodeActionFailed, ErrCodeConflictInMappingEntry, ErrCodeSamePortValuesRequired,
+		ErrCodeNoSuchEntryInArray, ErrCodeSpecifiedArrayIndexInvalid} {
+		inner := &mockRouterClient{addErr: upnpFault(code), deleteErr: upnpFault(code)}
+		router, slept := newTestRetryingRouterClient(inner, 5, time.Second)
+
+		err := router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600)
+		assert.True(t, isUPnPError(err, code))
+		assert.Len(t, inner.addCalls, 1)
+
+		assert.Error(t, router.DeletePortMapping("", 80, "TCP"))
+		assert.Len(t, inner.deleteCalls, 1)
+		assert.Empty(t, *slept)
+	}
+}
+
+func TestRetryingRouterClientReturnsResults(t *testing.T) {
+	inner := &mockRouterClient{externalIP: "203.0.113.5", entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 8080, InternalClient: "192.168.1.10", Enabled: true},
+	}}
+	router, slept := newTestRetryingRouterClient(inner, 3, time.Second)
+
+	ip, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.5", ip)
+
+	port, client, _, _, _, err := router.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(8080), port)
+	assert.Equal(t, "192.168.1.10", client)
+
+	mappings, err := GetAllPortMappings(context.Background(), router)
+	assert.NoError(t, err)
+	assert.Len(t, mappings, 1)
+	assert.Empty(t, *slept)
+
+	inner.externalIPErr = errors.New("connection reset")
+	_, err = router.GetExternalIPAddress()
+	assert.Error(t, err)
+	assert.Len(t, *slept, 2)
+}
+
+func TestRetryingRouterClientStopsWaitingWhenContextDone(t *testing.T) {
+	inner := &flakyRouterClient{mockRouterClient: &mockRouterClient{}, failures: 10}
+	router := NewRetryingRouterClient(inner, 5, time.Hour).(*retryingRouterClient)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := router.AddPortMappingCtx(ctx, "", 80, "TCP", 80, "192.168.1.10", true, "", 3600)
+	assert.EqualError(t, err, "router is rebooting")
+	assert.Less(t, int64(time.Since(start)), int64(time.Minute))
+	assert.Equal(t, 9, inner.failures)
+}
+
+func TestInstrumentRouterClientRetries(t *testing.T) {
+	inner := &flakyRouterClient{mockRouterClient: &mockRouterClient{}, failures: 2}
+	r := NewServiceReconciler(nil, nil, WithRouterCallRetries(3, time.Millisecond))
+
+	assert.NoError(t, r.instrumentRouterClient(inner).AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.Equal(t, []uint16{80}, inner.addedExternalPorts())
+
+	// Without retries the first failure is returned.
+	inner = &flakyRouterClient{mockRouterClient: &mockRouterClient{}, failures: 1}
+	r = NewServiceReconciler(nil, nil)
+	assert.Error(t, r.instrumentRouterClient(inner).AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+}
@@ -0,0 +1,1012 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/httpu"
+	"github.com/huin/goupnp/ssdp"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// discoveryLog is used by router discovery, which happens outside of any reconcile.
+var discoveryLog = ctrl.Log.WithName("router-discovery")
+
+type RouterClient interface {
+	igdClient
+
+	// GetPortMappingNumberOfEntries returns how many port mappings the router has. Not every router supports this.
+	GetPortMappingNumberOfEntries() (
+		NewPortMappingNumberOfEntries uint16,
+		err error,
+	)
+}
+
+// igdClient is the part of RouterClient that goupnp implements for every Internet Gateway Device service we use.
+type igdClient interface {
+	AddPortMapping(
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+	) (err error)
+
+	DeletePortMapping(
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (err error)
+
+	GetSpecificPortMappingEntry(
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+		err error,
+	)
+
+	GetGenericPortMappingEntry(
+		NewPortMappingIndex uint16,
+	) (
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+		err error,
+	)
+
+	GetExternalIPAddress() (
+		NewExternalIPAddress string,
+		err error,
+	)
+
+	GetConnectionTypeInfo() (
+		NewConnectionType string,
+		NewPossibleConnectionTypes string,
+		err error,
+	)
+}
+
+// igdContextClient is the same as igdClient, but with each call taking a context that cancels it.
+type igdContextClient interface {
+	AddPortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+	) (err error)
+
+	DeletePortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (err error)
+
+	GetSpecificPortMappingEntryCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+		err error,
+	)
+
+	GetGenericPortMappingEntryCtx(
+		ctx context.Context,
+		NewPortMappingIndex uint16,
+	) (
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+		err error,
+	)
+
+	GetExternalIPAddressCtx(
+		ctx context.Context,
+	) (
+		NewExternalIPAddress string,
+		err error,
+	)
+
+	GetConnectionTypeInfoCtx(
+		ctx context.Context,
+	) (
+		NewConnectionType string,
+		NewPossibleConnectionTypes string,
+		err error,
+	)
+}
+
+// goupnpClient is implemented by every goupnp Internet Gateway Device service client we use.
+type goupnpClient interface {
+	igdClient
+	igdContextClient
+}
+
+// Make sure that every UPnP client we might pick can be used as a ContextualRouterClient, once wrapped with
+// newIGDRouterClient.
+var (
+	_ goupnpClient = &internetgateway2.WANIPConnection1{}
+	_ goupnpClient = &internetgateway2.WANIPConnection2{}
+	_ goupnpClient = &internetgateway2.WANPPPConnection1{}
+	_ goupnpClient = &internetgateway1.WANIPConnection1{}
+	_ goupnpClient = &internetgateway1.WANPPPConnection1{}
+
+	_ ContextualRouterClient = &igdRouterClient{}
+)
+
+// PickRouterClient finds a router to configure. If a root device description URL is given then the router at that
+// location is used, otherwise we discover one on the local network. If more than one is found then we use the best
+// one, as decided by PickAllRouterClients. If several URLs are given then the router at each of them is used, and
+// they're all configured together.
+func PickRouterClient(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+	return discoverRouter(ctx, discoveryFor("", rootDesc))
+}
+
+// PickOption changes how a router picker made by NewRouterClientPicker finds routers.
+type PickOption func(*pickOptions)
+
+type pickOptions struct {
+	interfaces []net.Interface
+	// interfaceSearch returns how to discover devices on a network interface. If nil then interfaceDeviceSearch is
+	// used.
+	interfaceSearch func(iface *net.Interface) (deviceSearch, error)
+}
+
+// WithInterfaces only discovers routers on the given network interfaces, looking on all of them at the same time. This
+// stops us from finding a router on the wrong network when the node is also connected to a VPN or a management
+// network. If no interfaces are given then routers are discovered on every interface, as usual.
+func WithInterfaces(ifaces ...net.Interface) PickOption {
+	return func(o *pickOptions) {
+		o.interfaces = append(o.interfaces, ifaces...)
+	}
+}
+
+// NewRouterClientPicker returns a function that finds a router to configure in the same way as PickRouterClient, but
+// changed by the given options. It can be used as a ServiceReconciler's RouterClientFactory. With no options it
+// behaves exactly like PickRouterClient.
+func NewRouterClientPicker(opts ...PickOption) func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+	var o pickOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+		discovery := discoveryFor("", rootDesc)
+		if upnp, ok := discovery.(UPnPDiscovery); ok && len(o.interfaces) > 0 {
+			upnp.Interfaces = o.interfaces
+			upnp.interfaceSearch = o.interfaceSearch
+			discovery = upnp
+		}
+		return discoverRouter(ctx, discovery)
+	}
+}
+
+// PickAllRouterClients finds every router we could configure. If root device description URLs are given then only
+// the services on the routers at those locations are returned, otherwise we discover them on the local network.
+// Clients are returned in our order of preference, which is the newest version of each service first. An error is
+// returned if nothing is found, or if any of the given routers can't be used.
+func PickAllRouterClients(ctx context.Context, rootDesc ...string) ([]RouterClient, error) {
+	return pickAllRouterClients(ctx, goupnp.DiscoverDevices, rootDesc)
+}
+
+// PickRouterClientOnInterface finds a router to configure in the same way as PickRouterClient, except that discovery
+// only happens on the named network interface. This stops us from finding a router on the wrong network when there's
+// more than one. If there's no such interface then we log a warning and discover routers on every interface instead.
+func PickRouterClientOnInterface(ctx context.Context, iface string, rootDesc ...string) (RouterClient, error) {
+	return discoverRouter(ctx, discoveryFor(iface, rootDesc))
+}
+
+// pickAllRouterClients implements PickAllRouterClients, using search to discover routers if we need to.
+func pickAllRouterClients(ctx context.Context, search deviceSearch, rootDesc []string) ([]RouterClient, error) {
+	services, err := discoverRouterServices(ctx, search, rootDesc)
+	if err != nil {
+		return nil, err
+	}
+	return flattenRouterServices(services), nil
+}
+
+// routerServices are the clients for every instance of one type of UPnP service that we found, such as
+// RouterServiceIGD2WANIPConnection2.
+type routerServices struct {
+	name    string
+	clients []discoveredClient
+}
+
+// discoverRouterServices finds every router service we could configure, in the same way as PickAllRouterClients, but
+// grouped by the type of service, in our order of preference.
+func discoverRouterServices(ctx context.Context, search deviceSearch, rootDesc []string) ([]routerServices, error) {
+	switch len(rootDesc) {
+	case 0:
+	case 1:
+		if rootDesc[0] != "" {
+			return routerServicesByURL(rootDesc[0])
+		}
+	default:
+		var services []routerServices
+		for _, desc := range rootDesc {
+			found, err := routerServicesByURL(desc)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, found...)
+		}
+		return services, nil
+	}
+
+	// Try each type of client in parallel. Routers only offer some of these services, and some discovery requests may
+	// fail, so we only give up if nothing at all is found.
+	found := make([]routerServices, len(upnpDiscoverers))
+	errs := make([]error, len(upnpDiscoverers))
+	var wg sync.WaitGroup
+	var panics panicCatcher
+	for i, d := range upnpDiscoverers {
+		wg.Add(1)
+		go func(i int, d upnpDiscoverer) {
+			defer wg.Done()
+			defer panics.catch()
+			clients, err := d.discover(search)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s discovery failed: %w", d.name, err)
+			}
+			found[i] = routerServices{name: d.name, clients: clients}
+		}(i, d)
+	}
+	wg.Wait()
+	panics.repanic()
+	discoveryErr := utilerrors.NewAggregate(errs)
+
+	total := 0
+	for _, services := range found {
+		total += len(services.clients)
+	}
+	if total == 0 {
+		if discoveryErr != nil {
+			return nil, fmt.Errorf("no services found: %w", discoveryErr)
+		}
+		return nil, errors.New("No services found")
+	}
+	if discoveryErr != nil {
+		discoveryLog.V(1).Info("Some router discovery requests failed", "error", discoveryErr.Error())
+	}
+	return found, nil
+}
+
+// flattenRouterServices returns the clients for every service, in order, without any that were found twice.
+func flattenRouterServices(services []routerServices) []RouterClient {
+	var clients routerClientSet
+	for _, found := range services {
+		for _, c := range found.clients {
+			clients.add(c.endpoint, c.client)
+		}
+	}
+	return clients.clients
+}
+
+// pickRouterClientsOnInterfaces discovers routers on each of the given network interfaces at the same time, using
+// searchFor to get how to search on each one. The clients found are returned in the order of the interfaces, and then
+// in our order of preference. Like discovering on every interface, we only give up if nothing at all is found.
+func pickRouterClientsOnInterfaces(
+	ctx context.Context,
+	ifaces []net.Interface,
+	searchFor func(iface *net.Interface) (deviceSearch, error),
+) ([]RouterClient, error) {
+	found := make([][]RouterClient, len(ifaces))
+	errs := make([]error, len(ifaces))
+	var wg sync.WaitGroup
+	var panics panicCatcher
+	for i := range ifaces {
+		wg.Add(1)
+		go func(i int, iface *net.Interface) {
+			defer wg.Done()
+			defer panics.catch()
+			search, err := searchFor(iface)
+			if err == nil {
+				found[i], err = pickAllRouterClients(ctx, search, nil)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("interface %s: %w", iface.Name, err)
+			}
+		}(i, &ifaces[i])
+	}
+	wg.Wait()
+	panics.repanic()
+	discoveryErr := utilerrors.NewAggregate(errs)
+
+	var clients []RouterClient
+	for _, discovered := range found {
+		clients = append(clients, discovered...)
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no services found on any interface: %w", discoveryErr)
+	}
+	if discoveryErr != nil {
+		discoveryLog.V(1).Info("Router discovery failed on some interfaces", "error", discoveryErr.Error())
+	}
+	return clients, nil
+}
+
+// discoveredClient is a client for a UPnP service found on the local network, along with the service's endpoint.
+type discoveredClient struct {
+	endpoint url.URL
+	client   RouterClient
+}
+
+// deviceSearch finds the UPnP devices on the local network offering the given search target.
+type deviceSearch func(searchTarget string) ([]goupnp.MaybeRootDevice, error)
+
+// upnpDiscoverer finds every instance of one type of UPnP service on the local network.
+type upnpDiscoverer struct {
+	name     string
+	discover func(search deviceSearch) ([]discoveredClient, error)
+}
+
+// The names of the UPnP services we look for when discovering routers, with the version of the Internet Gateway Device
+// spec they're from.
+const (
+	RouterServiceIGD2WANIPConnection2  = "IGD2 WANIPConnection2"
+	RouterServiceIGD2WANIPConnection1  = "IGD2 WANIPConnection1"
+	RouterServiceIGD2WANPPPConnection1 = "IGD2 WANPPPConnection1"
+	RouterServiceIGD1WANIPConnection1  = "IGD1 WANIPConnection1"
+	RouterServiceIGD1WANPPPConnection1 = "IGD1 WANPPPConnection1"
+)
+
+// upnpDiscoverers are the services we look for when discovering routers, in our order of preference. Older routers
+// only implement version 1 of the Internet Gateway Device spec, so we look for those services too.
+var upnpDiscoverers = []upnpDiscoverer{
+	{name: RouterServiceIGD2WANIPConnection2, discover: func(search deviceSearch) ([]discoveredClient, error) {
+		return discoverServices(search, internetgateway2.URN_WANIPConnection_2,
+			func(root *goupnp.RootDevice, loc *url.URL) ([]discoveredClient, error) {
+				clients, err := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(root, loc)
+				var discovered []discoveredClient
+				for _, c := range clients {
+					discovered = append(discovered, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+				}
+				return discovered, err
+			})
+	}},
+	{name: RouterServiceIGD2WANIPConnection1, discover: func(search deviceSearch) ([]discoveredClient, error) {
+		return discoverServices(search, internetgateway2.URN_WANIPConnection_1,
+			func(root *goupnp.RootDevice, loc *url.URL) ([]discoveredClient, error) {
+				clients, err := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(root, loc)
+				var discovered []discoveredClient
+				for _, c := range clients {
+					discovered = append(discovered, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+				}
+				return discovered, err
+			})
+	}},
+	{name: RouterServiceIGD2WANPPPConnection1, discover: func(search deviceSearch) ([]discoveredClient, error) {
+		return discoverServices(search, internetgateway2.URN_WANPPPConnection_1,
+			func(root *goupnp.RootDevice, loc *url.URL) ([]discoveredClient, error) {
+				clients, err := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(root, loc)
+				var discovered []discoveredClient
+				for _, c := range clients {
+					discovered = append(discovered, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+				}
+				return discovered, err
+			})
+	}},
+	{name: RouterServiceIGD1WANIPConnection1, discover: func(search deviceSearch) ([]discoveredClient, error) {
+		return discoverServices(search, internetgateway1.URN_WANIPConnection_1,
+			func(root *goupnp.RootDevice, loc *url.URL) ([]discoveredClient, error) {
+				clients, err := internetgateway1.NewWANIPConnection1ClientsFromRootDevice(root, loc)
+				var discovered []discoveredClient
+				for _, c := range clients {
+					discovered = append(discovered, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+				}
+				return discovered, err
+			})
+	}},
+	{name: RouterServiceIGD1WANPPPConnection1, discover: func(search deviceSearch) ([]discoveredClient, error) {
+		return discoverServices(search, internetgateway1.URN_WANPPPConnection_1,
+			func(root *goupnp.RootDevice, loc *url.URL) ([]discoveredClient, error) {
+				clients, err := internetgateway1.NewWANPPPConnection1ClientsFromRootDevice(root, loc)
+				var discovered []discoveredClient
+				for _, c := range clients {
+					discovered = append(discovered, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+				}
+				return discovered, err
+			})
+	}},
+}
+
+// discoverServices uses search to find the devices offering searchTarget, and creates clients for the services on
+// each of them with fromRootDevice. Like goupnp's own discovery, devices that can't be probed are skipped.
+func discoverServices(
+	search deviceSearch,
+	searchTarget string,
+	fromRootDevice func(root *goupnp.RootDevice, loc *url.URL) ([]discoveredClient, error),
+) ([]discoveredClient, error) {
+	devices, err := search(searchTarget)
+	if err != nil {
+		return nil, err
+	}
+	var discovered []discoveredClient
+	for _, device := range devices {
+		if device.Err != nil {
+			continue
+		}
+		clients, err := fromRootDevice(device.Root, device.Location)
+		if err != nil {
+			continue
+		}
+		discovered = append(discovered, clients...)
+	}
+	return discovered, nil
+}
+
+// interfaceDeviceSearch returns a deviceSearch that only sends discovery requests from the IPv4 addresses of the given
+// network interface, so that we only find routers on the network it's connected to.
+func interfaceDeviceSearch(iface *net.Interface) (deviceSearch, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get addresses of interface %s: %w", iface.Name, err)
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		ips = append(ips, ipNet.IP.String())
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no IPv4 address", iface.Name)
+	}
+
+	return func(searchTarget string) ([]goupnp.MaybeRootDevice, error) {
+		delegates := make([]httpu.ClientInterface, 0, len(ips))
+		for _, ip := range ips {
+			c, err := httpu.NewHTTPUClientAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("unable to send discovery requests from %s: %w", ip, err)
+			}
+			defer c.Close()
+			delegates = append(delegates, c)
+		}
+		responses, err := ssdp.SSDPRawSearch(httpu.NewMultiClient(delegates), searchTarget, 2, 3)
+		if err != nil {
+			return nil, err
+		}
+
+		devices := make([]goupnp.MaybeRootDevice, len(responses))
+		for i, response := range responses {
+			device := &devices[i]
+			device.USN = response.Header.Get("USN")
+			loc, err := response.Location()
+			if err != nil {
+				device.Err = err
+				continue
+			}
+			device.Location = loc
+			device.Root, device.Err = goupnp.DeviceByURL(loc)
+		}
+		return devices, nil
+	}, nil
+}
+
+// pickEachRouterClient uses pick to find the router at each of the given root device descriptions, and combines them
+// so that they're all configured together. We need every router to forward ports, so if any of them can't be found
+// then that's an error.
+func pickEachRouterClient(
+	ctx context.Context,
+	pick func(ctx context.Context, rootDesc ...string) (RouterClient, error),
+	rootDesc []string,
+) (RouterClient, error) {
+	routers := make([]RouterClient, 0, len(rootDesc))
+	for _, desc := range rootDesc {
+		router, err := pick(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use router at %s: %w", desc, err)
+		}
+		routers = append(routers, router)
+	}
+	return &multiRouterClient{routers: routers}, nil
+}
+
+// pickRouterClientsByURL creates clients for the services on the router with the root device description at the given
+// URL, skipping discovery entirely.
+func pickRouterClientsByURL(rootDesc string) ([]RouterClient, error) {
+	services, err := routerServicesByURL(rootDesc)
+	if err != nil {
+		return nil, err
+	}
+	return flattenRouterServices(services), nil
+}
+
+// routerServicesByURL creates clients for the services on the router with the root device description at the given
+// URL, grouped by the type of service in the same order of preference as for discovery.
+func routerServicesByURL(rootDesc string) ([]routerServices, error) {
+	loc, err := url.Parse(rootDesc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid router root device description URL %q: %w", rootDesc, err)
+	}
+	root, err := goupnp.DeviceByURL(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	// A router will only offer some of these services, so failing to find any one of them isn't an error.
+	ip2Clients, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(root, loc)
+	ip1Clients, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(root, loc)
+	ppp1Clients, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(root, loc)
+	ip1v1Clients, _ := internetgateway1.NewWANIPConnection1ClientsFromRootDevice(root, loc)
+	ppp1v1Clients, _ := internetgateway1.NewWANPPPConnection1ClientsFromRootDevice(root, loc)
+
+	services := []routerServices{
+		{name: RouterServiceIGD2WANIPConnection2},
+		{name: RouterServiceIGD2WANIPConnection1},
+		{name: RouterServiceIGD2WANPPPConnection1},
+		{name: RouterServiceIGD1WANIPConnection1},
+		{name: RouterServiceIGD1WANPPPConnection1},
+	}
+	for _, c := range ip2Clients {
+		services[0].clients = append(services[0].clients, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+	}
+	for _, c := range ip1Clients {
+		services[1].clients = append(services[1].clients, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+	}
+	for _, c := range ppp1Clients {
+		services[2].clients = append(services[2].clients, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+	}
+	for _, c := range ip1v1Clients {
+		services[3].clients = append(services[3].clients, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+	}
+	for _, c := range ppp1v1Clients {
+		services[4].clients = append(services[4].clients, discoveredClient{c.SOAPClient.EndpointURL, newIGDRouterClient(c, c.ServiceClient)})
+	}
+	total := 0
+	for _, found := range services {
+		total += len(found.clients)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no services found on router at %s", rootDesc)
+	}
+	return services, nil
+}
+
+// routerClientSet collects router clients in the order they're added, ignoring any we already have. Version 1 and 2
+// of the Internet Gateway Device spec share some service types, so discovery can find the same service twice.
+type routerClientSet struct {
+	seen    map[string]bool
+	clients []RouterClient
+}
+
+func (s *routerClientSet) add(endpoint url.URL, client RouterClient) {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	key := endpoint.String()
+	if s.seen[key] {
+		return
+	}
+	s.seen[key] = true
+	s.clients = append(s.clients, client)
+}
+
+type cachedRouterClient struct {
+	client RouterClient
+	expiry time.Time
+	// mappings caches the router's port mappings, or is nil if MappingCacheRefreshInterval isn't set.
+	mappings *MappingCache
+	// connectionType is how the router connects to the internet, or empty if it wouldn't say.
+	connectionType string
+}
+
+// getRouterClient returns a client for the router to configure. If we've been given routers then we always use those.
+// Otherwise we discover one, which is expensive, so once found we keep using the same one until RouterCacheTTL has
+// elapsed or we're told it's stopped working.
+func (r *ServiceReconciler) getRouterClient(ctx context.Context) (RouterClient, error) {
+	var router RouterClient
+	switch len(r.RouterClients) {
+	case 0:
+		return r.cachedRouterClient(ctx, r.routerCacheKey(), r.discoverRouterClient)
+	case 1:
+		router = r.RouterClients[0]
+	default:
+		router = &multiRouterClient{routers: r.RouterClients}
+	}
+	r.routerClientsMappingsOnce.Do(func() {
+		r.installVerboseTransport(router)
+		r.routerClientsMappings = r.newMappingCache(router)
+		r.routerClientsConnectionType = r.detectConnectionType(router)
+	})
+	return r.withMappingCache(r.instrumentRouterClient(router), r.routerClientsMappings), nil
+}
+
+// cachedRouterClient returns the router cached under cacheKey, using discover to find it if it isn't cached or the
+// cache has expired.
+func (r *ServiceReconciler) cachedRouterClient(
+	ctx context.Context,
+	cacheKey string,
+	discover func(ctx context.Context) (RouterClient, error),
+) (RouterClient, error) {
+	r.routerCacheMu.RLock()
+	cached, ok := r.routerCache[cacheKey]
+	r.routerCacheMu.RUnlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return r.withMappingCache(r.instrumentRouterClient(cached.client), cached.mappings), nil
+	}
+
+	ctx, span := r.tracer().Start(ctx, "DiscoverRouter")
+	router, err := discover(ctx)
+	endSpan(span, err)
+	if err != nil {
+		return nil, &routerNotFoundError{err: err}
+	}
+
+	r.installVerboseTransport(router)
+	connectionType := r.detectConnectionType(router)
+
+	ttl := r.RouterCacheTTL
+	if ttl <= 0 {
+		ttl = defaultRouterCacheTTL
+	}
+	r.routerCacheMu.Lock()
+	defer r.routerCacheMu.Unlock()
+	if r.routerCache == nil {
+		r.routerCache = make(map[string]cachedRouterClient)
+	}
+	mappings := r.newMappingCache(router)
+	r.routerCache[cacheKey] = cachedRouterClient{
+		client:         router,
+		expiry:         time.Now().Add(ttl),
+		mappings:       mappings,
+		connectionType: connectionType,
+	}
+	return r.withMappingCache(r.instrumentRouterClient(router), mappings), nil
+}
+
+// newMappingCache returns a cache of the router's port mappings, or nil if MappingCacheRefreshInterval isn't set.
+func (r *ServiceReconciler) newMappingCache(router RouterClient) *MappingCache {
+	if r.MappingCacheRefreshInterval <= 0 {
+		return nil
+	}
+	return NewMappingCache(r.instrumentRouterClient(router), r.MappingCacheRefreshInterval)
+}
+
+// withMappingCache wraps router so that existing port mappings are looked up in mappings, unless it's nil.
+func (r *ServiceReconciler) withMappingCache(router RouterClient, mappings *MappingCache) RouterClient {
+	if mappings == nil {
+		return router
+	}
+	return &mappingCacheRouterClient{RouterClient: router, cache: mappings}
+}
+
+// refreshMappingCaches reads every router's port mapping table again, so that the caches don't hide any changes made
+// since they were last read. Routers that can't list their mappings are asked about each one directly instead, so
+// failing to read the table isn't an error.
+func (r *ServiceReconciler) refreshMappingCaches(ctx context.Context) {
+	caches := []*MappingCache{r.routerClientsMappings}
+	r.routerCacheMu.RLock()
+	for _, cached := range r.routerCache {
+		caches = append(caches, cached.mappings)
+	}
+	r.routerCacheMu.RUnlock()
+	for _, cache := range caches {
+		if cache == nil {
+			continue
+		}
+		if err := cache.Refresh(ctx); err != nil {
+			r.Log.V(1).Info("Unable to read the router's port mappings", "error", err.Error())
+		}
+	}
+}
+
+// instrumentRouterClient wraps the router so that calls to it time out after UPnPCallTimeout, so that they're logged if
+// LogRouterCalls is set, so that failed calls are retried up to RouterCallAttempts times within that timeout, and so
+// that we record metrics about them if we're recording metrics.
+func (r *ServiceReconciler) instrumentRouterClient(router RouterClient) RouterClient {
+	timeout := r.UPnPCallTimeout
+	if timeout <= 0 {
+		timeout = defaultUPnPCallTimeout
+	}
+	if r.LogRouterCalls {
+		router = NewLoggingRouterClient(router, r.Log.WithName("router"))
+	}
+	if r.RouterCallAttempts > 1 {
+		router = NewRetryingRouterClient(router, r.RouterCallAttempts, r.RouterCallBackoff)
+	}
+	router = &timeoutRouterClient{RouterClient: router, timeout: timeout}
+	if r.Metrics == nil {
+		return router
+	}
+	return &timedRouterClient{RouterClient: router, metrics: r.Metrics}
+}
+
+// discoverRouterClient finds a router using the protocols allowed by HolepunchMode.
+func (r *ServiceReconciler) discoverRouterClient(ctx context.Context) (RouterClient, error) {
+	r.routerState.discovering()
+	pickUPnP := r.RouterClientFactory
+	rootDesc := r.routerRootDesc()
+	if pickUPnP == nil {
+		discovery := r.RouterDiscovery
+		if discovery == nil {
+			discovery = discoveryFor(r.UPnPInterface, rootDesc)
+		}
+		pickUPnP = func(ctx context.Context, _ ...string) (RouterClient, error) {
+			return discoverRouter(ctx, discovery)
+		}
+	} else if len(rootDesc) > 1 {
+		// The router at each URL is configured, rather than just one.
+		factory := pickUPnP
+		pickUPnP = func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+			return pickEachRouterClient(ctx, factory, rootDesc)
+		}
+	}
+	pickNATPMP := r.pickNatPMPRouterClient
+	if pickNATPMP == nil {
+		pickNATPMP = PickNatPMPRouterClient
+	}
+
+	switch r.HolepunchMode {
+	case HolepunchModeUPnP:
+		return pickUPnP(ctx, rootDesc...)
+	case HolepunchModeNATPMP:
+		return pickNATPMP(ctx)
+	case HolepunchModeAuto, "":
+		router, err := pickUPnP(ctx, rootDesc...)
+		if err == nil {
+			return router, nil
+		}
+		r.Log.Info("No UPnP router found, trying NAT-PMP", "upnp-error", err.Error())
+		router, natPMPErr := pickNATPMP(ctx)
+		if natPMPErr != nil {
+			return nil, fmt.Errorf("no router found with UPnP (%v) or NAT-PMP (%v)", err, natPMPErr)
+		}
+		return router, nil
+	default:
+		return nil, fmt.Errorf("unknown holepunch mode %q", r.HolepunchMode)
+	}
+}
+
+// invalidateRouterClient forgets about the cached router, so that we discover it again next time. This should be
+// called whenever a call to the router fails, as that might be because it has gone away or changed address. A
+// different router might have a different external IP, so we forget that too.
+func (r *ServiceReconciler) invalidateRouterClient() {
+	r.routerCacheMu.Lock()
+	delete(r.routerCache, r.routerCacheKey())
+	r.routerCacheMu.Unlock()
+	if cached, ok := r.RouterDiscovery.(*CachedDiscovery); ok {
+		cached.Invalidate()
+	}
+	r.FlushExternalIPCache()
+}
+
+// getExternalIPAddress asks the router for its external IP, unless we've already asked it within the last
+// ExternalIPCacheTTL.
+func (r *ServiceReconciler) getExternalIPAddress(router RouterClient) (string, error) {
+	r.externalIPMu.Lock()
+	if r.cachedExternalIP != "" && time.Now().Before(r.externalIPExpiry) {
+		externalIP := r.cachedExternalIP
+		r.externalIPMu.Unlock()
+		return externalIP, nil
+	}
+	r.externalIPMu.Unlock()
+
+	// Asking the router can take a while, so the lock isn't held meanwhile, and reconciles that ask at the same time
+	// share the one request.
+	externalIP, err, _ := r.externalIPGroup.Do("", func() (interface{}, error) {
+		externalIP, err := router.GetExternalIPAddress()
+		if err != nil {
+			return "", err
+		}
+		r.externalIPMu.Lock()
+		r.cachedExternalIP = externalIP
+		r.externalIPExpiry = time.Now().Add(r.externalIPCacheTTL())
+		r.externalIPMu.Unlock()
+		return externalIP, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return externalIP.(string), nil
+}
+
+func (r *ServiceReconciler) externalIPCacheTTL() time.Duration {
+	if r.ExternalIPCacheTTL <= 0 {
+		return defaultExternalIPCacheTTL
+	}
+	return r.ExternalIPCacheTTL
+}
+
+// FlushExternalIPCache forgets the router's external IP, so that the next reconcile asks the router for it again. The
+// IP recorded on every service might now be out of date, so every service is fully reconciled next time too.
+func (r *ServiceReconciler) FlushExternalIPCache() {
+	r.externalIPMu.Lock()
+	r.cachedExternalIP = ""
+	r.externalIPExpiry = time.Time{}
+	r.externalIPMu.Unlock()
+
+	r.processedMu.Lock()
+	r.processed = nil
+	r.processedMu.Unlock()
+}
+
+// dryRunRouterClient wraps a RouterClient so that changes to port mappings are only logged, rather than being made.
+// Queries are still passed through to the router.
+type dryRunRouterClient struct {
+	RouterClient
+	log logr.Logger
+}
+
+// withDryRun wraps router so that it doesn't make any changes if we're in dry-run mode, otherwise it is
+// returned unchanged.
+func (r *ServiceReconciler) withDryRun(log logr.Logger, router RouterClient) RouterClient {
+	if !r.dryRun() {
+		return router
+	}
+	return &dryRunRouterClient{RouterClient: router, log: log}
+}
+
+func (d *dryRunRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	d.log.Info("[DRY-RUN] Would add port mapping",
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol,
+		"internal-port", NewInternalPort,
+		"internal-client", NewInternalClient,
+		"upnp-description", NewPortMappingDescription,
+		"lease-duration", NewLeaseDuration)
+	return nil
+}
+
+// AddAnyPortMapping pretends that the router gave us the external port we asked for, so long as it would support
+// AddAnyPortMapping at all.
+func (d *dryRunRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (NewReservedPort uint16, err error) {
+	if _, ok := d.RouterClient.(AnyPortMappingSupport); !ok {
+		return 0, errAnyPortMappingNotSupported
+	}
+	if err := d.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient,
+		NewEnabled, NewPortMappingDescription, NewLeaseDuration); err != nil {
+		return 0, err
+	}
+	return NewExternalPort, nil
+}
+
+func (d *dryRunRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	d.log.Info("[DRY-RUN] Would remove port mapping",
+		"external-port", NewExternalPort,
+		"protocol", NewProtocol)
+	return nil
+}
+
+func (d *dryRunRouterClient) AddPortMappingCtx(
+	_ context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return d.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient,
+		NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+}
+
+func (d *dryRunRouterClient) DeletePortMappingCtx(
+	_ context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return d.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+}
+
+func (d *dryRunRouterClient) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return asContextual(d.RouterClient).GetSpecificPortMappingEntryCtx(ctx, NewRemoteHost, NewExternalPort,
+		NewProtocol)
+}
+
+func (d *dryRunRouterClient) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	return asContextual(d.RouterClient).GetGenericPortMappingEntryCtx(ctx, NewPortMappingIndex)
+}
+
+func (d *dryRunRouterClient) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	return asContextual(d.RouterClient).GetExternalIPAddressCtx(ctx)
+}
+
+func (d *dryRunRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	return asContextual(d.RouterClient).GetConnectionTypeInfoCtx(ctx)
+}
+
+func (d *dryRunRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	return asContextual(d.RouterClient).GetPortMappingNumberOfEntriesCtx(ctx)
+}
@@ -0,0 +1,308 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/stretchr/testify/assert"
+)
+
+// withUPnPDiscoverers replaces router discovery for the duration of a test.
+func withUPnPDiscoverers(t *testing.T, discoverers ...upnpDiscoverer) {
+	original := upnpDiscoverers
+	upnpDiscoverers = discoverers
+	t.Cleanup(func() { upnpDiscoverers = original })
+}
+
+func discovers(name string, err error, clients ...discoveredClient) upnpDiscoverer {
+	return upnpDiscoverer{name: name, discover: func(deviceSearch) ([]discoveredClient, error) {
+		return clients, err
+	}}
+}
+
+func TestPickAllRouterClientsIgnoresPartialFailures(t *testing.T) {
+	a, b := &mockRouterClient{}, &mockRouterClient{}
+	withUPnPDiscoverers(t,
+		discovers("first", errors.New("timed out")),
+		discovers("second", nil, discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/a"}, a}),
+		discovers("third", errors.New("connection refused")),
+		discovers("fourth", nil, discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/b"}, b}),
+	)
+
+	clients, err := PickAllRouterClients(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []RouterClient{a, b}, clients)
+}
+
+func TestPickAllRouterClientsReturnsEveryErrorWhenNothingFound(t *testing.T) {
+	withUPnPDiscoverers(t,
+		discovers("first", errors.New("timed out")),
+		discovers("second", nil),
+		discovers("third", errors.New("connection refused")),
+	)
+
+	_, err := PickAllRouterClients(context.Background())
+	assert.EqualError(t, err,
+		"no services found: [first discovery failed: timed out, third discovery failed: connection refused]")
+}
+
+func TestPickAllRouterClientsNothingFoundWithoutErrors(t *testing.T) {
+	withUPnPDiscoverers(t, discovers("first", nil), discovers("second", nil))
+
+	_, err := PickAllRouterClients(context.Background())
+	assert.EqualError(t, err, "No services found")
+}
+
+func TestPickRouterClientPrefersFirstDiscoverer(t *testing.T) {
+	a, b := &mockRouterClient{}, &mockRouterClient{}
+	withUPnPDiscoverers(t,
+		discovers("first", errors.New("timed out")),
+		discovers("second", nil, discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/a"}, a}),
+		discovers("third", nil, discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/b"}, b}),
+	)
+
+	router, err := PickRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, a, router)
+}
+
+func TestPickRouterClientOnInterfaceFallsBackWhenInterfaceMissing(t *testing.T) {
+	a := &mockRouterClient{}
+	var searches []deviceSearch
+	withUPnPDiscoverers(t, upnpDiscoverer{name: "first", discover: func(search deviceSearch) ([]discoveredClient, error) {
+		searches = append(searches, search)
+		return []discoveredClient{{url.URL{Host: "192.168.1.1:5000", Path: "/a"}, a}}, nil
+	}})
+
+	router, err := PickRouterClientOnInterface(context.Background(), "does-not-exist0")
+	assert.NoError(t, err)
+	assert.Same(t, a, router)
+	if assert.Len(t, searches, 1) {
+		assert.Equal(t, reflect.ValueOf(goupnp.DiscoverDevices).Pointer(), reflect.ValueOf(searches[0]).Pointer())
+	}
+}
+
+func TestInterfaceDeviceSearchRejectsUnusableInterface(t *testing.T) {
+	_, err := interfaceDeviceSearch(&net.Interface{Index: 1 << 20, Name: "missing0"})
+	assert.Error(t, err)
+}
+
+// searchesByInterface is a fake discovery function per network interface. Each finds one device, whose USN is the
+// name of the interface it was found on, unless the interface is in failing.
+func searchesByInterface(failing ...string) func(iface *net.Interface) (deviceSearch, error) {
+	return func(iface *net.Interface) (deviceSearch, error) {
+		for _, name := range failing {
+			if name == iface.Name {
+				return nil, errors.New("no IPv4 address")
+			}
+		}
+		return func(string) ([]goupnp.MaybeRootDevice, error) {
+			return []goupnp.MaybeRootDevice{{USN: iface.Name}}, nil
+		}, nil
+	}
+}
+
+// discoversByDevice finds the client for each device with the given USN.
+func discoversByDevice(clients map[string]RouterClient) upnpDiscoverer {
+	return upnpDiscoverer{name: "by-device", discover: func(search deviceSearch) ([]discoveredClient, error) {
+		devices, err := search("urn:schemas-upnp-org:service:WANIPConnection:1")
+		if err != nil {
+			return nil, err
+		}
+		var found []discoveredClient
+		for _, device := range devices {
+			if client, ok := clients[device.USN]; ok {
+				found = append(found, discoveredClient{url.URL{Host: device.USN, Path: "/ctl"}, client})
+			}
+		}
+		return found, nil
+	}}
+}
+
+func TestPickRouterClientsOnInterfacesAggregatesResults(t *testing.T) {
+	lan, vpn := &mockRouterClient{}, &mockRouterClient{}
+	withUPnPDiscoverers(t, discoversByDevice(map[string]RouterClient{"eth0": lan, "wg0": vpn}))
+	ifaces := []net.Interface{{Name: "wg0"}, {Name: "eth1"}, {Name: "eth0"}, {Name: "eth2"}}
+
+	// Nothing is found on eth1 and there's no way to search on eth2, but the other interfaces still count.
+	clients, err := pickRouterClientsOnInterfaces(context.Background(), ifaces, searchesByInterface("eth2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []RouterClient{vpn, lan}, clients)
+
+	_, err = pickRouterClientsOnInterfaces(context.Background(), ifaces[1:2], searchesByInterface())
+	assert.EqualError(t, err, "no services found on any interface: interface eth1: No services found")
+}
+
+func TestNewRouterClientPickerWithInterfaces(t *testing.T) {
+	lan, vpn := &mockRouterClient{}, &mockRouterClient{}
+	withUPnPDiscoverers(t, discoversByDevice(map[string]RouterClient{"eth0": lan, "wg0": vpn}))
+	fakeSearch := func(o *pickOptions) { o.interfaceSearch = searchesByInterface() }
+
+	pick := NewRouterClientPicker(WithInterfaces(net.Interface{Name: "eth0"}, net.Interface{Name: "wg0"}), fakeSearch)
+	router, err := pick(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, lan, router)
+
+	// Without any interfaces we discover on every interface, as usual.
+	withUPnPDiscoverers(t, discovers("first", nil, discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/a"}, vpn}))
+	router, err = NewRouterClientPicker(fakeSearch)(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, vpn, router)
+}
+
+// ipv6RootDescServer is like rootDescServer, but listens on the IPv6 loopback address. The test is skipped if there
+// isn't one.
+func ipv6RootDescServer(t *testing.T, serviceType string) *httptest.Server {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback address not available: %v", err)
+	}
+	server := httptest.NewUnstartedServer(rootDescHandler(serviceType))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPickRouterClientURLs(t *testing.T) {
+	// Any of these finding a router by discovery would be a mistake.
+	withUPnPDiscoverers(t, discovers("first", errors.New("discovery shouldn't be used")))
+	server := rootDescServer(t, internetgateway1.URN_WANIPConnection_1)
+	host := server.Listener.Addr().String()
+
+	tests := []struct {
+		name     string
+		rootDesc func(t *testing.T) string
+		wantHost string
+		wantErr  string
+	}{
+		{
+			name:     "URL with port",
+			rootDesc: func(*testing.T) string { return "http://" + host + "/rootDesc.xml" },
+			wantHost: host,
+		},
+		{
+			name:     "URL with auth credentials",
+			rootDesc: func(*testing.T) string { return "http://admin:secret@" + host + "/rootDesc.xml" },
+			wantHost: host,
+		},
+		{
+			name: "IPv6 literal host",
+			rootDesc: func(t *testing.T) string {
+				return ipv6RootDescServer(t, internetgateway1.URN_WANIPConnection_1).URL + "/rootDesc.xml"
+			},
+			wantHost: "[::1]",
+		},
+		{
+			name:     "invalid URL",
+			rootDesc: func(*testing.T) string { return "http://[::1/rootDesc.xml" },
+			wantErr:  "invalid router root device description URL",
+		},
+		{
+			name:     "invalid escape",
+			rootDesc: func(*testing.T) string { return "http://" + host + "/%zz" },
+			wantErr:  "invalid router root device description URL",
+		},
+		{
+			name:     "no scheme",
+			rootDesc: func(*testing.T) string { return host + "/rootDesc.xml" },
+			wantErr:  "invalid router root device description URL",
+		},
+		{
+			name:     "no scheme or port",
+			rootDesc: func(*testing.T) string { return "router.invalid/rootDesc.xml" },
+			wantErr:  "unsupported protocol scheme",
+		},
+		{
+			name:     "no root device description",
+			rootDesc: func(*testing.T) string { return "http://" + host + "/missing.xml" },
+			wantErr:  "404",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, err := PickRouterClient(context.Background(), tt.rootDesc(t))
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+					assert.NotContains(t, err.Error(), "discovery shouldn't be used")
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, endpointHost(t, router), tt.wantHost)
+		})
+	}
+}
+
+func TestPickRouterClientCredentialsAreSent(t *testing.T) {
+	var user, password string
+	handler := rootDescHandler(internetgateway1.URN_WANIPConnection_1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ = req.BasicAuth()
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	_, err := PickRouterClient(context.Background(),
+		"http://admin:secret@"+server.Listener.Addr().String()+"/rootDesc.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", user)
+	assert.Equal(t, "secret", password)
+}
+
+func TestPickRouterClientURLOrDiscovery(t *testing.T) {
+	discovered := &mockRouterClient{}
+	var discoveries int
+	withUPnPDiscoverers(t, upnpDiscoverer{name: "first", discover: func(deviceSearch) ([]discoveredClient, error) {
+		discoveries++
+		return []discoveredClient{{url.URL{Host: "192.168.1.1:5000", Path: "/a"}, discovered}}, nil
+	}})
+	first := rootDescServer(t, internetgateway1.URN_WANIPConnection_1)
+	second := rootDescServer(t, internetgateway1.URN_WANIPConnection_1)
+	firstURL, secondURL := first.URL+"/rootDesc.xml", second.URL+"/rootDesc.xml"
+
+	tests := []struct {
+		name           string
+		rootDesc       []string
+		wantDiscovered bool
+		wantRouters    int
+	}{
+		{name: "no URLs", rootDesc: nil, wantDiscovered: true},
+		{name: "empty URL", rootDesc: []string{""}, wantDiscovered: true},
+		{name: "empty URLs", rootDesc: []string{"", ""}, wantDiscovered: true},
+		{name: "one URL", rootDesc: []string{firstURL}, wantRouters: 1},
+		{name: "one URL and an empty one", rootDesc: []string{"", firstURL}, wantRouters: 1},
+		{name: "two URLs", rootDesc: []string{firstURL, secondURL}, wantRouters: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discoveries = 0
+			router, err := PickRouterClient(context.Background(), tt.rootDesc...)
+			assert.NoError(t, err)
+			if tt.wantDiscovered {
+				assert.Equal(t, 1, discoveries)
+				assert.Same(t, discovered, router)
+				return
+			}
+			assert.Zero(t, discoveries)
+			switch tt.wantRouters {
+			case 1:
+				assert.Equal(t, first.Listener.Addr().String(), endpointHost(t, router))
+			default:
+				if multi, ok := router.(*multiRouterClient); assert.True(t, ok, "expected a multiRouterClient, got %T", router) {
+					assert.Len(t, multi.routers, tt.wantRouters)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp"
+)
+
+// RouterDiscovery finds the routers to configure. Every router returned is configured together, such as when there's a
+// double NAT, so implementations that find several candidates for the same router should only return the best one.
+type RouterDiscovery interface {
+	Discover(ctx context.Context) ([]RouterClient, error)
+}
+
+// UPnPDiscovery finds a UPnP router on the local network. If more than one service is found then the best one is used,
+// as decided by PickAllRouterClients.
+type UPnPDiscovery struct {
+	// Interface is the name of the network interface to discover routers on, for example "eth0". If empty then we look
+	// on every interface. If there's no such interface then we log a warning and look on every interface instead.
+	Interface string
+	// Interfaces are the network interfaces to discover routers on, all at the same time. If set then Interface is
+	// ignored, and the best router found on any of them is used, preferring those on earlier interfaces.
+	Interfaces []net.Interface
+	// interfaceSearch returns how to discover devices on one of Interfaces. If nil then interfaceDeviceSearch is used.
+	interfaceSearch func(iface *net.Interface) (deviceSearch, error)
+}
+
+var _ RouterDiscovery = UPnPDiscovery{}
+
+func (d UPnPDiscovery) Discover(ctx context.Context) ([]RouterClient, error) {
+	if len(d.Interfaces) > 0 {
+		searchFor := d.interfaceSearch
+		if searchFor == nil {
+			searchFor = interfaceDeviceSearch
+		}
+		clients, err := pickRouterClientsOnInterfaces(ctx, d.Interfaces, searchFor)
+		if err != nil {
+			return nil, err
+		}
+		return clients[:1], nil
+	}
+
+	search := deviceSearch(goupnp.DiscoverDevices)
+	if d.Interface != "" {
+		iface, err := net.InterfaceByName(d.Interface)
+		if err != nil {
+			discoveryLog.Info("Unable to find network interface, discovering routers on every interface instead",
+				"interface", d.Interface, "error", err.Error())
+		} else if search, err = interfaceDeviceSearch(iface); err != nil {
+			return nil, err
+		}
+	}
+	clients, err := pickAllRouterClients(ctx, search, nil)
+	if err != nil {
+		return nil, err
+	}
+	return clients[:1], nil
+}
+
+// StaticDiscovery uses the routers with the given root device descriptions, rather than looking for them. We need
+// every router to forward ports, so if any of them can't be used then that's an error.
+type StaticDiscovery struct {
+	// URLs are the root device descriptions of the routers, for example "http://192.168.1.1:5000/rootDesc.xml".
+	URLs []string
+}
+
+var _ RouterDiscovery = StaticDiscovery{}
+
+func (d StaticDiscovery) Discover(ctx context.Context) ([]RouterClient, error) {
+	if len(d.URLs) == 0 {
+		return nil, errors.New("no router root device description URLs given")
+	}
+	routers := make([]RouterClient, 0, len(d.URLs))
+	for _, desc := range d.URLs {
+		clients, err := pickRouterClientsByURL(desc)
+		if err != nil {
+			if len(d.URLs) == 1 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("unable to use router at %s: %w", desc, err)
+		}
+		routers = append(routers, clients[0])
+	}
+	return routers, nil
+}
+
+// CachedDiscovery remembers the routers found by another RouterDiscovery, so that they're only looked for again once
+// the TTL has elapsed or the cache is invalidated. Failures aren't remembered.
+type CachedDiscovery struct {
+	discovery RouterDiscovery
+	ttl       time.Duration
+	// now returns the current time. If nil then time.Now is used.
+	now func() time.Time
+
+	mu      sync.Mutex
+	routers []RouterClient
+	expiry  time.Time
+}
+
+var _ RouterDiscovery = &CachedDiscovery{}
+
+// NewCachedDiscovery caches the routers found by discovery for ttl. If ttl is zero then defaultRouterCacheTTL is used.
+func NewCachedDiscovery(discovery RouterDiscovery, ttl time.Duration) *CachedDiscovery {
+	if ttl <= 0 {
+		ttl = defaultRouterCacheTTL
+	}
+	return &CachedDiscovery{discovery: discovery, ttl: ttl}
+}
+
+func (c *CachedDiscovery) Discover(ctx context.Context) ([]RouterClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.currentTime()
+	if c.routers != nil && now.Before(c.expiry) {
+		return c.routers, nil
+	}
+	routers, err := c.discovery.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.routers = routers
+	c.expiry = now.Add(c.ttl)
+	return routers, nil
+}
+
+// Invalidate forgets the cached routers, so that they're looked for again next time.
+func (c *CachedDiscovery) Invalidate() {
+	c.mu.Lock()
+	c.routers = nil
+	c.mu.Unlock()
+}
+
+func (c *CachedDiscovery) currentTime() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+// discoveryFor returns how to find the routers with the given root device descriptions, or to discover one on the
+// given network interface if there aren't any.
+func discoveryFor(iface string, rootDesc []string) RouterDiscovery {
+	var urls []string
+	for _, desc := range rootDesc {
+		if desc != "" {
+			urls = append(urls, desc)
+		}
+	}
+	if len(urls) > 0 {
+		return StaticDiscovery{URLs: urls}
+	}
+	return UPnPDiscovery{Interface: iface}
+}
+
+// discoverRouter uses discovery to find the routers to configure, combining them if there's more than one.
+func discoverRouter(ctx context.Context, discovery RouterDiscovery) (RouterClient, error) {
+	routers, err := discovery.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch len(routers) {
+	case 0:
+		return nil, errors.New("no routers found")
+	case 1:
+		return routers[0], nil
+	default:
+		return &multiRouterClient{routers: routers}, nil
+	}
+}
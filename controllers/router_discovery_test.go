@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// rootDescServer serves a root device description for a router offering a WANIPConnection service of the given type,
+// or no services at all if serviceType is empty.
+func rootDescServer(t *testing.T, serviceType string) *httptest.Server {
+	server := httptest.NewServer(rootDescHandler(serviceType))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// rootDescHandler serves the root device description for rootDescServer at /rootDesc.xml.
+func rootDescHandler(serviceType string) http.Handler {
+	var services string
+	if serviceType != "" {
+		services = fmt.Sprintf(`<serviceList><service>
+			<serviceType>%s</serviceType>
+			<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+			<SCPDURL>/WANIPCn.xml</SCPDURL>
+			<controlURL>/ctl/IPConn</controlURL>
+			<eventSubURL>/evt/IPConn</eventSubURL>
+		</service></serviceList>`, serviceType)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/rootDesc.xml" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<specVersion><major>1</major><minor>0</minor></specVersion>
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+		<friendlyName>Test Router</friendlyName>
+		<UDN>uuid:00000000-0000-0000-0000-000000000001</UDN>
+		%s
+	</device>
+</root>`, services)
+	})
+}
+
+func endpointHost(t *testing.T, router RouterClient) string {
+	igd, ok := router.(*igdRouterClient)
+	if !assert.True(t, ok, "expected a UPnP router client, got %T", router) {
+		return ""
+	}
+	return igd.service.SOAPClient.EndpointURL.Host
+}
+
+func TestStaticDiscoveryUsesEachURL(t *testing.T) {
+	first := rootDescServer(t, internetgateway1.URN_WANIPConnection_1)
+	second := rootDescServer(t, internetgateway1.URN_WANIPConnection_1)
+
+	routers, err := StaticDiscovery{URLs: []string{
+		first.URL + "/rootDesc.xml",
+		second.URL + "/rootDesc.xml",
+	}}.Discover(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, routers, 2) {
+		assert.Equal(t, first.Listener.Addr().String(), endpointHost(t, routers[0]))
+		assert.Equal(t, second.Listener.Addr().String(), endpointHost(t, routers[1]))
+	}
+}
+
+func TestStaticDiscoveryRejectsUnusableRouters(t *testing.T) {
+	good := rootDescServer(t, internetgateway1.URN_WANIPConnection_1)
+	noServices := rootDescServer(t, "")
+
+	_, err := StaticDiscovery{}.Discover(context.Background())
+	assert.Error(t, err)
+
+	_, err = StaticDiscovery{URLs: []string{"://not-a-url"}}.Discover(context.Background())
+	assert.Error(t, err)
+
+	_, err = StaticDiscovery{URLs: []string{noServices.URL + "/rootDesc.xml"}}.Discover(context.Background())
+	assert.EqualError(t, err, "no services found on router at "+noServices.URL+"/rootDesc.xml")
+
+	// Every router is needed, so one that can't be used means none of them are.
+	_, err = StaticDiscovery{URLs: []string{
+		good.URL + "/rootDesc.xml",
+		good.URL + "/missing.xml",
+	}}.Discover(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to use router at "+good.URL+"/missing.xml")
+	}
+}
+
+// countingDiscovery returns routers, or err if set, and counts how many times it was asked.
+type countingDiscovery struct {
+	routers []RouterClient
+	err     error
+	calls   int
+}
+
+func (d *countingDiscovery) Discover(ctx context.Context) ([]RouterClient, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.routers, nil
+}
+
+func TestCachedDiscoveryExpires(t *testing.T) {
+	router := &mockRouterClient{}
+	inner := &countingDiscovery{routers: []RouterClient{router}}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cached := NewCachedDiscovery(inner, time.Minute)
+	cached.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	routers, err := cached.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []RouterClient{router}, routers)
+	assert.Equal(t, 1, inner.calls)
+
+	// Until the TTL is up, we don't look again.
+	now = now.Add(59 * time.Second)
+	routers, err = cached.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []RouterClient{router}, routers)
+	assert.Equal(t, 1, inner.calls)
+
+	// Then we do, and the new result is cached in turn.
+	now = now.Add(time.Second)
+	_, err = cached.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inner.calls)
+	_, err = cached.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inner.calls)
+
+	// Invalidating it means we look again straight away.
+	cached.Invalidate()
+	_, err = cached.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, inner.calls)
+}
+
+func TestCachedDiscoveryDoesNotCacheFailures(t *testing.T) {
+	inner := &countingDiscovery{err: errors.New("No services found")}
+	cached := NewCachedDiscovery(inner, time.Minute)
+	ctx := context.Background()
+
+	_, err := cached.Discover(ctx)
+	assert.EqualError(t, err, "No services found")
+
+	router := &mockRouterClient{}
+	inner.err = nil
+	inner.routers = []RouterClient{router}
+	routers, err := cached.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []RouterClient{router}, routers)
+	assert.Equal(t, 2, inner.calls)
+}
+
+func TestReconcileUsesRouterDiscovery(t *testing.T) {
+	first, second := &mockRouterClient{}, &mockRouterClient{}
+	discovery := &countingDiscovery{routers: []RouterClient{first, second}}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterRootDesc("http://192.168.1.1:5000/rootDesc.xml"),
+		WithRouterDiscovery(discovery),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, discovery.calls)
+	// Every router that was found has the port forwarded.
+	assert.Len(t, first.addCalls, 1)
+	assert.Len(t, second.addCalls, 1)
+}
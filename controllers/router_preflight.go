@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+const (
+	// preflightPort is the external and internal port of the port mapping VerifyRouterPortMapping makes. It's near the
+	// top of the ephemeral range, so is unlikely to be one that anything else wants.
+	preflightPort = 65534
+	// preflightLeaseDuration is the lease, in seconds, of that port mapping, so that the router removes it by itself if
+	// we don't get the chance to.
+	preflightLeaseDuration = 60
+	// preflightDescription is the description of that port mapping.
+	preflightDescription = "Holepunch connectivity check"
+)
+
+// VerifyRouterConnectivity checks that we can talk to router, by asking it for its external IP address and connection
+// type. Every router should answer both, so an error means that it isn't going to forward any ports for us.
+func VerifyRouterConnectivity(ctx context.Context, router RouterClient) error {
+	client := asContextual(router)
+	if _, err := client.GetExternalIPAddressCtx(ctx); err != nil {
+		return fmt.Errorf("unable to get router's external IP address: %w", err)
+	}
+	if _, _, err := client.GetConnectionTypeInfoCtx(ctx); err != nil {
+		return fmt.Errorf("unable to get router's connection type: %w", err)
+	}
+	return nil
+}
+
+// VerifyRouterPortMapping checks that router will actually forward ports, which some routers only allow if UPnP has
+// been turned on in their settings even though they answer other requests. A TCP port mapping from preflightPort to
+// the same port on internalClient is made with a short lease, then removed straight away.
+func VerifyRouterPortMapping(ctx context.Context, router RouterClient, internalClient string) error {
+	client := asContextual(router)
+	err := client.AddPortMappingCtx(ctx, "", preflightPort, "TCP", preflightPort, internalClient, true,
+		preflightDescription, preflightLeaseDuration)
+	if err != nil {
+		return fmt.Errorf("unable to add test port mapping for port %d: %w", preflightPort, err)
+	}
+	if err := client.DeletePortMappingCtx(ctx, "", preflightPort, "TCP"); err != nil {
+		return fmt.Errorf("unable to remove test port mapping for port %d: %w", preflightPort, err)
+	}
+	return nil
+}
+
+// VerifyRouter finds the router and checks that we can talk to it with VerifyRouterConnectivity, so that a controller
+// that isn't going to be able to forward any ports finds out before it starts watching services. If testPortMapping is
+// set then VerifyRouterPortMapping is used to check that it will forward ports too, to our own IP address. In dry-run
+// mode the test port mapping is only logged.
+func (r *ServiceReconciler) VerifyRouter(ctx context.Context, testPortMapping bool) error {
+	router, err := r.getRouterClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to find router: %w", err)
+	}
+	if err := VerifyRouterConnectivity(ctx, router); err != nil {
+		return err
+	}
+	if !testPortMapping {
+		return nil
+	}
+	localIP := r.localIP
+	if localIP == nil {
+		localIP = defaultLocalIP
+	}
+	internalClient, err := localIP()
+	if err != nil {
+		return fmt.Errorf("unable to find our own IP address to test a port mapping with: %w", err)
+	}
+	return VerifyRouterPortMapping(ctx, r.withDryRun(r.Log.WithName("preflight"), router), internalClient)
+}
+
+// defaultLocalIP returns our IP address on the network that the default gateway is on, which is usually the router.
+func defaultLocalIP() (string, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return "", err
+	}
+	// Nothing is sent when "dialing" UDP, but it does pick which of our addresses would be used.
+	conn, err := net.Dial("udp", net.JoinHostPort(gateway.String(), "1900"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
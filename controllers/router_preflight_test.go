@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestVerifyRouterConnectivity(t *testing.T) {
+	assert.NoError(t, VerifyRouterConnectivity(context.Background(), &mockRouterClient{}))
+
+	err := VerifyRouterConnectivity(context.Background(), &mockRouterClient{externalIPErr: upnpFault(501)})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "external IP address")
+
+	err = VerifyRouterConnectivity(context.Background(), &mockRouterClient{connectionTypeErr: upnpFault(401)})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "connection type")
+}
+
+func TestVerifyRouterPortMapping(t *testing.T) {
+	router := &mockRouterClient{}
+	assert.NoError(t, VerifyRouterPortMapping(context.Background(), router, "192.168.1.5"))
+	if assert.Len(t, router.addCalls, 1) {
+		call := router.addCalls[0]
+		assert.Equal(t, uint16(preflightPort), call.ExternalPort)
+		assert.Equal(t, "192.168.1.5", call.InternalClient)
+		assert.Equal(t, uint32(preflightLeaseDuration), call.LeaseDuration)
+	}
+	assert.Equal(t, []portMappingCall{{ExternalPort: preflightPort, Protocol: "TCP"}}, router.deleteCalls)
+
+	// A router that won't forward ports fails, and there's nothing to remove.
+	router = &mockRouterClient{addErr: upnpFault(606)}
+	assert.Error(t, VerifyRouterPortMapping(context.Background(), router, "192.168.1.5"))
+	assert.Empty(t, router.deleteCalls)
+}
+
+func TestVerifyRouter(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}), WithRouterClients(router))
+	r.localIP = func() (string, error) { return "192.168.1.5", nil }
+	assert.NoError(t, r.VerifyRouter(context.Background(), false))
+	assert.Empty(t, router.addCalls)
+
+	assert.NoError(t, r.VerifyRouter(context.Background(), true))
+	assert.Len(t, router.addCalls, 1)
+	assert.Len(t, router.deleteCalls, 1)
+
+	// Dry runs don't touch the router.
+	r = NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}), WithRouterClients(router), WithDryRun(true))
+	r.localIP = func() (string, error) { return "192.168.1.5", nil }
+	assert.NoError(t, r.VerifyRouter(context.Background(), true))
+	assert.Len(t, router.addCalls, 1)
+
+	r.localIP = func() (string, error) { return "", errors.New("no default gateway") }
+	assert.Error(t, r.VerifyRouter(context.Background(), true))
+}
+
+func TestVerifyRouterNotFound(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, WithLogger(logf.NullLogger{}),
+		WithRouterClientFactory(func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+			return nil, errors.New("no routers found")
+		}))
+	err := r.VerifyRouter(context.Background(), false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to find router")
+}
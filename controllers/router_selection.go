@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/huin/goupnp"
+)
+
+// RouterSelectionStrategy decides which of the router services we found to configure.
+type RouterSelectionStrategy interface {
+	// Select picks a router from clients, which are keyed by the name of the service they're for (one of the
+	// RouterService constants), in the order they were found. Every key has at least one client.
+	Select(clients map[string][]RouterClient) (RouterClient, error)
+}
+
+// FriendlyNamer is implemented by RouterClients for routers that say what they're called, such as the UPnP routers we
+// discover. It isn't part of RouterClient, as NAT-PMP routers have no such name.
+type FriendlyNamer interface {
+	// FriendlyName is the name the router gives itself, usually its make and model.
+	FriendlyName() string
+}
+
+var _ FriendlyNamer = &igdRouterClient{}
+
+// SelectRouterClient finds a router to configure in the same way as PickRouterClient, but uses strategy to choose
+// between the services found. If strategy is nil then FirstAvailableStrategy is used, which makes it the same as
+// PickRouterClient for a single router.
+func SelectRouterClient(ctx context.Context, strategy RouterSelectionStrategy, rootDesc ...string) (RouterClient, error) {
+	return selectRouterClient(ctx, goupnp.DiscoverDevices, strategy, rootDesc)
+}
+
+// selectRouterClient implements SelectRouterClient, using search to discover routers if we need to.
+func selectRouterClient(
+	ctx context.Context,
+	search deviceSearch,
+	strategy RouterSelectionStrategy,
+	rootDesc []string,
+) (RouterClient, error) {
+	if strategy == nil {
+		strategy = FirstAvailableStrategy{}
+	}
+	services, err := discoverRouterServices(ctx, search, rootDesc)
+	if err != nil {
+		return nil, err
+	}
+	return strategy.Select(groupRouterServices(services))
+}
+
+// groupRouterServices keys the clients for each service by the service's name, leaving out any that were found twice
+// in the same way as flattenRouterServices.
+func groupRouterServices(services []routerServices) map[string][]RouterClient {
+	grouped := make(map[string][]RouterClient)
+	seen := make(map[string]bool)
+	for _, found := range services {
+		for _, c := range found.clients {
+			key := c.endpoint.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			grouped[found.name] = append(grouped[found.name], c.client)
+		}
+	}
+	return grouped
+}
+
+// routerServicePreference is our order of preference for the services we discover, which is the same as the order in
+// which upnpDiscoverers are listed.
+var routerServicePreference = []string{
+	RouterServiceIGD2WANIPConnection2,
+	RouterServiceIGD2WANIPConnection1,
+	RouterServiceIGD2WANPPPConnection1,
+	RouterServiceIGD1WANIPConnection1,
+	RouterServiceIGD1WANPPPConnection1,
+}
+
+// serviceNames returns the names of the services in clients in our order of preference, followed by any we don't know
+// about in alphabetical order.
+func serviceNames(clients map[string][]RouterClient) []string {
+	var names, unknown []string
+	known := make(map[string]bool, len(routerServicePreference))
+	for _, name := range routerServicePreference {
+		known[name] = true
+		if len(clients[name]) > 0 {
+			names = append(names, name)
+		}
+	}
+	for name, found := range clients {
+		if !known[name] && len(found) > 0 {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return append(names, unknown...)
+}
+
+// orderedClients returns every client in clients, with the services in the order given by names.
+func orderedClients(clients map[string][]RouterClient, names []string) []RouterClient {
+	var ordered []RouterClient
+	for _, name := range names {
+		ordered = append(ordered, clients[name]...)
+	}
+	return ordered
+}
+
+// FirstAvailableStrategy picks the first client for the service we prefer most, which is what PickRouterClient does.
+type FirstAvailableStrategy struct{}
+
+func (FirstAvailableStrategy) Select(clients map[string][]RouterClient) (RouterClient, error) {
+	ordered := orderedClients(clients, serviceNames(clients))
+	if len(ordered) == 0 {
+		return nil, errors.New("no routers found")
+	}
+	return ordered[0], nil
+}
+
+// HighestVersionStrategy picks the first client for the newest service, going by the version of the Internet Gateway
+// Device spec and then the version of the service, as given in the service's name. Services with the same versions are
+// picked between in our usual order of preference. For the services we discover this is the same as
+// FirstAvailableStrategy, but it also ranks services that we don't know about.
+type HighestVersionStrategy struct{}
+
+func (HighestVersionStrategy) Select(clients map[string][]RouterClient) (RouterClient, error) {
+	names := serviceNames(clients)
+	sort.SliceStable(names, func(i, j int) bool {
+		igdI, serviceI := serviceVersions(names[i])
+		igdJ, serviceJ := serviceVersions(names[j])
+		if igdI != igdJ {
+			return igdI > igdJ
+		}
+		return serviceI > serviceJ
+	})
+	ordered := orderedClients(clients, names)
+	if len(ordered) == 0 {
+		return nil, errors.New("no routers found")
+	}
+	return ordered[0], nil
+}
+
+// serviceVersions parses the Internet Gateway Device spec version and the service version out of a service name such
+// as "IGD2 WANIPConnection1". Either is zero if it can't be parsed.
+func serviceVersions(name string) (igd, service int) {
+	parts := strings.Fields(name)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+	_, _ = fmt.Sscanf(parts[0], "IGD%d", &igd)
+	if last := parts[1][len(parts[1])-1]; last >= '0' && last <= '9' {
+		service = int(last - '0')
+	}
+	return igd, service
+}
+
+// ByFriendlyNameStrategy picks the first client, in our usual order of preference, for a router that calls itself name
+// (ignoring case). This is for when there's more than one router on the network, and we need to use a particular one.
+// Routers that don't implement FriendlyNamer are never picked.
+func ByFriendlyNameStrategy(name string) RouterSelectionStrategy {
+	return byFriendlyNameStrategy{name: name}
+}
+
+type byFriendlyNameStrategy struct {
+	name string
+}
+
+func (s byFriendlyNameStrategy) Select(clients map[string][]RouterClient) (RouterClient, error) {
+	var found []string
+	for _, client := range orderedClients(clients, serviceNames(clients)) {
+		namer, ok := client.(FriendlyNamer)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(namer.FriendlyName(), s.name) {
+			return client, nil
+		}
+		found = append(found, fmt.Sprintf("%q", namer.FriendlyName()))
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no router named %q found", s.name)
+	}
+	return nil, fmt.Errorf("no router named %q found, only %s", s.name, strings.Join(found, ", "))
+}
+
+// AllAvailableStrategy picks every client, so that they're all configured together. This is for networks with more
+// than one router that each need the same ports forwarding, such as a double NAT.
+type AllAvailableStrategy struct{}
+
+func (AllAvailableStrategy) Select(clients map[string][]RouterClient) (RouterClient, error) {
+	ordered := orderedClients(clients, serviceNames(clients))
+	switch len(ordered) {
+	case 0:
+		return nil, errors.New("no routers found")
+	case 1:
+		return ordered[0], nil
+	default:
+		return &multiRouterClient{routers: ordered}, nil
+	}
+}
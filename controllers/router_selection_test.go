@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// namedRouterClient is a mock router that says what it's called.
+type namedRouterClient struct {
+	*mockRouterClient
+	name string
+}
+
+func (n *namedRouterClient) FriendlyName() string {
+	return n.name
+}
+
+func newNamedRouterClient(name string) *namedRouterClient {
+	return &namedRouterClient{mockRouterClient: &mockRouterClient{}, name: name}
+}
+
+func TestSelectRouterClient(t *testing.T) {
+	igd1 := newNamedRouterClient("Old Router")
+	igd2PPP := newNamedRouterClient("New Router")
+	igd2IP := newNamedRouterClient("New Router")
+	withUPnPDiscoverers(t,
+		discovers(RouterServiceIGD1WANIPConnection1, nil, discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/ip1"}, igd1}),
+		discovers(RouterServiceIGD2WANPPPConnection1, errors.New("timed out")),
+		discovers(RouterServiceIGD2WANIPConnection1, nil,
+			discoveredClient{url.URL{Host: "192.168.1.2:5000", Path: "/ppp1"}, igd2PPP},
+			// The same service found twice is only used once.
+			discoveredClient{url.URL{Host: "192.168.1.1:5000", Path: "/ip1"}, igd1},
+		),
+		discovers(RouterServiceIGD2WANIPConnection2, nil, discoveredClient{url.URL{Host: "192.168.1.2:5000", Path: "/ip2"}, igd2IP}),
+	)
+	ctx := context.Background()
+
+	t.Run("first available", func(t *testing.T) {
+		router, err := SelectRouterClient(ctx, FirstAvailableStrategy{})
+		assert.NoError(t, err)
+		assert.Same(t, igd2IP, router)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		router, err := SelectRouterClient(ctx, nil)
+		assert.NoError(t, err)
+		assert.Same(t, igd2IP, router)
+	})
+
+	t.Run("highest version", func(t *testing.T) {
+		router, err := SelectRouterClient(ctx, HighestVersionStrategy{})
+		assert.NoError(t, err)
+		assert.Same(t, igd2IP, router)
+	})
+
+	t.Run("by friendly name", func(t *testing.T) {
+		router, err := SelectRouterClient(ctx, ByFriendlyNameStrategy("old router"))
+		assert.NoError(t, err)
+		assert.Same(t, igd1, router)
+
+		_, err = SelectRouterClient(ctx, ByFriendlyNameStrategy("Missing Router"))
+		assert.EqualError(t, err,
+			`no router named "Missing Router" found, only "New Router", "New Router", "Old Router"`)
+	})
+
+	t.Run("all available", func(t *testing.T) {
+		router, err := SelectRouterClient(ctx, AllAvailableStrategy{})
+		assert.NoError(t, err)
+		assert.Equal(t, &multiRouterClient{routers: []RouterClient{igd2IP, igd2PPP, igd1}}, router)
+	})
+}
+
+func TestSelectRouterClientNothingFound(t *testing.T) {
+	withUPnPDiscoverers(t, discovers(RouterServiceIGD2WANIPConnection2, nil))
+
+	_, err := SelectRouterClient(context.Background(), AllAvailableStrategy{})
+	assert.EqualError(t, err, "No services found")
+}
+
+func TestHighestVersionStrategyRanksUnknownServices(t *testing.T) {
+	igd1, igd3 := &mockRouterClient{}, &mockRouterClient{}
+	clients := map[string][]RouterClient{
+		RouterServiceIGD1WANPPPConnection1: {igd1},
+		"IGD3 WANIPConnection1":            {igd3},
+	}
+
+	router, err := HighestVersionStrategy{}.Select(clients)
+	assert.NoError(t, err)
+	assert.Same(t, igd3, router)
+	// The services we know about always come first otherwise.
+	router, err = FirstAvailableStrategy{}.Select(clients)
+	assert.NoError(t, err)
+	assert.Same(t, igd1, router)
+}
+
+func TestByFriendlyNameStrategySkipsUnnamedRouters(t *testing.T) {
+	_, err := ByFriendlyNameStrategy("Router").Select(map[string][]RouterClient{
+		RouterServiceIGD2WANIPConnection2: {&mockRouterClient{}},
+	})
+	assert.EqualError(t, err, `no router named "Router" found`)
+}
+
+func TestAllAvailableStrategySingleRouter(t *testing.T) {
+	router := &mockRouterClient{}
+	selected, err := AllAvailableStrategy{}.Select(map[string][]RouterClient{RouterServiceIGD1WANIPConnection1: {router}})
+	assert.NoError(t, err)
+	assert.Same(t, router, selected)
+}
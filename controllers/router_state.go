@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RouterState is where the router every service uses is in its lifecycle, as far as we can tell.
+type RouterState string
+
+const (
+	// RouterUndiscovered means we haven't looked for the router yet.
+	RouterUndiscovered RouterState = "Undiscovered"
+	// RouterDiscovering means we're looking for the router.
+	RouterDiscovering RouterState = "Discovering"
+	// RouterConnected means we've found the router, but haven't forwarded any ports on it yet.
+	RouterConnected RouterState = "Connected"
+	// RouterMapping means we're forwarding a service's ports on the router.
+	RouterMapping RouterState = "Mapping"
+	// RouterHealthy means the router answered the last time we forwarded ports on it.
+	RouterHealthy RouterState = "Healthy"
+	// RouterDegraded means the router hasn't answered recently, but not for long enough to give up on it.
+	RouterDegraded RouterState = "Degraded"
+	// RouterLost means we can't find the router, or it has stopped answering altogether.
+	RouterLost RouterState = "Lost"
+)
+
+const (
+	// routerLostAfterFailures is how many times in a row the router can fail to answer before it counts as lost.
+	routerLostAfterFailures = 3
+	// unhealthyRouterBackoffFactor is how much longer to wait before retrying a service while the router is degraded
+	// or lost, so that we don't keep hammering (and logging about) a router that isn't there.
+	unhealthyRouterBackoffFactor = 4
+)
+
+// routerStateMachine tracks the RouterState of the router every service uses. Reconciles may run at the same time, so
+// every transition happens under a lock. Events are only emitted when the router's health changes (it's degraded,
+// lost, or connected again after either), rather than on every transition, so that a router that keeps failing
+// doesn't flood the services with events.
+type routerStateMachine struct {
+	mu    sync.Mutex
+	state RouterState
+	// since is when we entered the current state.
+	since time.Time
+	// failures is how many times in a row the router has failed to answer.
+	failures int
+	// reported is the unhealthy state (RouterDegraded or RouterLost) that we last emitted an event about, or empty if
+	// we've since emitted one to say the router is back.
+	reported RouterState
+	// now returns the current time. If nil then time.Now is used.
+	now func() time.Time
+}
+
+// routerEvent is an event to emit about a change in the router's health.
+type routerEvent struct {
+	eventType string
+	reason    string
+	message   string
+}
+
+// current returns the router's state, and when it entered that state.
+func (m *routerStateMachine) current() (RouterState, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == "" {
+		return RouterUndiscovered, time.Time{}
+	}
+	return m.state, m.since
+}
+
+// unhealthy returns whether the router is degraded or lost.
+func (m *routerStateMachine) unhealthy() bool {
+	state, _ := m.current()
+	return state == RouterDegraded || state == RouterLost
+}
+
+// discovering records that we've started looking for the router. Routers are looked for again every so often even
+// while they're working, which doesn't change their state.
+func (m *routerStateMachine) discovering() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == "" || m.state == RouterUndiscovered || m.state == RouterLost {
+		m.enterLocked(RouterDiscovering)
+	}
+}
+
+// found records whether we managed to get hold of the router.
+func (m *routerStateMachine) found(err error) *routerEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failures++
+		return m.failLocked(RouterLost, err)
+	}
+	// If we'd lost the router, it has yet to answer us, so we don't say that it's back until it does.
+	switch m.state {
+	case "", RouterUndiscovered, RouterDiscovering, RouterLost:
+		m.enterLocked(RouterConnected)
+	}
+	return nil
+}
+
+// mapping records that we've started forwarding ports on the router.
+func (m *routerStateMachine) mapping() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enterLocked(RouterMapping)
+}
+
+// mapped records how forwarding ports on the router went. Errors that the router itself gave us mean it's working,
+// even though it wouldn't do what we asked.
+func (m *routerStateMachine) mapped(err error) *routerEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil && !routerUnreachable(err) {
+		err = nil
+	}
+	if err == nil {
+		m.failures = 0
+		m.enterLocked(RouterHealthy)
+		if m.reported != "" {
+			m.reported = ""
+			return &routerEvent{corev1.EventTypeNormal, "RouterConnected", "Router is answering again"}
+		}
+		return nil
+	}
+	m.failures++
+	if m.failures >= routerLostAfterFailures {
+		return m.failLocked(RouterLost, err)
+	}
+	return m.failLocked(RouterDegraded, err)
+}
+
+// failLocked moves to an unhealthy state, returning an event about it unless we've already said so. m.mu must be held.
+func (m *routerStateMachine) failLocked(state RouterState, err error) *routerEvent {
+	m.enterLocked(state)
+	if m.reported == state {
+		return nil
+	}
+	m.reported = state
+	if state == RouterLost {
+		return &routerEvent{corev1.EventTypeWarning, "RouterLost", "Lost contact with router: " + err.Error()}
+	}
+	return &routerEvent{corev1.EventTypeWarning, "RouterDegraded", "Router is not answering reliably: " + err.Error()}
+}
+
+// enterLocked moves to a state, recording when. m.mu must be held.
+func (m *routerStateMachine) enterLocked(state RouterState) {
+	if m.state == state {
+		return
+	}
+	now := time.Now
+	if m.now != nil {
+		now = m.now
+	}
+	m.state = state
+	m.since = now()
+}
+
+// routerUnreachable returns whether an error means that we couldn't talk to the router, rather than the router telling
+// us no. Timeouts and network errors count, but UPnP errors and our own checks don't.
+func routerUnreachable(err error) bool {
+	if _, ok := parseUPnPError(err); ok {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// RouterState returns the state of the router every service uses, and when it entered that state.
+func (r *ServiceReconciler) RouterState() (RouterState, time.Time) {
+	return r.routerState.current()
+}
+
+// recordRouterEvent emits an event on the service about a change in the router's health, if there is one.
+func (r *ServiceReconciler) recordRouterEvent(service *corev1.Service, event *routerEvent) {
+	if event == nil {
+		return
+	}
+	r.Recorder.Event(service, event.eventType, event.reason, event.message)
+}
+
+// unhealthyRouterDelay stretches the delay before retrying a service while the router is degraded or lost, up to
+// defaultRetryMaxDelay. Delays that are already longer are left alone.
+func unhealthyRouterDelay(delay time.Duration) time.Duration {
+	longer := delay * unhealthyRouterBackoffFactor
+	if longer > defaultRetryMaxDelay {
+		longer = defaultRetryMaxDelay
+	}
+	if longer < delay {
+		return delay
+	}
+	return longer
+}
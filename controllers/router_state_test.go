@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// errRouterUnreachable is what we get when the router doesn't answer at all.
+var errRouterUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// drainEvents returns the events that have been recorded so far.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestRouterStateTransitions(t *testing.T) {
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(20)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+	clock := newFakeClock()
+	r.routerState.now = clock.now
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	state, _ := r.RouterState()
+	assert.Equal(t, RouterUndiscovered, state)
+
+	// The router alternates between answering and not. It doesn't count as lost until it's failed a few times in a
+	// row, and we only hear about it when its health changes.
+	for i, step := range []struct {
+		err    error
+		state  RouterState
+		events []string
+	}{
+		{nil, RouterHealthy, nil},
+		{errRouterUnreachable, RouterDegraded, []string{"Warning RouterDegraded Router is not answering reliably: dial tcp: connection refused"}},
+		{nil, RouterHealthy, []string{"Normal RouterConnected Router is answering again"}},
+		{errRouterUnreachable, RouterDegraded, []string{"Warning RouterDegraded Router is not answering reliably: dial tcp: connection refused"}},
+		{errRouterUnreachable, RouterDegraded, nil},
+		{errRouterUnreachable, RouterLost, []string{"Warning RouterLost Lost contact with router: dial tcp: connection refused"}},
+		{errRouterUnreachable, RouterLost, nil},
+		{nil, RouterHealthy, []string{"Normal RouterConnected Router is answering again"}},
+	} {
+		clock.t = clock.t.Add(time.Minute)
+		router.addErr = step.err
+		_, _ = r.reconcileRequest(req, true)
+		state, since := r.RouterState()
+		assert.Equal(t, step.state, state, "step %d", i)
+		assert.Equal(t, step.events, drainEvents(recorder), "step %d", i)
+		if i == 0 {
+			assert.Equal(t, clock.now(), since)
+		}
+	}
+}
+
+func TestRouterStateIgnoresRouterRefusals(t *testing.T) {
+	router := &mockRouterClient{addErr: upnpFault(ErrCodeConflictInMappingEntry)}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+
+	// The router answered, even if it wouldn't do what we asked.
+	_, _ = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	state, _ := r.RouterState()
+	assert.Equal(t, RouterHealthy, state)
+}
+
+func TestRouterStateLostWhenNotFound(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithHolepunchMode(HolepunchModeUPnP),
+		WithRouterClientFactory(func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+			return nil, errors.New("no UPnP routers found")
+		}),
+	)
+
+	_, _ = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	state, _ := r.RouterState()
+	assert.Equal(t, RouterLost, state)
+	assert.Contains(t, drainEvents(recorder), "Warning RouterLost Lost contact with router: no UPnP routers found")
+}
+
+func TestUnhealthyRouterBacksOffMore(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	newReconciler := func(err error) *ServiceReconciler {
+		r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+			WithLogger(logf.NullLogger{}),
+			WithEventRecorder(record.NewFakeRecorder(10)),
+			WithRouterClients(&mockRouterClient{addErr: err}),
+		)
+		r.RateLimiter = workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Hour)
+		return r
+	}
+
+	result, err := newReconciler(errors.New("something went wrong")).Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, result.RequeueAfter)
+
+	result, err = newReconciler(errRouterUnreachable).Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, unhealthyRouterBackoffFactor*time.Second, result.RequeueAfter)
+
+	assert.Equal(t, defaultRetryMaxDelay, unhealthyRouterDelay(defaultRetryMaxDelay/2))
+	assert.Equal(t, time.Hour, unhealthyRouterDelay(time.Hour))
+}
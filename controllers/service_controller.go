@@ -2,153 +2,1558 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/huin/goupnp/dcps/internetgateway2"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
 )
 
-const (
-	holepunchAnnotationName          = "holepunch/punch-external"
-	holepunchPortMapAnnotationPrefix = "holepunch.port/"
-	leaseDurationSeconds             = 3600
-)
+const (
+	holepunchAnnotationName            = "holepunch/punch-external"
+	holepunchPortMapAnnotationPrefix   = "holepunch.port/"
+	leaseDurationAnnotationName        = "holepunch/lease-duration"
+	reconcileIntervalAnnotationName    = "holepunch.io/reconcile-interval"
+	activeMappingsAnnotationName       = "holepunch.io/active-mappings"
+	externalIPAnnotationName           = "holepunch.io/external-ip"
+	skipPortsAnnotationName            = "holepunch.io/skip-ports"
+	remoteHostAnnotationName           = "holepunch.io/remote-host"
+	descriptionAnnotationName          = "holepunch.io/description"
+	descriptionTemplateAnnotationName  = "holepunch.io/description-template"
+	lastReconcileAnnotationName        = "holepunch.io/last-reconcile"
+	lastStatusAnnotationName           = "holepunch.io/last-status"
+	activePinholesAnnotationName       = "holepunch.io/active-pinholes"
+	routerURLAnnotationName            = "holepunch.io/router-url"
+	assignedPortsAnnotationName        = "holepunch.io/assigned-ports"
+	useClusterIPAnnotationName         = "holepunch.io/use-cluster-ip"
+	useNodeIPAnnotationName            = "holepunch.io/use-node-ip"
+	ingressIndexAnnotationName         = "holepunch.io/ingress-index"
+	descriptionPrefixAnnotationName    = "holepunch.io/description-prefix"
+	portMappingsAnnotationName         = "holepunch.io/port-mappings"
+	routerConnectionTypeAnnotationName = "holepunch.io/router-connection-type"
+	portEnabledAnnotationPrefix        = "holepunch.port.enabled/"
+	portLeaseAnnotationPrefix          = "holepunch.port.lease/"
+	portMappingCleanupFinalizer        = "holepunch.io/port-mapping-cleanup"
+	leaseDurationSeconds               = 3600
+	leaseRenewalSlackSeconds           = 10
+	maxPortRangeLength                 = 256
+	maxDescriptionLength               = 128
+	minLeaseDuration                   = 60 * time.Second
+	maxLeaseDuration                   = 24 * time.Hour
+	defaultMaxCleanupAttempts          = 5
+	defaultRouterCacheTTL              = 5 * time.Minute
+	defaultExternalIPCacheTTL          = 5 * time.Minute
+	defaultDNSTimeout                  = 5 * time.Second
+	defaultMaxConcurrentMappings       = 5
+	defaultUPnPCallTimeout             = 30 * time.Second
+	defaultUPnPRateLimit               = rate.Limit(10)
+	defaultUPnPRateBurst               = 5
+)
+
+// ServiceReconciler reconciles a Service object
+type ServiceReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// MaxCleanupAttempts is how many times we'll try to remove the port mappings for a deleted service before giving
+	// up and letting the deletion go ahead anyway. The mappings will then only go away when their lease expires. If
+	// zero then defaultMaxCleanupAttempts is used.
+	MaxCleanupAttempts int
+
+	// LeaseDuration is how long port mapping leases last for, unless a service asks for something else with the lease
+	// duration annotation. If zero then leaseDurationSeconds is used.
+	LeaseDuration time.Duration
+
+	// ClusterName names the cluster, for description templates to tell apart port mappings from several clusters
+	// sharing a router. It's empty if not set.
+	ClusterName string
+
+	// DescriptionPrefix is put at the start of the description of every port mapping we make, unless a service asks for
+	// something else with the description-prefix annotation. Mappings whose description doesn't start with it belong to
+	// other software, so are never changed or removed. If empty then any mapping on a port we forwarded can be.
+	DescriptionPrefix string
+
+	// RouterRootDesc are the URLs of the root device descriptions of the routers to configure, for example
+	// "http://192.168.1.1:5000/rootDesc.xml". If there's more than one, such as with a double NAT, then every router is
+	// configured. If empty then we discover a router on the local network instead.
+	RouterRootDesc []string
+
+	// RouterClients are the routers to configure, if they've already been found (e.g., with PickAllRouterClients). If
+	// there's more than one then every router is configured. If empty then we find a router ourselves, using
+	// RouterRootDesc and HolepunchMode.
+	RouterClients []RouterClient
+
+	// RouterClientFactory finds a UPnP router, given the root device description to use (if any). This is only used
+	// when RouterClients is empty, and we don't have a router cached. If nil then RouterDiscovery is used.
+	RouterClientFactory func(ctx context.Context, rootDesc ...string) (RouterClient, error)
+
+	// RouterDiscovery finds the UPnP routers to configure. This is only used when RouterClients is empty,
+	// RouterClientFactory is nil, and we don't have a router cached. If nil then a StaticDiscovery of RouterRootDesc is
+	// used, or a UPnPDiscovery on UPnPInterface if that's empty. If set then RouterRootDesc and UPnPInterface are
+	// ignored.
+	RouterDiscovery RouterDiscovery
+
+	// IPv6RouterClientFactory finds a router whose IPv6 firewall we can open pinholes in for services with an IPv6
+	// address, given the root device description to use (if any). If nil then PickIPv6RouterClient is used.
+	IPv6RouterClientFactory func(ctx context.Context, rootDesc ...string) (IPv6RouterClient, error)
+
+	// PortMappingAnnotationFormat is which style of port mapping annotation is read from services. If empty then
+	// PortMappingAnnotationFormatAuto is used.
+	PortMappingAnnotationFormat PortMappingAnnotationFormat
+
+	// HolepunchMode controls which protocols we use to find and configure a router. If empty then HolepunchModeAuto is
+	// used.
+	HolepunchMode HolepunchMode
+
+	// RouterCacheTTL is how long we'll keep using a router we've found before discovering it again. If zero then
+	// defaultRouterCacheTTL is used.
+	RouterCacheTTL time.Duration
+
+	// MappingCacheRefreshInterval is how long we'll use a copy of the router's port mapping table to check for
+	// existing mappings, before reading it again. If zero then we ask the router about each mapping instead.
+	MappingCacheRefreshInterval time.Duration
+
+	// ExternalIPCacheTTL is how long we'll remember the router's external IP before asking it again. If zero then
+	// defaultExternalIPCacheTTL is used.
+	ExternalIPCacheTTL time.Duration
+
+	// ServiceIPSelector chooses which of a LoadBalancer's IPs to forward ports to, if it has more than one. If nil then
+	// PreferIPv4Selector is used.
+	ServiceIPSelector ServiceIPSelector
+
+	// IPVersionPreference controls whether ports are forwarded to a LoadBalancer's IPv4 address, opened up on its IPv6
+	// address, or both. If empty then IPVersionDualStack is used.
+	IPVersionPreference IPVersionPreference
+
+	// DNSTimeout bounds how long we'll wait to resolve the hostname of a LoadBalancer that has been given one instead
+	// of an IP. If zero then defaultDNSTimeout is used.
+	DNSTimeout time.Duration
+
+	// MaxConcurrentMappings is how many port mappings for a single service we'll ask the router for at once. If zero
+	// then defaultMaxConcurrentMappings is used.
+	MaxConcurrentMappings int
+
+	// UPnPCallTimeout is how long we'll wait for the router to answer a single request before giving up on it. If zero
+	// then defaultUPnPCallTimeout is used.
+	UPnPCallTimeout time.Duration
+
+	// RouterCallAttempts is how many times we'll try a call to the router that fails with what could be a network
+	// problem, with RouterCallBackoff between the first two attempts and twice as long between each after that. All of
+	// the attempts happen within UPnPCallTimeout. If less than two, calls aren't retried.
+	RouterCallAttempts int
+	RouterCallBackoff  time.Duration
+
+	// LogRouterCalls logs every call made to the router, and its response, at V(2).
+	LogRouterCalls bool
+
+	// VerboseErrors adds everything the router said about why it rejected a request to the errors we log, and logs
+	// the whole of every failed SOAP request, and the router's response, at V(1).
+	VerboseErrors bool
+
+	// UPnPInterface is the name of the network interface to discover UPnP routers on, for example "eth0". If empty
+	// then we look on every interface. This isn't used if RouterRootDesc, RouterClientFactory or RouterDiscovery are
+	// set.
+	UPnPInterface string
+
+	// Metrics records metrics about what we're doing to the router. If nil then no metrics are recorded.
+	Metrics MetricsRecorder
+
+	// TracerProvider records a trace of each reconcile, with spans for the calls to the router. If nil then the global
+	// TracerProvider is used, which doesn't record anything unless one has been registered with otel.
+	TracerProvider trace.TracerProvider
+
+	// DryRun stops us from making any changes to the router. Instead the port mappings we would add or remove are
+	// logged. Everything else about the service is still worked out as normal, so that any problems with it show up.
+	DryRun bool
+
+	// CleanupOnShutdown asks for the port mappings of every service to be removed when holepunch stops, with Cleanup,
+	// rather than leaving them until their leases expire.
+	CleanupOnShutdown bool
+
+	// MappingStore, if set, is where the port mappings for each service are saved after they're forwarded, so that
+	// they're still known about after holepunch restarts.
+	MappingStore   MappingStore
+	driftCheckOnce sync.Once
+
+	// SweepStaleOnStart asks for port mappings left on the router by an earlier run of holepunch, which no longer
+	// belong to a service, to be removed with SweepStaleMappings before the first service is reconciled.
+	SweepStaleOnStart bool
+	staleSweepOnce    sync.Once
+
+	// RateLimiter decides how long to wait before retrying a service after a transient error. If nil then an
+	// exponential backoff from defaultRetryBaseDelay up to defaultRetryMaxDelay is used.
+	RateLimiter     workqueue.RateLimiter
+	rateLimiterOnce sync.Once
+
+	// UPnPRateLimiter limits how quickly we add port mappings, as some routers can't cope with lots of requests in
+	// quick succession. It's shared by every service. If nil then defaultUPnPRateLimit, with a burst of
+	// defaultUPnPRateBurst, is used.
+	UPnPRateLimiter     *rate.Limiter
+	upnpRateLimiterOnce sync.Once
+
+	// History remembers the most recent reconciles that forwarded a service's ports or failed, for diagnosing problems.
+	// If nil then the last DefaultReconcileHistorySize are remembered.
+	History     *ReconcileHistory
+	historyOnce sync.Once
+
+	// ServiceLabelSelector limits the services we look after to those with matching labels. If nil then services are
+	// looked after whatever their labels.
+	ServiceLabelSelector labels.Selector
+	// ServiceNamespaceSelector limits the services we look after to those in these namespaces. If empty then services
+	// in every namespace are looked after. Services must match both this and ServiceLabelSelector.
+	ServiceNamespaceSelector []string
+
+	// APIReader reads straight from the API server, for use before the manager's cache has started (e.g., by
+	// ValidateAllServices). If nil then Client is used.
+	APIReader client.Reader
+
+	// FallbackToNodePort forwards the ports of LoadBalancer services whose IP hasn't been allocated yet to their node
+	// ports on a Ready node instead, until the IP is allocated.
+	FallbackToNodePort bool
+
+	// ExcludeSelf leaves alone any service for the pod we're running in, so that we never touch our own service, even
+	// if it has the holepunch annotation. SelfPod must be set for this to work.
+	ExcludeSelf bool
+	// SelfPod is the namespace and name of the pod we're running in.
+	SelfPod types.NamespacedName
+
+	// ShutdownContext is done when holepunch is shutting down, which cancels any calls to the router that reconciles
+	// are making. If nil then reconciles are never cancelled.
+	ShutdownContext context.Context
+
+	cleanupAttemptsMu sync.Mutex
+	cleanupAttempts   map[types.NamespacedName]int
+
+	routerCacheMu sync.RWMutex
+	routerCache   map[string]cachedRouterClient
+
+	// routerClientsMappings caches the port mappings of RouterClients, if MappingCacheRefreshInterval is set. They're
+	// asked for their connection type at the same time.
+	routerClientsMappingsOnce   sync.Once
+	routerClientsMappings       *MappingCache
+	routerClientsConnectionType string
+
+	ipv6RouterCacheMu sync.Mutex
+	ipv6RouterCache   *cachedIPv6RouterClient
+
+	externalIPMu     sync.Mutex
+	cachedExternalIP string
+	externalIPExpiry time.Time
+	externalIPGroup  singleflight.Group
+
+	// remoteHosts remembers what the hostnames in remote host annotations resolved to.
+	remoteHostsMu sync.Mutex
+	remoteHosts   map[string]resolvedRemoteHost
+
+	// pickNatPMPRouterClient is used to find a NAT-PMP router. If nil then PickNatPMPRouterClient is used.
+	pickNatPMPRouterClient func(ctx context.Context) (RouterClient, error)
+	// lookupHostFn is used to resolve LoadBalancer and remote host hostnames. If nil then net.DefaultResolver is used.
+	lookupHostFn HostLookupFn
+	// rateLimitClock is used to wait for UPnPRateLimiter. If nil then the real time is used.
+	rateLimitClock rateLimitClock
+	// localIP finds our own IP address for VerifyRouter's test port mapping. If nil then defaultLocalIP is used.
+	localIP func() (string, error)
+
+	// portClaims tracks which service is using each external port, so that we notice when two want the same one.
+	portClaims portConflictTracker
+
+	// processed records the version of each service whose ports we last forwarded successfully, so that we can skip
+	// reconciles (such as the one caused by our own update to the service) until something changes or the lease needs
+	// renewing.
+	processedMu sync.RWMutex
+	processed   map[types.NamespacedName]processedService
+
+	// config is the configuration in use, which overrides some of the settings above, or nil if there isn't any. It
+	// combines holepunchConfig, the spec of the HolepunchConfig, with configMapConfig, the settings from the ConfigMap
+	// watched by a ConfigMapReconciler. The HolepunchConfig wins where they both have a setting. configVersion is the
+	// HolepunchConfig's resource version, configLoaded is whether we've looked for it yet, and configChanged is closed
+	// whenever config changes.
+	configMu        sync.RWMutex
+	config          *holepunchv1alpha1.HolepunchConfigSpec
+	holepunchConfig *holepunchv1alpha1.HolepunchConfigSpec
+	configMapConfig *holepunchv1alpha1.HolepunchConfigSpec
+	configVersion   string
+	configLoaded    bool
+	configChanged   chan struct{}
+
+	// ready is set to 1 once a service has been reconciled successfully. It's only accessed atomically.
+	ready int32
+
+	// routerState tracks the health of the router every service uses.
+	routerState routerStateMachine
+}
+
+// processedService is a service whose ports have been forwarded.
+type processedService struct {
+	// resourceVersion is the version of the service that the ports were forwarded for. A service's generation isn't
+	// changed by updates to its annotations, so we can't use that.
+	resourceVersion string
+	// renewAt is when the port mappings' leases need renewing.
+	renewAt time.Time
+}
+
+// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=core,resources=services/status,verbs=get
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;create;update
+
+func (r *ServiceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	return r.reconcileRequest(req, false)
+}
+
+// Ready returns an error until a service has been reconciled successfully. Reconciling a service with the holepunch
+// annotation means talking to the router, so a controller that can't reach its router never becomes ready unless it
+// has no ports to forward.
+func (r *ServiceReconciler) Ready() error {
+	if atomic.LoadInt32(&r.ready) == 0 {
+		return errors.New("no service has been reconciled successfully yet")
+	}
+	return nil
+}
+
+// reconcileRequest reconciles a service, backing off after errors. Unless force is set, services that haven't changed
+// since their ports were last forwarded are left alone until their leases need renewing. A panic while reconciling is
+// returned as an error.
+func (r *ServiceReconciler) reconcileRequest(req ctrl.Request, force bool) (ctrl.Result, error) {
+	result, _, err := r.reconcileRequestOutcome(req, force)
+	return result, err
+}
+
+// reconcileRequestOutcome is reconcileRequest, but also returns why the reconcile failed even when it's going to be
+// retried, as failure.
+func (r *ServiceReconciler) reconcileRequestOutcome(req ctrl.Request, force bool) (result ctrl.Result, failure error, err error) {
+	ctx, span := r.tracer().Start(r.shutdownContext(), "Reconcile",
+		trace.WithAttributes(serviceAttributes(req.NamespacedName)...))
+	log := r.Log.WithValues("service", req.NamespacedName)
+
+	// goupnp can panic on responses from the router that it doesn't expect. That shouldn't take down every other
+	// service's port forwarding with it.
+	defer func() {
+		if p := recover(); p != nil {
+			r.metrics().RecordReconcilePanic()
+			result, err = ctrl.Result{}, fmt.Errorf("panic in reconcile: %v\n%s", p, debug.Stack())
+			failure = err
+			log.Error(err, "Recovered from panic")
+			r.recordHistory(req.NamespacedName.String(), err, nil)
+			endSpan(span, err)
+		}
+	}()
+
+	r.checkMappingDriftOnStart(ctx)
+	r.sweepStaleOnStart(ctx)
+	result, err = r.reconcileWithConfig(ctx, log, req, force)
+	endSpan(span, err)
+	if err == nil {
+		atomic.StoreInt32(&r.ready, 1)
+		r.rateLimiter().Forget(req)
+		return result, nil, nil
+	}
+	r.forgetProcessed(req.NamespacedName)
+	r.recordHistory(req.NamespacedName.String(), err, nil)
+	if !r.dryRun() {
+		stub := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: req.Namespace, Name: req.Name}}
+		r.recordReconcileStatus(ctx, log, stub, err)
+	}
+
+	if r.VerboseErrors {
+		log = log.WithValues("error-detail", verboseUPnPError(err))
+	}
+
+	// We do our own backoff rather than returning the error, so that a router that's gone away for a while doesn't get
+	// hammered with retries. There's no point retrying permanent errors at all.
+	if errorKind(err) == Permanent {
+		log.Error(err, "Not retrying, as this error won't go away by itself")
+		r.rateLimiter().Forget(req)
+		return ctrl.Result{}, err, nil
+	}
+	delay := r.rateLimiter().When(req)
+	if r.routerState.unhealthy() {
+		delay = unhealthyRouterDelay(delay)
+	}
+	log.Info("Will retry after transient error", "error", err.Error(), "retry-after", delay.String())
+	return ctrl.Result{RequeueAfter: delay}, err, nil
+}
+
+// reconcileWithConfig reconciles a service using the latest HolepunchConfig.
+func (r *ServiceReconciler) reconcileWithConfig(ctx context.Context, log logr.Logger, req ctrl.Request, force bool) (ctrl.Result, error) {
+	if err := r.loadConfig(ctx); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to load HolepunchConfig: %w", err)
+	}
+	return r.reconcile(ctx, log, req, force)
+}
+
+func (r *ServiceReconciler) reconcile(ctx context.Context, log logr.Logger, req ctrl.Request, force bool) (ctrl.Result, error) {
+	// Get the service
+	var service corev1.Service
+	if err := r.Get(ctx, req.NamespacedName, &service); err != nil {
+		if apierrors.IsNotFound(err) {
+			// The service is gone, so its external ports are free for other services to use.
+			r.portClaims.releaseAll(req.NamespacedName)
+			r.forgetProcessed(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// The namespace's HolepunchPolicy fills in anything the service's own annotations don't say. settings is only used
+	// to work out how to forward the service's ports, and is never written back.
+	policy, err := r.getHolepunchPolicy(ctx, service.Namespace)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to load HolepunchPolicy: %w", err)
+	}
+	settings := applyPortMappingAnnotationFormat(applyHolepunchPolicy(service, policy), r.PortMappingAnnotationFormat)
+
+	// If the service is going away then we need to tear down anything we setup on the router before we let it go.
+	if !service.DeletionTimestamp.IsZero() {
+		r.forgetProcessed(req.NamespacedName)
+		return r.reconcileDelete(ctx, log, &service)
+	}
+
+	// Users can ask for only TCP or only UDP ports to be forwarded. If we can't tell what they asked for then we leave
+	// the service alone until the annotation is fixed, which will trigger a reconcile anyway.
+	forwardTCP, forwardUDP, err := getHolepunchProtocolFilter(settings)
+	if err != nil {
+		log.Error(err, "Invalid holepunch annotation")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidHolepunchAnnotation", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+
+	// We only care about services that have our annotation on them, or that the policy opts in
+	if !HasHolepunchAnnotation(settings) {
+		r.forgetProcessed(req.NamespacedName)
+		if hasFinalizer(service, portMappingCleanupFinalizer) {
+			// We used to forward ports for this service, but the annotation has since been removed (or set to
+			// "false"). Take down the mappings we made.
+			return r.reconcileDisabled(ctx, log, &service)
+		}
+		// Nothing to be done
+		return ctrl.Result{}, nil
+	}
+
+	// Changing our own service could start another reconcile of it, and so on forever, so if asked to we treat it as
+	// though it didn't have the annotation.
+	if r.ExcludeSelf && isSelfService(ctx, r.Client, r.SelfPod, service) {
+		log.V(1).Info("Not forwarding ports for Holepunch's own service")
+		r.forgetProcessed(req.NamespacedName)
+		if hasFinalizer(service, portMappingCleanupFinalizer) {
+			return r.reconcileDisabled(ctx, log, &service)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Nothing's changed since we last forwarded this service's ports, so there's nothing to do until the lease needs
+	// renewing. This saves asking the router about every port again whenever we update the service ourselves.
+	if renewAt, ok := r.unchangedSinceProcessed(service); ok && !force {
+		log.V(1).Info("Service unchanged since its ports were forwarded, waiting to renew the lease",
+			"renew-at", renewAt)
+		return ctrl.Result{RequeueAfter: time.Until(renewAt)}, nil
+	}
+
+	// We only care about LoadBalancer and NodePort services. We need a real internal IP to map to! Services for pods on
+	// the host's network can be of any type, as it's their node's IP that we map to.
+	useNodeIP, err := getUseNodeIP(service)
+	if err != nil {
+		log.Error(err, "Invalid use-node-ip annotation")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidUseNodeIP", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer && service.Spec.Type != corev1.ServiceTypeNodePort && !useNodeIP {
+		// This means we've put the annotation on a service that isn't a loadbalancer.
+		log.Error(nil, "Holepunch enabled on non-LoadBalancer, non-NodePort service")
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "UnsupportedServiceType",
+			"Can't forward ports for a %s service; it must be a LoadBalancer or NodePort service", service.Spec.Type)
+		return ctrl.Result{}, nil
+	}
+
+	// If we've been asked to, a LoadBalancer service whose IP hasn't been allocated yet has its ports forwarded to its
+	// node ports in the meantime. Once the IP turns up the service changes, and we switch over to forwarding to it.
+	var serviceIP string
+	if r.FallbackToNodePort && service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		if serviceIP, err = r.getServiceIP(ctx, service); err != nil {
+			nodeIP, fallback, fallbackErr := getNodePortFallback(ctx, r.Client, settings)
+			if fallbackErr != nil {
+				log.Info("Unable to fall back to forwarding to node ports", "error", fallbackErr.Error())
+			} else {
+				log.Info("LoadBalancer IP not available, forwarding to node ports instead", "error", err.Error())
+				r.Recorder.Eventf(&service, corev1.EventTypeNormal, "NodePortFallback",
+					"LoadBalancer IP not available, forwarding to node ports on %s instead", nodeIP)
+				serviceIP, settings = nodeIP, fallback
+			}
+		}
+	}
+
+	// Work out which ports we want forwarded. This takes into account the port mapping annotations, which instruct us
+	// to setup the UPnP mappings to use a *different* external and internal port. Some routers may not support this
+	// feature.
+	for _, servicePort := range service.Spec.Ports {
+		if _, err := toUPnPProtocol(servicePort.Protocol); err != nil {
+			if errors.Is(err, ErrProtocolNotSupported) {
+				// There's nothing we can do about this port, but we can still forward the others.
+				log.Info("Skipping port with unsupported protocol", "port", servicePort.Port,
+					"protocol", servicePort.Protocol)
+				r.Recorder.Eventf(&service, corev1.EventTypeWarning, "UnsupportedProtocol",
+					"%s is not supported by UPnP IGD; port %d will not be forwarded", servicePort.Protocol, servicePort.Port)
+				continue
+			}
+			log.Error(err, "Unable to resolve protocol to use", "port", servicePort.Port)
+			return ctrl.Result{}, fmt.Errorf("unable to resolve protocol of port %d of service %s: %w", servicePort.Port, req.NamespacedName, err)
+		}
+	}
+	desiredMappings, err := getSpecMappings(settings)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to read port mappings of service %s: %w", req.NamespacedName, err)
+	}
+	// Annotations for ports the service doesn't have are harmless, but probably a typo.
+	if err := validatePortMappingAnnotations(service); err != nil {
+		log.Info("Ignoring port mapping annotations", "reason", err.Error())
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "UnmatchedPortMapping", err.Error())
+	}
+	desiredMappings = filterMappingsByProtocol(log, desiredMappings, forwardTCP, forwardUDP)
+
+	// Some ports, like metrics endpoints, should never be exposed to the internet.
+	skippedPorts, err := getSkippedPorts(settings)
+	if err != nil {
+		log.Error(err, "Invalid skip ports annotation")
+		return ctrl.Result{}, fmt.Errorf("unable to read skipped ports of service %s: %w", req.NamespacedName, err)
+	}
+	enabledPorts, err := getPortEnabledMap(service)
+	if err != nil {
+		log.Error(err, "Invalid port enabled annotation")
+		return ctrl.Result{}, fmt.Errorf("unable to read enabled ports of service %s: %w", req.NamespacedName, err)
+	}
+	for port, enabled := range enabledPorts {
+		if !enabled {
+			skippedPorts[port] = true
+		}
+	}
+	desiredMappings = filterSkippedPorts(log, settings, desiredMappings, skippedPorts)
+
+	// Users can ask for a different lease duration for this service. If it's invalid there's no point retrying until
+	// the annotation is changed, which will trigger a reconcile anyway.
+	leaseDuration, err := getLeaseDuration(settings, r.defaultLeaseDuration())
+	if err != nil {
+		log.Error(err, "Invalid lease duration")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidLeaseDuration", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+	// Ports can each have their own lease too, but as they're all renewed together, that has to be before the shortest
+	// one runs out.
+	portLeases, err := getPortLeaseDurations(settings, desiredMappings, r.defaultLeaseDuration())
+	if err != nil {
+		log.Error(err, "Invalid port lease duration")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidLeaseDuration", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+	leaseDuration = shortestLease(portLeases, leaseDuration)
+	log = log.WithValues("lease-duration", leaseDuration)
+
+	// The same goes for how often to renew the port mappings, which must be before the lease runs out.
+	reconcileInterval, err := getReconcileInterval(settings, leaseDuration)
+	if err != nil {
+		log.Error(err, "Invalid reconcile interval")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidReconcileInterval", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+
+	// Likewise, a remote host that isn't an IP address or hostname won't fix itself.
+	if _, err := getRemoteHost(settings); err != nil {
+		log.Error(err, "Invalid remote host")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidRemoteHost", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+	settings = r.withResolvedRemoteHost(ctx, log, &service, settings)
+
+	// And so does a router URL that isn't a URL.
+	if _, err := getServiceRouterURL(service); err != nil {
+		log.Error(err, "Invalid router URL")
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidRouterURL", err.Error())
+		r.updateConditions(ctx, log, &service, portsMappedCondition(ReasonInvalidConfiguration, err))
+		return ctrl.Result{}, nil
+	}
+
+	// Find out what we mapped last time, so we can remove anything that's no longer wanted.
+	existingMappings, err := getActiveMappings(service)
+	if err != nil {
+		log.Error(err, "Failed to read previously active port mappings")
+		return ctrl.Result{}, fmt.Errorf("unable to read active port mappings of service %s: %w", req.NamespacedName, err)
+	}
+
+	// If the router gave us different external ports to the ones we asked for last time, keep asking for those so
+	// that they don't change every time the lease is renewed.
+	assignedPorts, err := getAssignedPorts(service)
+	if err != nil {
+		log.Error(err, "Failed to read assigned external ports")
+		return ctrl.Result{}, fmt.Errorf("unable to read assigned external ports of service %s: %w", req.NamespacedName, err)
+	}
+	requestedMappings := make(map[string]uint16, len(desiredMappings))
+	for key, externalPort := range desiredMappings {
+		requestedMappings[key] = externalPort
+		if assignedPort, ok := assignedPorts[key]; ok {
+			desiredMappings[key] = assignedPort
+		}
+	}
+
+	// Most routers will let a second service take over an external port, which would break the first one. portClaims
+	// only knows about services we've reconciled since we started, so check every other service before we touch the
+	// router.
+	if err := r.checkExternalPortConflicts(ctx, log, settings, desiredMappings); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to check external ports of service %s for conflicts: %w", req.NamespacedName, err)
+	}
+
+	// Make sure that we get a chance to remove the port mappings if the service is deleted. We do this before touching
+	// the router so that we never create a mapping we don't know to clean up. In dry-run mode we never create any
+	// mappings, so there's nothing to clean up.
+	if !r.dryRun() && !hasFinalizer(service, portMappingCleanupFinalizer) {
+		controllerutil.AddFinalizer(&service, portMappingCleanupFinalizer)
+		if err := r.Update(ctx, &service); err != nil {
+			log.Error(err, "Failed to add finalizer")
+			return ctrl.Result{}, fmt.Errorf("unable to add finalizer to service %s: %w", req.NamespacedName, err)
+		}
+	}
+
+	// Find a router to configure
+	router, ownRouter, err := r.getServiceRouterClient(ctx, log, &service)
+	if !ownRouter {
+		r.recordRouterEvent(&service, r.routerState.found(err))
+	}
+	if err != nil {
+		log.Error(err, "Failed to find router to configure")
+		r.updateConditions(ctx, log, &service, routerReachableCondition(err),
+			portsMappedCondition(ReasonRouterNotFound, errors.New("no router to forward ports on")))
+		return ctrl.Result{}, fmt.Errorf("unable to find router for service %s: %w", req.NamespacedName, err)
+	}
+	// Calls to the router stop if we're shutting down, rather than holding it up.
+	router = withContext(ctx, r.withDryRun(log, router))
+
+	// Ask that router for *it's* external IP.
+	// This is where the term "external" gets weird. There's the underlying pods in the K8s cluster which have IPs, then
+	// the service has an IP inside the cluster, but it also has an "external" IP which is really an IP on the user's
+	// home network (usually), and when we ask the *router* for "external" we really do mean public internet IP.
+	// We only need this to tell the user about it, so it's not worth failing over. If the router really has gone away
+	// then we'll find out when we try to forward ports. Only the external IP of the router every service uses is cached.
+	var externalIP string
+	_, span := r.tracer().Start(ctx, "GetExternalIPAddress")
+	if ownRouter {
+		externalIP, err = router.GetExternalIPAddress()
+	} else {
+		externalIP, err = r.getExternalIPAddress(router)
+	}
+	endSpan(span, err)
+	if err != nil {
+		log.Info("Failed to resolve external IP address, continuing anyway", "error", err.Error())
+		externalIP = ""
+	}
+	log = log.WithValues("external-ip", externalIP)
+
+	// Find the service's IP, that we're hoping is a local network IP from the perspective of the router. For NodePort
+	// services this is the IP of one of the nodes instead. We already have it if we've checked whether to fall back to
+	// node ports. A LoadBalancer can have an IPv6 address too, which may be the only one we want, depending on
+	// IPVersionPreference.
+	var serviceIPv6 string
+	switch {
+	case serviceIP != "":
+	case service.Spec.Type == corev1.ServiceTypeNodePort:
+		serviceIP, err = getNodeIP(ctx, r.Client)
+		if err != nil {
+			log.Error(err, "Failed to get IP for a node to forward to")
+			return ctrl.Result{}, fmt.Errorf("unable to get node IP for service %s: %w", req.NamespacedName, err)
+		}
+	default:
+		serviceIP, serviceIPv6, err = r.getServiceIPs(ctx, service, externalIP)
+		if err != nil {
+			log.Error(err, "Failed to get IP for service (has it not been allocated yet?)")
+			return ctrl.Result{}, fmt.Errorf("unable to get IP of service %s: %w", req.NamespacedName, err)
+		}
+	}
+	log = log.WithValues("service-ip", serviceIP)
+
+	// Port mappings are only made to an IPv4 address, so if we're only opening pinholes to the IPv6 one then any port
+	// mappings we made before are removed instead.
+	natMappings := desiredMappings
+	if serviceIP == "" {
+		natMappings = map[string]uint16{}
+	}
+
+	// Routers that get their IP over PPPoE or DHCP can have it changed under them whenever the session or lease ends, and
+	// may drop their port mappings when it does, so those are renewed more often to put them back sooner. Leases are
+	// also kept within what routers will accept.
+	connectionType := r.routerConnectionType(service, ownRouter)
+	if fitted := fitLeaseDuration(connectionType, leaseDuration); fitted != leaseDuration {
+		reconcileInterval = scaleReconcileInterval(reconcileInterval, leaseDuration, fitted)
+		leaseDuration = fitted
+		log.V(1).Info("Adjusted lease duration and reconcile interval to suit the router",
+			"connection-type", connectionType, "dynamic-ip", isDynamicConnectionType(connectionType),
+			"effective-lease-duration", leaseDuration)
+	}
+	for key, lease := range portLeases {
+		portLeases[key] = fitLeaseDuration(connectionType, lease)
+	}
+	if useClusterIP, _ := getUseClusterIP(service); useClusterIP && service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		// A ClusterIP is normally only reachable from inside the cluster, so the router won't be able to reach it unless
+		// the network has been set up for it.
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "ForwardingToClusterIP",
+			"Forwarding ports to ClusterIP %s as %s is set; this only works if the router can reach ClusterIPs, which depends on your network",
+			serviceIP, useClusterIPAnnotationName)
+	}
+
+	if !ownRouter {
+		r.routerState.mapping()
+	}
+	err = r.syncPortMappings(ctx, log, router, settings, serviceIP, leaseDuration, portLeases, natMappings,
+		existingMappings)
+	if !ownRouter {
+		r.recordRouterEvent(&service, r.routerState.mapped(err))
+	}
+	if err != nil {
+		r.invalidateServiceRouterClient(service)
+		r.updateConditions(ctx, log, &service, routerReachableCondition(nil),
+			portsMappedCondition(ReasonPortMappingFailed, err))
+		return ctrl.Result{}, fmt.Errorf("unable to forward ports of service %s: %w", req.NamespacedName, err)
+	}
+
+	// The router may have granted a shorter lease than we asked for, in which case we need to come back sooner.
+	actualLeaseDuration := leaseDuration
+	if !r.dryRun() {
+		remoteHost, _ := getRemoteHost(settings)
+		actualLeaseDuration = confirmLeaseDuration(router, remoteHost,
+			mappingsWithLease(natMappings, portLeases, leaseDuration), leaseDuration)
+	}
+	if actualLeaseDuration != leaseDuration {
+		reconcileInterval = scaleReconcileInterval(reconcileInterval, leaseDuration, actualLeaseDuration)
+		log.Info("Router granted a shorter lease than requested", "actual-lease-duration", actualLeaseDuration,
+			"reschedule-seconds", int(reconcileInterval/time.Second))
+	}
+
+	r.metrics().RecordActiveMappings(externalIP, req.NamespacedName, len(natMappings))
+
+	// Record what we've mapped, so that we know what to remove later even if the service changes underneath us.
+	if r.dryRun() {
+		log.Info("[DRY-RUN] Not recording active port mappings", "mappings", natMappings)
+	} else if err := r.recordActiveMappings(ctx, &service, natMappings,
+		assignedPortChanges(requestedMappings, natMappings), externalIP, connectionType,
+		routerReachableCondition(nil), portsMappedCondition(ReasonPortsMapped, nil)); err != nil {
+		log.Error(err, "Failed to record active port mappings")
+		return ctrl.Result{}, fmt.Errorf("unable to record active port mappings on service %s: %w", req.NamespacedName, err)
+	} else if err := r.saveServiceMappings(ctx, settings, natMappings, serviceIP, leaseDuration,
+		actualLeaseDuration); err != nil {
+		log.Error(err, "Failed to save active port mappings")
+		return ctrl.Result{}, fmt.Errorf("unable to save port mappings of service %s: %w", req.NamespacedName, err)
+	}
+
+	// If the service also has an IPv6 address then there's no NAT to get through, but the router's firewall will
+	// still need opening for the same ports. If we no longer want IPv6 then any pinholes we opened before are closed.
+	if serviceIPv6 != "" {
+		if err := r.syncPinholes(ctx, log, &service, serviceIPv6, desiredMappings, leaseDuration); err != nil {
+			log.Error(err, "Failed to open IPv6 pinholes")
+			return ctrl.Result{}, fmt.Errorf("unable to open IPv6 pinholes for service %s: %w", req.NamespacedName, err)
+		}
+	} else if _, wantIPv6 := r.ipVersions(externalIP); !wantIPv6 {
+		if pinholes, _ := getActivePinholes(service); len(pinholes) > 0 {
+			if err := r.syncPinholes(ctx, log, &service, "", nil, leaseDuration); err != nil {
+				log.Error(err, "Failed to close IPv6 pinholes")
+				return ctrl.Result{}, fmt.Errorf("unable to close IPv6 pinholes for service %s: %w", req.NamespacedName, err)
+			}
+		}
+	}
+
+	if !r.dryRun() {
+		r.recordReconcileStatus(ctx, log, &service, nil)
+	}
+
+	r.recordHistory(req.NamespacedName.String(), nil, desiredMappings)
+
+	// Even on a "success" we need to come back before our lease is up to redo it.
+	r.markProcessed(service, time.Now().Add(reconcileInterval))
+	log.Info("Success, ports forwarded.", "reschedule-seconds", int(reconcileInterval/time.Second))
+	return ctrl.Result{RequeueAfter: reconcileInterval}, nil
+}
+
+// syncPortMappings makes the router's port mappings for a service match the desired ones. Mappings that existed
+// previously but are no longer desired are removed, and every desired mapping is (re-)added so that its lease is
+// renewed. Both desired and existing are in the form produced by getSpecMappings. If the router won't let us use the
+// external port we asked for, desired is updated with the external port that was used instead. Ports that something
+// other than us has already forwarded are removed from desired. Each mapping's lease lasts for the number of seconds
+// given for its key in portLeases, or leaseDuration if it isn't there.
+func (r *ServiceReconciler) syncPortMappings(ctx context.Context, log logr.Logger, router RouterClient, service corev1.Service, serviceIP string, leaseDuration uint32, portLeases map[string]uint32, desired, existing map[string]uint16) error {
+	description, truncated := getMappingDescription(service)
+	if truncated {
+		log.Info("Description annotation is too long, truncating it", "description", description)
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "DescriptionTruncated",
+			"%s annotation is longer than %d characters; using %q", descriptionAnnotationName, maxDescriptionLength,
+			description)
+	}
+	prefix := r.descriptionPrefix(service)
+	describe, err := mappingDescriptions(service, r.ClusterName, prefix)
+	if err != nil {
+		log.Info("Invalid description template, using the usual description instead", "error", err.Error())
+		r.Recorder.Event(&service, corev1.EventTypeWarning, "InvalidDescriptionTemplate", err.Error())
+	}
+	remoteHost, err := getRemoteHost(service)
+	if err != nil {
+		return err
+	}
+
+	// Remove anything that we don't want anymore first. This includes ports which are still on the service but now
+	// have a different external port, and frees up the external port in case a new mapping wants it.
+	for _, key := range sortedMappingKeys(existing) {
+		externalPort := existing[key]
+		if desiredExternalPort, ok := desired[key]; ok && desiredExternalPort == externalPort {
+			continue
+		}
+		_, protocol, err := parseMappingKey(key)
+		if err != nil {
+			return err
+		}
+
+		portLogger := log.WithValues("mapping", key, "external-port", externalPort)
+		portLogger.Info("Removing UPnP port-forwarding that is no longer wanted")
+		if err := deleteOwnedPortMapping(portLogger, router, prefix, unprefixedDescription(service), remoteHost, externalPort, protocol); err != nil {
+			portLogger.Error(err, "Failed to remove UPnP port-forwarding")
+			return err
+		}
+		r.portClaims.release(types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, externalPort, protocol)
+	}
+
+	// Try to forward every port we want. Routers can be slow to respond, so we do this concurrently rather than
+	// waiting for each port in turn. One port failing doesn't stop us from trying the others.
+	maxConcurrent := r.MaxConcurrentMappings
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentMappings
+	}
+	sem := semaphore.NewWeighted(int64(maxConcurrent))
+	var tasks errgroup.Group
+	var panics panicCatcher
+	var changedMu sync.Mutex
+	changed := make(map[string]uint16)
+	var skipped []string
+	for _, key := range sortedMappingKeys(desired) {
+		key := key
+		externalPort := desired[key]
+		lease, ok := portLeases[key]
+		if !ok {
+			lease = leaseDuration
+		}
+		tasks.Go(func() error {
+			defer panics.catch()
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			defer sem.Release(1)
+			forwardedPort, err := r.addPortMapping(ctx, log, router, service, serviceIP, remoteHost, lease,
+				describe(key, externalPort), key, externalPort)
+			if errors.Is(err, errPortMappingSkipped) {
+				// Someone else has the port, which we've already warned about. That shouldn't stop the service's
+				// other ports from being forwarded.
+				changedMu.Lock()
+				skipped = append(skipped, key)
+				changedMu.Unlock()
+				return nil
+			}
+			if err == nil && forwardedPort != externalPort {
+				changedMu.Lock()
+				changed[key] = forwardedPort
+				changedMu.Unlock()
+			}
+			return err
+		})
+	}
+	err = tasks.Wait()
+	panics.repanic()
+	for key, externalPort := range changed {
+		desired[key] = externalPort
+	}
+	for _, key := range skipped {
+		delete(desired, key)
+	}
+	return err
+}
+
+// addPortMapping forwards a single port for a service, unless the router already has the mapping we want. It returns
+// the external port that was forwarded, which is the internal port instead if the router requires them to be the same.
+func (r *ServiceReconciler) addPortMapping(ctx context.Context, log logr.Logger, router RouterClient, service corev1.Service, serviceIP string, remoteHost string, leaseDuration uint32, description string, key string, externalPort uint16) (uint16, error) {
+	portNumber, protocol, err := parseMappingKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Log out
+	portLogger := log.WithValues("forwarding-port", portNumber,
+		"external-port", externalPort,
+		"upnp-description", description)
+	if remoteHost != "" {
+		portLogger = portLogger.WithValues("remote-host", remoteHost)
+	}
+
+	// Most routers will let a second service take over an external port, which would break the first one.
+	name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	if owner, ok := r.portClaims.claim(name, externalPort, protocol); !ok {
+		err := fmt.Errorf("external port %d/%s is already claimed by service %s", externalPort, protocol, owner)
+		portLogger.Error(err, "Refusing to replace port mapping")
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "PortConflict",
+			"External port %d/%s is already claimed by service %s", externalPort, protocol, owner)
+		return 0, err
+	}
+
+	upToDate, err := r.checkExistingPortMapping(service, router, remoteHost, externalPort, protocol, portNumber, serviceIP,
+		description, leaseDuration)
+	if err != nil {
+		portLogger.Error(err, "Refusing to replace port mapping")
+		return 0, err
+	}
+	if upToDate {
+		portLogger.V(1).Info("Port mapping already up to date, not renewing")
+		return externalPort, nil
+	}
+
+	portLogger.Info("Attempting to forward port from router with UPnP")
+
+	// Routers that can pick the external port themselves will give us another one if they can't use the one we want,
+	// rather than failing.
+	forward := func(remoteHost string) (forwardedPort uint16, err error) {
+		_, span := r.tracer().Start(ctx, "AddPortMapping",
+			trace.WithAttributes(portMappingAttributes(externalPort, protocol, portNumber)...))
+		defer func() { endSpan(span, err) }()
+		if err := r.waitForUPnPRateLimit(ctx); err != nil {
+			return 0, err
+		}
+		forwardedPort, err = addAnyPortMapping(router, remoteHost, externalPort, protocol, portNumber, serviceIP, true,
+			description, leaseDuration)
+		if errors.Is(err, errAnyPortMappingNotSupported) {
+			return externalPort, addPortMappingAsIs(router, remoteHost, externalPort, protocol, portNumber, serviceIP,
+				description, leaseDuration)
+		}
+		return forwardedPort, err
+	}
+	mappedRemoteHost := remoteHost
+	forwardedPort, err := forward(remoteHost)
+	if isUPnPError(err, ErrCodeWildCardNotPermittedInSrcIP) && remoteHost != "" {
+		// The router can only forward ports to every remote host, so that's the best we can do.
+		portLogger.Info("Router does not support restricting port mappings to a remote host, retrying without")
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "RemoteHostNotSupported",
+			"Router does not support restricting port mappings to a remote host; port %d will be forwarded for any remote host instead of only %s",
+			externalPort, remoteHost)
+		mappedRemoteHost = ""
+		forwardedPort, err = forward("")
+	}
+	if isUPnPError(err, ErrCodeConflictInMappingEntry) {
+		forwardedPort, err = r.resolveMappingConflict(portLogger, service, router, mappedRemoteHost, externalPort,
+			protocol, description, err, func() (uint16, error) { return forward(mappedRemoteHost) })
+	}
+	r.metrics().RecordPortMapping(name, portNumber, protocol, err)
+	if errors.Is(err, errPortMappingSkipped) {
+		r.portClaims.release(name, externalPort, protocol)
+		return 0, err
+	}
+	if isUPnPError(err, ErrCodeSamePortValuesRequired) && externalPort != portNumber {
+		// The router can't rewrite ports, so the only thing we can do is forward the port as-is.
+		portLogger.Info("Router requires the same internal and external port, retrying with the internal port")
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "SamePortValuesRequired",
+			"Router requires same internal and external port; ignoring port mapping for port %d", portNumber)
+		r.portClaims.release(name, externalPort, protocol)
+		return r.addPortMapping(ctx, log, router, service, serviceIP, remoteHost, leaseDuration, description, key, portNumber)
+	}
+	if upnpErr, ok := parseUPnPError(err); ok {
+		err = upnpErr
+		if upnpErr.Code == ErrCodeConflictInMappingEntry {
+			// Something other than holepunch has the external port, so there's nothing we can do until it gives it up.
+			r.Recorder.Eventf(&service, corev1.EventTypeWarning, "PortMappingConflict",
+				"Router reports external port %d/%s is already forwarded to another client", externalPort, protocol)
+		}
+	}
+	if err != nil {
+		portLogger.Error(err, "Failed to configure UPnP port-forwarding")
+		return 0, err
+	}
+	if forwardedPort != externalPort {
+		portLogger.Info("Router assigned a different external port", "assigned-port", forwardedPort)
+		r.portClaims.release(name, externalPort, protocol)
+		if owner, ok := r.portClaims.claim(name, forwardedPort, protocol); !ok {
+			// As far as we know another service is using that port, so the router must have lost its mapping. Give
+			// the port back rather than take it over.
+			err := fmt.Errorf("router assigned external port %d/%s, which is already claimed by service %s",
+				forwardedPort, protocol, owner)
+			portLogger.Error(err, "Refusing to use assigned external port")
+			r.Recorder.Eventf(&service, corev1.EventTypeWarning, "PortConflict",
+				"Router assigned external port %d/%s, which is already claimed by service %s", forwardedPort, protocol, owner)
+			if deleteErr := deletePortMapping(router, mappedRemoteHost, forwardedPort, protocol); deleteErr != nil {
+				portLogger.Error(deleteErr, "Failed to remove UPnP port-forwarding", "assigned-port", forwardedPort)
+			}
+			return 0, err
+		}
+	}
+	return forwardedPort, nil
+}
+
+// resolveMappingConflict handles the router refusing to forward an external port because something already has it,
+// which conflictErr says. If the existing mapping has our description (or the one an earlier version without
+// description prefixes gave it) then it's a stale one of ours, such as from before the service's IP changed or from
+// another instance of holepunch, so it's removed and retry is called to forward
+// the port again. If it belongs to something else then we leave it be, and errPortMappingSkipped is returned so that
+// the service's other ports can still be forwarded. If we can't tell whose it is then conflictErr is returned.
+func (r *ServiceReconciler) resolveMappingConflict(log logr.Logger, service corev1.Service, router RouterClient, remoteHost string, externalPort uint16, protocol string, description string, conflictErr error, retry func() (uint16, error)) (uint16, error) {
+	_, existingClient, _, existingDescription, _, err := router.GetSpecificPortMappingEntry(remoteHost, externalPort, protocol)
+	if err != nil {
+		log.Info("Unable to find out what the external port is already mapped to", "error", err.Error())
+		return 0, conflictErr
+	}
+	// An empty prefix would make every mapping ours, so then only one with exactly our description is replaced.
+	prefix, unprefixed := r.descriptionPrefix(service), unprefixedDescription(service)
+	if existingDescription != description && (prefix == "" || !ownsDescription(prefix, unprefixed, existingDescription)) {
+		log.Info("External port is already mapped by something else, skipping it",
+			"existing-client", existingClient, "existing-description", existingDescription)
+		r.Recorder.Eventf(&service, corev1.EventTypeWarning, "PortMappingConflict",
+			"External port %d/%s is already forwarded to %s by %q; not forwarding it", externalPort, protocol,
+			existingClient, existingDescription)
+		return 0, errPortMappingSkipped
+	}
+
+	log.Info("Removing stale port mapping that conflicts with this one", "existing-client", existingClient)
+	if err := deletePortMapping(router, remoteHost, externalPort, protocol); err != nil {
+		log.Error(err, "Failed to remove stale UPnP port-forwarding")
+		return 0, conflictErr
+	}
+	return retry()
+}
+
+// addPortMappingAsIs forwards a port using exactly the external port given, for routers that can't pick one for us.
+func addPortMappingAsIs(router RouterClient, remoteHost string, externalPort uint16, protocol string, portNumber uint16, serviceIP string, description string, leaseDuration uint32) error {
+	return router.AddPortMapping(
+		// The remote host that may use the mapping, or empty for any host.
+		remoteHost,
+		// External port number to expose to Internet:
+		externalPort,
+		// Forward TCP (this could be "UDP" if we wanted that instead).
+		protocol,
+		// Internal port number on the LAN to forward to.
+		// Some routers might not support this being different to the external
+		// port number.
+		portNumber,
+		// Internal address on the LAN we want to forward to.
+		serviceIP,
+		// Enabled:
+		true,
+		// Informational description for the client requesting the port forwarding.
+		description,
+		// How long should the port forward last for in seconds.
+		// If you want to keep it open for longer and potentially across router
+		// resets, you might want to periodically request before this elapses.
+		leaseDuration,
+	)
+}
+
+// checkExistingPortMapping asks the router what it already has mapped on an external port. It returns true if the
+// existing mapping is exactly what we want and renewing it wouldn't extend its lease, in which case it can be left
+// alone. If the external port is mapped somewhere else, or has a description that ownsDescription doesn't recognise, by
+// someone other than us then a warning event is emitted and an error returned, as we don't want to steal the port from
+// whatever set it up.
+func (r *ServiceReconciler) checkExistingPortMapping(service corev1.Service, router RouterClient, remoteHost string, externalPort uint16, protocol string, internalPort uint16, serviceIP string, description string, leaseDuration uint32) (bool, error) {
+	existingPort, existingClient, enabled, existingDescription, remainingLease, err := router.GetSpecificPortMappingEntry(remoteHost, externalPort, protocol)
+	if err != nil {
+		// Most routers return an error if there's no such mapping, which is what we'd expect for a new port. If the
+		// router has really gone away then adding the mapping will fail too.
+		return false, nil
+	}
+
+	// A mapping that isn't ours is left alone even if it's the same as ours, as it belongs to other software.
+	prefix, unprefixed := r.descriptionPrefix(service), unprefixedDescription(service)
+	if ownsDescription(prefix, unprefixed, existingDescription) && existingPort == internalPort &&
+		existingClient == serviceIP {
+		if !strings.HasPrefix(existingDescription, prefix) {
+			// An earlier version made it, so it's renewed to give it our prefix.
+			return false, nil
+		}
+		// A lease duration of zero means that the mapping never expires.
+		return enabled && (remainingLease == 0 || remainingLease+leaseRenewalSlackSeconds >= leaseDuration), nil
+	}
+
+	// The mapping points somewhere else. If we made it (e.g., the service's IP has changed) then we just replace it.
+	if existingDescription == description || existingDescription == unprefixed {
+		return false, nil
+	}
+	err = fmt.Errorf("external port %d/%s is already mapped to %s:%d (%q)", externalPort, protocol, existingClient,
+		existingPort, existingDescription)
+	r.Recorder.Event(&service, corev1.EventTypeWarning, "PortMappingConflict", err.Error())
+	return false, err
+}
+
+// reconcileDelete removes any port mappings we made for a service that is being deleted, and then removes our
+// finalizer so that the deletion can go ahead.
+func (r *ServiceReconciler) reconcileDelete(ctx context.Context, log logr.Logger, service *corev1.Service) (ctrl.Result, error) {
+	if !hasFinalizer(*service, portMappingCleanupFinalizer) {
+		// Either we never touched this service or we've already cleaned up.
+		return ctrl.Result{}, nil
+	}
+
+	router, _, err := r.getServiceRouterClient(ctx, log, service)
+	if err != nil {
+		log.Error(err, "Failed to find router to configure")
+		return r.cleanupFailed(ctx, log, service, err)
+	}
+	router = withContext(ctx, r.withDryRun(log, router))
+
+	settings := r.withResolvedRemoteHost(ctx, log, service, r.withHolepunchPolicy(ctx, log, *service))
+	if err := deletePortMappings(log, router, settings, r.descriptionPrefix(settings)); err != nil {
+		r.invalidateServiceRouterClient(*service)
+		return r.cleanupFailed(ctx, log, service, err)
+	}
+	if err := r.deletePinholes(ctx, log, *service); err != nil {
+		return r.cleanupFailed(ctx, log, service, err)
+	}
+
+	log.Info("Port mappings removed")
+	name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	if err := r.saveMappings(ctx, name, nil); err != nil {
+		return r.cleanupFailed(ctx, log, service, err)
+	}
+	r.portClaims.releaseAll(name)
+	r.metrics().RecordActiveMappings("", name, 0)
+	r.resetCleanupAttempts(service)
+	return ctrl.Result{}, r.removeFinalizer(ctx, service)
+}
+
+// reconcileDisabled removes the port mappings for a service that we used to forward ports for, but which no longer has
+// the holepunch annotation set to "true".
+func (r *ServiceReconciler) reconcileDisabled(ctx context.Context, log logr.Logger, service *corev1.Service) (ctrl.Result, error) {
+	name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	router, _, err := r.getServiceRouterClient(ctx, log, service)
+	if err != nil {
+		log.Error(err, "Failed to find router to configure")
+		return ctrl.Result{}, fmt.Errorf("unable to find router for service %s: %w", name, err)
+	}
+	router = withContext(ctx, r.withDryRun(log, router))
+
+	// We only need the external port and protocol to remove a mapping, so it doesn't matter if the service has since
+	// lost its IP.
+	settings := r.withResolvedRemoteHost(ctx, log, service, r.withHolepunchPolicy(ctx, log, *service))
+	if err := deletePortMappings(log, router, settings, r.descriptionPrefix(settings)); err != nil {
+		log.Error(err, "Failed to remove UPnP port-forwarding")
+		r.invalidateServiceRouterClient(*service)
+		return ctrl.Result{}, fmt.Errorf("unable to remove port mappings of service %s: %w", name, err)
+	}
+	if err := r.deletePinholes(ctx, log, *service); err != nil {
+		log.Error(err, "Failed to close IPv6 pinholes")
+		return ctrl.Result{}, fmt.Errorf("unable to close IPv6 pinholes for service %s: %w", name, err)
+	}
 
-// ServiceReconciler reconciles a Service object
-type ServiceReconciler struct {
-	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	log.Info("Holepunch disabled, port mappings removed")
+	if err := r.saveMappings(ctx, name, nil); err != nil {
+		log.Error(err, "Failed to forget saved port mappings")
+		return ctrl.Result{}, fmt.Errorf("unable to forget saved port mappings of service %s: %w", name, err)
+	}
+	r.portClaims.releaseAll(name)
+	r.metrics().RecordActiveMappings("", name, 0)
+	delete(service.Annotations, activeMappingsAnnotationName)
+	delete(service.Annotations, externalIPAnnotationName)
+	delete(service.Annotations, routerConnectionTypeAnnotationName)
+	delete(service.Annotations, conditionsAnnotationName)
+	delete(service.Annotations, activePinholesAnnotationName)
+	delete(service.Annotations, assignedPortsAnnotationName)
+	return ctrl.Result{}, r.removeFinalizer(ctx, service)
 }
 
-// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch
-// +kubebuilder:rbac:groups=core,resources=services/status,verbs=get
+func (r *ServiceReconciler) rateLimiter() workqueue.RateLimiter {
+	r.rateLimiterOnce.Do(func() {
+		if r.RateLimiter == nil {
+			r.RateLimiter = newRetryRateLimiter()
+		}
+	})
+	return r.RateLimiter
+}
 
-func (r *ServiceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
-	log := r.Log.WithValues("service", req.NamespacedName)
+func (r *ServiceReconciler) serviceIPSelector() ServiceIPSelector {
+	if r.ServiceIPSelector == nil {
+		return PreferIPv4Selector{}
+	}
+	return r.ServiceIPSelector
+}
 
-	// Get the service
-	var service corev1.Service
-	if err := r.Get(ctx, req.NamespacedName, &service); err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+func (r *ServiceReconciler) metrics() MetricsRecorder {
+	if r.Metrics == nil {
+		return noopMetricsRecorder{}
 	}
+	return r.Metrics
+}
 
-	// We only care about services that have our annotation on them
-	if !hasHolepunchAnnotation(service) {
-		// Nothing to be done
-		return ctrl.Result{}, nil
+// recordActiveMappings stores the port mappings we've made on the service as an annotation, along with the router's
+// external IP, its connection type and the given conditions so that users can see them. Any external ports the router
+// assigned in place of the ones we asked for are recorded too, so that we can ask for them again. The service is only
+// updated if any of these have changed. If the external IP or connection type is empty (because we couldn't find it
+// out) then whatever was last recorded is left alone.
+func (r *ServiceReconciler) recordActiveMappings(ctx context.Context, service *corev1.Service, mappings map[string]uint16, assigned map[string]uint16, externalIP string, connectionType string, conditions ...Condition) error {
+	// encoding/json sorts map keys, so this is stable for the same set of mappings.
+	encoded, err := json.Marshal(mappings)
+	if err != nil {
+		return err
+	}
+	var encodedAssigned []byte
+	if len(assigned) > 0 {
+		if encodedAssigned, err = json.Marshal(assigned); err != nil {
+			return err
+		}
+	}
+	conditionsChanged := setConditions(service, conditions...)
+	if !conditionsChanged && service.Annotations[activeMappingsAnnotationName] == string(encoded) &&
+		service.Annotations[assignedPortsAnnotationName] == string(encodedAssigned) &&
+		(externalIP == "" || service.Annotations[externalIPAnnotationName] == externalIP) &&
+		(connectionType == "" || service.Annotations[routerConnectionTypeAnnotationName] == connectionType) {
+		return nil
+	}
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	service.Annotations[activeMappingsAnnotationName] = string(encoded)
+	if encodedAssigned == nil {
+		delete(service.Annotations, assignedPortsAnnotationName)
+	} else {
+		service.Annotations[assignedPortsAnnotationName] = string(encodedAssigned)
 	}
+	if externalIP != "" {
+		service.Annotations[externalIPAnnotationName] = externalIP
+	}
+	if connectionType != "" {
+		service.Annotations[routerConnectionTypeAnnotationName] = connectionType
+	}
+	return r.Update(ctx, service)
+}
 
-	// We only care about LoadBalancer services. We need a real internal IP to map to!
-	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
-		// This means we've put the annotation on a service that isn't a loadbalancer.
-		log.Error(nil, "Holepunch enabled on non-LoadBalancer service")
-		// TODO emit event onto the service
-		return ctrl.Result{}, nil
+// cleanupFailed records a failed attempt to remove the port mappings for a deleted service. If we've not yet run out of
+// attempts then the error is returned so that we retry, otherwise (or if the error is Permanent) we give up and remove
+// the finalizer anyway so that the service isn't stuck forever. Any mappings left on the router will go away when their
+// lease expires.
+func (r *ServiceReconciler) cleanupFailed(ctx context.Context, log logr.Logger, service *corev1.Service, cleanupErr error) (ctrl.Result, error) {
+	maxAttempts := r.MaxCleanupAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxCleanupAttempts
 	}
 
-	// Get the port mapping, if one exists. This instructs us to setup the UPnP mappings to use a *different* external
-	// and internal port. Some routers may not support this feature.
-	portMapping, err := getHolepunchPortMapping(service)
-	if err != nil {
-		return ctrl.Result{}, err
+	key := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	r.cleanupAttemptsMu.Lock()
+	if r.cleanupAttempts == nil {
+		r.cleanupAttempts = make(map[types.NamespacedName]int)
 	}
+	r.cleanupAttempts[key]++
+	attempts := r.cleanupAttempts[key]
+	r.cleanupAttemptsMu.Unlock()
 
-	// Find a router to configure
-	router, err := PickRouterClient(ctx)
-	if err != nil {
-		log.Error(err, "Failed to find router to configure")
-		return ctrl.Result{}, err
+	if attempts < maxAttempts && errorKind(cleanupErr) != Permanent {
+		log.Error(cleanupErr, "Failed to remove UPnP port-forwarding, will retry",
+			"attempt", attempts,
+			"max-attempts", maxAttempts)
+		return ctrl.Result{}, cleanupErr
 	}
 
-	// Ask that router for *it's* external IP.
-	// This is where the term "external" gets weird. There's the underlying pods in the K8s cluster which have IPs, then
-	// the service has an IP inside the cluster, but it also has an "external" IP which is really an IP on the user's
-	// home network (usually), and when we ask the *router* for "external" we really do mean public internet IP.
-	externalIP, err := router.GetExternalIPAddress()
-	if err != nil {
-		log.Error(err, "Failed to resolve external IP address")
-		return ctrl.Result{}, err
+	log.Error(cleanupErr, "Failed to remove UPnP port-forwarding, giving up and leaving mappings to expire",
+		"attempt", attempts,
+		"max-attempts", maxAttempts,
+		"lease-duration", r.defaultLeaseDuration())
+	r.resetCleanupAttempts(service)
+	return ctrl.Result{}, r.removeFinalizer(ctx, service)
+}
+
+// defaultLeaseDuration returns how long, in seconds, port mapping leases last for when a service doesn't say.
+func (r *ServiceReconciler) defaultLeaseDuration() uint32 {
+	if config := r.configSpec(); config != nil && config.LeaseDurationSeconds != nil {
+		return uint32(*config.LeaseDurationSeconds)
 	}
-	log = log.WithValues("external-ip", externalIP)
+	if r.LeaseDuration <= 0 {
+		return leaseDurationSeconds
+	}
+	return uint32(r.LeaseDuration / time.Second)
+}
+
+func (r *ServiceReconciler) resetCleanupAttempts(service *corev1.Service) {
+	r.cleanupAttemptsMu.Lock()
+	defer r.cleanupAttemptsMu.Unlock()
+	delete(r.cleanupAttempts, types.NamespacedName{Namespace: service.Namespace, Name: service.Name})
+}
+
+// markProcessed records that the service's ports have been forwarded, and don't need forwarding again until renewAt
+// unless the service changes. The service must be as it was after any updates we made to it.
+func (r *ServiceReconciler) markProcessed(service corev1.Service, renewAt time.Time) {
+	r.processedMu.Lock()
+	defer r.processedMu.Unlock()
+	if r.processed == nil {
+		r.processed = make(map[types.NamespacedName]processedService)
+	}
+	r.processed[types.NamespacedName{Namespace: service.Namespace, Name: service.Name}] = processedService{
+		resourceVersion: service.ResourceVersion,
+		renewAt:         renewAt,
+	}
+}
+
+// unchangedSinceProcessed returns true if the service is exactly as it was when we last forwarded its ports, and their
+// leases don't need renewing yet. It also returns when they do.
+func (r *ServiceReconciler) unchangedSinceProcessed(service corev1.Service) (time.Time, bool) {
+	r.processedMu.RLock()
+	defer r.processedMu.RUnlock()
+	processed, ok := r.processed[types.NamespacedName{Namespace: service.Namespace, Name: service.Name}]
+	if !ok || processed.resourceVersion != service.ResourceVersion || !time.Now().Before(processed.renewAt) {
+		return time.Time{}, false
+	}
+	return processed.renewAt, true
+}
+
+// forgetProcessed makes sure the service is fully reconciled next time.
+func (r *ServiceReconciler) forgetProcessed(name types.NamespacedName) {
+	r.processedMu.Lock()
+	defer r.processedMu.Unlock()
+	delete(r.processed, name)
+}
+
+func (r *ServiceReconciler) removeFinalizer(ctx context.Context, service *corev1.Service) error {
+	controllerutil.RemoveFinalizer(service, portMappingCleanupFinalizer)
+	return r.Update(ctx, service)
+}
 
-	// Find the service's IP, that we're hoping is a local network IP from the perspective of the router.
-	serviceIP, err := getServiceIP(service)
+// deletePortMappings removes every port mapping that we've made for the service from the router. Mappings whose
+// description doesn't start with prefix are left alone, as something else must have taken the port over.
+func deletePortMappings(log logr.Logger, router RouterClient, service corev1.Service, prefix string) error {
+	mappings, err := getActiveMappings(service)
 	if err != nil {
-		log.Error(err, "Failed to get IP for service (has it not been allocated yet?)")
-		return ctrl.Result{}, err
+		return err
 	}
-	log = log.WithValues("service-ip", serviceIP)
+	if mappings == nil {
+		// We don't have a record of what we mapped (e.g., the service was last reconciled by an older version of
+		// holepunch), so work out what we *would* have mapped from the spec.
+		mappings, err = getSpecMappings(service)
+		if err != nil {
+			return err
+		}
+	}
+
+	// If the remote host annotation is invalid then we can't have used it, so we'll have made the mappings for any
+	// remote host.
+	remoteHost, _ := getRemoteHost(service)
+
+	for _, key := range sortedMappingKeys(mappings) {
+		_, protocol, err := parseMappingKey(key)
+		if err != nil {
+			return err
+		}
+		externalPort := mappings[key]
+
+		log.Info("Removing UPnP port-forwarding", "external-port", externalPort, "protocol", protocol)
+		if err := deleteOwnedPortMapping(log, router, prefix, unprefixedDescription(service), remoteHost, externalPort,
+			protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePortMapping removes a single port mapping from the router. Mappings for a remote host may have been made for
+// any remote host instead if the router didn't support it, so if we can't remove the mapping for the remote host then
+// we try that too.
+func deletePortMapping(router RouterClient, remoteHost string, externalPort uint16, protocol string) error {
+	err := router.DeletePortMapping(remoteHost, externalPort, protocol)
+	if err != nil && remoteHost != "" {
+		err = router.DeletePortMapping("", externalPort, protocol)
+	}
+	return err
+}
 
-	description := fmt.Sprintf("Mapping for %s/%s", service.Name, service.Namespace)
+// getActiveMappings reads back the port mappings recorded on the service by recordActiveMappings. If there is no
+// record then nil is returned.
+func getActiveMappings(service corev1.Service) (map[string]uint16, error) {
+	encoded, ok := service.Annotations[activeMappingsAnnotationName]
+	if !ok {
+		return nil, nil
+	}
+	mappings := make(map[string]uint16)
+	if err := json.Unmarshal([]byte(encoded), &mappings); err != nil {
+		return nil, permanentError(fmt.Errorf("unable to parse %s annotation: %w", activeMappingsAnnotationName, err))
+	}
+	return mappings, nil
+}
+
+// getSpecMappings works out the port mappings we would make for a service from its spec and annotations, in the same
+// form as is recorded by recordActiveMappings. Ports with protocols we can't forward are skipped.
+//
+// For NodePort services we forward to the node port rather than the service port, but the external port still defaults
+// to (and the port mapping annotations still refer to) the service port. So a service with port 80 and node port 30080
+// will be mapped from external port 80 to internal port 30080.
+func getSpecMappings(service corev1.Service) (map[string]uint16, error) {
+	portMapping, err := GetPortMappings(service)
+	if err != nil {
+		return nil, err
+	}
 
-	// Try to forward every port
+	mappings := make(map[string]uint16)
 	for _, servicePort := range service.Spec.Ports {
-		// For some reason the Kubernetes Service API thinks a port can be an int32. On Linux at least it'll *always*
-		// be a uint16 so this is a safe cast.
-		portNumber := uint16(servicePort.Port)
 		protocol, err := toUPnPProtocol(servicePort.Protocol)
 		if err != nil {
-			log.Error(err, "Unable to resolve protocol to use")
-			return ctrl.Result{}, err
+			continue
 		}
-
-		// Figure out if we want to map the port
+		portNumber := uint16(servicePort.Port)
 		externalPort, ok := portMapping[portNumber]
 		if !ok {
-			// We didn't have a mapping for this port.
 			externalPort = portNumber
 		}
+		internalPort := portNumber
+		if service.Spec.Type == corev1.ServiceTypeNodePort {
+			if servicePort.NodePort == 0 {
+				return nil, fmt.Errorf("no node port allocated for port %d (not yet allocated?)", servicePort.Port)
+			}
+			internalPort = uint16(servicePort.NodePort)
+		}
+		mappings[mappingKey(internalPort, protocol)] = externalPort
+	}
+	return mappings, nil
+}
 
-		// Log out
-		portLogger := log.WithValues("forwarding-port", portNumber,
-			"external-port", externalPort,
-			"upnp-description", description,
-			"lease-duration", leaseDurationSeconds)
-		portLogger.Info("Attempting to forward port from router with UPnP")
-
-		if err = router.AddPortMapping(
-			"",
-			// External port number to expose to Internet:
-			externalPort,
-			// Forward TCP (this could be "UDP" if we wanted that instead).
-			protocol,
-			// Internal port number on the LAN to forward to.
-			// Some routers might not support this being different to the external
-			// port number.
-			portNumber,
-			// Internal address on the LAN we want to forward to.
-			serviceIP,
-			// Enabled:
-			true,
-			// Informational description for the client requesting the port forwarding.
-			description,
-			// How long should the port forward last for in seconds.
-			// If you want to keep it open for longer and potentially across router
-			// resets, you might want to periodically request before this elapses.
-			leaseDurationSeconds,
-		); err != nil {
-			portLogger.Error(err, "Failed to configure UPnP port-forwarding")
-			return ctrl.Result{}, err
+// filterMappingsByProtocol removes any mappings for protocols we haven't been asked to forward.
+func filterMappingsByProtocol(log logr.Logger, mappings map[string]uint16, forwardTCP, forwardUDP bool) map[string]uint16 {
+	filtered := make(map[string]uint16)
+	for _, key := range sortedMappingKeys(mappings) {
+		_, protocol, err := parseMappingKey(key)
+		if err == nil && ((protocol == "TCP" && !forwardTCP) || (protocol == "UDP" && !forwardUDP)) {
+			log.Info("Skipping port, as its protocol isn't enabled by the holepunch annotation", "mapping", key)
+			continue
 		}
+		filtered[key] = mappings[key]
 	}
+	return filtered
+}
 
-	// Even on a "success" we need to come back before our lease is up to redo it.
-	log.Info("Success, ports forwarded.", "reschedule-seconds", leaseDurationSeconds - 30)
-	return ctrl.Result{RequeueAfter: (leaseDurationSeconds - 30) * time.Second}, nil
+// filterSkippedPorts removes the mappings for any service ports that we've been asked to skip, either with the skip
+// ports annotation or by disabling them individually.
+func filterSkippedPorts(log logr.Logger, service corev1.Service, mappings map[string]uint16, skippedPorts map[uint16]bool) map[string]uint16 {
+	for _, servicePort := range service.Spec.Ports {
+		if !skippedPorts[uint16(servicePort.Port)] {
+			continue
+		}
+		protocol, err := toUPnPProtocol(servicePort.Protocol)
+		if err != nil {
+			continue
+		}
+		// Mappings are keyed by the port we forward to, which for NodePort services is the node port.
+		internalPort := uint16(servicePort.Port)
+		if service.Spec.Type == corev1.ServiceTypeNodePort {
+			internalPort = uint16(servicePort.NodePort)
+		}
+		key := mappingKey(internalPort, protocol)
+		if _, ok := mappings[key]; ok {
+			log.V(1).Info("Skipping port, as it has been disabled by annotation", "port", servicePort.Port)
+			delete(mappings, key)
+		}
+	}
+	return mappings
+}
+
+// getSkippedPorts parses the skip ports annotation, which is a comma-separated list of service ports that should not
+// be forwarded (e.g., "9090,9091").
+func getSkippedPorts(service corev1.Service) (map[uint16]bool, error) {
+	skipped := make(map[uint16]bool)
+	value, ok := service.Annotations[skipPortsAnnotationName]
+	if !ok {
+		return skipped, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(entry), 10, 16)
+		if err != nil {
+			return nil, permanentError(fmt.Errorf("invalid port %q in %s annotation: %w", entry, skipPortsAnnotationName, err))
+		}
+		skipped[uint16(port)] = true
+	}
+	return skipped, nil
+}
+
+// getPortEnabledMap parses the per-port enabled annotations (e.g., holepunch.port.enabled/80: "false"), which turn
+// forwarding individual service ports on or off. Ports without an annotation aren't in the map, and are enabled.
+func getPortEnabledMap(service corev1.Service) (map[uint16]bool, error) {
+	enabled := make(map[uint16]bool)
+	for key, value := range service.Annotations {
+		if !strings.HasPrefix(key, portEnabledAnnotationPrefix) {
+			continue
+		}
+		port, err := strconv.ParseUint(strings.TrimPrefix(key, portEnabledAnnotationPrefix), 10, 16)
+		if err != nil {
+			return nil, permanentError(fmt.Errorf("invalid port in annotation %s: %w", key, err))
+		}
+		on, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, permanentError(fmt.Errorf("annotation %s must be \"true\" or \"false\", not %q", key, value))
+		}
+		enabled[uint16(port)] = on
+	}
+	return enabled, nil
+}
+
+// sortedMappingKeys returns the keys of a set of port mappings in a stable order, which makes what we do to the router a
+// lot easier to reason about in logs.
+func sortedMappingKeys(mappings map[string]uint16) []string {
+	keys := make([]string, 0, len(mappings))
+	for key := range mappings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mappingKey is the key we use to record a port mapping, in the form "<internal port>/<protocol>". e.g., "80/TCP".
+func mappingKey(internalPort uint16, protocol string) string {
+	return fmt.Sprintf("%d/%s", internalPort, protocol)
+}
+
+func parseMappingKey(key string) (uint16, string, error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid port mapping key %q", key)
+	}
+	internalPort, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid port mapping key %q: %w", key, err)
+	}
+	return uint16(internalPort), parts[1], nil
 }
 
-func getHolepunchPortMapping(service corev1.Service) (map[uint16]uint16, error) {
+// GetHolepunchPortMapping parses a service's port mapping annotations into a map of internal port to external port.
+//
+// The internal port can be given by the name of a port on the service as well as by number, so
+// "holepunch.port/http: 3000" maps whichever port is named "http" to external port 3000. As well as single ports,
+// annotations can map a range of ports. "holepunch.port/8000-8010: 9000" maps internal ports
+// 8000 through 8010 to external ports 9000 through 9010, which could also be written as
+// "holepunch.port/8000-8010: 9000-9010".
+func GetHolepunchPortMapping(service corev1.Service) (map[uint16]uint16, error) {
 	portMapping := make(map[uint16]uint16)
 	for annotationName, annotationValue := range service.Annotations {
 		if strings.HasPrefix(annotationName, holepunchPortMapAnnotationPrefix) {
@@ -156,32 +1561,257 @@ func getHolepunchPortMapping(service corev1.Service) (map[uint16]uint16, error)
 			// Meanwhile "external port" is "port exposed by the router on the open internet". If we have the annotaiton
 			// "holepunch.port/80: 3000" that means that our "internal port" is 80 and our "external port" is 3000.
 			internalPortStr := strings.TrimPrefix(annotationName, holepunchPortMapAnnotationPrefix)
-			internalPort, err := strconv.ParseUint(internalPortStr, 10, 16)
+			internalStart, internalEnd, err := resolveInternalPorts(service, internalPortStr)
 			if err != nil {
-				return nil, err
+				return nil, permanentError(err)
 			}
 			externalPortStr := annotationValue
-			externalPort, err := strconv.ParseUint(externalPortStr, 10, 16)
+			externalStart, externalEnd, err := parsePortRange(externalPortStr)
 			if err != nil {
-				return nil, err
+				return nil, permanentError(err)
+			}
+
+			// A single external port is the start of a range the same length as the internal one.
+			length := uint32(internalEnd - internalStart)
+			if externalStart == externalEnd && !strings.Contains(externalPortStr, "-") {
+				if uint32(externalStart)+length > math.MaxUint16 {
+					return nil, permanentError(fmt.Errorf("external port range starting at %d for %s is past port %d",
+						externalStart, annotationName, math.MaxUint16))
+				}
+				externalEnd = externalStart + uint16(length)
+			}
+			if uint32(externalEnd-externalStart) != length {
+				return nil, permanentError(fmt.Errorf("internal port range %s and external port range %s are different lengths",
+					internalPortStr, externalPortStr))
+			}
+
+			for offset := uint32(0); offset <= length; offset++ {
+				portMapping[internalStart+uint16(offset)] = externalStart + uint16(offset)
 			}
-			// These casts to uint16 (from uint64) are safe because we told strconv.ParseUint earlier to confine to 16
-			// bits only.
-			portMapping[uint16(internalPort)] = uint16(externalPort)
 		}
 	}
 	return portMapping, nil
 }
 
-func hasHolepunchAnnotation(service corev1.Service) bool {
-	for name, value := range service.Annotations {
-		if name == holepunchAnnotationName {
-			return value == "true"
+// validatePortMappingAnnotations checks that every port mapping annotation refers to at least one port on the service,
+// returning an error listing the annotations that don't. A range only has to include one of the service's ports, as
+// the rest of the range is allowed to be missing. Annotations that can't be parsed are left to GetHolepunchPortMapping.
+func validatePortMappingAnnotations(service corev1.Service) error {
+	servicePorts := make(map[uint16]bool)
+	for _, servicePort := range service.Spec.Ports {
+		servicePorts[uint16(servicePort.Port)] = true
+	}
+
+	var unmatched []string
+	for annotationName := range service.Annotations {
+		if !strings.HasPrefix(annotationName, holepunchPortMapAnnotationPrefix) {
+			continue
+		}
+		start, end, err := resolveInternalPorts(service, strings.TrimPrefix(annotationName, holepunchPortMapAnnotationPrefix))
+		if err != nil {
+			continue
+		}
+		matched := false
+		for port := uint32(start); port <= uint32(end); port++ {
+			matched = matched || servicePorts[uint16(port)]
+		}
+		if !matched {
+			unmatched = append(unmatched, annotationName)
+		}
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+	sort.Strings(unmatched)
+	return fmt.Errorf("port mapping annotations %s don't match any port on the service", strings.Join(unmatched, ", "))
+}
+
+// resolveInternalPorts works out which internal ports a port mapping annotation refers to. This is either the name of
+// a port on the service, or anything parsePortRange accepts.
+func resolveInternalPorts(service corev1.Service, value string) (uint16, uint16, error) {
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Name != "" && servicePort.Name == value {
+			return uint16(servicePort.Port), uint16(servicePort.Port), nil
+		}
+	}
+	start, end, err := parsePortRange(value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a port number, port range, or the name of a port on the service: %w", value, err)
+	}
+	return start, end, nil
+}
+
+// parsePortRange parses either a single port (e.g., "80") or an inclusive range of ports (e.g., "8000-8010"). A single
+// port is returned as a range with the same start and end.
+func parsePortRange(value string) (uint16, uint16, error) {
+	parts := strings.SplitN(value, "-", 2)
+	// These casts to uint16 (from uint64) are safe because we told strconv.ParseUint to confine to 16 bits only.
+	start, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return uint16(start), uint16(start), nil
+	}
+	end, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("port range %q starts after it ends", value)
+	}
+	if end-start+1 > maxPortRangeLength {
+		return 0, 0, fmt.Errorf("port range %q is longer than %d ports", value, maxPortRangeLength)
+	}
+	return uint16(start), uint16(end), nil
+}
+
+// getLeaseDuration returns how long, in seconds, port mapping leases should last for the service. This is taken from
+// the lease duration annotation if present (e.g., "30m", or "2h"), otherwise defaultSeconds is used.
+func getLeaseDuration(service corev1.Service, defaultSeconds uint32) (uint32, error) {
+	value, ok := service.Annotations[leaseDurationAnnotationName]
+	if !ok {
+		return defaultSeconds, nil
+	}
+	return parseLeaseDuration(leaseDurationAnnotationName, value)
+}
+
+// getPortLeaseDuration returns how long, in seconds, the lease on the port mapping for one of the service's ports
+// should last for. This is taken from the per-port lease annotation if present (e.g., holepunch.port.lease/80: "10m"),
+// otherwise it's the same as for the rest of the service, from getLeaseDuration.
+func getPortLeaseDuration(service corev1.Service, port uint16, defaultSeconds uint32) (uint32, error) {
+	name := portLeaseAnnotationPrefix + strconv.Itoa(int(port))
+	value, ok := service.Annotations[name]
+	if !ok {
+		return getLeaseDuration(service, defaultSeconds)
+	}
+	return parseLeaseDuration(name, value)
+}
+
+// parseLeaseDuration parses the value of the lease duration annotation called name into seconds.
+func parseLeaseDuration(name, value string) (uint32, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, permanentError(fmt.Errorf("unable to parse %s annotation %q as a duration (e.g., \"30m\" or \"2h\"): %w",
+			name, value, err))
+	}
+	if duration < minLeaseDuration || duration > maxLeaseDuration {
+		return 0, permanentError(fmt.Errorf("%s annotation %q must be between %s and %s",
+			name, value, minLeaseDuration, maxLeaseDuration))
+	}
+	return uint32(duration / time.Second), nil
+}
+
+// getReconcileInterval returns how long to wait before renewing the service's port mappings, given that their leases
+// last for leaseDuration seconds. This is taken from the reconcile interval annotation if present (e.g., "5m"),
+// otherwise it's 30 seconds before the lease runs out.
+func getReconcileInterval(service corev1.Service, leaseDuration uint32) (time.Duration, error) {
+	lease := time.Duration(leaseDuration) * time.Second
+	value, ok := service.Annotations[reconcileIntervalAnnotationName]
+	if !ok {
+		return lease - 30*time.Second, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, permanentError(fmt.Errorf("unable to parse %s annotation %q as a duration (e.g., \"5m\"): %w",
+			reconcileIntervalAnnotationName, value, err))
+	}
+	if interval <= 0 || interval >= lease {
+		return 0, permanentError(fmt.Errorf("%s annotation %q must be positive and shorter than the lease duration of %s",
+			reconcileIntervalAnnotationName, value, lease))
+	}
+	return interval, nil
+}
+
+// getRemoteHost returns the remote host that the service's port mappings should be restricted to, from the remote
+// host annotation. This must be an IPv4 or IPv6 address, or a hostname, which withResolvedRemoteHost turns into an IP.
+// If the annotation isn't set then an empty string is returned, which allows any remote host.
+func getRemoteHost(service corev1.Service) (string, error) {
+	value, ok := service.Annotations[remoteHostAnnotationName]
+	if !ok {
+		return "", nil
+	}
+	value = strings.TrimSpace(value)
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String(), nil
+	}
+	hostname := strings.ToLower(strings.TrimSuffix(value, "."))
+	if len(validation.IsDNS1123Subdomain(hostname)) > 0 {
+		return "", permanentError(fmt.Errorf("%s annotation %q is not an IP address or hostname", remoteHostAnnotationName,
+			value))
+	}
+	return hostname, nil
+}
+
+// getMappingDescription works out the description to give the router for a service's port mappings. This is the
+// description annotation if there is one, otherwise it says which service the mapping is for. Routers only have to
+// accept descriptions up to 128 characters long, so a longer annotation is truncated, in which case truncated is true.
+func getMappingDescription(service corev1.Service) (description string, truncated bool) {
+	description, ok := service.Annotations[descriptionAnnotationName]
+	if !ok || strings.TrimSpace(description) == "" {
+		if service.Spec.Type == corev1.ServiceTypeNodePort {
+			return fmt.Sprintf("NodePort mapping for %s/%s", service.Name, service.Namespace), false
+		}
+		return fmt.Sprintf("Mapping for %s/%s", service.Name, service.Namespace), false
+	}
+	if runes := []rune(description); len(runes) > maxDescriptionLength {
+		return string(runes[:maxDescriptionLength]), true
+	}
+	return description, false
+}
+
+// HasHolepunchAnnotation returns true if the service has asked for its ports to be forwarded. Only "true" or a list of
+// protocols counts, so a value we don't understand (e.g., "ture") doesn't forward anything.
+func HasHolepunchAnnotation(service corev1.Service) bool {
+	forwardTCP, forwardUDP, err := getHolepunchProtocolFilter(service)
+	return err == nil && (forwardTCP || forwardUDP)
+}
+
+// hasInvalidHolepunchAnnotation returns true if the service has the holepunch annotation, but with a value we don't
+// understand. Its ports aren't forwarded, but the user should be told why.
+func hasInvalidHolepunchAnnotation(service corev1.Service) bool {
+	_, _, err := getHolepunchProtocolFilter(service)
+	return err != nil
+}
+
+// getHolepunchProtocolFilter works out which protocols the holepunch annotation asks for ports to be forwarded for.
+// The annotation can be "true" for both TCP and UDP, or a comma-separated list of protocols in any case (e.g., "tcp"
+// or "TCP,udp"). If the annotation is missing or "false" then neither protocol is forwarded.
+func getHolepunchProtocolFilter(service corev1.Service) (filterTCP, filterUDP bool, err error) {
+	value, ok := service.Annotations[holepunchAnnotationName]
+	if !ok || strings.EqualFold(strings.TrimSpace(value), "false") {
+		return false, false, nil
+	}
+	if strings.TrimSpace(value) == "true" {
+		return true, true, nil
+	}
+	for _, protocol := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(protocol)) {
+		case "tcp":
+			filterTCP = true
+		case "udp":
+			filterUDP = true
+		default:
+			return false, false, permanentError(fmt.Errorf(
+				"%s annotation %q must be \"true\", \"false\", or a comma-separated list of protocols (\"tcp\" or \"udp\")",
+				holepunchAnnotationName, value))
+		}
+	}
+	return filterTCP, filterUDP, nil
+}
+
+func hasFinalizer(service corev1.Service, finalizer string) bool {
+	for _, f := range service.Finalizers {
+		if f == finalizer {
+			return true
 		}
 	}
 	return false
 }
 
+// ErrProtocolNotSupported is returned when a service port uses a protocol that can't be forwarded, such as SCTP.
+var ErrProtocolNotSupported = errors.New("protocol not supported")
+
 func toUPnPProtocol(serviceProtocol corev1.Protocol) (string, error) {
 	if serviceProtocol == corev1.ProtocolTCP {
 		return "TCP", nil
@@ -189,81 +1819,190 @@ func toUPnPProtocol(serviceProtocol corev1.Protocol) (string, error) {
 		return "UDP", nil
 	} else {
 		// This could happen, for example with corev1.ProtocolSTCP
-		return "", errors.New(fmt.Sprintf("protocol type %s not supported", serviceProtocol))
+		return "", permanentError(fmt.Errorf("protocol type %s: %w", serviceProtocol, ErrProtocolNotSupported))
+	}
+}
+
+// getUseClusterIP parses the use-cluster-ip annotation, which asks for ports to be forwarded to the service's ClusterIP
+// rather than its LoadBalancer IP. Without the annotation the LoadBalancer IP is used.
+func getUseClusterIP(service corev1.Service) (bool, error) {
+	value, ok := service.Annotations[useClusterIPAnnotationName]
+	if !ok {
+		return false, nil
+	}
+	useClusterIP, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, permanentError(fmt.Errorf("annotation %s must be \"true\" or \"false\", not %q",
+			useClusterIPAnnotationName, value))
 	}
+	return useClusterIP, nil
 }
 
-func getServiceIP(service corev1.Service) (string, error) {
-	for _, ingress := range service.Status.LoadBalancer.Ingress {
-		if ingress.IP != "" {
-			// TODO don't just take the first
-			return ingress.IP, nil
+// getClusterIP returns the service's ClusterIP, which headless services don't have.
+func getClusterIP(service corev1.Service) (string, error) {
+	switch service.Spec.ClusterIP {
+	case "":
+		return "", errors.New("service has not been given a ClusterIP yet")
+	case corev1.ClusterIPNone:
+		return "", permanentError(fmt.Errorf("%s is set, but the service is headless and has no ClusterIP",
+			useClusterIPAnnotationName))
+	}
+	return service.Spec.ClusterIP, nil
+}
+
+// getServiceIP finds the IP of the service's LoadBalancer, using ServiceIPSelector to choose between them if there's
+// more than one, unless the service has picked one with the ingress-index annotation. Some cloud providers give a
+// LoadBalancer a hostname instead of an IP, in which case we resolve it and use the first IPv4 address we get back. If
+// the service has asked to use its ClusterIP, or the IP of a node running one of its pods, instead then that's
+// returned.
+func (r *ServiceReconciler) getServiceIP(ctx context.Context, service corev1.Service) (string, error) {
+	useClusterIP, err := getUseClusterIP(service)
+	if err != nil {
+		return "", err
+	}
+	useNodeIP, err := getUseNodeIP(service)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case useClusterIP && useNodeIP:
+		return "", permanentError(fmt.Errorf("%s and %s can't both be set", useClusterIPAnnotationName,
+			useNodeIPAnnotationName))
+	case useClusterIP:
+		return getClusterIP(service)
+	case useNodeIP:
+		return getNodeIPForService(ctx, r.Client, service)
+	}
+
+	ingresses := service.Status.LoadBalancer.Ingress
+	index, hasIndex, err := getIngressIndex(service)
+	if err != nil {
+		return "", err
+	}
+	var ip string
+	if hasIndex {
+		ip, err = getServiceIPAtIndex(service, index)
+		if err == nil || !errors.Is(err, ErrNoServiceIP) {
+			return ip, err
+		}
+		// Resolve the chosen ingress point's hostname before any others.
+		ingresses = append([]corev1.LoadBalancerIngress{ingresses[index]}, ingresses...)
+	} else {
+		ip, err = r.serviceIPSelector().Select(ingresses)
+	}
+	if err == nil {
+		if candidates := ingressIPs(ingresses); len(candidates) > 1 {
+			r.Log.V(1).Info("LoadBalancer has more than one IP, picked one to forward ports to",
+				"service", types.NamespacedName{Namespace: service.Namespace, Name: service.Name},
+				"candidates", candidates, "service-ip", ip)
+		}
+		return ip, nil
+	}
+	if !errors.Is(err, ErrNoServiceIP) {
+		return "", err
+	}
+
+	// No IPs, so fall back to any hostnames
+	var resolveErr error
+	for _, ingress := range ingresses {
+		if ingress.Hostname == "" {
+			continue
+		}
+		ip, err := r.resolveHostname(ctx, ingress.Hostname)
+		if err != nil {
+			resolveErr = err
+			continue
 		}
+		return ip, nil
+	}
+	if resolveErr != nil {
+		return "", resolveErr
 	}
-	return "", errors.New("no IP available for LoadBalancer (not yet allocated?)")
+	return "", err
 }
 
-type RouterClient interface {
-	AddPortMapping(
-		NewRemoteHost string,
-		NewExternalPort uint16,
-		NewProtocol string,
-		NewInternalPort uint16,
-		NewInternalClient string,
-		NewEnabled bool,
-		NewPortMappingDescription string,
-		NewLeaseDuration uint32,
-	) (err error)
+// resolveHostname looks up a LoadBalancer's hostname, returning the first IPv4 address.
+func (r *ServiceReconciler) resolveHostname(ctx context.Context, hostname string) (string, error) {
+	timeout := r.DNSTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	GetExternalIPAddress() (
-		NewExternalIPAddress string,
-		err error,
-	)
+	lookupHost := r.lookupHostFn
+	if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+	addresses, err := lookupHost(ctx, hostname)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve LoadBalancer hostname %q: %w", hostname, err)
+	}
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("LoadBalancer hostname %q did not resolve to any IPv4 addresses", hostname)
 }
 
-func PickRouterClient(ctx context.Context) (RouterClient, error) {
-	tasks, _ := errgroup.WithContext(ctx)
-	// Request each type of client in parallel, and return what is found.
-	var ip1Clients []*internetgateway2.WANIPConnection1
-	tasks.Go(func() error {
-		var err error
-		ip1Clients, _, err = internetgateway2.NewWANIPConnection1Clients()
-		return err
-	})
-	var ip2Clients []*internetgateway2.WANIPConnection2
-	tasks.Go(func() error {
-		var err error
-		ip2Clients, _, err = internetgateway2.NewWANIPConnection2Clients()
-		return err
-	})
-	var ppp1Clients []*internetgateway2.WANPPPConnection1
-	tasks.Go(func() error {
-		var err error
-		ppp1Clients, _, err = internetgateway2.NewWANPPPConnection1Clients()
-		return err
+// getNodeIP finds the internal IP of a node that we can forward NodePort traffic to. We use the first Ready node, in
+// name order so that we pick the same one every time unless it goes away.
+func getNodeIP(ctx context.Context, c client.Client) (string, error) {
+	var nodes corev1.NodeList
+	if err := c.List(ctx, &nodes); err != nil {
+		return "", err
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool {
+		return nodes.Items[i].Name < nodes.Items[j].Name
 	})
 
-	if err := tasks.Wait(); err != nil {
-		return nil, err
+	for _, node := range nodes.Items {
+		if !isNodeReady(node) {
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == corev1.NodeInternalIP && address.Address != "" {
+				return address.Address, nil
+			}
+		}
 	}
+	return "", errors.New("no Ready node with an internal IP available")
+}
 
-	// Trivial handling for where we find exactly one device to talk to, you
-	// might want to provide more flexible handling than this if multiple
-	// devices are found.
-	switch {
-	case len(ip2Clients) > 0:
-		return ip2Clients[0], nil
-	case len(ip1Clients) > 0:
-		return ip1Clients[0], nil
-	case len(ppp1Clients) > 0:
-		return ppp1Clients[0], nil
-	default:
-		return nil, errors.New("No services found")
+func isNodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
 	}
+	return false
 }
 
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("holepunch")
+	}
+	if err := mgr.GetFieldIndexer().IndexField(&corev1.Service{}, externalPortsIndexField, indexExternalPorts); err != nil {
+		return err
+	}
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Service{}).
-		Complete(r)
+		// Services without the annotation are still interesting if their namespace's HolepunchPolicy opts them in.
+		WithEventFilter(servicePredicate(func(meta metav1.Object) bool {
+			return isHolepunchService(meta) || r.namespaceOptedIn(meta)
+		})).
+		WithEventFilter(servicePredicate(r.inScope)).
+		WithEventFilter(HolepunchChangePredicate).
+		Build(r)
+	if err != nil {
+		return err
+	}
+	// These are watched separately, as the event filter would otherwise ignore them.
+	if err := c.Watch(&source.Kind{Type: &holepunchv1alpha1.HolepunchConfig{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.servicesForConfig)}); err != nil {
+		return err
+	}
+	return c.Watch(&source.Kind{Type: &holepunchv1alpha1.HolepunchPolicy{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.servicesForPolicy)})
 }
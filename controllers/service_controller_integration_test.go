@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
+)
+
+// These tests run the whole of Reconcile against a real API server, with a mock router. The reconciler reads through
+// a manager's cache, like it does when deployed, so that the external ports index is there. The controller itself
+// isn't started, so that each test decides when to reconcile.
+var _ = Describe("ServiceReconciler", func() {
+	const timeout = 10 * time.Second
+
+	var (
+		ctx       context.Context
+		namespace string
+		mgr       manager.Manager
+		stop      chan struct{}
+		router    *mockRouterClient
+		recorder  *record.FakeRecorder
+	)
+
+	// newReconciler makes a reconciler that reads through the manager's cache, with the given options on top of the
+	// mock router and event recorder.
+	newReconciler := func(opts ...Option) *ServiceReconciler {
+		return NewServiceReconciler(mgr.GetClient(), scheme.Scheme, append([]Option{
+			WithEventRecorder(recorder),
+			WithRouterClients(router),
+		}, opts...)...)
+	}
+
+	requestFor := func(name string) ctrl.Request {
+		return ctrl.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}
+	}
+
+	// createService creates a service, gives it a LoadBalancer IP if it's a LoadBalancer, and waits for the cache to
+	// see it.
+	createService := func(name string, serviceType corev1.ServiceType, annotations map[string]string) *corev1.Service {
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Type:  serviceType,
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, service)).To(Succeed())
+		if serviceType == corev1.ServiceTypeLoadBalancer {
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+			Expect(k8sClient.Status().Update(ctx, service)).To(Succeed())
+		}
+		Eventually(func() (string, error) {
+			var cached corev1.Service
+			err := mgr.GetClient().Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &cached)
+			return cached.ResourceVersion, err
+		}, timeout).Should(Equal(service.ResourceVersion))
+		return service
+	}
+
+	getService := func(name string) (*corev1.Service, error) {
+		var service corev1.Service
+		err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &service)
+		return &service, err
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		router = &mockRouterClient{externalIP: "203.0.113.1"}
+		recorder = record.NewFakeRecorder(100)
+
+		// Every test gets its own namespace, as envtest can't delete them.
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "holepunch-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		var err error
+		mgr, err = ctrl.NewManager(cfg, ctrl.Options{Scheme: scheme.Scheme, MetricsBindAddress: "0"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.GetFieldIndexer().IndexField(&corev1.Service{}, externalPortsIndexField, indexExternalPorts)).
+			To(Succeed())
+		stop = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(stop)).To(Succeed())
+		}()
+	})
+
+	AfterEach(func() {
+		close(stop)
+
+		// External ports are claimed across the whole cluster, so get rid of this test's services before the next one.
+		// They may still have our finalizer if the test didn't clean up.
+		var services corev1.ServiceList
+		Expect(k8sClient.List(ctx, &services, client.InNamespace(namespace))).To(Succeed())
+		for i := range services.Items {
+			service := &services.Items[i]
+			if len(service.Finalizers) > 0 {
+				service.Finalizers = nil
+				Expect(k8sClient.Update(ctx, service)).To(Succeed())
+			}
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, service))).To(Succeed())
+		}
+	})
+
+	It("forwards the ports of an annotated LoadBalancer service and requeues to renew the lease", func() {
+		createService("web", corev1.ServiceTypeLoadBalancer, map[string]string{holepunchAnnotationName: "true"})
+
+		result, err := newReconciler().Reconcile(requestFor("web"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+		Expect(result.RequeueAfter).To(BeNumerically("<=", leaseDurationSeconds*time.Second))
+
+		Expect(router.addCalls).To(HaveLen(1))
+		Expect(router.addCalls[0].ExternalPort).To(Equal(uint16(80)))
+		Expect(router.addCalls[0].Protocol).To(Equal("TCP"))
+		Expect(router.addCalls[0].InternalClient).To(Equal("192.168.1.10"))
+		Expect(router.addCalls[0].LeaseDuration).To(Equal(uint32(leaseDurationSeconds)))
+
+		// What we did is recorded on the service, so that we can clean up after it.
+		service, err := getService("web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Finalizers).To(ContainElement(portMappingCleanupFinalizer))
+		Expect(service.Annotations).To(HaveKey(activeMappingsAnnotationName))
+		Expect(service.Annotations).To(HaveKeyWithValue(externalIPAnnotationName, "203.0.113.1"))
+	})
+
+	It("leaves services without the annotation alone", func() {
+		createService("plain", corev1.ServiceTypeLoadBalancer, nil)
+
+		result, err := newReconciler().Reconcile(requestFor("plain"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+		Expect(router.addCalls).To(BeEmpty())
+
+		service, err := getService("plain")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Finalizers).To(BeEmpty())
+	})
+
+	It("doesn't forward ports for annotated services that aren't a LoadBalancer or NodePort", func() {
+		createService("internal", corev1.ServiceTypeClusterIP, map[string]string{holepunchAnnotationName: "true"})
+
+		result, err := newReconciler().Reconcile(requestFor("internal"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+		Expect(router.addCalls).To(BeEmpty())
+
+		service, err := getService("internal")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Finalizers).To(BeEmpty())
+	})
+
+	It("requeues when the router can't be found", func() {
+		createService("web", corev1.ServiceTypeLoadBalancer, map[string]string{holepunchAnnotationName: "true"})
+		r := NewServiceReconciler(mgr.GetClient(), scheme.Scheme,
+			WithEventRecorder(recorder),
+			WithHolepunchMode(HolepunchModeUPnP),
+			WithRouterClientFactory(func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+				return nil, errors.New("no UPnP routers found")
+			}),
+		)
+
+		result, err := r.Reconcile(requestFor("web"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+		state, _ := r.RouterState()
+		Expect(state).To(Equal(RouterLost))
+	})
+
+	It("requeues when the router won't add a port mapping", func() {
+		createService("web", corev1.ServiceTypeLoadBalancer, map[string]string{holepunchAnnotationName: "true"})
+		router.addErr = errors.New("something went wrong")
+
+		result, err := newReconciler().Reconcile(requestFor("web"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+		Expect(router.addCalls).To(HaveLen(1))
+
+		// Nothing was forwarded, so there's nothing recorded as active.
+		service, err := getService("web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Annotations).NotTo(HaveKey(activeMappingsAnnotationName))
+	})
+
+	It("removes the port mappings when the service is deleted", func() {
+		service := createService("web", corev1.ServiceTypeLoadBalancer, map[string]string{holepunchAnnotationName: "true"})
+		r := newReconciler()
+		_, err := r.Reconcile(requestFor("web"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(router.addCalls).To(HaveLen(1))
+
+		// Our finalizer holds up the deletion until we've cleaned up.
+		Expect(k8sClient.Delete(ctx, service)).To(Succeed())
+		Eventually(func() (bool, error) {
+			var cached corev1.Service
+			err := mgr.GetClient().Get(ctx, requestFor("web").NamespacedName, &cached)
+			return !cached.DeletionTimestamp.IsZero(), err
+		}, timeout).Should(BeTrue())
+
+		_, err = r.Reconcile(requestFor("web"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(router.deleteCalls).To(ConsistOf(portMappingCall{ExternalPort: 80, Protocol: "TCP"}))
+
+		Eventually(func() bool {
+			_, err := getService("web")
+			return apierrors.IsNotFound(err)
+		}, timeout).Should(BeTrue())
+	})
+
+	It("warns about a service asking for an external port that another already has", func() {
+		createService("first", corev1.ServiceTypeLoadBalancer, map[string]string{holepunchAnnotationName: "true"})
+		// Creation timestamps only have a resolution of a second, so make sure the second service is created later.
+		time.Sleep(time.Second)
+		createService("second", corev1.ServiceTypeLoadBalancer, map[string]string{holepunchAnnotationName: "true"})
+
+		result, err := newReconciler().Reconcile(requestFor("second"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+		Expect(router.addCalls).To(BeEmpty())
+		Expect(drainEvents(recorder)).To(ContainElement(fmt.Sprintf(
+			"Warning PortConflict External port 80/TCP is already claimed by service %s/first", namespace)))
+	})
+
+	It("picks up a HolepunchPolicy in the service's namespace", func() {
+		Expect(k8sClient.Create(ctx, &holepunchv1alpha1.HolepunchPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "holepunch"},
+			Spec:       holepunchv1alpha1.HolepunchPolicySpec{DefaultLeaseDuration: &metav1.Duration{Duration: 30 * time.Minute}},
+		})).To(Succeed())
+		// The policy opts the service in, even without the annotation.
+		createService("web", corev1.ServiceTypeLoadBalancer, nil)
+
+		Eventually(func() ([]addPortMappingCall, error) {
+			_, err := newReconciler().Reconcile(requestFor("web"))
+			return router.addCalls, err
+		}, timeout).ShouldNot(BeEmpty())
+		Expect(router.addCalls[0].LeaseDuration).To(Equal(uint32(1800)))
+
+		service, err := getService("web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(service.Annotations).NotTo(HaveKey(leaseDurationAnnotationName))
+	})
+})
@@ -1,15 +1,174 @@
 package controllers
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+type portMappingCall struct {
+	RemoteHost   string
+	ExternalPort uint16
+	Protocol     string
+}
+
+type addPortMappingCall struct {
+	portMappingCall
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+}
+
+// portMappingEntry is a mapping that a mockRouterClient already has.
+type portMappingEntry struct {
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+}
+
+// mockRouterClient is a RouterClient that records the calls made to it rather than talking to a real router.
+type mockRouterClient struct {
+	// mu guards the recorded calls, as ports may be forwarded concurrently.
+	mu          sync.Mutex
+	addCalls    []addPortMappingCall
+	addErr      error
+	deleteCalls []portMappingCall
+	deleteErr   error
+	// entries are the mappings the router already has, keyed by external port and protocol as from mappingKey.
+	entries map[string]portMappingEntry
+	// externalIP is the router's external IP, or "203.0.113.1" if empty.
+	externalIP      string
+	externalIPErr   error
+	externalIPCalls int
+	// numberOfEntriesErr is returned by GetPortMappingNumberOfEntries, which otherwise counts entries.
+	numberOfEntriesErr error
+	// connectionType is the router's connection type, or "IP_Routed" if empty.
+	connectionType      string
+	connectionTypeErr   error
+	connectionTypeCalls int
+}
+
+func (m *mockRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addCalls = append(m.addCalls, addPortMappingCall{
+		portMappingCall: portMappingCall{
+			RemoteHost:   remoteHost,
+			ExternalPort: externalPort,
+			Protocol:     protocol,
+		},
+		InternalPort:   internalPort,
+		InternalClient: internalClient,
+		Enabled:        enabled,
+		Description:    description,
+		LeaseDuration:  leaseDuration,
+	})
+	return m.addErr
+}
+
+// addedExternalPorts returns the external ports that AddPortMapping was called with, in the order the calls were made.
+func (m *mockRouterClient) addedExternalPorts() []uint16 {
+	var ports []uint16
+	for _, call := range m.addCalls {
+		ports = append(ports, call.ExternalPort)
+	}
+	return ports
+}
+
+func (m *mockRouterClient) DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteCalls = append(m.deleteCalls, portMappingCall{
+		RemoteHost:   remoteHost,
+		ExternalPort: externalPort,
+		Protocol:     protocol,
+	})
+	return m.deleteErr
+}
+
+func (m *mockRouterClient) GetSpecificPortMappingEntry(remoteHost string, externalPort uint16, protocol string) (uint16, string, bool, string, uint32, error) {
+	entry, ok := m.entries[mappingKey(externalPort, protocol)]
+	if !ok {
+		return 0, "", false, "", 0, errors.New("NoSuchEntryInArray")
+	}
+	return entry.InternalPort, entry.InternalClient, entry.Enabled, entry.Description, entry.LeaseDuration, nil
+}
+
+// GetGenericPortMappingEntry lists the router's existing mappings, in order of their keys.
+func (m *mockRouterClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if int(index) >= len(keys) {
+		return "", 0, "", 0, "", false, "", 0, upnpFault(ErrCodeSpecifiedArrayIndexInvalid)
+	}
+	externalPort, protocol, err := parseMappingKey(keys[index])
+	if err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+	entry := m.entries[keys[index]]
+	return "", externalPort, protocol, entry.InternalPort, entry.InternalClient, entry.Enabled, entry.Description, entry.LeaseDuration, nil
+}
+
+func (m *mockRouterClient) GetPortMappingNumberOfEntries() (uint16, error) {
+	if m.numberOfEntriesErr != nil {
+		return 0, m.numberOfEntriesErr
+	}
+	return uint16(len(m.entries)), nil
+}
+
+func (m *mockRouterClient) GetExternalIPAddress() (string, error) {
+	m.mu.Lock()
+	m.externalIPCalls++
+	m.mu.Unlock()
+	if m.externalIPErr != nil {
+		return "", m.externalIPErr
+	}
+	if m.externalIP != "" {
+		return m.externalIP, nil
+	}
+	return "203.0.113.1", nil
+}
+
+func (m *mockRouterClient) GetConnectionTypeInfo() (string, string, error) {
+	m.mu.Lock()
+	m.connectionTypeCalls++
+	m.mu.Unlock()
+	if m.connectionTypeErr != nil {
+		return "", "", m.connectionTypeErr
+	}
+	if m.connectionType != "" {
+		return m.connectionType, m.connectionType, nil
+	}
+	return "IP_Routed", "IP_Routed", nil
+}
+
 func TestGetHolepunchPortMapping(t *testing.T) {
-	portMapping, err := getHolepunchPortMapping(corev1.Service{
+	portMapping, err := GetHolepunchPortMapping(corev1.Service{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        "my-service",
 			Namespace:   "default",
@@ -28,7 +187,7 @@ func TestGetHolepunchPortMapping(t *testing.T) {
 }
 
 func TestGetHolepunchPortMappingNonNumericErrors(t *testing.T) {
-	portMapping, err := getHolepunchPortMapping(corev1.Service{
+	portMapping, err := GetHolepunchPortMapping(corev1.Service{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        "my-service",
 			Namespace:   "default",
@@ -43,7 +202,7 @@ func TestGetHolepunchPortMappingNonNumericErrors(t *testing.T) {
 }
 
 func TestGetHolepunchPortMappingInvalidPortNumberErrors(t *testing.T) {
-	portMapping, err := getHolepunchPortMapping(corev1.Service{
+	portMapping, err := GetHolepunchPortMapping(corev1.Service{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        "my-service",
 			Namespace:   "default",
@@ -57,3 +216,2155 @@ func TestGetHolepunchPortMappingInvalidPortNumberErrors(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, portMapping)
 }
+
+func serviceWithNamedPorts(annotations map[string]string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Annotations: annotations},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+				{Port: 8080, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+}
+
+func TestGetHolepunchPortMappingNamedPorts(t *testing.T) {
+	portMapping, err := GetHolepunchPortMapping(serviceWithNamedPorts(map[string]string{
+		holepunchPortMapAnnotationPrefix + "http":  "3000",
+		holepunchPortMapAnnotationPrefix + "https": "4000",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint16{80: 3000, 443: 4000}, portMapping)
+}
+
+func TestGetHolepunchPortMappingMixedNamedAndNumericPorts(t *testing.T) {
+	portMapping, err := GetHolepunchPortMapping(serviceWithNamedPorts(map[string]string{
+		holepunchPortMapAnnotationPrefix + "http": "3000",
+		holepunchPortMapAnnotationPrefix + "8080": "5000",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint16{80: 3000, 8080: 5000}, portMapping)
+}
+
+func TestGetHolepunchPortMappingUnknownNamedPortErrors(t *testing.T) {
+	portMapping, err := GetHolepunchPortMapping(serviceWithNamedPorts(map[string]string{
+		holepunchPortMapAnnotationPrefix + "grpc": "3000",
+	}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `"grpc"`)
+	assert.Equal(t, Permanent, errorKind(err))
+	assert.Nil(t, portMapping)
+}
+
+func TestValidatePortMappingAnnotations(t *testing.T) {
+	for name, tc := range map[string]struct {
+		annotations map[string]string
+		noPorts     bool
+		unmatched   string
+	}{
+		"numeric port":          {annotations: map[string]string{holepunchPortMapAnnotationPrefix + "8080": "5000"}},
+		"named port":            {annotations: map[string]string{holepunchPortMapAnnotationPrefix + "https": "4000"}},
+		"range including ports": {annotations: map[string]string{holepunchPortMapAnnotationPrefix + "8000-8100": "9000"}},
+		"no annotations":        {},
+		"other annotations":     {annotations: map[string]string{holepunchAnnotationName: "true"}},
+		"invalid annotation":    {annotations: map[string]string{holepunchPortMapAnnotationPrefix + "http-": "3000"}},
+		"missing port": {
+			annotations: map[string]string{
+				holepunchPortMapAnnotationPrefix + "80":   "3000",
+				holepunchPortMapAnnotationPrefix + "9999": "8080",
+			},
+			unmatched: holepunchPortMapAnnotationPrefix + "9999",
+		},
+		"range without ports": {
+			annotations: map[string]string{holepunchPortMapAnnotationPrefix + "9000-9010": "9000"},
+			unmatched:   holepunchPortMapAnnotationPrefix + "9000-9010",
+		},
+		"several missing ports": {
+			annotations: map[string]string{
+				holepunchPortMapAnnotationPrefix + "9999": "8080",
+				holepunchPortMapAnnotationPrefix + "81":   "3001",
+			},
+			unmatched: holepunchPortMapAnnotationPrefix + "81, " + holepunchPortMapAnnotationPrefix + "9999",
+		},
+		"no service ports": {
+			annotations: map[string]string{holepunchPortMapAnnotationPrefix + "80": "3000"},
+			noPorts:     true,
+			unmatched:   holepunchPortMapAnnotationPrefix + "80",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := serviceWithNamedPorts(tc.annotations)
+			if tc.noPorts {
+				service.Spec.Ports = nil
+			}
+			err := validatePortMappingAnnotations(service)
+			if tc.unmatched == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, "port mapping annotations "+tc.unmatched+" don't match any port on the service")
+		})
+	}
+}
+
+func TestReconcileWarnsAboutUnmatchedPortMappings(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[holepunchPortMapAnnotationPrefix+"9999"] = "8080"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	// The service's own ports are still forwarded.
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	assert.Contains(t, drainEvents(recorder), "Warning UnmatchedPortMapping port mapping annotations "+
+		holepunchPortMapAnnotationPrefix+"9999 don't match any port on the service")
+}
+
+func TestGetHolepunchPortMappingRanges(t *testing.T) {
+	longest := make(map[uint16]uint16)
+	for port := uint16(1000); port <= 1255; port++ {
+		longest[port] = port + 1000
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		expected map[uint16]uint16
+	}{
+		{
+			name:     "external start only",
+			key:      "8000-8002",
+			value:    "9000",
+			expected: map[uint16]uint16{8000: 9000, 8001: 9001, 8002: 9002},
+		},
+		{
+			name:     "explicit external range",
+			key:      "8000-8002",
+			value:    "9000-9002",
+			expected: map[uint16]uint16{8000: 9000, 8001: 9001, 8002: 9002},
+		},
+		{
+			name:     "single port range",
+			key:      "8000-8000",
+			value:    "9000",
+			expected: map[uint16]uint16{8000: 9000},
+		},
+		{
+			name:     "range ending at highest port",
+			key:      "65534-65535",
+			value:    "65534",
+			expected: map[uint16]uint16{65534: 65534, 65535: 65535},
+		},
+		{
+			name:     "longest allowed range",
+			key:      "1000-1255",
+			value:    "2000",
+			expected: longest,
+		},
+		{name: "mismatched lengths", key: "8000-8010", value: "9000-9005"},
+		{name: "single internal port with external range", key: "8000", value: "9000-9001"},
+		{name: "inverted internal range", key: "8010-8000", value: "9000"},
+		{name: "inverted external range", key: "8000-8010", value: "9010-9000"},
+		{name: "range too long", key: "1000-1256", value: "2000"},
+		{name: "internal range past highest port", key: "65530-65536", value: "1000"},
+		{name: "external range past highest port", key: "8000-8010", value: "65530"},
+		{name: "missing range end", key: "8000-", value: "9000"},
+		{name: "non-numeric range", key: "8000-http", value: "9000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			portMapping, err := GetHolepunchPortMapping(corev1.Service{
+				ObjectMeta: v1.ObjectMeta{
+					Annotations: map[string]string{
+						holepunchAnnotationName:                     "true",
+						holepunchPortMapAnnotationPrefix + test.key: test.value,
+					},
+				},
+			})
+			if test.expected == nil {
+				assert.Error(t, err)
+				assert.Equal(t, Permanent, errorKind(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, portMapping)
+		})
+	}
+}
+
+func TestDeletePortMappings(t *testing.T) {
+	router := &mockRouterClient{}
+	err := deletePortMappings(logf.NullLogger{}, router, corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "my-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				holepunchAnnotationName:                 "true",
+				holepunchPortMapAnnotationPrefix + "80": "3000",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, Protocol: corev1.ProtocolTCP},
+				{Port: 53, Protocol: corev1.ProtocolUDP},
+				{Port: 9999, Protocol: corev1.ProtocolSCTP},
+			},
+		},
+	}, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []portMappingCall{
+		{ExternalPort: 3000, Protocol: "TCP"},
+		{ExternalPort: 53, Protocol: "UDP"},
+	}, router.deleteCalls)
+}
+
+func TestDeletePortMappingsRouterErrors(t *testing.T) {
+	router := &mockRouterClient{deleteErr: errors.New("router unavailable")}
+	err := deletePortMappings(logf.NullLogger{}, router, corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}, "")
+	assert.Error(t, err)
+}
+
+func TestCleanupFailedGivesUpAfterMaxAttempts(t *testing.T) {
+	now := v1.Now()
+	service := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:              "my-service",
+			Namespace:         "default",
+			DeletionTimestamp: &now,
+			Finalizers:        []string{portMappingCleanupFinalizer},
+		},
+	}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service.DeepCopy()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithMaxCleanupAttempts(3),
+	)
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "my-service"}
+	cleanupErr := errors.New("router unavailable")
+
+	// Every attempt up until the last should return the error so that we retry, and leave the finalizer in place.
+	for i := 0; i < 2; i++ {
+		_, err := r.cleanupFailed(ctx, r.Log, service, cleanupErr)
+		assert.Equal(t, cleanupErr, err)
+
+		var stored corev1.Service
+		assert.NoError(t, r.Get(ctx, key, &stored))
+		assert.Contains(t, stored.Finalizers, portMappingCleanupFinalizer)
+	}
+
+	// On the last attempt we give up and remove the finalizer so the service isn't stuck.
+	_, err := r.cleanupFailed(ctx, r.Log, service, cleanupErr)
+	assert.NoError(t, err)
+
+	var stored corev1.Service
+	assert.NoError(t, r.Get(ctx, key, &stored))
+	assert.NotContains(t, stored.Finalizers, portMappingCleanupFinalizer)
+	assert.NotContains(t, r.cleanupAttempts, key)
+}
+
+func TestDeletePortMappingsUsesActiveMappings(t *testing.T) {
+	router := &mockRouterClient{}
+	err := deletePortMappings(logf.NullLogger{}, router, corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "my-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				// Port 8080 has since been removed from the spec, and the holepunch annotation has been removed, but
+				// we still need to clean both up.
+				activeMappingsAnnotationName: `{"80/TCP":3000,"8080/UDP":8080}`,
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []portMappingCall{
+		{ExternalPort: 3000, Protocol: "TCP"},
+		{ExternalPort: 8080, Protocol: "UDP"},
+	}, router.deleteCalls)
+}
+
+func TestRecordActiveMappings(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "my-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				holepunchAnnotationName: "true",
+			},
+		},
+	}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service.DeepCopy()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+	)
+	ctx := context.Background()
+	mappings := map[string]uint16{
+		"80/TCP":  3000,
+		"443/TCP": 4000,
+	}
+
+	assert.NoError(t, r.recordActiveMappings(ctx, service, mappings, nil, "", ""))
+
+	var stored corev1.Service
+	assert.NoError(t, r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "my-service"}, &stored))
+	assert.Equal(t, `{"443/TCP":4000,"80/TCP":3000}`, stored.Annotations[activeMappingsAnnotationName])
+	assert.Equal(t, "true", stored.Annotations[holepunchAnnotationName])
+
+	readBack, err := getActiveMappings(stored)
+	assert.NoError(t, err)
+	assert.Equal(t, mappings, readBack)
+}
+
+func TestGetActiveMappingsMissingAnnotation(t *testing.T) {
+	mappings, err := getActiveMappings(corev1.Service{})
+	assert.NoError(t, err)
+	assert.Nil(t, mappings)
+}
+
+func TestGetActiveMappingsInvalidAnnotationErrors(t *testing.T) {
+	mappings, err := getActiveMappings(corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				activeMappingsAnnotationName: "not-json",
+			},
+		},
+	})
+	assert.Error(t, err)
+	assert.Nil(t, mappings)
+}
+
+func TestParseMappingKey(t *testing.T) {
+	port, protocol, err := parseMappingKey(mappingKey(80, "TCP"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(80), port)
+	assert.Equal(t, "TCP", protocol)
+
+	_, _, err = parseMappingKey("80")
+	assert.Error(t, err)
+
+	_, _, err = parseMappingKey("http/TCP")
+	assert.Error(t, err)
+}
+
+func TestSyncPortMappingsAddOnly(t *testing.T) {
+	router := &mockRouterClient{}
+	service := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"},
+	}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.10", leaseDurationSeconds, nil,
+		map[string]uint16{"80/TCP": 3000, "443/TCP": 443},
+		nil)
+	assert.NoError(t, err)
+	assert.Empty(t, router.deleteCalls)
+	assert.ElementsMatch(t, []addPortMappingCall{
+		{
+			portMappingCall: portMappingCall{ExternalPort: 443, Protocol: "TCP"},
+			InternalPort:    443,
+			InternalClient:  "192.168.1.10",
+			Enabled:         true,
+			Description:     "Mapping for my-service/default",
+			LeaseDuration:   leaseDurationSeconds,
+		},
+		{
+			portMappingCall: portMappingCall{ExternalPort: 3000, Protocol: "TCP"},
+			InternalPort:    80,
+			InternalClient:  "192.168.1.10",
+			Enabled:         true,
+			Description:     "Mapping for my-service/default",
+			LeaseDuration:   leaseDurationSeconds,
+		},
+	}, router.addCalls)
+}
+
+func TestSyncPortMappingsRemoveOnly(t *testing.T) {
+	router := &mockRouterClient{}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 600, nil,
+		map[string]uint16{"80/TCP": 3000, "443/TCP": 4000},
+		map[string]uint16{"80/TCP": 3000, "443/TCP": 4000, "8080/TCP": 8080})
+	assert.NoError(t, err)
+	assert.Equal(t, []portMappingCall{
+		{ExternalPort: 8080, Protocol: "TCP"},
+	}, router.deleteCalls)
+	// Everything we still want is re-added to renew the lease
+	assert.ElementsMatch(t, []uint16{4000, 3000}, router.addedExternalPorts())
+}
+
+func TestSyncPortMappingsAddAndRemove(t *testing.T) {
+	router := &mockRouterClient{}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 600, nil,
+		map[string]uint16{"80/TCP": 5000, "53/UDP": 53},
+		map[string]uint16{"80/TCP": 3000, "8080/TCP": 8080})
+	assert.NoError(t, err)
+	// Port 80 has moved to a different external port, so the old one needs removing too.
+	assert.Equal(t, []portMappingCall{
+		{ExternalPort: 3000, Protocol: "TCP"},
+		{ExternalPort: 8080, Protocol: "TCP"},
+	}, router.deleteCalls)
+	assert.ElementsMatch(t, []uint16{53, 5000}, router.addedExternalPorts())
+}
+
+func TestSyncPortMappingsDeleteErrors(t *testing.T) {
+	router := &mockRouterClient{deleteErr: errors.New("router unavailable")}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 600, nil,
+		map[string]uint16{"80/TCP": 80},
+		map[string]uint16{"8080/TCP": 8080})
+	assert.Error(t, err)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestSyncPortMappingsUsesLeaseDuration(t *testing.T) {
+	router := &mockRouterClient{}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 1800, nil,
+		map[string]uint16{"80/TCP": 80},
+		nil)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, uint32(1800), router.addCalls[0].LeaseDuration)
+}
+
+func TestSyncPortMappingsSkipsUpToDateMapping(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"3000/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, LeaseDuration: 1795},
+		"443/TCP":  {InternalPort: 443, InternalClient: "192.168.1.10", Enabled: true, LeaseDuration: 60},
+		"53/UDP":   {InternalPort: 53, InternalClient: "192.168.1.10", Enabled: false, LeaseDuration: 1800},
+	}}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 1800, nil,
+		map[string]uint16{"80/TCP": 3000, "443/TCP": 443, "53/UDP": 53},
+		nil)
+	assert.NoError(t, err)
+	// Port 443's lease is running out, and port 53 has been disabled, so only those are re-added.
+	assert.ElementsMatch(t, []uint16{443, 53}, router.addedExternalPorts())
+}
+
+func TestSyncPortMappingsReplacesOwnStaleMapping(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.9", Enabled: true, Description: "Mapping for my-service/default"},
+	}}
+	service := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"},
+	}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.10", 1800, nil,
+		map[string]uint16{"80/TCP": 80},
+		nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+}
+
+func TestSyncPortMappingsConflictErrors(t *testing.T) {
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 8080, InternalClient: "192.168.1.20", Enabled: true, Description: "Someone else's game server"},
+	}}
+	recorder := record.NewFakeRecorder(1)
+	service := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"},
+	}
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.10", 1800, nil,
+		map[string]uint16{"80/TCP": 80},
+		nil)
+	assert.Error(t, err)
+	assert.Empty(t, router.addCalls)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "PortMappingConflict")
+}
+
+// manyMappings returns n desired TCP mappings, for ports 8000 onwards.
+func manyMappings(n int) map[string]uint16 {
+	mappings := make(map[string]uint16)
+	for i := 0; i < n; i++ {
+		port := uint16(8000 + i)
+		mappings[mappingKey(port, "TCP")] = port
+	}
+	return mappings
+}
+
+// failingRouterClient is a mockRouterClient that fails to add mappings for some external ports.
+type failingRouterClient struct {
+	*mockRouterClient
+	failPorts map[uint16]bool
+}
+
+func (f *failingRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	if err := f.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration); err != nil {
+		return err
+	}
+	if f.failPorts[externalPort] {
+		return errors.New("ConflictInMappingEntry")
+	}
+	return nil
+}
+
+// slowRouterClient is a mockRouterClient that takes a while to add each mapping, and tracks how many it was asked to
+// add at once.
+type slowRouterClient struct {
+	*mockRouterClient
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (s *slowRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return s.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration)
+}
+
+func TestSyncPortMappingsManyPorts(t *testing.T) {
+	router := &slowRouterClient{mockRouterClient: &mockRouterClient{}}
+	err := NewServiceReconciler(nil, nil, WithMaxConcurrentMappings(3)).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 600, nil,
+		manyMappings(10),
+		nil)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint16{8000, 8001, 8002, 8003, 8004, 8005, 8006, 8007, 8008, 8009}, router.addedExternalPorts())
+	assert.True(t, router.maxInFlight > 1, "mappings should be added concurrently")
+	assert.True(t, router.maxInFlight <= 3, "at most MaxConcurrentMappings should be added at once, got %d", router.maxInFlight)
+}
+
+func TestSyncPortMappingsIndividualPortErrors(t *testing.T) {
+	router := &failingRouterClient{
+		mockRouterClient: &mockRouterClient{},
+		failPorts:        map[uint16]bool{8002: true, 8007: true},
+	}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, corev1.Service{}, "192.168.1.10", 600, nil,
+		manyMappings(10),
+		nil)
+	assert.Error(t, err)
+	// Every port is still attempted, even though some of them failed
+	assert.Len(t, router.addCalls, 10)
+}
+
+func serviceWithLeaseDuration(value string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "my-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				holepunchAnnotationName:     "true",
+				leaseDurationAnnotationName: value,
+			},
+		},
+	}
+}
+
+func TestGetLeaseDuration(t *testing.T) {
+	leaseDuration, err := getLeaseDuration(serviceWithLeaseDuration("30m"), leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1800), leaseDuration)
+
+	leaseDuration, err = getLeaseDuration(serviceWithLeaseDuration("2h"), leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7200), leaseDuration)
+}
+
+func TestGetLeaseDurationMissingAnnotationUsesDefault(t *testing.T) {
+	leaseDuration, err := getLeaseDuration(corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				holepunchAnnotationName: "true",
+			},
+		},
+	}, 1234)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1234), leaseDuration)
+}
+
+func TestGetLeaseDurationRangeLimits(t *testing.T) {
+	leaseDuration, err := getLeaseDuration(serviceWithLeaseDuration("1m"), leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(60), leaseDuration)
+
+	leaseDuration, err = getLeaseDuration(serviceWithLeaseDuration("24h"), leaseDurationSeconds)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(86400), leaseDuration)
+
+	_, err = getLeaseDuration(serviceWithLeaseDuration("59s"), leaseDurationSeconds)
+	assert.Error(t, err)
+
+	_, err = getLeaseDuration(serviceWithLeaseDuration("24h1s"), leaseDurationSeconds)
+	assert.Error(t, err)
+
+	_, err = getLeaseDuration(serviceWithLeaseDuration("-1h"), leaseDurationSeconds)
+	assert.Error(t, err)
+}
+
+func TestGetLeaseDurationInvalidDurationErrors(t *testing.T) {
+	_, err := getLeaseDuration(serviceWithLeaseDuration("3600"), leaseDurationSeconds)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), leaseDurationAnnotationName)
+
+	_, err = getLeaseDuration(serviceWithLeaseDuration("an hour"), leaseDurationSeconds)
+	assert.Error(t, err)
+}
+
+func TestGetReconcileInterval(t *testing.T) {
+	withInterval := func(value string) corev1.Service {
+		service := serviceWithLeaseDuration("1h")
+		service.Annotations[reconcileIntervalAnnotationName] = value
+		return service
+	}
+
+	for name, tc := range map[string]struct {
+		service  corev1.Service
+		expected time.Duration
+		valid    bool
+	}{
+		"minutes":            {service: withInterval("5m"), expected: 5 * time.Minute, valid: true},
+		"seconds":            {service: withInterval("90s"), expected: 90 * time.Second, valid: true},
+		"just under lease":   {service: withInterval("59m59s"), expected: time.Hour - time.Second, valid: true},
+		"missing annotation": {service: serviceWithLeaseDuration("1h"), expected: time.Hour - 30*time.Second, valid: true},
+		"equal to lease":     {service: withInterval("1h")},
+		"longer than lease":  {service: withInterval("2h")},
+		"zero":               {service: withInterval("0s")},
+		"negative":           {service: withInterval("-5m")},
+		"no unit":            {service: withInterval("300")},
+		"not a duration":     {service: withInterval("five minutes")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			interval, err := getReconcileInterval(tc.service, 3600)
+			if !tc.valid {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), reconcileIntervalAnnotationName)
+				assert.Equal(t, Permanent, errorKind(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, interval)
+		})
+	}
+}
+
+func TestReconcileUsesReconcileInterval(t *testing.T) {
+	reconcileWith := func(interval string) (ctrl.Result, *mockRouterClient, *record.FakeRecorder) {
+		service := holepunchedService()
+		service.Annotations[reconcileIntervalAnnotationName] = interval
+		router := &mockRouterClient{}
+		recorder := record.NewFakeRecorder(10)
+		r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+			WithLogger(logf.NullLogger{}),
+			WithEventRecorder(recorder),
+			WithRouterClients(router),
+		)
+		result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+		assert.NoError(t, err)
+		return result, router, recorder
+	}
+
+	// The lease is left alone, we just come back to renew it sooner.
+	result, router, _ := reconcileWith("5m")
+	assert.Equal(t, 5*time.Minute, result.RequeueAfter)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, uint32(leaseDurationSeconds), router.addCalls[0].LeaseDuration)
+	}
+
+	// An interval the lease wouldn't last for is a mistake, so nothing is forwarded until it's fixed.
+	result, router, recorder := reconcileWith("2h")
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Empty(t, router.addCalls)
+	events := drainEvents(recorder)
+	if assert.Len(t, events, 1) {
+		assert.Contains(t, events[0], "Warning InvalidReconcileInterval")
+	}
+}
+
+// countingPicker returns a router picker that always returns the given router, counting how many times it was called.
+func countingPicker(router RouterClient, calls *int) func(context.Context, ...string) (RouterClient, error) {
+	return func(context.Context, ...string) (RouterClient, error) {
+		*calls++
+		return router, nil
+	}
+}
+
+// withLookupHost replaces how the reconciler resolves LoadBalancer hostnames.
+func withLookupHost(lookup func(context.Context, string) ([]string, error)) Option {
+	return func(r *ServiceReconciler) {
+		r.lookupHostFn = lookup
+	}
+}
+
+func TestGetRouterClientCachesRouter(t *testing.T) {
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(nil, nil, WithRouterClientFactory(countingPicker(router, &calls)))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		got, err := r.getRouterClient(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, router, withoutTimeout(got))
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestGetRouterClientRediscoversAfterExpiry(t *testing.T) {
+	calls := 0
+	r := NewServiceReconciler(nil, nil, WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)))
+	ctx := context.Background()
+
+	_, err := r.getRouterClient(ctx)
+	assert.NoError(t, err)
+
+	// Pretend the TTL has elapsed
+	cached := r.routerCache[""]
+	cached.expiry = time.Now().Add(-time.Second)
+	r.routerCache[""] = cached
+
+	_, err = r.getRouterClient(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestGetRouterClientRediscoversAfterInvalidation(t *testing.T) {
+	calls := 0
+	r := NewServiceReconciler(nil, nil, WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)))
+	ctx := context.Background()
+
+	_, err := r.getRouterClient(ctx)
+	assert.NoError(t, err)
+	r.invalidateRouterClient()
+	_, err = r.getRouterClient(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestGetRouterClientKeyedByRootDesc(t *testing.T) {
+	calls := 0
+	r := NewServiceReconciler(nil, nil,
+		WithRouterRootDesc("http://192.168.1.1:5000/rootDesc.xml"),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+	)
+	ctx := context.Background()
+
+	_, err := r.getRouterClient(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, r.routerCache, "http://192.168.1.1:5000/rootDesc.xml")
+
+	r.RouterRootDesc = []string{"http://192.168.2.1:5000/rootDesc.xml"}
+	_, err = r.getRouterClient(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, r.routerCache, 2)
+}
+
+func TestGetRouterClientDoesNotCacheErrors(t *testing.T) {
+	calls := 0
+	r := NewServiceReconciler(nil, nil,
+		WithHolepunchMode(HolepunchModeUPnP),
+		WithRouterClientFactory(func(context.Context, ...string) (RouterClient, error) {
+			calls++
+			return nil, errors.New("No services found")
+		}),
+	)
+	ctx := context.Background()
+
+	_, err := r.getRouterClient(ctx)
+	assert.Error(t, err)
+	_, err = r.getRouterClient(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestGetRouterClientConfiguresEveryRootDesc(t *testing.T) {
+	modem, router := &mockRouterClient{}, &mockRouterClient{}
+	routers := map[string]RouterClient{
+		"http://192.168.0.1:5000/rootDesc.xml": modem,
+		"http://192.168.1.1:5000/rootDesc.xml": router,
+	}
+	var asked [][]string
+	r := NewServiceReconciler(nil, nil,
+		WithHolepunchMode(HolepunchModeUPnP),
+		WithRouterRootDesc("http://192.168.0.1:5000/rootDesc.xml", "http://192.168.1.1:5000/rootDesc.xml"),
+		WithRouterClientFactory(func(_ context.Context, rootDesc ...string) (RouterClient, error) {
+			asked = append(asked, rootDesc)
+			return routers[rootDesc[0]], nil
+		}),
+	)
+
+	client, err := r.getRouterClient(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &multiRouterClient{routers: []RouterClient{modem, router}}, withoutTimeout(client))
+	assert.Equal(t, [][]string{
+		{"http://192.168.0.1:5000/rootDesc.xml"},
+		{"http://192.168.1.1:5000/rootDesc.xml"},
+	}, asked)
+
+	assert.NoError(t, client.AddPortMapping("", 3000, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.Equal(t, []uint16{3000}, modem.addedExternalPorts())
+	assert.Equal(t, []uint16{3000}, router.addedExternalPorts())
+}
+
+func TestGetRouterClientFailsIfAnyRootDescFails(t *testing.T) {
+	r := NewServiceReconciler(nil, nil,
+		WithHolepunchMode(HolepunchModeUPnP),
+		WithRouterRootDesc("http://192.168.0.1:5000/rootDesc.xml", "http://192.168.1.1:5000/rootDesc.xml"),
+		WithRouterClientFactory(func(_ context.Context, rootDesc ...string) (RouterClient, error) {
+			if rootDesc[0] == "http://192.168.1.1:5000/rootDesc.xml" {
+				return nil, errors.New("connection refused")
+			}
+			return &mockRouterClient{}, nil
+		}),
+	)
+
+	_, err := r.getRouterClient(context.Background())
+	assert.EqualError(t, err, "unable to use router at http://192.168.1.1:5000/rootDesc.xml: connection refused")
+	assert.Empty(t, r.routerCache)
+}
+
+func node(name string, ready bool, internalIP string) *corev1.Node {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	n := &corev1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: status},
+			},
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: name},
+			},
+		},
+	}
+	if internalIP != "" {
+		n.Status.Addresses = append(n.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: internalIP})
+	}
+	return n
+}
+
+func TestGetNodeIPPicksFirstReadyNode(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme,
+		node("node-c", true, "192.168.1.13"),
+		node("node-a", false, "192.168.1.11"),
+		node("node-b", true, "192.168.1.12"),
+	)
+	ip, err := getNodeIP(context.Background(), c)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.12", ip)
+}
+
+func TestGetNodeIPSkipsNodesWithoutInternalIP(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme,
+		node("node-a", true, ""),
+		node("node-b", true, "192.168.1.12"),
+	)
+	ip, err := getNodeIP(context.Background(), c)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.12", ip)
+}
+
+func TestGetNodeIPNoReadyNodesErrors(t *testing.T) {
+	c := fake.NewFakeClientWithScheme(scheme.Scheme,
+		node("node-a", false, "192.168.1.11"),
+	)
+	_, err := getNodeIP(context.Background(), c)
+	assert.Error(t, err)
+}
+
+func TestGetSpecMappingsNodePort(t *testing.T) {
+	mappings, err := getSpecMappings(corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				holepunchAnnotationName:                 "true",
+				holepunchPortMapAnnotationPrefix + "80": "3000",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				{Port: 53, NodePort: 30053, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint16{
+		"30080/TCP": 3000,
+		"30053/UDP": 53,
+	}, mappings)
+}
+
+func TestGetSpecMappingsNodePortNotAllocatedErrors(t *testing.T) {
+	_, err := getSpecMappings(corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{
+				{Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestSyncPortMappingsNodePortDescription(t *testing.T) {
+	router := &mockRouterClient{}
+	service := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort},
+	}
+	err := NewServiceReconciler(nil, nil).syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.12", leaseDurationSeconds, nil,
+		map[string]uint16{"30080/TCP": 80},
+		nil)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, "NodePort mapping for my-service/default", router.addCalls[0].Description)
+	assert.Equal(t, uint16(30080), router.addCalls[0].InternalPort)
+	assert.Equal(t, uint16(80), router.addCalls[0].ExternalPort)
+}
+
+func serviceWithIngress(ingress ...corev1.LoadBalancerIngress) corev1.Service {
+	return corev1.Service{
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{Ingress: ingress},
+		},
+	}
+}
+
+// staticLookup returns a lookupHostFn that resolves hostnames using the given table.
+func staticLookup(table map[string][]string) func(context.Context, string) ([]string, error) {
+	return func(_ context.Context, host string) ([]string, error) {
+		addresses, ok := table[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addresses, nil
+	}
+}
+
+func TestGetServiceIP(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(nil)))
+	ip, err := r.getServiceIP(context.Background(), serviceWithIngress(corev1.LoadBalancerIngress{IP: "192.168.1.10"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", ip)
+}
+
+func TestGetServiceIPPrefersIPOverHostname(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(map[string][]string{
+		"lb.example.com": {"192.168.1.20"},
+	})))
+	ip, err := r.getServiceIP(context.Background(), serviceWithIngress(
+		corev1.LoadBalancerIngress{Hostname: "lb.example.com"},
+		corev1.LoadBalancerIngress{IP: "192.168.1.10"},
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", ip)
+}
+
+func TestGetServiceIPResolvesHostname(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(map[string][]string{
+		"lb.example.com": {"2001:db8::1", "192.168.1.20", "192.168.1.21"},
+	})))
+	ip, err := r.getServiceIP(context.Background(), serviceWithIngress(corev1.LoadBalancerIngress{Hostname: "lb.example.com"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.20", ip)
+}
+
+func TestGetServiceIPHostnameResolutionFails(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(nil)))
+	_, err := r.getServiceIP(context.Background(), serviceWithIngress(corev1.LoadBalancerIngress{Hostname: "lb.example.com"}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to resolve LoadBalancer hostname")
+
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr))
+}
+
+func TestGetServiceIPHostnameWithOnlyIPv6Fails(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(map[string][]string{
+		"lb.example.com": {"2001:db8::1"},
+	})))
+	_, err := r.getServiceIP(context.Background(), serviceWithIngress(corev1.LoadBalancerIngress{Hostname: "lb.example.com"}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "IPv4")
+}
+
+func TestGetServiceIPNoIngressFails(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(nil)))
+	_, err := r.getServiceIP(context.Background(), serviceWithIngress())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not yet allocated")
+}
+
+func TestGetServiceIPHostnameLookupUsesTimeout(t *testing.T) {
+	r := NewServiceReconciler(nil, nil,
+		WithDNSTimeout(10*time.Millisecond),
+		withLookupHost(func(ctx context.Context, _ string) ([]string, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}),
+	)
+	_, err := r.getServiceIP(context.Background(), serviceWithIngress(corev1.LoadBalancerIngress{Hostname: "lb.example.com"}))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestGetServiceIPUseClusterIP(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(nil)))
+	withClusterIP := func(annotation, clusterIP string) corev1.Service {
+		service := serviceWithIngress(corev1.LoadBalancerIngress{IP: "192.168.1.10"})
+		service.Annotations = map[string]string{useClusterIPAnnotationName: annotation}
+		service.Spec.ClusterIP = clusterIP
+		return service
+	}
+
+	for name, test := range map[string]struct {
+		service   corev1.Service
+		ip        string
+		permanent bool
+	}{
+		"cluster IP":         {service: withClusterIP("true", "10.96.0.20"), ip: "10.96.0.20"},
+		"turned off":         {service: withClusterIP("false", "10.96.0.20"), ip: "192.168.1.10"},
+		"without annotation": {service: serviceWithIngress(corev1.LoadBalancerIngress{IP: "192.168.1.10"}), ip: "192.168.1.10"},
+		"headless":           {service: withClusterIP("true", corev1.ClusterIPNone), permanent: true},
+		"no cluster IP yet":  {service: withClusterIP("true", "")},
+		"invalid annotation": {service: withClusterIP("yes please", "10.96.0.20"), permanent: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ip, err := r.getServiceIP(context.Background(), test.service)
+			if test.ip != "" {
+				assert.NoError(t, err)
+				assert.Equal(t, test.ip, ip)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Equal(t, test.permanent, errorKind(err) == Permanent)
+			}
+		})
+	}
+}
+
+func TestReconcileUseClusterIPWarns(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[useClusterIPAnnotationName] = "true"
+	service.Spec.ClusterIP = "10.96.0.20"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	if assert.Len(t, router.addCalls, 1) {
+		assert.Equal(t, "10.96.0.20", router.addCalls[0].InternalClient)
+	}
+	assert.Contains(t, drainEvents(recorder),
+		"Warning ForwardingToClusterIP Forwarding ports to ClusterIP 10.96.0.20 as holepunch.io/use-cluster-ip is set; "+
+			"this only works if the router can reach ClusterIPs, which depends on your network")
+}
+
+func TestReconcileDryRunDoesNotChangeRouter(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[holepunchPortMapAnnotationPrefix+"80"] = "3000"
+	router := &mockRouterClient{}
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithDryRun(true),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(leaseDurationSeconds-30)*time.Second, result.RequeueAfter)
+	assert.Empty(t, router.addCalls)
+	assert.Empty(t, router.deleteCalls)
+
+	// Nothing is recorded on the service either, as no mappings were actually made
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+	assert.Empty(t, updated.Finalizers)
+	assert.NotContains(t, updated.Annotations, activeMappingsAnnotationName)
+}
+
+func TestReconcileDryRunStillValidatesService(t *testing.T) {
+	service := holepunchedService()
+	service.Status.LoadBalancer.Ingress = nil
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithDryRun(true),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	// The service has no IP yet, so we retry just like we would if we weren't in dry-run mode
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRetryBaseDelay, result.RequeueAfter)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestDryRunRouterClientOnlyPassesThroughQueries(t *testing.T) {
+	mock := &mockRouterClient{}
+	router := NewServiceReconciler(nil, nil, WithDryRun(true)).withDryRun(logf.NullLogger{}, mock)
+
+	assert.NoError(t, router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600))
+	assert.NoError(t, router.DeletePortMapping("", 80, "TCP"))
+	ip, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.1", ip)
+	assert.Empty(t, mock.addCalls)
+	assert.Empty(t, mock.deleteCalls)
+
+	assert.Same(t, mock, NewServiceReconciler(nil, nil).withDryRun(logf.NullLogger{}, mock))
+}
+
+func serviceWithHolepunchAnnotation(value string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{holepunchAnnotationName: value},
+		},
+	}
+}
+
+func TestGetHolepunchProtocolFilter(t *testing.T) {
+	tests := []struct {
+		value      string
+		forwardTCP bool
+		forwardUDP bool
+	}{
+		{value: "true", forwardTCP: true, forwardUDP: true},
+		{value: "tcp", forwardTCP: true},
+		{value: "TCP", forwardTCP: true},
+		{value: "udp", forwardUDP: true},
+		{value: "tcp,udp", forwardTCP: true, forwardUDP: true},
+		{value: "UDP, tcp", forwardTCP: true, forwardUDP: true},
+		{value: "false"},
+		{value: "FALSE"},
+	}
+	for _, test := range tests {
+		forwardTCP, forwardUDP, err := getHolepunchProtocolFilter(serviceWithHolepunchAnnotation(test.value))
+		assert.NoError(t, err, test.value)
+		assert.Equal(t, test.forwardTCP, forwardTCP, test.value)
+		assert.Equal(t, test.forwardUDP, forwardUDP, test.value)
+	}
+
+	forwardTCP, forwardUDP, err := getHolepunchProtocolFilter(corev1.Service{})
+	assert.NoError(t, err)
+	assert.False(t, forwardTCP)
+	assert.False(t, forwardUDP)
+}
+
+func TestGetHolepunchProtocolFilterInvalidValuesError(t *testing.T) {
+	for _, value := range []string{"yes", "sctp", "tcp,sctp", "tcp,", "true,udp", "", "True", "1", "ture"} {
+		_, _, err := getHolepunchProtocolFilter(serviceWithHolepunchAnnotation(value))
+		assert.Error(t, err, value)
+		assert.Equal(t, Permanent, errorKind(err), value)
+	}
+}
+
+func TestHasHolepunchAnnotation(t *testing.T) {
+	// Only "true" or a list of protocols asks for ports to be forwarded. Any other value we don't understand doesn't,
+	// but getHolepunchProtocolFilter complains about it so that it isn't silently ignored. valid is whether it's a value
+	// we understand.
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+		valid       bool
+	}{
+		{name: "true", annotations: map[string]string{holepunchAnnotationName: "true"}, want: true, valid: true},
+		{name: "false", annotations: map[string]string{holepunchAnnotationName: "false"}, want: false, valid: true},
+		{name: "True", annotations: map[string]string{holepunchAnnotationName: "True"}, want: false, valid: false},
+		{name: "FALSE", annotations: map[string]string{holepunchAnnotationName: "FALSE"}, want: false, valid: true},
+		{name: "false with spaces", annotations: map[string]string{holepunchAnnotationName: " false "}, want: false, valid: true},
+		{name: "protocol list", annotations: map[string]string{holepunchAnnotationName: "tcp,udp"}, want: true, valid: true},
+		{name: "1", annotations: map[string]string{holepunchAnnotationName: "1"}, want: false, valid: false},
+		{name: "yes", annotations: map[string]string{holepunchAnnotationName: "yes"}, want: false, valid: false},
+		{name: "empty", annotations: map[string]string{holepunchAnnotationName: ""}, want: false, valid: false},
+		{name: "typo", annotations: map[string]string{holepunchAnnotationName: "ture"}, want: false, valid: false},
+		{name: "no annotations", annotations: map[string]string{}, want: false, valid: true},
+		{name: "nil annotations", annotations: nil, want: false, valid: true},
+		{
+			name: "among other annotations",
+			annotations: map[string]string{
+				descriptionAnnotationName:   "web",
+				leaseDurationAnnotationName: "2h",
+				holepunchAnnotationName:     "true",
+			},
+			want:  true,
+			valid: true,
+		},
+		{
+			name:        "similar annotation",
+			annotations: map[string]string{"holepunch/punch-external-ports": "true"},
+			want:        false,
+			valid:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := corev1.Service{ObjectMeta: v1.ObjectMeta{Annotations: tt.annotations}}
+			assert.Equal(t, tt.want, HasHolepunchAnnotation(service))
+			_, _, err := getHolepunchProtocolFilter(service)
+			assert.Equal(t, tt.valid, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestFilterMappingsByProtocol(t *testing.T) {
+	mappings := map[string]uint16{"80/TCP": 3000, "443/TCP": 443, "53/UDP": 53}
+	assert.Equal(t, mappings, filterMappingsByProtocol(logf.NullLogger{}, mappings, true, true))
+	assert.Equal(t, map[string]uint16{"80/TCP": 3000, "443/TCP": 443}, filterMappingsByProtocol(logf.NullLogger{}, mappings, true, false))
+	assert.Equal(t, map[string]uint16{"53/UDP": 53}, filterMappingsByProtocol(logf.NullLogger{}, mappings, false, true))
+}
+
+func TestReconcileOnlyForwardsFilteredProtocols(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[holepunchAnnotationName] = "tcp"
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 53, Protocol: corev1.ProtocolUDP})
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+}
+
+func TestReconcileInvalidHolepunchAnnotationSkipsService(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[holepunchAnnotationName] = "yes"
+	router := &mockRouterClient{}
+	calls := 0
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Equal(t, 0, calls)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "InvalidHolepunchAnnotation")
+}
+
+func TestReconcileRecordsExternalIP(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	var stored corev1.Service
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	assert.Equal(t, "203.0.113.1", stored.Annotations[externalIPAnnotationName])
+
+	// The router's external IP can change, e.g., if the ISP hands out a new one. We'll notice once we stop using the
+	// cached one.
+	router.externalIP = "198.51.100.7"
+	r.FlushExternalIPCache()
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	assert.Equal(t, "198.51.100.7", stored.Annotations[externalIPAnnotationName])
+
+	// Failing to find out the external IP doesn't stop ports being forwarded, and leaves the last known IP in place
+	router.externalIPErr = errors.New("router doesn't know its external IP")
+	r.FlushExternalIPCache()
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(leaseDurationSeconds-30)*time.Second, result.RequeueAfter)
+	assert.Len(t, router.addCalls, 3)
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	assert.Equal(t, "198.51.100.7", stored.Annotations[externalIPAnnotationName])
+}
+
+func TestGetExternalIPAddressCachesResult(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil)
+
+	for i := 0; i < 3; i++ {
+		ip, err := r.getExternalIPAddress(router)
+		assert.NoError(t, err)
+		assert.Equal(t, "203.0.113.1", ip)
+	}
+	assert.Equal(t, 1, router.externalIPCalls)
+
+	r.FlushExternalIPCache()
+	_, err := r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, router.externalIPCalls)
+}
+
+// slowExternalIPRouter doesn't answer when asked for its external IP until released.
+type slowExternalIPRouter struct {
+	*mockRouterClient
+	asked   chan struct{}
+	release chan struct{}
+}
+
+func (s slowExternalIPRouter) GetExternalIPAddress() (string, error) {
+	s.asked <- struct{}{}
+	<-s.release
+	return s.mockRouterClient.GetExternalIPAddress()
+}
+
+func TestGetExternalIPAddressDoesNotHoldLockWhileAskingRouter(t *testing.T) {
+	router := slowExternalIPRouter{&mockRouterClient{}, make(chan struct{}), make(chan struct{})}
+	r := NewServiceReconciler(nil, nil)
+
+	result := make(chan string)
+	go func() {
+		ip, _ := r.getExternalIPAddress(router)
+		result <- ip
+	}()
+	<-router.asked
+
+	flushed := make(chan struct{})
+	go func() {
+		r.FlushExternalIPCache()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flushing the cache waited for the router to answer")
+	}
+
+	close(router.release)
+	assert.Equal(t, "203.0.113.1", <-result)
+}
+
+func TestGetExternalIPAddressCacheExpires(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil, WithExternalIPCacheTTL(time.Nanosecond))
+
+	_, err := r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, router.externalIPCalls)
+}
+
+func TestGetExternalIPAddressDoesNotCacheErrors(t *testing.T) {
+	router := &mockRouterClient{externalIPErr: errors.New("router unavailable")}
+	r := NewServiceReconciler(nil, nil)
+
+	_, err := r.getExternalIPAddress(router)
+	assert.Error(t, err)
+	router.externalIPErr = nil
+	ip, err := r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.1", ip)
+	assert.Equal(t, 2, router.externalIPCalls)
+}
+
+func TestInvalidateRouterClientFlushesExternalIP(t *testing.T) {
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(nil, nil)
+
+	_, err := r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	r.invalidateRouterClient()
+	_, err = r.getExternalIPAddress(router)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, router.externalIPCalls)
+}
+
+func serviceWithSkipPorts(value string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{skipPortsAnnotationName: value},
+		},
+	}
+}
+
+func TestGetSkippedPorts(t *testing.T) {
+	skipped, err := getSkippedPorts(serviceWithSkipPorts("9090"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]bool{9090: true}, skipped)
+
+	skipped, err = getSkippedPorts(serviceWithSkipPorts("9090, 9091,9092"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]bool{9090: true, 9091: true, 9092: true}, skipped)
+
+	skipped, err = getSkippedPorts(corev1.Service{})
+	assert.NoError(t, err)
+	assert.Empty(t, skipped)
+}
+
+func TestGetSkippedPortsInvalidValuesError(t *testing.T) {
+	for _, value := range []string{"metrics", "70000", "-1", "9090,", "9090-9091", ""} {
+		_, err := getSkippedPorts(serviceWithSkipPorts(value))
+		assert.Error(t, err, value)
+		assert.Equal(t, Permanent, errorKind(err), value)
+	}
+}
+
+func TestFilterSkippedPorts(t *testing.T) {
+	service := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				holepunchPortMapAnnotationPrefix + "8000-8003": "9000",
+				skipPortsAnnotationName:                        "8001,9090",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: 8000, Protocol: corev1.ProtocolTCP},
+				{Port: 8001, Protocol: corev1.ProtocolTCP},
+				{Port: 8002, Protocol: corev1.ProtocolUDP},
+				{Port: 9090, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	mappings, err := getSpecMappings(service)
+	assert.NoError(t, err)
+	skipped, err := getSkippedPorts(service)
+	assert.NoError(t, err)
+
+	// Skipping a port inside a mapped range only skips that port
+	assert.Equal(t, map[string]uint16{"8000/TCP": 9000, "8002/UDP": 9002},
+		filterSkippedPorts(logf.NullLogger{}, service, mappings, skipped))
+}
+
+func TestFilterSkippedPortsNodePort(t *testing.T) {
+	service := corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP},
+				{Port: 9090, NodePort: 30090, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	mappings := map[string]uint16{"30080/TCP": 80, "30090/TCP": 9090}
+	assert.Equal(t, map[string]uint16{"30080/TCP": 80},
+		filterSkippedPorts(logf.NullLogger{}, service, mappings, map[uint16]bool{9090: true}))
+}
+
+func serviceWithAnnotations(annotations map[string]string) corev1.Service {
+	return corev1.Service{ObjectMeta: v1.ObjectMeta{Annotations: annotations}}
+}
+
+func TestGetPortEnabledMap(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[uint16]bool
+		wantErr     bool
+	}{
+		{name: "no annotations", annotations: nil, want: map[uint16]bool{}},
+		{name: "explicit enable", annotations: map[string]string{portEnabledAnnotationPrefix + "80": "true"}, want: map[uint16]bool{80: true}},
+		{name: "explicit disable", annotations: map[string]string{portEnabledAnnotationPrefix + "80": "false"}, want: map[uint16]bool{80: false}},
+		{
+			name: "mixed",
+			annotations: map[string]string{
+				portEnabledAnnotationPrefix + "80":      "TRUE",
+				portEnabledAnnotationPrefix + "443":     " false ",
+				holepunchPortMapAnnotationPrefix + "80": "3000",
+			},
+			want: map[uint16]bool{80: true, 443: false},
+		},
+		{name: "invalid boolean", annotations: map[string]string{portEnabledAnnotationPrefix + "80": "nope"}, wantErr: true},
+		{name: "empty value", annotations: map[string]string{portEnabledAnnotationPrefix + "80": ""}, wantErr: true},
+		{name: "invalid port", annotations: map[string]string{portEnabledAnnotationPrefix + "http": "true"}, wantErr: true},
+		{name: "port out of range", annotations: map[string]string{portEnabledAnnotationPrefix + "70000": "true"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getPortEnabledMap(serviceWithAnnotations(tt.annotations))
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, Permanent, errorKind(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReconcileRespectsPortEnabledAnnotations(t *testing.T) {
+	service := holepunchedService()
+	service.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP},
+		{Port: 443, Protocol: corev1.ProtocolTCP},
+		{Port: 8080, Protocol: corev1.ProtocolTCP},
+	}
+	service.Annotations[portEnabledAnnotationPrefix+"80"] = "true"
+	service.Annotations[portEnabledAnnotationPrefix+"443"] = "false"
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	// Ports without an annotation are enabled by default
+	assert.ElementsMatch(t, []uint16{80, 8080}, router.addedExternalPorts())
+}
+
+func TestToUPnPProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol corev1.Protocol
+		want     string
+		wantErr  bool
+	}{
+		{name: "TCP", protocol: corev1.ProtocolTCP, want: "TCP"},
+		{name: "UDP", protocol: corev1.ProtocolUDP, want: "UDP"},
+		{name: "SCTP", protocol: corev1.ProtocolSCTP, wantErr: true},
+		// Kubernetes protocols are case sensitive, so these aren't TCP or UDP.
+		{name: "lower case TCP", protocol: "tcp", wantErr: true},
+		{name: "mixed case UDP", protocol: "Udp", wantErr: true},
+		{name: "empty", protocol: "", wantErr: true},
+		{name: "future protocol", protocol: "QUIC", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toUPnPProtocol(tt.protocol)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrProtocolNotSupported))
+				assert.Contains(t, err.Error(), "protocol type "+string(tt.protocol)+":")
+				assert.Empty(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			// Routers compare protocols case sensitively, and the UPnP spec only allows upper case.
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReconcileSkipsSCTPPorts(t *testing.T) {
+	service := holepunchedService()
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 9999, Protocol: corev1.ProtocolSCTP})
+	router := &mockRouterClient{}
+	calls := 0
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(leaseDurationSeconds-30)*time.Second, result.RequeueAfter)
+	// The TCP port is still forwarded
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	assert.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "UnsupportedProtocol")
+	assert.Contains(t, event, "port 9999 will not be forwarded")
+}
+
+func serviceWithRemoteHost(remoteHost string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "my-service",
+			Namespace:   "default",
+			Annotations: map[string]string{remoteHostAnnotationName: remoteHost},
+		},
+	}
+}
+
+func TestGetRemoteHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		service corev1.Service
+		want    string
+		wantErr bool
+	}{
+		{name: "not set", service: corev1.Service{}, want: ""},
+		{name: "IPv4", service: serviceWithRemoteHost("203.0.113.5"), want: "203.0.113.5"},
+		{name: "IPv6", service: serviceWithRemoteHost("2001:db8::5"), want: "2001:db8::5"},
+		{name: "IPv6 is normalised", service: serviceWithRemoteHost("2001:0db8:0000::0005"), want: "2001:db8::5"},
+		{name: "hostname", service: serviceWithRemoteHost("example.com"), want: "example.com"},
+		{name: "hostname is normalised", service: serviceWithRemoteHost(" Home.Example.COM. "), want: "home.example.com"},
+		{name: "invalid hostname", service: serviceWithRemoteHost("my office"), wantErr: true},
+		{name: "CIDR", service: serviceWithRemoteHost("203.0.113.0/24"), wantErr: true},
+		{name: "empty", service: serviceWithRemoteHost(""), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getRemoteHost(tt.service)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// remoteHostRejectingRouterClient is a router that can only make port mappings for any remote host.
+type remoteHostRejectingRouterClient struct {
+	*mockRouterClient
+}
+
+func (m *remoteHostRejectingRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	err := m.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration)
+	if remoteHost != "" {
+		return upnpFault(ErrCodeWildCardNotPermittedInSrcIP)
+	}
+	return err
+}
+
+func TestSyncPortMappingsUsesRemoteHost(t *testing.T) {
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		serviceWithRemoteHost("203.0.113.5"), "192.168.1.10", 600, nil, map[string]uint16{"80/TCP": 80}, map[string]uint16{"443/TCP": 443})
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, "203.0.113.5", router.addCalls[0].RemoteHost)
+	assert.Equal(t, []portMappingCall{{RemoteHost: "203.0.113.5", ExternalPort: 443, Protocol: "TCP"}}, router.deleteCalls)
+	assert.Len(t, recorder.Events, 0)
+}
+
+func TestSyncPortMappingsFallsBackToAnyRemoteHost(t *testing.T) {
+	router := &remoteHostRejectingRouterClient{mockRouterClient: &mockRouterClient{}}
+	recorder := record.NewFakeRecorder(10)
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		serviceWithRemoteHost("203.0.113.5"), "192.168.1.10", 600, nil, map[string]uint16{"80/TCP": 80}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 2)
+	assert.Equal(t, "203.0.113.5", router.addCalls[0].RemoteHost)
+	assert.Equal(t, "", router.addCalls[1].RemoteHost)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "RemoteHostNotSupported")
+}
+
+func TestDeletePortMappingsFallsBackToAnyRemoteHost(t *testing.T) {
+	router := &mockRouterClient{deleteErr: errors.New("NoSuchEntryInArray")}
+	service := serviceWithRemoteHost("203.0.113.5")
+	service.Annotations[activeMappingsAnnotationName] = `{"80/TCP":80}`
+	err := deletePortMappings(logf.NullLogger{}, router, service, "")
+	assert.Error(t, err)
+	assert.Equal(t, []portMappingCall{
+		{RemoteHost: "203.0.113.5", ExternalPort: 80, Protocol: "TCP"},
+		{RemoteHost: "", ExternalPort: 80, Protocol: "TCP"},
+	}, router.deleteCalls)
+}
+
+func TestReconcileInvalidRemoteHost(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[remoteHostAnnotationName] = "my office"
+	router := &mockRouterClient{}
+	calls := 0
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Empty(t, router.addCalls)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "InvalidRemoteHost")
+}
+
+// samePortRouterClient is a router that can't forward ports to a different internal port.
+type samePortRouterClient struct {
+	*mockRouterClient
+}
+
+func (m *samePortRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	err := m.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration)
+	if externalPort != internalPort {
+		return upnpFault(ErrCodeSamePortValuesRequired)
+	}
+	return err
+}
+
+func TestSyncPortMappingsFallsBackToSamePort(t *testing.T) {
+	router := &samePortRouterClient{mockRouterClient: &mockRouterClient{}}
+	recorder := record.NewFakeRecorder(10)
+	desired := map[string]uint16{"80/TCP": 3000, "443/TCP": 443}
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		corev1.Service{}, "192.168.1.10", 600, nil, desired, nil)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint16{3000, 80, 443}, router.addedExternalPorts())
+	// The port that was actually forwarded is what gets recorded
+	assert.Equal(t, map[string]uint16{"80/TCP": 80, "443/TCP": 443}, desired)
+	assert.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "SamePortValuesRequired")
+	assert.Contains(t, event, "ignoring port mapping for port 80")
+}
+
+func TestSyncPortMappingsDoesNotRetryOtherErrors(t *testing.T) {
+	router := &mockRouterClient{addErr: upnpFault(ErrCodeActionFailed)}
+	recorder := record.NewFakeRecorder(10)
+	desired := map[string]uint16{"80/TCP": 3000}
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		corev1.Service{}, "192.168.1.10", 600, nil, desired, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []uint16{3000}, router.addedExternalPorts())
+	assert.Equal(t, map[string]uint16{"80/TCP": 3000}, desired)
+	assert.Len(t, recorder.Events, 0)
+}
+
+func TestSyncPortMappingsConflictInMappingEntry(t *testing.T) {
+	router := &mockRouterClient{addErr: upnpFault(ErrCodeConflictInMappingEntry)}
+	recorder := record.NewFakeRecorder(10)
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		corev1.Service{}, "192.168.1.10", 600, nil, map[string]uint16{"80/TCP": 80}, nil)
+	var upnpErr *UPnPError
+	if assert.True(t, errors.As(err, &upnpErr)) {
+		assert.Equal(t, ErrCodeConflictInMappingEntry, upnpErr.Code)
+	}
+	if assert.Len(t, recorder.Events, 1) {
+		event := <-recorder.Events
+		assert.Contains(t, event, "PortMappingConflict")
+		assert.Contains(t, event, "already forwarded to another client")
+	}
+}
+
+// conflictingRouterClient refuses to add a mapping over one it already has, like some routers do, rather than
+// replacing it.
+type conflictingRouterClient struct {
+	*mockRouterClient
+}
+
+func (c conflictingRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	err := c.mockRouterClient.AddPortMapping(remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[mappingKey(externalPort, protocol)]; ok {
+		return upnpFault(ErrCodeConflictInMappingEntry)
+	}
+	return err
+}
+
+func (c conflictingRouterClient) DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error {
+	err := c.mockRouterClient.DeletePortMapping(remoteHost, externalPort, protocol)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, mappingKey(externalPort, protocol))
+	return err
+}
+
+func TestSyncPortMappingsReplacesStaleConflictingMapping(t *testing.T) {
+	// We made this mapping, but the router won't let us renew it.
+	router := conflictingRouterClient{&mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "Mapping for my-service/default", LeaseDuration: 10},
+	}}}
+	recorder := record.NewFakeRecorder(10)
+	desired := map[string]uint16{"80/TCP": 80}
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		*holepunchedService(), "192.168.1.10", 600, nil, desired, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []portMappingCall{{ExternalPort: 80, Protocol: "TCP"}}, router.deleteCalls)
+	assert.Equal(t, []uint16{80, 80}, router.addedExternalPorts(), "the mapping is added again once the stale one is gone")
+	assert.Equal(t, map[string]uint16{"80/TCP": 80}, desired)
+	assert.Empty(t, drainEvents(recorder))
+}
+
+func TestSyncPortMappingsSkipsPortConflictingWithSomethingElse(t *testing.T) {
+	service := holepunchedService()
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: 443, Protocol: corev1.ProtocolTCP})
+	router := conflictingRouterClient{&mockRouterClient{entries: map[string]portMappingEntry{
+		"80/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true, Description: "Game console", LeaseDuration: 10},
+	}}}
+	recorder := record.NewFakeRecorder(10)
+	desired := map[string]uint16{"80/TCP": 80, "443/TCP": 443}
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		*service, "192.168.1.10", 600, nil, desired, nil)
+	assert.NoError(t, err, "the other port is still forwarded")
+	assert.Empty(t, router.deleteCalls, "the other mapping is left alone")
+	assert.ElementsMatch(t, []uint16{80, 443}, router.addedExternalPorts())
+	assert.Equal(t, map[string]uint16{"443/TCP": 443}, desired)
+	assert.Equal(t, []string{
+		`Warning PortMappingConflict External port 80/TCP is already forwarded to 192.168.1.10 by "Game console"; not forwarding it`,
+	}, drainEvents(recorder))
+}
+
+func TestReconcileForwardsPorts(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[holepunchPortMapAnnotationPrefix+"80"] = "3000"
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: (leaseDurationSeconds - 30) * time.Second}, result)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, []addPortMappingCall{{
+		portMappingCall: portMappingCall{RemoteHost: "", ExternalPort: 3000, Protocol: "TCP"},
+		InternalPort:    80,
+		InternalClient:  "192.168.1.10",
+		Enabled:         true,
+		Description:     "Mapping for my-service/default",
+		LeaseDuration:   leaseDurationSeconds,
+	}}, router.addCalls)
+
+	var stored corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	assert.True(t, hasFinalizer(stored, portMappingCleanupFinalizer))
+	assert.Equal(t, `{"80/TCP":3000}`, stored.Annotations[activeMappingsAnnotationName])
+}
+
+func TestReconcileIgnoresUnannotatedAndMissingServices(t *testing.T) {
+	service := holepunchedService()
+	delete(service.Annotations, holepunchAnnotationName)
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	for _, name := range []string{"my-service", "no-such-service"} {
+		result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}})
+		assert.NoError(t, err)
+		assert.Equal(t, ctrl.Result{}, result)
+	}
+	assert.Equal(t, 0, calls)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestReconcileIgnoresClusterIPServices(t *testing.T) {
+	service := holepunchedService()
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	router := &mockRouterClient{}
+	calls := 0
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Empty(t, router.addCalls)
+	assert.Equal(t, []string{
+		"Warning UnsupportedServiceType Can't forward ports for a ClusterIP service; it must be a LoadBalancer or NodePort service",
+	}, drainEvents(recorder))
+}
+
+func TestReconcileRequeuesWhenRouterFails(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{addErr: errors.New("router unavailable")}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: defaultRetryBaseDelay}, result)
+
+	// The router is forgotten, in case it's the wrong one, and found again next time
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestReconcileDeletedServiceRemovesMappings(t *testing.T) {
+	service := holepunchedService()
+	service.Finalizers = []string{portMappingCleanupFinalizer}
+	service.Annotations[activeMappingsAnnotationName] = `{"80/TCP":3000}`
+	now := v1.Now()
+	service.DeletionTimestamp = &now
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Equal(t, []portMappingCall{{RemoteHost: "", ExternalPort: 3000, Protocol: "TCP"}}, router.deleteCalls)
+	assert.Empty(t, router.addCalls)
+
+	var stored corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	assert.False(t, hasFinalizer(stored, portMappingCleanupFinalizer))
+}
+
+func TestReconcileUsesConfiguredRouterClients(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithRouterClientFactory(func(context.Context, ...string) (RouterClient, error) {
+			t.Fatal("router discovery should not be used when routers are configured")
+			return nil, nil
+		}),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+}
+
+func serviceWithDescription(description string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "my-service",
+			Namespace:   "default",
+			Annotations: map[string]string{descriptionAnnotationName: description},
+		},
+	}
+}
+
+func TestGetMappingDescription(t *testing.T) {
+	nodePort := corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort},
+	}
+	tests := []struct {
+		name          string
+		service       corev1.Service
+		want          string
+		wantTruncated bool
+	}{
+		{name: "default", service: corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"}},
+			want: "Mapping for my-service/default"},
+		{name: "NodePort", service: nodePort, want: "NodePort mapping for my-service/default"},
+		{name: "custom", service: serviceWithDescription("My Game Server"), want: "My Game Server"},
+		{name: "blank", service: serviceWithDescription("  "), want: "Mapping for my-service/default"},
+		{name: "exactly the limit", service: serviceWithDescription(strings.Repeat("a", 128)),
+			want: strings.Repeat("a", 128)},
+		{name: "too long", service: serviceWithDescription(strings.Repeat("a", 200)),
+			want: strings.Repeat("a", 128), wantTruncated: true},
+		{name: "too long multi-byte", service: serviceWithDescription(strings.Repeat("é", 130)),
+			want: strings.Repeat("é", 128), wantTruncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := getMappingDescription(tt.service)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantTruncated, truncated)
+		})
+	}
+}
+
+func TestSyncPortMappingsUsesDescriptionAnnotation(t *testing.T) {
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		serviceWithDescription("My Game Server"), "192.168.1.10", 600, nil, map[string]uint16{"80/TCP": 80}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, "My Game Server", router.addCalls[0].Description)
+	assert.Len(t, recorder.Events, 0)
+}
+
+func TestSyncPortMappingsWarnsOnTruncatedDescription(t *testing.T) {
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	err := NewServiceReconciler(nil, nil, WithEventRecorder(recorder)).syncPortMappings(context.Background(), logf.NullLogger{}, router,
+		serviceWithDescription(strings.Repeat("a", 200)), "192.168.1.10", 600, nil, map[string]uint16{"80/TCP": 80}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 1)
+	assert.Equal(t, strings.Repeat("a", 128), router.addCalls[0].Description)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "DescriptionTruncated")
+}
+
+func TestReconcileSkipsUnchangedService(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+
+	// Our own update to the service triggers another reconcile, which has nothing to do
+	router.entries = nil
+	result, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80}, router.addedExternalPorts())
+	assert.True(t, result.RequeueAfter > 0)
+	assert.True(t, result.RequeueAfter <= time.Duration(leaseDurationSeconds-30)*time.Second)
+
+	// Changing the service's annotations means it's reconciled again
+	var stored corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &stored))
+	stored.Annotations[holepunchPortMapAnnotationPrefix+"80"] = "8080"
+	assert.NoError(t, c.Update(context.Background(), &stored))
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80, 8080}, router.addedExternalPorts())
+}
+
+func TestReconcileRenewsLeaseOfUnchangedService(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+
+	// Pretend the lease is due for renewal
+	r.processedMu.Lock()
+	processed := r.processed[req.NamespacedName]
+	processed.renewAt = time.Now().Add(-time.Second)
+	r.processed[req.NamespacedName] = processed
+	r.processedMu.Unlock()
+
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{80, 80}, router.addedExternalPorts())
+}
+
+func TestAuditDoesNotSkipUnchangedServices(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{}
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(router, &calls)),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, r.audit(context.Background()))
+	assert.Equal(t, []uint16{80, 80}, router.addedExternalPorts())
+}
+
+// panickingRouterClient is a router whose client panics when asked to forward a port, like goupnp can on a response
+// it doesn't expect.
+type panickingRouterClient struct {
+	*mockRouterClient
+}
+
+func (m *panickingRouterClient) AddPortMapping(string, uint16, string, uint16, string, bool, string, uint32) error {
+	var entry *portMappingEntry
+	_ = entry.InternalClient
+	return nil
+}
+
+func TestReconcileRecoversFromPanic(t *testing.T) {
+	service := holepunchedService()
+	metrics, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	assert.NoError(t, err)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithMetricsRecorder(metrics),
+		WithRouterClients(&panickingRouterClient{mockRouterClient: &mockRouterClient{}}),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	var result ctrl.Result
+	assert.NotPanics(t, func() {
+		result, err = r.Reconcile(req)
+	})
+	assert.Equal(t, ctrl.Result{}, result)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "panic in reconcile: runtime error: invalid memory address or nil pointer dereference")
+		assert.Contains(t, err.Error(), "panickingRouterClient", "the error should include the stack trace")
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.reconcilePanics))
+
+	// The reconciler is still usable afterwards.
+	r.RouterClients = []RouterClient{&mockRouterClient{}}
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.reconcilePanics))
+}
+
+func TestReadyAfterSuccessfulReconcile(t *testing.T) {
+	service := holepunchedService()
+	router := &mockRouterClient{addErr: errors.New("router unavailable")}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+	assert.Error(t, r.Ready())
+
+	// The router can't be reached, so we're not ready yet.
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Error(t, r.Ready())
+
+	router.addErr = nil
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Ready())
+}
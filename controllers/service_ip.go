@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrNoServiceIP is returned by a ServiceIPSelector when none of a LoadBalancer's ingress points has an IP it can use.
+var ErrNoServiceIP = errors.New("no IP available for LoadBalancer (not yet allocated?)")
+
+// ErrNoServiceIPv6 is returned when only a LoadBalancer's IPv6 address is wanted, but it doesn't have one.
+var ErrNoServiceIPv6 = errors.New("no IPv6 address available for LoadBalancer")
+
+// ServiceIPSelector picks which of a LoadBalancer's ingress IPs to forward ports to. Ingress points with only a
+// hostname are ignored, as they're resolved separately. If there's nothing suitable then ErrNoServiceIP is returned.
+type ServiceIPSelector interface {
+	Select(ingresses []corev1.LoadBalancerIngress) (string, error)
+}
+
+// DefaultServiceIPSelector picks the IP that the router is most likely to be able to reach. IPv4 addresses come before
+// IPv6 ones (unless PreferIPv6 is set), then addresses in private ranges (RFC 1918, or unique local IPv6 addresses)
+// come before public ones. Any ties are broken by picking the lowest address, so that the same IP is picked every time
+// whatever order the ingress points are listed in.
+type DefaultServiceIPSelector struct {
+	PreferIPv6 bool
+}
+
+var _ ServiceIPSelector = DefaultServiceIPSelector{}
+
+func (s DefaultServiceIPSelector) Select(ingresses []corev1.LoadBalancerIngress) (string, error) {
+	candidates := ingressIPs(ingresses)
+	if len(candidates) == 0 {
+		return "", ErrNoServiceIP
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if aIPv4, bIPv4 := a.To4() != nil, b.To4() != nil; aIPv4 != bIPv4 {
+			return aIPv4 != s.PreferIPv6
+		}
+		if aPrivate, bPrivate := isPrivateIP(a), isPrivateIP(b); aPrivate != bPrivate {
+			return aPrivate
+		}
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+	return candidates[0].String(), nil
+}
+
+// PreferIPv4Selector only picks IPv4 addresses, choosing between them in the same way as DefaultServiceIPSelector.
+// UPnP and NAT-PMP port mappings can only forward to an IPv4 address, so this is what ServiceReconciler uses by
+// default. IPv6 addresses are opened up with pinholes instead.
+type PreferIPv4Selector struct{}
+
+var _ ServiceIPSelector = PreferIPv4Selector{}
+
+func (PreferIPv4Selector) Select(ingresses []corev1.LoadBalancerIngress) (string, error) {
+	var ipv4 []corev1.LoadBalancerIngress
+	for _, ingress := range ingresses {
+		if ip := net.ParseIP(ingress.IP); ip != nil && ip.To4() != nil {
+			ipv4 = append(ipv4, ingress)
+		}
+	}
+	return DefaultServiceIPSelector{}.Select(ipv4)
+}
+
+// ingressIPs returns the IP of every ingress point that has a valid one.
+func ingressIPs(ingresses []corev1.LoadBalancerIngress) []net.IP {
+	var ips []net.IP
+	for _, ingress := range ingresses {
+		if ip := net.ParseIP(ingress.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// privateIPNets are the address ranges reserved for private networks.
+var privateIPNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	for _, ipNet := range privateIPNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getIngressIndex parses the ingress-index annotation, which picks which of the service's LoadBalancer ingress points
+// to forward ports to, counting from zero. The bool is false if the annotation isn't set.
+func getIngressIndex(service corev1.Service) (int, bool, error) {
+	value, ok := service.Annotations[ingressIndexAnnotationName]
+	if !ok {
+		return 0, false, nil
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || index < 0 {
+		return 0, false, permanentError(fmt.Errorf("annotation %s must be a non-negative integer, not %q",
+			ingressIndexAnnotationName, value))
+	}
+	return index, true, nil
+}
+
+// getServiceIPAtIndex returns the IP of the LoadBalancer ingress point at index. If that ingress point only has a
+// hostname then the first other ingress point with an IPv4 address is used instead, as in PreferIPv4Selector, and if
+// there isn't one then an error wrapping ErrNoServiceIP is returned. An index past the end of the list is an error,
+// although not a permanent one, as the LoadBalancer may be given more ingress points later.
+func getServiceIPAtIndex(service corev1.Service, index int) (string, error) {
+	ingresses := service.Status.LoadBalancer.Ingress
+	if index >= len(ingresses) {
+		return "", fmt.Errorf("annotation %s asks for ingress point %d, but the LoadBalancer only has %d",
+			ingressIndexAnnotationName, index, len(ingresses))
+	}
+	if ip := net.ParseIP(ingresses[index].IP); ip != nil {
+		return ip.String(), nil
+	}
+	for _, ingress := range ingresses {
+		if ip := net.ParseIP(ingress.IP); ip != nil && ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("ingress point %d only has a hostname, and no other ingress point has an IPv4 address: %w",
+		index, ErrNoServiceIP)
+}
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func ingressIPsOf(ips ...string) []corev1.LoadBalancerIngress {
+	ingresses := make([]corev1.LoadBalancerIngress, 0, len(ips))
+	for _, ip := range ips {
+		ingresses = append(ingresses, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return ingresses
+}
+
+func TestServiceIPSelectors(t *testing.T) {
+	tests := []struct {
+		name        string
+		ingresses   []corev1.LoadBalancerIngress
+		defaultIP   string
+		preferIPv6  string
+		preferIPv4  string
+		noIPAtAll   bool
+		noIPv4AtAll bool
+	}{
+		{
+			name:      "empty",
+			noIPAtAll: true,
+		},
+		{
+			name:       "single",
+			ingresses:  ingressIPsOf("192.168.1.10"),
+			defaultIP:  "192.168.1.10",
+			preferIPv6: "192.168.1.10",
+			preferIPv4: "192.168.1.10",
+		},
+		{
+			name:       "dual-stack",
+			ingresses:  ingressIPsOf("2001:db8::10", "192.168.1.10"),
+			defaultIP:  "192.168.1.10",
+			preferIPv6: "2001:db8::10",
+			preferIPv4: "192.168.1.10",
+		},
+		{
+			name:        "IPv6 only",
+			ingresses:   ingressIPsOf("fd00::10"),
+			defaultIP:   "fd00::10",
+			preferIPv6:  "fd00::10",
+			noIPv4AtAll: true,
+		},
+		{
+			name:      "hostname only",
+			ingresses: []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}},
+			noIPAtAll: true,
+		},
+		{
+			name:       "private before public",
+			ingresses:  ingressIPsOf("203.0.113.5", "2001:db8::10", "10.0.0.5", "fd00::10"),
+			defaultIP:  "10.0.0.5",
+			preferIPv6: "fd00::10",
+			preferIPv4: "10.0.0.5",
+		},
+		{
+			name:       "lowest address wins ties",
+			ingresses:  ingressIPsOf("192.168.1.20", "192.168.1.3", "not-an-ip", "192.168.1.100"),
+			defaultIP:  "192.168.1.3",
+			preferIPv6: "192.168.1.3",
+			preferIPv4: "192.168.1.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(selector ServiceIPSelector, expected string, noIP bool) {
+				ip, err := selector.Select(tt.ingresses)
+				if noIP {
+					assert.True(t, errors.Is(err, ErrNoServiceIP), "expected ErrNoServiceIP, got %v", err)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, expected, ip)
+			}
+			check(DefaultServiceIPSelector{}, tt.defaultIP, tt.noIPAtAll)
+			check(DefaultServiceIPSelector{PreferIPv6: true}, tt.preferIPv6, tt.noIPAtAll)
+			check(PreferIPv4Selector{}, tt.preferIPv4, tt.noIPAtAll || tt.noIPv4AtAll)
+		})
+	}
+}
+
+func TestGetServiceIPUsesSelector(t *testing.T) {
+	service := serviceWithIngress(ingressIPsOf("2001:db8::10", "192.168.1.10")...)
+
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(nil)))
+	ip, err := r.getServiceIP(context.Background(), service)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", ip)
+
+	r = NewServiceReconciler(nil, nil, withLookupHost(staticLookup(nil)),
+		WithServiceIPSelector(DefaultServiceIPSelector{PreferIPv6: true}))
+	ip, err = r.getServiceIP(context.Background(), service)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::10", ip)
+}
+
+func TestGetServiceIPFallsBackToHostnameWithoutUsableIP(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(map[string][]string{
+		"lb.example.com": {"192.168.1.20"},
+	})))
+	ip, err := r.getServiceIP(context.Background(), serviceWithIngress(
+		corev1.LoadBalancerIngress{IP: "2001:db8::10"},
+		corev1.LoadBalancerIngress{Hostname: "lb.example.com"},
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.20", ip)
+}
+
+func TestGetServiceIPAtIndex(t *testing.T) {
+	service := serviceWithIngress(
+		corev1.LoadBalancerIngress{IP: "192.168.1.10"},
+		corev1.LoadBalancerIngress{IP: "192.168.1.20"},
+		corev1.LoadBalancerIngress{Hostname: "lb.example.com"},
+	)
+	ip, err := getServiceIPAtIndex(service, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.20", ip)
+
+	// Only a hostname, so the first IP is used instead.
+	ip, err = getServiceIPAtIndex(service, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", ip)
+
+	_, err = getServiceIPAtIndex(service, 3)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "only has 3")
+	assert.NotEqual(t, Permanent, errorKind(err))
+
+	_, err = getServiceIPAtIndex(serviceWithIngress(corev1.LoadBalancerIngress{Hostname: "lb.example.com"}), 0)
+	assert.True(t, errors.Is(err, ErrNoServiceIP))
+}
+
+func TestGetServiceIPAtIndexFallsBackToIPv4Only(t *testing.T) {
+	// Port mappings can't forward to an IPv6 address, so it's skipped in favour of a later IPv4 one.
+	service := serviceWithIngress(
+		corev1.LoadBalancerIngress{Hostname: "lb.example.com"},
+		corev1.LoadBalancerIngress{IP: "2001:db8::10"},
+		corev1.LoadBalancerIngress{IP: "192.168.1.10"},
+	)
+	ip, err := getServiceIPAtIndex(service, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10", ip)
+
+	_, err = getServiceIPAtIndex(serviceWithIngress(
+		corev1.LoadBalancerIngress{Hostname: "lb.example.com"},
+		corev1.LoadBalancerIngress{IP: "2001:db8::10"},
+	), 0)
+	assert.True(t, errors.Is(err, ErrNoServiceIP))
+	assert.Contains(t, err.Error(), "IPv4")
+}
+
+func TestGetIngressIndex(t *testing.T) {
+	_, ok, err := getIngressIndex(corev1.Service{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	service := corev1.Service{}
+	service.Annotations = map[string]string{ingressIndexAnnotationName: " 1 "}
+	index, ok, err := getIngressIndex(service)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, index)
+
+	for _, value := range []string{"-1", "first", ""} {
+		service.Annotations[ingressIndexAnnotationName] = value
+		_, _, err := getIngressIndex(service)
+		assert.Equal(t, Permanent, errorKind(err), value)
+	}
+}
+
+func TestGetServiceIPUsesIngressIndex(t *testing.T) {
+	r := NewServiceReconciler(nil, nil, withLookupHost(staticLookup(map[string][]string{
+		"lb.example.com": {"192.168.1.30"},
+	})))
+
+	// Without the annotation the private address would be picked.
+	service := serviceWithIngress(ingressIPsOf("192.168.1.10", "203.0.113.10")...)
+	service.Annotations = map[string]string{ingressIndexAnnotationName: "1"}
+	ip, err := r.getServiceIP(context.Background(), service)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.10", ip)
+
+	// The chosen hostname is resolved before any others.
+	service = serviceWithIngress(
+		corev1.LoadBalancerIngress{Hostname: "other.example.com"},
+		corev1.LoadBalancerIngress{Hostname: "lb.example.com"},
+	)
+	service.Annotations = map[string]string{ingressIndexAnnotationName: "1"}
+	ip, err = r.getServiceIP(context.Background(), service)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.30", ip)
+
+	service.Annotations[ingressIndexAnnotationName] = "2"
+	_, err = r.getServiceIP(context.Background(), service)
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getServiceRouterURL returns the root device description URL of the router that the service asks to have its ports
+// forwarded on with the router URL annotation, or an empty string if it doesn't ask for one. Only absolute HTTP(S) URLs
+// are accepted, as that's all a UPnP router will serve its description over.
+func getServiceRouterURL(service corev1.Service) (string, error) {
+	value, ok := service.Annotations[routerURLAnnotationName]
+	if !ok || value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", permanentError(fmt.Errorf("invalid %s annotation %q: %w", routerURLAnnotationName, value, err))
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", permanentError(fmt.Errorf("invalid %s annotation %q: must be an http or https URL",
+			routerURLAnnotationName, value))
+	}
+	return value, nil
+}
+
+// getServiceRouterClient returns the router to configure for the service. That's the one at its router URL annotation
+// if it has one, which is cached separately to the router every other service uses. It also returns whether that's
+// the router being used. If the service's own router can't be found then we warn about it and fall back to the usual
+// router, rather than leave its ports unforwarded. Services with an invalid router URL annotation use the usual router.
+func (r *ServiceReconciler) getServiceRouterClient(ctx context.Context, log logr.Logger, service *corev1.Service) (RouterClient, bool, error) {
+	routerURL, err := getServiceRouterURL(*service)
+	if err != nil || routerURL == "" {
+		router, err := r.getRouterClient(ctx)
+		return router, false, err
+	}
+
+	// We've been told exactly where the router is, so there's no point trying NAT-PMP if it isn't there.
+	pick := r.RouterClientFactory
+	if pick == nil {
+		pick = PickRouterClient
+	}
+	router, err := r.cachedRouterClient(ctx, serviceRouterCacheKey(routerURL), func(ctx context.Context) (RouterClient, error) {
+		return pick(ctx, routerURL)
+	})
+	if err == nil {
+		return router, true, nil
+	}
+	log.Info("Unable to use the service's own router, falling back to the default router", "router-url", routerURL,
+		"error", err.Error())
+	r.Recorder.Eventf(service, corev1.EventTypeWarning, "RouterURLUnreachable",
+		"Unable to use router at %s, using the default router instead: %v", routerURL, err)
+	router, err = r.getRouterClient(ctx)
+	return router, false, err
+}
+
+// invalidateServiceRouterClient forgets about the cached router for the service, as well as the router every other
+// service uses, since a service whose own router can't be found falls back to that.
+func (r *ServiceReconciler) invalidateServiceRouterClient(service corev1.Service) {
+	if routerURL, err := getServiceRouterURL(service); err == nil && routerURL != "" {
+		r.routerCacheMu.Lock()
+		delete(r.routerCache, serviceRouterCacheKey(routerURL))
+		r.routerCacheMu.Unlock()
+	}
+	r.invalidateRouterClient()
+}
+
+// serviceRouterCacheKey is the key that a service's own router is cached under. It can't clash with routerCacheKey, as
+// URLs don't contain spaces.
+func serviceRouterCacheKey(routerURL string) string {
+	return "service " + routerURL
+}
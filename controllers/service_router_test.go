@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultRouterURL = "http://192.168.1.1:5000/rootDesc.xml"
+	dmzRouterURL     = "http://10.0.0.1:49000/rootDesc.xml"
+)
+
+func TestGetServiceRouterURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    *string
+		expected string
+		wantErr  bool
+	}{
+		{name: "no annotation"},
+		{name: "empty", value: stringPtr("")},
+		{name: "http", value: stringPtr(dmzRouterURL), expected: dmzRouterURL},
+		{name: "https", value: stringPtr("https://router.lan/igd.xml"), expected: "https://router.lan/igd.xml"},
+		{name: "missing scheme", value: stringPtr("10.0.0.1:49000/rootDesc.xml"), wantErr: true},
+		{name: "relative", value: stringPtr("/rootDesc.xml"), wantErr: true},
+		{name: "missing host", value: stringPtr("http:///rootDesc.xml"), wantErr: true},
+		{name: "not http", value: stringPtr("ftp://10.0.0.1/rootDesc.xml"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := holepunchedService()
+			if tt.value != nil {
+				service.Annotations[routerURLAnnotationName] = *tt.value
+			}
+			routerURL, err := getServiceRouterURL(*service)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, Permanent, errorKind(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, routerURL)
+		})
+	}
+}
+
+// routersByURL returns a RouterClientFactory that picks the router for the given root device description, or fails if
+// there isn't one.
+func routersByURL(routers map[string]RouterClient) func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+	return func(ctx context.Context, rootDesc ...string) (RouterClient, error) {
+		if len(rootDesc) == 1 {
+			if router, ok := routers[rootDesc[0]]; ok {
+				return router, nil
+			}
+		}
+		return nil, errors.New("connection refused")
+	}
+}
+
+func TestReconcileUsesServiceRouterURL(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[routerURLAnnotationName] = dmzRouterURL
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, service)
+	home := &mockRouterClient{}
+	dmz := &mockRouterClient{externalIP: "198.51.100.7"}
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterRootDesc(defaultRouterURL),
+		WithRouterClientFactory(routersByURL(map[string]RouterClient{defaultRouterURL: home, dmzRouterURL: dmz})),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Empty(t, home.addCalls)
+	assert.Len(t, dmz.addCalls, 1)
+
+	// The external IP is the service's own router's, not the default router's.
+	var updated corev1.Service
+	assert.NoError(t, c.Get(context.Background(), req.NamespacedName, &updated))
+	assert.Equal(t, "198.51.100.7", updated.Annotations[externalIPAnnotationName])
+
+	// Other services still use the default router.
+	other := holepunchedService()
+	other.Name = "other"
+	other.Spec.Ports[0].Port = 8080
+	assert.NoError(t, c.Create(context.Background(), other))
+	_, err = r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other"}})
+	assert.NoError(t, err)
+	assert.Len(t, home.addCalls, 1)
+	assert.Len(t, dmz.addCalls, 1)
+}
+
+func TestReconcileFallsBackWhenServiceRouterUnreachable(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[routerURLAnnotationName] = dmzRouterURL
+	home := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterRootDesc(defaultRouterURL),
+		WithRouterClientFactory(routersByURL(map[string]RouterClient{defaultRouterURL: home})),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Len(t, home.addCalls, 1)
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Contains(t, <-recorder.Events, "RouterURLUnreachable")
+	}
+}
+
+func TestReconcileRejectsInvalidServiceRouterURL(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[routerURLAnnotationName] = "10.0.0.1:49000/rootDesc.xml"
+	router := &mockRouterClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithRouterClients(router),
+	)
+
+	result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.Empty(t, router.addCalls)
+	if assert.Len(t, recorder.Events, 1) {
+		assert.Contains(t, <-recorder.Events, "InvalidRouterURL")
+	}
+}
+
+func TestReconcileDeleteUsesServiceRouterURL(t *testing.T) {
+	service := holepunchedService()
+	service.Annotations[routerURLAnnotationName] = dmzRouterURL
+	service.Annotations[holepunchAnnotationName] = "false"
+	service.Annotations[activeMappingsAnnotationName] = `{"80/TCP":80}`
+	service.Finalizers = []string{portMappingCleanupFinalizer}
+	home, dmz := &mockRouterClient{}, &mockRouterClient{}
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, service), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterRootDesc(defaultRouterURL),
+		WithRouterClientFactory(routersByURL(map[string]RouterClient{defaultRouterURL: home, dmzRouterURL: dmz})),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+	assert.Empty(t, home.deleteCalls)
+	assert.Len(t, dmz.deleteCalls, 1)
+}
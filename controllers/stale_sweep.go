@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// staleMappingDescriptionPrefix is how the descriptions we give port mappings by default start, followed by the
+// service's name and namespace. See getMappingDescription.
+const staleMappingDescriptionPrefix = "Mapping for "
+
+// parseMappingDescription works out which service a port mapping with one of our default descriptions is for.
+func parseMappingDescription(description string) (types.NamespacedName, bool) {
+	if !strings.HasPrefix(description, staleMappingDescriptionPrefix) {
+		return types.NamespacedName{}, false
+	}
+	parts := strings.Split(strings.TrimPrefix(description, staleMappingDescriptionPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Name: parts[0], Namespace: parts[1]}, true
+}
+
+// SweepStaleMappings removes port mappings from the router that an earlier run of holepunch made, but which no longer
+// belong to a service, such as because it crashed before it could remove them. Mappings are recognised by their
+// default description after DescriptionPrefix (e.g., "holepunch:Mapping for my-service/default"), or without it for
+// mappings made by versions of holepunch from before description prefixes. Those for a service that no longer exists,
+// no longer has the holepunch annotation, or no longer has that port forwarded are removed. Those for a port the
+// service does still have forwarded, but to a different IP address, are pointed at the service's IP instead, with our
+// prefix. It returns how many mappings were removed and how many were updated.
+//
+// Services with their own router or description prefix are left alone, as are mappings with any other description,
+// even if they were made by holepunch, as we can't tell which service they're for. This should only be run where the
+// controller is running (i.e., on the leader), so that two replicas don't sweep the router at once.
+func (r *ServiceReconciler) SweepStaleMappings(ctx context.Context) (removed, updated int, err error) {
+	router, err := r.getRouterClient(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to find router to sweep: %w", err)
+	}
+	router = r.withDryRun(r.Log, router)
+	mappings, err := GetAllPortMappings(ctx, router)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to list router's port mappings: %w", err)
+	}
+
+	var services corev1.ServiceList
+	if err := r.List(ctx, &services); err != nil {
+		return 0, 0, fmt.Errorf("unable to list services: %w", err)
+	}
+	current := make(map[types.NamespacedName]corev1.Service)
+	for _, service := range services.Items {
+		current[types.NamespacedName{Namespace: service.Namespace, Name: service.Name}] = service
+	}
+
+	for _, m := range mappings {
+		// Mappings made before description prefixes don't have one, but are still ours.
+		name, ok := parseMappingDescription(strings.TrimPrefix(m.Description, r.DescriptionPrefix))
+		if !ok {
+			continue
+		}
+		log := r.Log.WithValues("service", name, "external-port", m.ExternalPort, "protocol", m.Protocol,
+			"internal-client", m.InternalClient)
+		service, exists := current[name]
+		if exists {
+			service = r.withHolepunchPolicy(ctx, log, service)
+			if routerURL, _ := getServiceRouterURL(service); routerURL != "" ||
+				r.descriptionPrefix(service) != r.DescriptionPrefix {
+				continue
+			}
+		}
+		if !exists || !HasHolepunchAnnotation(service) || !service.DeletionTimestamp.IsZero() ||
+			!hasActiveMapping(service, m) {
+			log.Info("Removing stale port mapping left by an earlier run")
+			if err := deletePortMapping(router, m.RemoteHost, m.ExternalPort, m.Protocol); err != nil {
+				log.Error(err, "Failed to remove stale port mapping")
+				continue
+			}
+			removed++
+			continue
+		}
+
+		serviceIP, err := r.getServiceIP(ctx, service)
+		if err != nil || serviceIP == m.InternalClient {
+			// If the service doesn't have an IP yet then there's nothing to point the mapping at, and reconciling
+			// the service will sort it out once it does.
+			continue
+		}
+		leaseDuration, err := getLeaseDuration(service, r.defaultLeaseDuration())
+		if err != nil {
+			continue
+		}
+		log.Info("Updating port mapping left by an earlier run to the service's IP", "service-ip", serviceIP)
+		// Routers won't point an existing mapping somewhere else, so it has to be removed first.
+		if err := deletePortMapping(router, m.RemoteHost, m.ExternalPort, m.Protocol); err != nil {
+			log.Error(err, "Failed to remove outdated port mapping")
+			continue
+		}
+		if err := addPortMappingAsIs(router, m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, serviceIP,
+			withDescriptionPrefix(r.DescriptionPrefix, m.Description), leaseDuration); err != nil {
+			log.Error(err, "Failed to update outdated port mapping")
+			continue
+		}
+		updated++
+	}
+	return removed, updated, nil
+}
+
+// hasActiveMapping returns true if m is one of the port mappings recorded on the service as active, or if we can't tell
+// because the record can't be read.
+func hasActiveMapping(service corev1.Service, m PortMappingEntry) bool {
+	active, err := getActiveMappings(service)
+	if err != nil {
+		return true
+	}
+	for key, externalPort := range active {
+		if _, protocol, err := parseMappingKey(key); err == nil && externalPort == m.ExternalPort &&
+			strings.EqualFold(protocol, m.Protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepStaleOnStart runs SweepStaleMappings the first time it's called, if SweepStaleOnStart is set. Like
+// checkMappingDriftOnStart it's called before the first reconcile, which only happens on the leader.
+func (r *ServiceReconciler) sweepStaleOnStart(ctx context.Context) {
+	r.staleSweepOnce.Do(func() {
+		if !r.SweepStaleOnStart {
+			return
+		}
+		removed, updated, err := r.SweepStaleMappings(ctx)
+		if err != nil {
+			r.Log.Error(err, "Unable to sweep stale port mappings")
+			return
+		}
+		r.Log.Info("Swept stale port mappings", "removed", removed, "updated", updated)
+	})
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestParseMappingDescription(t *testing.T) {
+	name, ok := parseMappingDescription("Mapping for my-service/default")
+	assert.True(t, ok)
+	assert.Equal(t, types.NamespacedName{Namespace: "default", Name: "my-service"}, name)
+
+	for _, description := range []string{"My Game Server", "NodePort mapping for my-service/default",
+		"Mapping for my-service", "Mapping for /default", "Mapping for a/b/c"} {
+		_, ok := parseMappingDescription(description)
+		assert.False(t, ok, description)
+	}
+}
+
+// staleSweepFixtures returns services and a router with port mappings left over from an earlier run for them.
+func staleSweepFixtures() ([]*corev1.Service, *mockRouterClient) {
+	current := holepunchedService()
+	current.Annotations[activeMappingsAnnotationName] = `{"80/TCP":8080}`
+	moved := holepunchedService()
+	moved.Name = "moved"
+	moved.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.20"}}
+	moved.Annotations[activeMappingsAnnotationName] = `{"80/TCP":8083}`
+	unannotated := holepunchedService()
+	unannotated.Name = "unannotated"
+	unannotated.Annotations = map[string]string{activeMappingsAnnotationName: `{"53/UDP":8084}`}
+
+	router := &mockRouterClient{entries: map[string]portMappingEntry{
+		"8080/TCP": {InternalPort: 80, InternalClient: "192.168.1.10", Description: "Mapping for my-service/default"},
+		"8081/TCP": {InternalPort: 80, InternalClient: "192.168.1.11", Description: "Mapping for gone/default"},
+		"8082/TCP": {InternalPort: 443, InternalClient: "192.168.1.10", Description: "Mapping for my-service/default"},
+		"8083/TCP": {InternalPort: 80, InternalClient: "192.168.1.99", Description: "Mapping for moved/default"},
+		"8084/UDP": {InternalPort: 53, InternalClient: "192.168.1.12", Description: "Mapping for unannotated/default"},
+		"9000/TCP": {InternalPort: 9000, InternalClient: "192.168.1.50", Description: "My Game Server"},
+	}}
+	return []*corev1.Service{current, moved, unannotated}, router
+}
+
+func TestSweepStaleMappings(t *testing.T) {
+	services, router := staleSweepFixtures()
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, services[0], services[1], services[2])
+	r := NewServiceReconciler(c, scheme.Scheme, WithLogger(logf.NullLogger{}), WithRouterClients(router))
+
+	removed, updated, err := r.SweepStaleMappings(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.Equal(t, 1, updated)
+	assert.ElementsMatch(t, []portMappingCall{
+		{ExternalPort: 8081, Protocol: "TCP"},
+		{ExternalPort: 8082, Protocol: "TCP"},
+		{ExternalPort: 8083, Protocol: "TCP"},
+		{ExternalPort: 8084, Protocol: "UDP"},
+	}, router.deleteCalls)
+	if assert.Len(t, router.addCalls, 1) {
+		call := router.addCalls[0]
+		assert.Equal(t, uint16(8083), call.ExternalPort)
+		assert.Equal(t, uint16(80), call.InternalPort)
+		assert.Equal(t, "192.168.1.20", call.InternalClient)
+		assert.Equal(t, "Mapping for moved/default", call.Description)
+	}
+}
+
+func TestSweepStaleMappingsDryRun(t *testing.T) {
+	services, router := staleSweepFixtures()
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, services[0], services[1], services[2])
+	r := NewServiceReconciler(c, scheme.Scheme, WithLogger(logf.NullLogger{}), WithRouterClients(router),
+		WithDryRun(true))
+
+	_, _, err := r.SweepStaleMappings(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, router.deleteCalls)
+	assert.Empty(t, router.addCalls)
+}
+
+func TestReconcileSweepsStaleMappingsOnce(t *testing.T) {
+	services, router := staleSweepFixtures()
+	c := fake.NewFakeClientWithScheme(scheme.Scheme, services[0], services[1], services[2])
+	r := NewServiceReconciler(c, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(router),
+		WithSweepStaleOnStart(true),
+	)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}}
+
+	_, err := r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.deleteCalls, 4)
+
+	r.forgetProcessed(req.NamespacedName)
+	_, err = r.Reconcile(req)
+	assert.NoError(t, err)
+	assert.Len(t, router.deleteCalls, 4, "the router is only swept once")
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ValidateAllServices checks the holepunch annotations of every service we look after, and warns about any that are
+// invalid or that ask for an external port another service already has. It's meant to be called on startup, before
+// the manager is started, to catch mistakes made while we weren't running. Those would otherwise only turn up in the
+// logs once the service is reconciled. Each problem is logged and emitted as a Warning event on the service, and
+// doesn't stop the others from being checked. Only failing to list the services is returned as an error.
+func (r *ServiceReconciler) ValidateAllServices(ctx context.Context) error {
+	reader := r.apiReader()
+	services, err := r.listServicesInScope(ctx, reader)
+	if err != nil {
+		return fmt.Errorf("unable to list services to validate: %w", err)
+	}
+	// Whoever was created first gets an external port, as with findPortOwner.
+	sort.Slice(services.Items, func(i, j int) bool { return createdBefore(services.Items[i], services.Items[j]) })
+
+	owners := make(map[string]types.NamespacedName)
+	invalid := 0
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !r.inScope(service) || !service.DeletionTimestamp.IsZero() {
+			continue
+		}
+		policy, err := readHolepunchPolicy(ctx, reader, service.Namespace)
+		if err != nil {
+			r.Log.Info("Unable to read HolepunchPolicy, ignoring it", "namespace", service.Namespace,
+				"error", err.Error())
+		}
+		settings := applyPortMappingAnnotationFormat(applyHolepunchPolicy(*service, policy), r.PortMappingAnnotationFormat)
+		if !HasHolepunchAnnotation(settings) && !hasInvalidHolepunchAnnotation(settings) {
+			continue
+		}
+
+		problems, forwardable := r.validateServiceAnnotations(service, settings)
+		// A service whose ports won't be forwarded until it's fixed doesn't take any external ports from the others.
+		if forwardable {
+			problems += r.claimExternalPorts(service, settings, owners)
+		}
+		if problems > 0 {
+			invalid++
+		}
+	}
+	r.Log.Info("Validated holepunch annotations", "services", len(services.Items), "invalid", invalid)
+	return nil
+}
+
+// listServicesInScope lists the services in ServiceNamespaceSelector's namespaces, or in every namespace if it's empty.
+// Listing each namespace separately means we don't need permission to list services across the whole cluster.
+func (r *ServiceReconciler) listServicesInScope(ctx context.Context, reader client.Reader) (corev1.ServiceList, error) {
+	var services corev1.ServiceList
+	if len(r.ServiceNamespaceSelector) == 0 {
+		err := reader.List(ctx, &services)
+		return services, err
+	}
+	for _, namespace := range r.ServiceNamespaceSelector {
+		var inNamespace corev1.ServiceList
+		if err := reader.List(ctx, &inNamespace, client.InNamespace(namespace)); err != nil {
+			return services, err
+		}
+		services.Items = append(services.Items, inNamespace.Items...)
+	}
+	return services, nil
+}
+
+// validateServiceAnnotations warns about each problem with the service's holepunch annotations, returning how many
+// there are, and whether its ports can still be forwarded despite them. settings is the service with its
+// HolepunchPolicy applied, as for reconcile.
+func (r *ServiceReconciler) validateServiceAnnotations(service *corev1.Service, settings corev1.Service) (problems int, forwardable bool) {
+	forwardable = true
+	warn := func(reason string, err error) {
+		r.warnInvalidService(service, reason, err.Error())
+		problems++
+		forwardable = false
+	}
+	if _, _, err := getHolepunchProtocolFilter(settings); err != nil {
+		warn("InvalidHolepunchAnnotation", err)
+	}
+	if _, err := getSpecMappings(settings); err != nil {
+		warn("InvalidPortMapping", err)
+	} else if err := validatePortMappingAnnotations(settings); err != nil {
+		// These are only ignored, so the service's other ports are still forwarded.
+		r.warnInvalidService(service, "UnmatchedPortMapping", err.Error())
+		problems++
+	}
+	if _, _, err := getIngressIndex(settings); err != nil {
+		warn("InvalidIngressIndex", err)
+	}
+	if _, err := getDescriptionTemplate(settings); err != nil {
+		// The usual description is used instead, so the service's ports are still forwarded.
+		r.warnInvalidService(service, "InvalidDescriptionTemplate", err.Error())
+		problems++
+	}
+	if leaseDuration, err := getLeaseDuration(settings, r.defaultLeaseDuration()); err != nil {
+		warn("InvalidLeaseDuration", err)
+	} else if _, err := getPortLeaseDurations(settings, nil, leaseDuration); err != nil {
+		warn("InvalidLeaseDuration", err)
+	} else if _, err := getReconcileInterval(settings, leaseDuration); err != nil {
+		warn("InvalidReconcileInterval", err)
+	}
+	return problems, forwardable
+}
+
+// claimExternalPorts records the service as the owner of each of its external ports in owners, which maps port claim
+// keys to the service that has them. Ports that another service already has are warned about, and how many there are is
+// returned.
+func (r *ServiceReconciler) claimExternalPorts(service *corev1.Service, settings corev1.Service, owners map[string]types.NamespacedName) int {
+	name := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	var keys []string
+	for key := range effectiveExternalPorts(settings) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	conflicts := 0
+	for _, key := range keys {
+		owner, ok := owners[key]
+		if !ok {
+			owners[key] = name
+			continue
+		}
+		protocol, externalPort := splitPortClaimKey(key)
+		r.warnInvalidService(service, "PortConflict",
+			fmt.Sprintf("External port %s/%s is already claimed by service %s", externalPort, protocol, owner))
+		conflicts++
+	}
+	return conflicts
+}
+
+// splitPortClaimKey splits a key from portClaimKey back into its protocol and external port.
+func splitPortClaimKey(key string) (protocol string, externalPort string) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+func (r *ServiceReconciler) warnInvalidService(service *corev1.Service, reason string, message string) {
+	r.Log.Info("Service has invalid holepunch annotations", "service",
+		types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, "reason", reason, "problem", message)
+	r.Recorder.Event(service, corev1.EventTypeWarning, reason, message)
+}
+
+// apiReader returns APIReader, or the client if it isn't set.
+func (r *ServiceReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
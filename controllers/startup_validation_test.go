@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// namedService is holepunchedService with a different name and extra annotations.
+func namedService(name string, annotations map[string]string) *corev1.Service {
+	service := holepunchedService()
+	service.Name = name
+	for key, value := range annotations {
+		service.Annotations[key] = value
+	}
+	return service
+}
+
+func TestValidateAllServices(t *testing.T) {
+	notHolepunched := namedService("f-not-holepunched", map[string]string{holepunchPortMapAnnotationPrefix + "80": "http"})
+	notHolepunched.Annotations[holepunchAnnotationName] = "false"
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(nil, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithAPIReader(fake.NewFakeClientWithScheme(scheme.Scheme,
+			namedService("a-valid", map[string]string{holepunchPortMapAnnotationPrefix + "80": "3000"}),
+			namedService("b-bad-port-mapping", map[string]string{holepunchPortMapAnnotationPrefix + "80": "http"}),
+			namedService("c-bad-lease", map[string]string{leaseDurationAnnotationName: "forever"}),
+			namedService("d-conflict", map[string]string{holepunchPortMapAnnotationPrefix + "80": "3000"}),
+			namedService("e-unmatched", map[string]string{holepunchPortMapAnnotationPrefix + "443": "4000"}),
+			notHolepunched,
+		)),
+	)
+
+	assert.NoError(t, r.ValidateAllServices(context.Background()))
+	events := drainEvents(recorder)
+	if assert.Len(t, events, 4) {
+		assert.Contains(t, events[0], "Warning InvalidPortMapping")
+		assert.Contains(t, events[1], "Warning InvalidLeaseDuration")
+		assert.Contains(t, events[2], "Warning PortConflict External port 3000/TCP is already claimed by service default/a-valid")
+		assert.Contains(t, events[3], "Warning UnmatchedPortMapping")
+	}
+}
+
+func TestValidateAllServicesOnlyInScope(t *testing.T) {
+	otherNamespace := namedService("bad-port-mapping", map[string]string{holepunchPortMapAnnotationPrefix + "80": "http"})
+	otherNamespace.Namespace = "other"
+	recorder := record.NewFakeRecorder(10)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, otherNamespace), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(recorder),
+		WithServiceNamespaceSelector("default"),
+	)
+
+	assert.NoError(t, r.ValidateAllServices(context.Background()))
+	assert.Empty(t, drainEvents(recorder))
+}
+
+// failingListClient fails to list anything.
+type failingListClient struct {
+	client.Client
+}
+
+func (c failingListClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	return errors.New("API server unavailable")
+}
+
+func TestValidateAllServicesListFails(t *testing.T) {
+	r := NewServiceReconciler(failingListClient{}, scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+	)
+	assert.Error(t, r.ValidateAllServices(context.Background()))
+}
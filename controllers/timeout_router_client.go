@@ -0,0 +1,338 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// timeoutRouterClient wraps a RouterClient so that no call to the router takes longer than a timeout. A router that
+// has hung would otherwise hold up a reconcile forever.
+//
+// Calls made without a context can't be cancelled, so one that times out carries on in the background until the router
+// answers or the connection fails. We just stop waiting for it. Calls made with a context pass it on to the router we
+// wrap, with the timeout added.
+type timeoutRouterClient struct {
+	RouterClient
+	timeout time.Duration
+}
+
+// call runs f, giving up if it doesn't finish within the timeout. As with awaitCall, f may still be running after
+// we've given up.
+func (t *timeoutRouterClient) call(operation string, f func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	if err := awaitCall(ctx, f); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+			return fmt.Errorf("router did not respond to %s within %s: %w", operation, t.timeout, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// callCtx runs f with a context that's done after the timeout. If the router we wrap takes a context then it stops the
+// call itself, rather than it carrying on in the background.
+func (t *timeoutRouterClient) callCtx(ctx context.Context, operation string, f func(ctx context.Context) error) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	if err := f(timeoutCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && timeoutCtx.Err() != nil && ctx.Err() == nil {
+			return fmt.Errorf("router did not respond to %s within %s: %w", operation, t.timeout, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// awaitCall runs f, giving up with ctx's error if ctx is done before f finishes. As f may still be running after we've
+// given up, it must only write to variables that aren't read if we give up. If f panics then so does awaitCall, so
+// that the panic happens on the caller's goroutine where it can be recovered from.
+func awaitCall(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	var panics panicCatcher
+	go func() {
+		defer close(done)
+		defer panics.catch()
+		done <- f()
+	}()
+	select {
+	case err, ok := <-done:
+		if !ok {
+			// f panicked rather than returning.
+			panics.repanic()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *timeoutRouterClient) AddPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return t.call("AddPortMapping", func() error {
+		return t.RouterClient.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	})
+}
+
+func (t *timeoutRouterClient) DeletePortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return t.call("DeletePortMapping", func() error {
+		return t.RouterClient.DeletePortMapping(NewRemoteHost, NewExternalPort, NewProtocol)
+	})
+}
+
+func (t *timeoutRouterClient) GetSpecificPortMappingEntry(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	var internalPort uint16
+	var internalClient, description string
+	var enabled bool
+	var leaseDuration uint32
+	err = t.call("GetSpecificPortMappingEntry", func() error {
+		var err error
+		internalPort, internalClient, enabled, description, leaseDuration, err =
+			t.RouterClient.GetSpecificPortMappingEntry(NewRemoteHost, NewExternalPort, NewProtocol)
+		return err
+	})
+	if err != nil {
+		return 0, "", false, "", 0, err
+	}
+	return internalPort, internalClient, enabled, description, leaseDuration, nil
+}
+
+func (t *timeoutRouterClient) GetGenericPortMappingEntry(
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	var m PortMappingEntry
+	err = t.call("GetGenericPortMappingEntry", func() error {
+		var err error
+		m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description,
+			m.LeaseDuration, err = t.RouterClient.GetGenericPortMappingEntry(NewPortMappingIndex)
+		return err
+	})
+	if err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+	return m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description,
+		m.LeaseDuration, nil
+}
+
+func (t *timeoutRouterClient) GetExternalIPAddress() (
+	NewExternalIPAddress string,
+	err error,
+) {
+	var ip string
+	err = t.call("GetExternalIPAddress", func() error {
+		var err error
+		ip, err = t.RouterClient.GetExternalIPAddress()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return ip, nil
+}
+
+func (t *timeoutRouterClient) GetConnectionTypeInfo() (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	var connectionType, possibleConnectionTypes string
+	err = t.call("GetConnectionTypeInfo", func() error {
+		var err error
+		connectionType, possibleConnectionTypes, err = t.RouterClient.GetConnectionTypeInfo()
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return connectionType, possibleConnectionTypes, nil
+}
+
+func (t *timeoutRouterClient) GetPortMappingNumberOfEntries() (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	var n uint16
+	err = t.call("GetPortMappingNumberOfEntries", func() error {
+		var err error
+		n, err = t.RouterClient.GetPortMappingNumberOfEntries()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (t *timeoutRouterClient) AddAnyPortMapping(
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (
+	NewReservedPort uint16,
+	err error,
+) {
+	var port uint16
+	err = t.call("AddAnyPortMapping", func() error {
+		var err error
+		port, err = addAnyPortMapping(t.RouterClient, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort,
+			NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+func (t *timeoutRouterClient) AddPortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) (err error) {
+	return t.callCtx(ctx, "AddPortMapping", func(ctx context.Context) error {
+		return asContextual(t.RouterClient).AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol,
+			NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	})
+}
+
+func (t *timeoutRouterClient) DeletePortMappingCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (err error) {
+	return t.callCtx(ctx, "DeletePortMapping", func(ctx context.Context) error {
+		return asContextual(t.RouterClient).DeletePortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
+	})
+}
+
+func (t *timeoutRouterClient) GetSpecificPortMappingEntryCtx(
+	ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+) (
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	err = t.callCtx(ctx, "GetSpecificPortMappingEntry", func(ctx context.Context) error {
+		var err error
+		NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration, err =
+			asContextual(t.RouterClient).GetSpecificPortMappingEntryCtx(ctx, NewRemoteHost, NewExternalPort,
+				NewProtocol)
+		return err
+	})
+	return
+}
+
+func (t *timeoutRouterClient) GetGenericPortMappingEntryCtx(
+	ctx context.Context,
+	NewPortMappingIndex uint16,
+) (
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+	err error,
+) {
+	err = t.callCtx(ctx, "GetGenericPortMappingEntry", func(ctx context.Context) error {
+		var err error
+		NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled,
+			NewPortMappingDescription, NewLeaseDuration, err =
+			asContextual(t.RouterClient).GetGenericPortMappingEntryCtx(ctx, NewPortMappingIndex)
+		return err
+	})
+	return
+}
+
+func (t *timeoutRouterClient) GetExternalIPAddressCtx(ctx context.Context) (
+	NewExternalIPAddress string,
+	err error,
+) {
+	err = t.callCtx(ctx, "GetExternalIPAddress", func(ctx context.Context) error {
+		var err error
+		NewExternalIPAddress, err = asContextual(t.RouterClient).GetExternalIPAddressCtx(ctx)
+		return err
+	})
+	return
+}
+
+func (t *timeoutRouterClient) GetConnectionTypeInfoCtx(ctx context.Context) (
+	NewConnectionType string,
+	NewPossibleConnectionTypes string,
+	err error,
+) {
+	err = t.callCtx(ctx, "GetConnectionTypeInfo", func(ctx context.Context) error {
+		var err error
+		NewConnectionType, NewPossibleConnectionTypes, err = asContextual(t.RouterClient).GetConnectionTypeInfoCtx(ctx)
+		return err
+	})
+	return
+}
+
+func (t *timeoutRouterClient) GetPortMappingNumberOfEntriesCtx(ctx context.Context) (
+	NewPortMappingNumberOfEntries uint16,
+	err error,
+) {
+	err = t.callCtx(ctx, "GetPortMappingNumberOfEntries", func(ctx context.Context) error {
+		var err error
+		NewPortMappingNumberOfEntries, err = asContextual(t.RouterClient).GetPortMappingNumberOfEntriesCtx(ctx)
+		return err
+	})
+	return
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// withoutTimeout unwraps a router returned by getRouterClient, so that tests can compare it with the router they gave.
+func withoutTimeout(router RouterClient) RouterClient {
+	if t, ok := router.(*timeoutRouterClient); ok {
+		return t.RouterClient
+	}
+	return router
+}
+
+// hungRouterClient is a router that never answers, until it's released.
+type hungRouterClient struct {
+	*mockRouterClient
+	release chan struct{}
+}
+
+func (h *hungRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	<-h.release
+	return nil
+}
+
+func (h *hungRouterClient) GetExternalIPAddress() (string, error) {
+	<-h.release
+	return "203.0.113.1", nil
+}
+
+func TestTimeoutRouterClientGivesUp(t *testing.T) {
+	hung := &hungRouterClient{mockRouterClient: &mockRouterClient{}, release: make(chan struct{})}
+	defer close(hung.release)
+	router := &timeoutRouterClient{RouterClient: hung, timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "", 3600)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	ip, err := router.GetExternalIPAddress()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Empty(t, ip)
+}
+
+func TestTimeoutRouterClientRaisesPanicsOnCaller(t *testing.T) {
+	router := &timeoutRouterClient{
+		RouterClient: &panickingRouterClient{mockRouterClient: &mockRouterClient{}},
+		timeout:      time.Second,
+	}
+	assert.Panics(t, func() {
+		_ = router.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "test", 600)
+	})
+	// Calls that don't panic still return as normal.
+	_, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+}
+
+func TestTimeoutRouterClientPassesThroughResults(t *testing.T) {
+	mock := &mockRouterClient{
+		externalIP: "203.0.113.5",
+		deleteErr:  errors.New("NoSuchEntryInArray"),
+		entries: map[string]portMappingEntry{
+			"80/TCP": {InternalPort: 8080, InternalClient: "192.168.1.10", Enabled: true, Description: "web", LeaseDuration: 600},
+		},
+	}
+	router := &timeoutRouterClient{RouterClient: mock, timeout: time.Second}
+
+	assert.NoError(t, router.AddPortMapping("", 443, "TCP", 443, "192.168.1.10", true, "", 3600))
+	assert.Equal(t, []uint16{443}, mock.addedExternalPorts())
+	assert.EqualError(t, router.DeletePortMapping("", 443, "TCP"), "NoSuchEntryInArray")
+
+	port, client, enabled, description, lease, err := router.GetSpecificPortMappingEntry("", 80, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(8080), port)
+	assert.Equal(t, "192.168.1.10", client)
+	assert.True(t, enabled)
+	assert.Equal(t, "web", description)
+	assert.Equal(t, uint32(600), lease)
+
+	_, externalPort, protocol, _, _, _, _, _, err := router.GetGenericPortMappingEntry(0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(80), externalPort)
+	assert.Equal(t, "TCP", protocol)
+
+	ip, err := router.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.5", ip)
+}
+
+func TestReconcileTimesOutHungRouter(t *testing.T) {
+	hung := &hungRouterClient{mockRouterClient: &mockRouterClient{}, release: make(chan struct{})}
+	defer close(hung.release)
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(hung),
+		WithUPnPCallTimeout(50*time.Millisecond),
+	)
+
+	done := make(chan ctrl.Result)
+	go func() {
+		result, _ := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		// Timing out is a transient error, so we back off and try again
+		assert.NotZero(t, result.RequeueAfter)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconcile didn't give up on a hung router")
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tracerName is the name of the instrumentation library that our spans come from.
+const tracerName = "github.com/JamesLaverack/holepunch/controllers"
+
+// tracer returns the Tracer to record spans with, from TracerProvider or else the global one.
+func (r *ServiceReconciler) tracer() trace.Tracer {
+	provider := r.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// endSpan ends a span, marking it as failed if there was an error.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// serviceAttributes identifies the service a span is about.
+func serviceAttributes(name types.NamespacedName) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("k8s.namespace.name", name.Namespace),
+		attribute.String("k8s.service.name", name.Name),
+	}
+}
+
+// portMappingAttributes identifies the port mapping a span is about.
+func portMappingAttributes(externalPort uint16, protocol string, internalPort uint16) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("holepunch.external_port", int(externalPort)),
+		attribute.String("holepunch.protocol", protocol),
+		attribute.Int("holepunch.internal_port", int(internalPort)),
+	}
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// spansByName indexes the spans an exporter has, by name.
+func spansByName(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestReconcileTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	calls := 0
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClientFactory(countingPicker(&mockRouterClient{}, &calls)),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+
+	spans := spansByName(exporter)
+	root, ok := spans["Reconcile"]
+	if !assert.True(t, ok, "expected a Reconcile span") {
+		return
+	}
+	assert.False(t, root.Parent.IsValid())
+	assert.Contains(t, root.Attributes, attribute.String("k8s.namespace.name", "default"))
+	assert.Contains(t, root.Attributes, attribute.String("k8s.service.name", "my-service"))
+	assert.Equal(t, codes.Unset, root.Status.Code)
+
+	for _, name := range []string{"DiscoverRouter", "GetExternalIPAddress", "AddPortMapping"} {
+		span, ok := spans[name]
+		if assert.True(t, ok, "expected a %s span", name) {
+			assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), "%s should be a child of Reconcile", name)
+		}
+	}
+	addSpan := spans["AddPortMapping"]
+	assert.Contains(t, addSpan.Attributes, attribute.Int("holepunch.external_port", 80))
+	assert.Contains(t, addSpan.Attributes, attribute.String("holepunch.protocol", "TCP"))
+	assert.Contains(t, addSpan.Attributes, attribute.Int("holepunch.internal_port", 80))
+}
+
+func TestReconcileTracingRecordsErrors(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	r := NewServiceReconciler(fake.NewFakeClientWithScheme(scheme.Scheme, holepunchedService()), scheme.Scheme,
+		WithLogger(logf.NullLogger{}),
+		WithEventRecorder(record.NewFakeRecorder(10)),
+		WithRouterClients(&mockRouterClient{addErr: errors.New("router unavailable")}),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))),
+	)
+
+	_, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "my-service"}})
+	assert.NoError(t, err)
+
+	spans := spansByName(exporter)
+	assert.Equal(t, codes.Error, spans["AddPortMapping"].Status.Code)
+	assert.Equal(t, "router unavailable", spans["AddPortMapping"].Status.Description)
+	assert.Equal(t, codes.Error, spans["Reconcile"].Status.Code)
+	assert.NotContains(t, spans, "DiscoverRouter", "routers given up front aren't discovered")
+}
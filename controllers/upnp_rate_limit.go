@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitClock tells the time and waits for it to pass, so that tests don't have to.
+type rateLimitClock interface {
+	now() time.Time
+	sleep(ctx context.Context, d time.Duration) error
+}
+
+// realClock is a rateLimitClock that uses the real time.
+type realClock struct{}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+func (realClock) sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *ServiceReconciler) upnpRateLimiter() *rate.Limiter {
+	r.upnpRateLimiterOnce.Do(func() {
+		if r.UPnPRateLimiter == nil {
+			r.UPnPRateLimiter = rate.NewLimiter(defaultUPnPRateLimit, defaultUPnPRateBurst)
+		}
+	})
+	return r.UPnPRateLimiter
+}
+
+// waitForUPnPRateLimit waits until UPnPRateLimiter lets us make another call to the router. If ctx is done first then
+// the call is given up on, and doesn't count against the limit.
+func (r *ServiceReconciler) waitForUPnPRateLimit(ctx context.Context) error {
+	clock := r.rateLimitClock
+	if clock == nil {
+		clock = realClock{}
+	}
+	now := clock.now()
+	reservation := r.upnpRateLimiter().ReserveN(now, 1)
+	if !reservation.OK() {
+		return errors.New("UPnP rate limiter does not allow any calls to the router")
+	}
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	if err := clock.sleep(ctx, delay); err != nil {
+		reservation.CancelAt(clock.now())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// sleepingClock is a rateLimitClock whose time only moves when something sleeps.
+type sleepingClock struct {
+	mu     sync.Mutex
+	clock  *fakeClock
+	sleeps []time.Duration
+}
+
+func (c *sleepingClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clock.now()
+}
+
+func (c *sleepingClock) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.clock.t = c.clock.t.Add(d)
+	return nil
+}
+
+func TestSyncPortMappingsIsRateLimited(t *testing.T) {
+	router := &mockRouterClient{}
+	clock := &sleepingClock{clock: newFakeClock()}
+	start := clock.now()
+	r := NewServiceReconciler(nil, nil, WithRateLimit(10, 1), WithMaxConcurrentMappings(1))
+	r.rateLimitClock = clock
+
+	service := corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default"}}
+	desired := map[string]uint16{"80/TCP": 80, "81/TCP": 81, "82/TCP": 82, "83/TCP": 83, "84/TCP": 84}
+	err := r.syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.10",
+		leaseDurationSeconds, nil, desired, nil)
+	assert.NoError(t, err)
+	assert.Len(t, router.addCalls, 5)
+
+	// The first call uses up the burst, and every call after it has to wait its turn.
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond,
+	}, clock.sleeps)
+	assert.Equal(t, 400*time.Millisecond, clock.now().Sub(start))
+}
+
+func TestUPnPRateLimitIsSharedBetweenServices(t *testing.T) {
+	router := &mockRouterClient{}
+	clock := &sleepingClock{clock: newFakeClock()}
+	r := NewServiceReconciler(nil, nil, WithRateLimit(10, 1))
+	r.rateLimitClock = clock
+
+	for _, name := range []string{"first", "second"} {
+		service := corev1.Service{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"}}
+		port := uint16(len(name))
+		err := r.syncPortMappings(context.Background(), logf.NullLogger{}, router, service, "192.168.1.10",
+			leaseDurationSeconds, nil, map[string]uint16{mappingKey(port, "TCP"): port}, nil)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, router.addCalls, 2)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, clock.sleeps)
+}
+
+func TestWaitForUPnPRateLimitGivesUpWhenCancelled(t *testing.T) {
+	clock := &sleepingClock{clock: newFakeClock()}
+	r := NewServiceReconciler(nil, nil, WithRateLimit(10, 1))
+	r.rateLimitClock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The burst doesn't need waiting for, but anything after it does.
+	assert.NoError(t, r.waitForUPnPRateLimit(ctx))
+	assert.ErrorIs(t, r.waitForUPnPRateLimit(ctx), context.Canceled)
+	// The call we gave up on doesn't count, so the next one only waits as long as it would have.
+	assert.NoError(t, r.waitForUPnPRateLimit(context.Background()))
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, clock.sleeps)
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/huin/goupnp/soap"
+)
+
+// maxVerboseBodyLength is how much of a SOAP request or response body is included in verbose errors. Routers can send
+// back whole HTML error pages, which are rarely worth reading to the end.
+const maxVerboseBodyLength = 2048
+
+// verboseUPnPError describes err with everything we know about why the router rejected it, for VerboseErrors. goupnp
+// only keeps the details of SOAP faults, so for anything else this is no more than err.Error().
+func verboseUPnPError(err error) string {
+	message := err.Error()
+	var upnpErr *UPnPError
+	if errors.As(err, &upnpErr) {
+		message += fmt.Sprintf(" [UPnP error code %d, description %q]", upnpErr.Code, upnpErr.Description)
+	}
+	var fault *soap.SOAPFaultError
+	if errors.As(err, &fault) {
+		message += fmt.Sprintf(" [SOAP fault code %q, string %q, detail %s]",
+			fault.FaultCode, fault.FaultString, truncateBody(fault.Detail.Raw))
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		message += fmt.Sprintf(" [HTTP %s %s]", urlErr.Op, urlErr.URL)
+	}
+	return message
+}
+
+// truncateBody returns body as a string, cut short if it's longer than maxVerboseBodyLength.
+func truncateBody(body []byte) string {
+	if len(body) > maxVerboseBodyLength {
+		return fmt.Sprintf("%s... (%d bytes truncated)", body[:maxVerboseBodyLength], len(body)-maxVerboseBodyLength)
+	}
+	return string(body)
+}
+
+// formatHeaders formats HTTP headers on one line, in the order they'd be sent.
+func formatHeaders(header http.Header) string {
+	var b strings.Builder
+	_ = header.Write(&b)
+	return strings.TrimSuffix(strings.ReplaceAll(b.String(), "\r\n", "; "), "; ")
+}
+
+// verboseTransport logs the whole of every SOAP request that fails, along with the router's response, at V(1). goupnp
+// throws away everything but the status of a failed request, which is rarely enough to tell why the router didn't
+// like it.
+type verboseTransport struct {
+	inner http.RoundTripper
+	log   logr.Logger
+}
+
+func (t *verboseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if req.Body != nil {
+		var err error
+		if requestBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	resp, err := t.inner.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	log := t.log.WithValues(
+		"url", req.URL.String(),
+		"request-headers", formatHeaders(req.Header),
+		"request-body", truncateBody(requestBody),
+	)
+	if err != nil {
+		log.V(1).Info("UPnP request failed", "error", err.Error())
+		return nil, err
+	}
+	responseBody, readErr := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+	log.V(1).Info("UPnP request failed",
+		"status", resp.Status,
+		"response-headers", formatHeaders(resp.Header),
+		"response-body", truncateBody(responseBody),
+	)
+	if readErr != nil {
+		return nil, readErr
+	}
+	return resp, nil
+}
+
+// installVerboseTransport makes every UPnP router in router log its failed SOAP requests, if VerboseErrors is set. It
+// must be called before the router is used, as the HTTP client can't be changed while it's in use.
+func (r *ServiceReconciler) installVerboseTransport(router RouterClient) {
+	if r.VerboseErrors {
+		installVerboseTransport(router, r.Log.WithName("router"))
+	}
+}
+
+// installVerboseTransport makes every UPnP router in router log its failed SOAP requests to log. NAT-PMP routers
+// don't use HTTP, so are left alone.
+func installVerboseTransport(router RouterClient, log logr.Logger) {
+	switch router := router.(type) {
+	case *igdRouterClient:
+		client := router.service.SOAPClient
+		if client == nil {
+			return
+		}
+		if _, ok := client.HTTPClient.Transport.(*verboseTransport); ok {
+			return
+		}
+		inner := client.HTTPClient.Transport
+		if inner == nil {
+			inner = http.DefaultTransport
+		}
+		client.HTTPClient.Transport = &verboseTransport{inner: inner, log: log}
+	case *multiRouterClient:
+		for _, inner := range router.routers {
+			installVerboseTransport(inner, log)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/soap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerboseUPnPError(t *testing.T) {
+	upnpErr, ok := parseUPnPError(upnpFault(ErrCodeConflictInMappingEntry))
+	assert.True(t, ok)
+	for name, err := range map[string]error{
+		"SOAP fault": fmt.Errorf("unable to add port mapping: %w", upnpErr),
+		"HTTP error": fmt.Errorf("unable to add port mapping: %w",
+			&url.Error{Op: "Post", URL: "http://192.168.1.1:5000/ctl/IPConn", Err: errors.New("connection refused")}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			verbose := verboseUPnPError(err)
+			assert.True(t, strings.HasPrefix(verbose, err.Error()))
+			assert.Greater(t, len(verbose), len(err.Error()))
+		})
+	}
+
+	verbose := verboseUPnPError(fmt.Errorf("unable to add port mapping: %w", upnpErr))
+	assert.Contains(t, verbose, `SOAP fault code "s:Client"`)
+	assert.Contains(t, verbose, "<errorCode>718</errorCode>")
+
+	// There's nothing more to say about errors that didn't come from the router.
+	plain := errors.New("router not found")
+	assert.Equal(t, plain.Error(), verboseUPnPError(plain))
+}
+
+func TestTruncateBody(t *testing.T) {
+	assert.Equal(t, "short", truncateBody([]byte("short")))
+	truncated := truncateBody([]byte(strings.Repeat("x", maxVerboseBodyLength+10)))
+	assert.True(t, strings.HasSuffix(truncated, "... (10 bytes truncated)"))
+	assert.Len(t, truncated, maxVerboseBodyLength+len("... (10 bytes truncated)"))
+}
+
+func TestVerboseTransportLogsFailedRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprint(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError><errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`)
+	}))
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	log := newRecordingLogger(1)
+	router := newIGDRouterClient(nil, goupnp.ServiceClient{SOAPClient: soap.NewSOAPClient(*endpoint)})
+	installVerboseTransport(router, log)
+	// Installing it twice doesn't log everything twice.
+	installVerboseTransport(&multiRouterClient{routers: []RouterClient{router}}, log)
+
+	err = router.service.SOAPClient.PerformAction("urn:schemas-upnp-org:service:WANIPConnection:1",
+		"AddPortMapping", &struct{ NewExternalPort string }{"8080"}, &struct{}{})
+	var fault *soap.SOAPFaultError
+	assert.True(t, errors.As(err, &fault), "the router's response still reaches goupnp")
+
+	assert.Len(t, *log.lines, 1)
+	line := (*log.lines)[0]
+	assert.Contains(t, line, "UPnP request failed url="+server.URL)
+	assert.Contains(t, line, "SOAPACTION: \"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping\"")
+	assert.Contains(t, line, "<NewExternalPort>8080</NewExternalPort>")
+	assert.Contains(t, line, "status=500 Internal Server Error")
+	assert.Contains(t, line, "<errorCode>718</errorCode>")
+}
+
+func TestVerboseTransportIgnoresSuccessfulRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprint(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:AddPortMappingResponse/></s:Body></s:Envelope>`)
+	}))
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	log := newRecordingLogger(1)
+	router := newIGDRouterClient(nil, goupnp.ServiceClient{SOAPClient: soap.NewSOAPClient(*endpoint)})
+	installVerboseTransport(router, log)
+
+	assert.NoError(t, router.service.SOAPClient.PerformAction("urn:schemas-upnp-org:service:WANIPConnection:1",
+		"AddPortMapping", &struct{}{}, &struct{}{}))
+	assert.Empty(t, *log.lines)
+}
@@ -17,17 +17,39 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	holepunchv1alpha1 "github.com/JamesLaverack/holepunch/api/v1alpha1"
 	"github.com/JamesLaverack/holepunch/controllers"
+	"github.com/JamesLaverack/holepunch/probe"
+	holepunchwebhook "github.com/JamesLaverack/holepunch/webhook"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -36,49 +58,563 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// cleanupTimeout is how long we spend removing port mappings on shutdown. Kubernetes gives pods 30 seconds to stop by
+// default, so this leaves time to spare.
+const cleanupTimeout = 20 * time.Second
+
+// adminTokenEnvVar is the environment variable --admin-token defaults to, so that the token needn't be in the pod spec.
+const adminTokenEnvVar = "HOLEPUNCH_ADMIN_TOKEN"
+
+// verboseErrorsEnvVar is the environment variable that turns on --verbose-errors, so that it can be turned on without
+// changing the container's arguments.
+const verboseErrorsEnvVar = "HOLEPUNCH_VERBOSE_ERRORS"
+
 func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
 	_ = corev1.AddToScheme(scheme)
+	_ = holepunchv1alpha1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
 	var metricsAddr string
+	var probeAddr string
+	var leaderElect bool
 	var enableLeaderElection bool
+	var leaderElectNamespace string
+	var leaderElectResourceLock string
+	var maxCleanupAttempts int
+	var routerRootDesc string
+	var allRouters bool
+	var routerCacheTTL time.Duration
+	var dnsTimeout time.Duration
+	var externalIPCacheTTL time.Duration
+	var mappingCacheRefreshInterval time.Duration
+	var holepunchMode string
+	var portMappingFormat string
+	var ipVersion string
+	var maxConcurrentMappings int
+	var dryRun bool
+	var enableWebhook bool
+	var auditInterval time.Duration
+	var externalIPWatchInterval time.Duration
+	var cleanupOnShutdown bool
+	var fallbackToNodePort bool
+	var excludeSelf bool
+	var verifyRouter bool
+	var sweepStaleOnStart bool
+	var verifyRouterPortMapping bool
+	var logLevel string
+	var verboseErrors bool
+	var clusterName string
+	var descriptionPrefix string
+	var historySize int
+	var serviceLabelSelector string
+	var serviceNamespaces string
+	var namespace string
+	var watchNamespaces string
+	var upnpRateLimit float64
+	var upnpRateBurst int
+	var upnpCallTimeout time.Duration
+	var routerCallAttempts int
+	var routerCallBackoff time.Duration
+	var upnpInterface string
+	var mappingStoreNamespace string
+	var mappingStoreConfigMap string
+	var configMapName string
+	var configMapNamespace string
+	var adminToken string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
+	flag.StringVar(&probeAddr, "probe-addr", ":8081",
+		"The address the liveness (/healthz) and readiness (/readyz) probe endpoints bind to. Set to \"0\" to disable.")
+	flag.BoolVar(&leaderElect, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
+		"Deprecated: use --leader-elect instead.")
+	flag.StringVar(&leaderElectNamespace, "leader-elect-namespace", "",
+		"The namespace to hold the leader election lock in. Defaults to the namespace Holepunch is running in.")
+	flag.StringVar(&leaderElectResourceLock, "leader-elect-resource-lock", "configmaps",
+		"The type of resource to use as the leader election lock. Only \"configmaps\" is currently supported.")
+	flag.IntVar(&maxCleanupAttempts, "max-cleanup-attempts", 5,
+		"How many times to try and remove port mappings for a deleted service before giving up. "+
+			"Mappings that could not be removed will expire when their lease does.")
+	flag.StringVar(&routerRootDesc, "router-root-desc", "",
+		"URL of the root device description of the router to configure (e.g., http://192.168.1.1:5000/rootDesc.xml). "+
+			"Give a comma-separated list of URLs to configure several routers, such as with a double NAT. "+
+			"If not set, a router will be discovered on the local network.")
+	flag.BoolVar(&allRouters, "all-routers", false,
+		"Forward ports on every UPnP router found, rather than just one. "+
+			"Routers are only looked for once, when Holepunch starts.")
+	flag.DurationVar(&routerCacheTTL, "router-cache-ttl", 5*time.Minute,
+		"How long to keep using a discovered router before discovering it again.")
+	flag.DurationVar(&externalIPCacheTTL, "external-ip-cache-ttl", 5*time.Minute,
+		"How long to remember the router's external IP before asking it again.")
+	flag.DurationVar(&mappingCacheRefreshInterval, "mapping-cache-refresh-interval", 0,
+		"How long to use a copy of the router's port mapping table before reading it again. "+
+			"If zero, the router is asked about each port mapping instead.")
+	flag.StringVar(&configMapName, "configmap-name", controllers.DefaultConfigMapName,
+		"The name of a ConfigMap to read settings from while running, as an alternative to a HolepunchConfig. "+
+			"Set to an empty string to disable.")
+	flag.StringVar(&configMapNamespace, "configmap-namespace", "holepunch-system",
+		"The namespace of the ConfigMap given by --configmap-name.")
+	flag.StringVar(&mappingStoreConfigMap, "mapping-store-configmap", "",
+		"The name of a ConfigMap to save each service's port mappings in, so that they're known about after a restart. "+
+			"If not set, they're only recorded on the services themselves.")
+	flag.StringVar(&mappingStoreNamespace, "mapping-store-namespace", "holepunch-system",
+		"The namespace of the ConfigMap given by --mapping-store-configmap.")
+	flag.DurationVar(&dnsTimeout, "dns-timeout", 5*time.Second,
+		"How long to wait when resolving the hostname of a LoadBalancer that has one instead of an IP.")
+	flag.StringVar(&holepunchMode, "mode", string(controllers.HolepunchModeAuto),
+		"Which protocols to use to configure the router. One of \"upnp\", \"natpmp\", or \"auto\" "+
+			"(try UPnP, and fall back to NAT-PMP if no UPnP router can be found).")
+	flag.StringVar(&portMappingFormat, "port-mapping-annotation-format", string(controllers.PortMappingAnnotationFormatAuto),
+		"Which port mapping annotations to read from services: \"key-based\" (holepunch.port/<port>), \"json\" "+
+			"(holepunch.io/port-mappings), or \"auto\" for both.")
+	flag.StringVar(&ipVersion, "ip-version", string(controllers.IPVersionDualStack),
+		"Which of a LoadBalancer's addresses to open ports up on: \"ipv4-only\" (port mappings), \"ipv6-only\" "+
+			"(IPv6 firewall pinholes), \"dual-stack\" for both, or \"auto\" to match the router's external IP.")
+	flag.IntVar(&maxConcurrentMappings, "max-concurrent-mappings", 5,
+		"How many port mappings for a single service to ask the router for at once.")
+	flag.DurationVar(&upnpCallTimeout, "upnp-call-timeout", 30*time.Second,
+		"How long to wait for the router to answer a single request before giving up on it.")
+	flag.IntVar(&routerCallAttempts, "router-call-attempts", 3,
+		"How many times to try a request to the router that fails because of what could be a network problem.")
+	flag.DurationVar(&routerCallBackoff, "router-call-backoff", time.Second,
+		"How long to wait before retrying a failed request to the router. The wait doubles after each retry.")
+	flag.Float64Var(&upnpRateLimit, "upnp-rate-limit", 10,
+		"How many port mappings a second to add at most, across every service, for routers that can't keep up.")
+	flag.IntVar(&upnpRateBurst, "upnp-rate-burst", 5,
+		"How many port mappings to add at once before --upnp-rate-limit applies.")
+	flag.StringVar(&upnpInterface, "upnp-interface", "",
+		"The network interface to discover UPnP routers on (e.g., eth0). "+
+			"If not set, routers are discovered on every interface.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Log the port mappings that would be made or removed, without actually changing the router.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Serve a validating webhook that rejects services with invalid port mapping annotations. "+
+			"Requires a serving certificate in /tmp/k8s-webhook-server/serving-certs.")
+	flag.DurationVar(&auditInterval, "audit-interval", 10*time.Minute,
+		"How often to check that every service's port mappings are still on the router, e.g. after it reboots. "+
+			"Set to zero to disable.")
+	flag.DurationVar(&externalIPWatchInterval, "external-ip-watch-interval", 10*time.Minute,
+		"How often to ask the router whether its external IP has changed, so that the IP recorded on each service "+
+			"can be updated straight away. Set to zero to disable.")
+	flag.BoolVar(&cleanupOnShutdown, "cleanup-on-shutdown", false,
+		"Remove the port mappings for every service when Holepunch stops, rather than leaving them until their leases expire.")
+	flag.BoolVar(&sweepStaleOnStart, "sweep-stale-on-start", false,
+		"Remove port mappings left on the router by an earlier run that no longer belong to a service, such as after a "+
+			"crash, before forwarding any ports.")
+	flag.BoolVar(&fallbackToNodePort, "fallback-to-node-port", false,
+		"Forward the ports of LoadBalancer services that haven't been given an IP yet to their node ports instead.")
+	flag.BoolVar(&verifyRouter, "verify-router", false,
+		"Check that the router can be found and answers requests before starting, and exit if it can't.")
+	flag.BoolVar(&verifyRouterPortMapping, "verify-router-port-mapping", false,
+		"As well as --verify-router, check that the router will forward ports by briefly forwarding port 65534 to "+
+			"Holepunch itself.")
+	flag.BoolVar(&excludeSelf, "exclude-self", false,
+		"Never forward ports for Holepunch's own service, even if it has the holepunch annotation. Needs the "+
+			"POD_NAMESPACE and POD_NAME environment variables set to the pod's namespace and name.")
+	flag.StringVar(&serviceLabelSelector, "service-label-selector", "",
+		"Only look after services whose labels match this selector, e.g. \"app=myapp\". By default every service is.")
+	flag.StringVar(&serviceNamespaces, "service-namespaces", "",
+		"Comma-separated namespaces to look after services in. By default services in every namespace are.")
+	flag.StringVar(&namespace, "namespace", "",
+		"Only watch this namespace, so that several copies of Holepunch can each look after their own namespace. "+
+			"By default every namespace is watched.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated namespaces to watch, like --namespace but for several namespaces at once.")
+	flag.IntVar(&historySize, "reconcile-history-size", controllers.DefaultReconcileHistorySize,
+		"How many of the most recent reconciles to serve on the probe server at "+probe.HistoryPath+".")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv(adminTokenEnvVar),
+		"The bearer token needed to ask Holepunch to reconcile every service, with a POST to "+probe.ReconcilePath+
+			" on the probe server. Defaults to the "+adminTokenEnvVar+" environment variable. If neither is set, "+
+			"the endpoint isn't served.")
+	flag.StringVar(&clusterName, "cluster-name", "",
+		"The name of this cluster, which services' description templates can use as {{.ClusterName}} to tell apart "+
+			"port mappings from clusters sharing a router.")
+	flag.StringVar(&descriptionPrefix, "description-prefix", "holepunch:",
+		"What the description of every port mapping Holepunch makes starts with. Port mappings whose description doesn't "+
+			"start with it are never changed or removed, so that those made by other software are left alone.")
+	flag.BoolVar(&verboseErrors, "verbose-errors", os.Getenv(verboseErrorsEnvVar) == "true",
+		"Log everything the router said about each error, and the whole of every failed UPnP request along with the "+
+			"router's response at debug level. Defaults to true if the "+verboseErrorsEnvVar+
+			" environment variable is \"true\".")
+	flag.StringVar(&logLevel, "zap-log-level", "info",
+		"How much to log, either \"info\" or \"debug\". At \"debug\" every call made to the router is logged too.")
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	logOpts := []zap.Opts{zap.UseDevMode(true)}
+	if logLevel == "debug" {
+		// logr's V(2) is zap's level -2, which is below anything zap has a name for.
+		level := uberzap.NewAtomicLevelAt(zapcore.Level(-2))
+		logOpts = append(logOpts, zap.Level(&level))
+	}
+	ctrl.SetLogger(zap.New(logOpts...))
+
+	if logLevel != "info" && logLevel != "debug" {
+		setupLog.Error(nil, "unknown log level", "log-level", logLevel)
+		os.Exit(1)
+	}
+
+	switch controllers.PortMappingAnnotationFormat(portMappingFormat) {
+	case controllers.PortMappingAnnotationFormatKeyBased, controllers.PortMappingAnnotationFormatJSON,
+		controllers.PortMappingAnnotationFormatAuto:
+	default:
+		setupLog.Error(nil, "unknown port mapping annotation format", "format", portMappingFormat)
+		os.Exit(1)
+	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "81773bb2.holepunch.jameslaverack.com",
-	})
+	switch controllers.IPVersionPreference(ipVersion) {
+	case controllers.IPVersionIPv4Only, controllers.IPVersionIPv6Only, controllers.IPVersionDualStack,
+		controllers.IPVersionAuto:
+	default:
+		setupLog.Error(nil, "unknown IP version", "ip-version", ipVersion)
+		os.Exit(1)
+	}
+
+	// controller-runtime always uses a ConfigMap to hold the leader election lock, so we can't offer anything else.
+	if leaderElectResourceLock != "configmaps" {
+		setupLog.Error(nil, "unsupported leader election resource lock", "resource-lock", leaderElectResourceLock)
+		os.Exit(1)
+	}
+
+	watchedNamespaces := splitList(watchNamespaces)
+	if namespace != "" && len(watchedNamespaces) > 0 {
+		setupLog.Error(nil, "--namespace and --watch-namespaces can't both be set")
+		os.Exit(1)
+	}
+	if namespace != "" {
+		watchedNamespaces = []string{namespace}
+	}
+	sort.Strings(watchedNamespaces)
+
+	managerOptions := ctrl.Options{
+		Scheme:                  scheme,
+		MetricsBindAddress:      metricsAddr,
+		Port:                    9443,
+		LeaderElection:          leaderElect || enableLeaderElection,
+		LeaderElectionNamespace: leaderElectNamespace,
+		LeaderElectionID:        "holepunch-leader",
+	}
+	switch {
+	case namespace != "":
+		managerOptions.Namespace = namespace
+	case len(watchedNamespaces) > 0:
+		managerOptions.NewCache = controllers.MultiNamespacedCacheBuilder(watchedNamespaces)
+	}
+	if len(watchedNamespaces) > 0 {
+		// Copies of Holepunch watching different namespaces mustn't wait on each other to be elected.
+		managerOptions.LeaderElectionID = "holepunch-leader-" + strings.Join(watchedNamespaces, ".")
+		if configMapName != "" && !contains(watchedNamespaces, configMapNamespace) {
+			setupLog.Info("the namespace of --configmap-name isn't watched, so its settings won't be used",
+				"configmap-namespace", configMapNamespace)
+		}
+	}
+	// Only look after services in the namespaces we're watching, unless we've been told to narrow that down further.
+	serviceNamespaceSelector := splitList(serviceNamespaces)
+	if len(serviceNamespaceSelector) == 0 {
+		serviceNamespaceSelector = watchedNamespaces
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), managerOptions)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err = (&controllers.ServiceReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Service"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	// Register our metrics with controller-runtime's registry, so they're served alongside its own.
+	metricsRecorder, err := controllers.RegisterMetrics(metrics.Registry)
+	if err != nil {
+		setupLog.Error(err, "unable to register metrics")
+		os.Exit(1)
+	}
+
+	labelSelector, err := labels.Parse(serviceLabelSelector)
+	if err != nil {
+		setupLog.Error(err, "invalid service label selector", "selector", serviceLabelSelector)
+		os.Exit(1)
+	}
+
+	routerRootDescs := splitList(routerRootDesc)
+	var routerClients []controllers.RouterClient
+	if allRouters {
+		routerClients, err = controllers.PickAllRouterClients(context.Background(), routerRootDescs...)
+		if err != nil {
+			setupLog.Error(err, "unable to find routers")
+			os.Exit(1)
+		}
+		setupLog.Info("found routers", "count", len(routerClients))
+	}
+
+	var mappingStore controllers.MappingStore
+	if mappingStoreConfigMap != "" {
+		// Read the ConfigMap straight from the API server, rather than from the manager's cache, so that saves don't
+		// keep conflicting with an out of date copy.
+		storeClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme()})
+		if err != nil {
+			setupLog.Error(err, "unable to create client for the mapping store")
+			os.Exit(1)
+		}
+		mappingStore = controllers.NewConfigMapMappingStore(storeClient, mappingStoreNamespace, mappingStoreConfigMap)
+	}
+
+	// These are usually set from the pod's own metadata with the downward API.
+	selfPod := types.NamespacedName{Namespace: os.Getenv("POD_NAMESPACE"), Name: os.Getenv("POD_NAME")}
+	if excludeSelf && (selfPod.Namespace == "" || selfPod.Name == "") {
+		setupLog.Error(nil, "--exclude-self needs the POD_NAMESPACE and POD_NAME environment variables to be set")
+		os.Exit(1)
+	}
+
+	// Reconciles stop talking to the router as soon as we're asked to shut down.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	reconciler := controllers.NewServiceReconciler(mgr.GetClient(), mgr.GetScheme(),
+		controllers.WithLogger(ctrl.Log.WithName("controllers").WithName("Service")),
+		controllers.WithEventRecorder(mgr.GetEventRecorderFor("holepunch")),
+		controllers.WithMetricsRecorder(metricsRecorder),
+		controllers.WithMaxCleanupAttempts(maxCleanupAttempts),
+		controllers.WithRouterRootDesc(routerRootDescs...),
+		controllers.WithRouterClients(routerClients...),
+		controllers.WithHolepunchMode(controllers.HolepunchMode(holepunchMode)),
+		controllers.WithPortMappingAnnotationFormat(controllers.PortMappingAnnotationFormat(portMappingFormat)),
+		controllers.WithIPVersionPreference(controllers.IPVersionPreference(ipVersion)),
+		controllers.WithRouterCacheTTL(routerCacheTTL),
+		controllers.WithExternalIPCacheTTL(externalIPCacheTTL),
+		controllers.WithMappingCacheRefreshInterval(mappingCacheRefreshInterval),
+		controllers.WithDNSTimeout(dnsTimeout),
+		controllers.WithMaxConcurrentMappings(maxConcurrentMappings),
+		controllers.WithUPnPCallTimeout(upnpCallTimeout),
+		controllers.WithRouterCallRetries(routerCallAttempts, routerCallBackoff),
+		controllers.WithUPnPInterface(upnpInterface),
+		controllers.WithRateLimit(rate.Limit(upnpRateLimit), upnpRateBurst),
+		controllers.WithDryRun(dryRun),
+		controllers.WithRouterCallLogging(logLevel == "debug"),
+		controllers.WithVerboseErrors(verboseErrors),
+		controllers.WithClusterName(clusterName),
+		controllers.WithDescriptionPrefix(descriptionPrefix),
+		controllers.WithReconcileHistorySize(historySize),
+		controllers.WithCleanupOnShutdown(cleanupOnShutdown),
+		controllers.WithSweepStaleOnStart(sweepStaleOnStart),
+		controllers.WithMappingStore(mappingStore),
+		controllers.WithFallbackToNodePort(fallbackToNodePort),
+		controllers.WithExcludeSelf(excludeSelf),
+		controllers.WithSelfPod(selfPod),
+		controllers.WithServiceLabelSelector(labelSelector),
+		controllers.WithServiceNamespaceSelector(serviceNamespaceSelector...),
+		controllers.WithShutdownContext(ctx),
+		controllers.WithAPIReader(mgr.GetAPIReader()),
+	)
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
+	if configMapName != "" {
+		err = (&controllers.ConfigMapReconciler{
+			Client:    mgr.GetClient(),
+			Log:       ctrl.Log.WithName("controllers").WithName("ConfigMap"),
+			Namespace: configMapNamespace,
+			Name:      configMapName,
+			Services:  reconciler,
+		}).SetupWithManager(mgr)
+		if err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ConfigMap")
+			os.Exit(1)
+		}
+	}
+	// The audit loop is started even if auditing is disabled, as the HolepunchConfig can turn it on. Runnables added
+	// to the manager only run on the leader, just like the controller does.
+	err = mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+		return reconciler.StartAuditLoop(ctx, auditInterval)
+	}))
+	if err != nil {
+		setupLog.Error(err, "unable to start audit loop")
+		os.Exit(1)
+	}
+	err = mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+		return reconciler.StartExternalIPWatcher(ctx, externalIPWatchInterval)
+	}))
+	if err != nil {
+		setupLog.Error(err, "unable to start external IP watcher")
+		os.Exit(1)
+	}
+	if enableWebhook {
+		mgr.GetWebhookServer().Register(holepunchwebhook.ServiceValidatorPath,
+			&webhook.Admission{Handler: &holepunchwebhook.ServiceValidator{}})
+	}
+	// Only the leader forwards ports, so only the leader should remove them when it stops. Runnables added to the
+	// manager only run on the leader, which is how we find out if that's us.
+	var elected int32
+	err = mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		atomic.StoreInt32(&elected, 1)
+		<-stop
+		return nil
+	}))
+	if err != nil {
+		setupLog.Error(err, "unable to watch for leader election")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
+	// Kubernetes restarts us if the manager stops running, and only sends traffic once we've caught up with the
+	// services in the cluster and (if we're the leader) reconciled one.
+	var running runningFlag
+	if err := mgr.Add(&running); err != nil {
+		setupLog.Error(err, "unable to watch for manager start")
+		os.Exit(1)
+	}
+	synced := &cacheSyncedFlag{cache: mgr.GetCache()}
+	if err := mgr.Add(synced); err != nil {
+		setupLog.Error(err, "unable to watch for cache sync")
+		os.Exit(1)
+	}
+	if probeAddr != "0" {
+		forceReconciler := controllers.NewForceReconciler(ctx, reconciler)
+		probes := &probe.Probes{
+			Liveness: running.check,
+			Readiness: func() error {
+				if err := synced.check(); err != nil {
+					return err
+				}
+				if atomic.LoadInt32(&elected) == 0 {
+					// Only the leader reconciles services. Standby replicas are ready to take over once they've
+					// caught up.
+					return nil
+				}
+				return reconciler.Ready()
+			},
+			History: reconciler.History,
+			// Only the leader reconciles services.
+			Reconcile: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if atomic.LoadInt32(&elected) == 0 {
+					http.Error(w, "not the leader", http.StatusServiceUnavailable)
+					return
+				}
+				forceReconciler.ServeHTTP(w, req)
+			}),
+			AdminToken: adminToken,
+		}
+		if err := probes.StartProbeServer(probeAddr); err != nil {
+			setupLog.Error(err, "unable to start probe server")
+			os.Exit(1)
+		}
+	}
+
+	// Warn about any services that were given invalid annotations while we weren't running. The manager's cache hasn't
+	// started yet, so this reads straight from the API server.
+	if err := reconciler.ValidateAllServices(ctx); err != nil {
+		setupLog.Error(err, "unable to validate services")
+	}
+
+	// Rather than quietly failing to forward every service's ports, make it obvious that the router can't be reached
+	// by not starting at all.
+	if verifyRouter || verifyRouterPortMapping {
+		if err := reconciler.VerifyRouter(ctx, verifyRouterPortMapping); err != nil {
+			setupLog.Error(err, "unable to verify router connectivity")
+			os.Exit(1)
+		}
+		setupLog.Info("verified router connectivity")
+	}
+
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx.Done()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	// A second signal now kills us straight away, in case cleaning up takes too long.
+	stop()
+
+	if reconciler.ShouldCleanupOnShutdown() && atomic.LoadInt32(&elected) == 1 {
+		setupLog.Info("removing port mappings before shutting down")
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if err := reconciler.Cleanup(cleanupCtx); err != nil {
+			setupLog.Error(err, "unable to remove all port mappings, they will expire when their leases do")
+			os.Exit(1)
+		}
+	}
+}
+
+// runningFlag is a manager Runnable that records whether the manager is running. Unlike the controller, it runs on
+// every replica rather than just the leader.
+type runningFlag int32
+
+func (f *runningFlag) Start(stop <-chan struct{}) error {
+	atomic.StoreInt32((*int32)(f), 1)
+	<-stop
+	atomic.StoreInt32((*int32)(f), 0)
+	return nil
+}
+
+func (f *runningFlag) NeedLeaderElection() bool {
+	return false
+}
+
+// check fails unless the manager is running.
+func (f *runningFlag) check() error {
+	if atomic.LoadInt32((*int32)(f)) == 0 {
+		return errors.New("manager is not running")
+	}
+	return nil
+}
+
+// cacheSyncedFlag is a manager Runnable that records whether the manager's cache has caught up with the services in the
+// cluster. Like runningFlag, it runs on every replica.
+type cacheSyncedFlag struct {
+	cache  cache.Cache
+	synced int32
+}
+
+func (f *cacheSyncedFlag) Start(stop <-chan struct{}) error {
+	if f.cache.WaitForCacheSync(stop) {
+		atomic.StoreInt32(&f.synced, 1)
+	}
+	<-stop
+	return nil
+}
+
+func (f *cacheSyncedFlag) NeedLeaderElection() bool {
+	return false
+}
+
+// check fails until the cache has synced.
+func (f *cacheSyncedFlag) check() error {
+	if atomic.LoadInt32(&f.synced) == 0 {
+		return errors.New("services have not been synchronized yet")
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value into its items, ignoring any that are empty.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// contains returns whether item is one of items.
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,440 @@
+// Package mockupnp provides a fake UPnP router for tests, so that the whole of reconciling a service can be tested,
+// right down to the SOAP requests sent to the router.
+//
+// The router offers a single WANIPConnection:1 service, and keeps its port mappings in memory:
+//
+//	srv := mockupnp.NewServer(t)
+//	defer srv.Close()
+//	router, err := controllers.PickRouterClient(ctx, srv.RootDescURL())
+//
+// Like a real router, adding a port mapping for an external port that's already mapped to another internal client
+// fails with ErrCodeConflictInMappingEntry. Other failures can be set up with RequireSamePorts and Fail.
+package mockupnp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ServiceType is the type of the UPnP service that the router offers.
+const ServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+const (
+	rootDescPath = "/rootDesc.xml"
+	controlPath  = "/ctl/IPConn"
+)
+
+// UPnP error codes that the router returns, from the WANIPConnection service specification.
+const (
+	// ErrCodeInvalidAction is returned for actions the router doesn't implement.
+	ErrCodeInvalidAction = 401
+	// ErrCodeInvalidArgs is returned when an action's arguments can't be understood.
+	ErrCodeInvalidArgs = 402
+	// ErrCodeActionFailed is a failure with no particular reason.
+	ErrCodeActionFailed = 501
+	// ErrCodeSpecifiedArrayIndexInvalid is returned by GetGenericPortMappingEntry past the end of the mapping table.
+	ErrCodeSpecifiedArrayIndexInvalid = 713
+	// ErrCodeNoSuchEntryInArray is returned when asked about, or to remove, a port mapping that doesn't exist.
+	ErrCodeNoSuchEntryInArray = 714
+	// ErrCodeConflictInMappingEntry is returned when adding a port mapping for an external port that's already mapped
+	// to another internal client.
+	ErrCodeConflictInMappingEntry = 718
+	// ErrCodeSamePortValuesRequired is returned when RequireSamePorts is set and a port mapping's internal and
+	// external ports differ.
+	ErrCodeSamePortValuesRequired = 725
+)
+
+// errorDescriptions are what the router says about each of its error codes.
+var errorDescriptions = map[int]string{
+	ErrCodeInvalidAction:              "Invalid Action",
+	ErrCodeInvalidArgs:                "Invalid Args",
+	ErrCodeActionFailed:               "Action Failed",
+	ErrCodeSpecifiedArrayIndexInvalid: "SpecifiedArrayIndexInvalid",
+	ErrCodeNoSuchEntryInArray:         "NoSuchEntryInArray",
+	ErrCodeConflictInMappingEntry:     "ConflictInMappingEntry",
+	ErrCodeSamePortValuesRequired:     "SamePortValuesRequired",
+}
+
+// Mapping is a port mapping in the router's table.
+type Mapping struct {
+	RemoteHost     string
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+}
+
+// mappingKey identifies a port mapping in the same way as the router does.
+type mappingKey struct {
+	remoteHost   string
+	externalPort uint16
+	protocol     string
+}
+
+func (m Mapping) key() mappingKey {
+	return mappingKey{remoteHost: m.RemoteHost, externalPort: m.ExternalPort, protocol: strings.ToUpper(m.Protocol)}
+}
+
+// Server is a fake UPnP router, served over HTTP on the loopback interface. It's safe to use from several goroutines.
+type Server struct {
+	server    *httptest.Server
+	closeOnce sync.Once
+
+	mu                sync.Mutex
+	mappings          map[mappingKey]Mapping
+	externalIP        string
+	connectionType    string
+	samePortsRequired bool
+	faults            map[string]int
+	calls             map[string]int
+}
+
+// NewServer starts a fake router, which is closed when the test finishes if Close hasn't been called first.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{
+		mappings:       make(map[mappingKey]Mapping),
+		externalIP:     "203.0.113.1",
+		connectionType: "IP_Routed",
+		faults:         make(map[string]int),
+		calls:          make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(rootDescPath, s.serveRootDesc)
+	mux.HandleFunc(controlPath, s.serveControl)
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close shuts the router down. It can be called more than once.
+func (s *Server) Close() {
+	s.closeOnce.Do(s.server.Close)
+}
+
+// RootDescURL returns the URL of the router's root device description, for controllers.PickRouterClient.
+func (s *Server) RootDescURL() string {
+	return s.server.URL + rootDescPath
+}
+
+// Host returns the host and port that the router is listening on.
+func (s *Server) Host() string {
+	return s.server.Listener.Addr().String()
+}
+
+// SetExternalIP sets the router's external IP address, which is 203.0.113.1 by default.
+func (s *Server) SetExternalIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.externalIP = ip
+}
+
+// RequireSamePorts sets whether the router refuses to forward a port to a different internal port, as some routers
+// do, with ErrCodeSamePortValuesRequired.
+func (s *Server) RequireSamePorts(required bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samePortsRequired = required
+}
+
+// Fail makes every call to the given action (e.g., "AddPortMapping") fail with the given UPnP error code, without
+// doing anything, until Fail is called again for the action with a code of zero.
+func (s *Server) Fail(action string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code == 0 {
+		delete(s.faults, action)
+		return
+	}
+	s.faults[action] = code
+}
+
+// AddMapping puts a port mapping in the router's table, as if something else on the network had made it.
+func (s *Server) AddMapping(m Mapping) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Protocol = strings.ToUpper(m.Protocol)
+	s.mappings[m.key()] = m
+}
+
+// Mappings returns the router's port mappings, in order of external port and then protocol.
+func (s *Server) Mappings() []Mapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedMappings()
+}
+
+// Calls returns how many times the given action has been called, including calls that failed.
+func (s *Server) Calls(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+// sortedMappings returns the port mappings in the order GetGenericPortMappingEntry indexes them. s.mu must be held.
+func (s *Server) sortedMappings() []Mapping {
+	mappings := make([]Mapping, 0, len(s.mappings))
+	for _, m := range s.mappings {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		a, b := mappings[i], mappings[j]
+		if a.ExternalPort != b.ExternalPort {
+			return a.ExternalPort < b.ExternalPort
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.RemoteHost < b.RemoteHost
+	})
+	return mappings
+}
+
+func (s *Server) serveRootDesc(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<specVersion><major>1</major><minor>0</minor></specVersion>
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+		<friendlyName>Mock UPnP Router</friendlyName>
+		<UDN>uuid:6d6f636b-7570-6e70-0000-000000000001</UDN>
+		<deviceList><device>
+			<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+			<friendlyName>WAN Device</friendlyName>
+			<UDN>uuid:6d6f636b-7570-6e70-0000-000000000002</UDN>
+			<deviceList><device>
+				<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+				<friendlyName>WAN Connection Device</friendlyName>
+				<UDN>uuid:6d6f636b-7570-6e70-0000-000000000003</UDN>
+				<serviceList><service>
+					<serviceType>%s</serviceType>
+					<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+					<SCPDURL>/WANIPCn.xml</SCPDURL>
+					<controlURL>%s</controlURL>
+					<eventSubURL>/evt/IPConn</eventSubURL>
+				</service></serviceList>
+			</device></deviceList>
+		</device></deviceList>
+	</device>
+</root>`, ServiceType, controlPath)
+}
+
+// soapRequest is the part of a SOAP request envelope that we need: the action and its arguments.
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// upnpError is a failed action, which is sent back as a SOAP fault.
+type upnpError int
+
+func (s *Server) serveControl(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var envelope soapRequest
+	if err := xml.NewDecoder(req.Body).Decode(&envelope); err != nil {
+		writeFault(w, ErrCodeInvalidArgs)
+		return
+	}
+	action := envelope.Body.Action.XMLName.Local
+	args := make(map[string]string)
+	for _, arg := range envelope.Body.Action.Args {
+		args[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[action]++
+	if code, ok := s.faults[action]; ok {
+		writeFault(w, code)
+		return
+	}
+	var response [][2]string
+	var code upnpError
+	switch action {
+	case "GetExternalIPAddress":
+		response = [][2]string{{"NewExternalIPAddress", s.externalIP}}
+	case "GetConnectionTypeInfo":
+		response = [][2]string{{"NewConnectionType", s.connectionType}, {"NewPossibleConnectionTypes", s.connectionType}}
+	case "GetStatusInfo":
+		response = [][2]string{{"NewConnectionStatus", "Connected"}, {"NewLastConnectionError", "ERROR_NONE"},
+			{"NewUptime", "3600"}}
+	case "AddPortMapping":
+		code = s.addPortMapping(args)
+	case "DeletePortMapping":
+		code = s.deletePortMapping(args)
+	case "GetSpecificPortMappingEntry":
+		response, code = s.getSpecificPortMappingEntry(args)
+	case "GetGenericPortMappingEntry":
+		response, code = s.getGenericPortMappingEntry(args)
+	default:
+		code = ErrCodeInvalidAction
+	}
+	if code != 0 {
+		writeFault(w, int(code))
+		return
+	}
+	writeResponse(w, action, response)
+}
+
+// mappingKeyArgs reads which port mapping an action is about from its arguments.
+func mappingKeyArgs(args map[string]string) (mappingKey, bool) {
+	externalPort, err := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+	if err != nil {
+		return mappingKey{}, false
+	}
+	protocol := strings.ToUpper(args["NewProtocol"])
+	if protocol != "TCP" && protocol != "UDP" {
+		return mappingKey{}, false
+	}
+	return mappingKey{remoteHost: args["NewRemoteHost"], externalPort: uint16(externalPort), protocol: protocol}, true
+}
+
+func (s *Server) addPortMapping(args map[string]string) upnpError {
+	key, ok := mappingKeyArgs(args)
+	if !ok {
+		return ErrCodeInvalidArgs
+	}
+	internalPort, err := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+	if err != nil {
+		return ErrCodeInvalidArgs
+	}
+	leaseDuration, err := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+	if err != nil {
+		return ErrCodeInvalidArgs
+	}
+	m := Mapping{
+		RemoteHost:     key.remoteHost,
+		ExternalPort:   key.externalPort,
+		Protocol:       key.protocol,
+		InternalPort:   uint16(internalPort),
+		InternalClient: args["NewInternalClient"],
+		Enabled:        args["NewEnabled"] == "1" || args["NewEnabled"] == "true",
+		Description:    args["NewPortMappingDescription"],
+		LeaseDuration:  uint32(leaseDuration),
+	}
+	if s.samePortsRequired && m.InternalPort != m.ExternalPort {
+		return ErrCodeSamePortValuesRequired
+	}
+	// Routers let the same internal client renew or change its mapping, but not take over someone else's.
+	if existing, ok := s.mappings[key]; ok && existing.InternalClient != m.InternalClient {
+		return ErrCodeConflictInMappingEntry
+	}
+	s.mappings[key] = m
+	return 0
+}
+
+func (s *Server) deletePortMapping(args map[string]string) upnpError {
+	key, ok := mappingKeyArgs(args)
+	if !ok {
+		return ErrCodeInvalidArgs
+	}
+	if _, ok := s.mappings[key]; !ok {
+		return ErrCodeNoSuchEntryInArray
+	}
+	delete(s.mappings, key)
+	return 0
+}
+
+func (s *Server) getSpecificPortMappingEntry(args map[string]string) ([][2]string, upnpError) {
+	key, ok := mappingKeyArgs(args)
+	if !ok {
+		return nil, ErrCodeInvalidArgs
+	}
+	m, ok := s.mappings[key]
+	if !ok {
+		return nil, ErrCodeNoSuchEntryInArray
+	}
+	return [][2]string{
+		{"NewInternalPort", strconv.Itoa(int(m.InternalPort))},
+		{"NewInternalClient", m.InternalClient},
+		{"NewEnabled", formatBool(m.Enabled)},
+		{"NewPortMappingDescription", m.Description},
+		{"NewLeaseDuration", strconv.Itoa(int(m.LeaseDuration))},
+	}, 0
+}
+
+func (s *Server) getGenericPortMappingEntry(args map[string]string) ([][2]string, upnpError) {
+	index, err := strconv.ParseUint(args["NewPortMappingIndex"], 10, 16)
+	if err != nil {
+		return nil, ErrCodeInvalidArgs
+	}
+	mappings := s.sortedMappings()
+	if int(index) >= len(mappings) {
+		return nil, ErrCodeSpecifiedArrayIndexInvalid
+	}
+	m := mappings[index]
+	return [][2]string{
+		{"NewRemoteHost", m.RemoteHost},
+		{"NewExternalPort", strconv.Itoa(int(m.ExternalPort))},
+		{"NewProtocol", m.Protocol},
+		{"NewInternalPort", strconv.Itoa(int(m.InternalPort))},
+		{"NewInternalClient", m.InternalClient},
+		{"NewEnabled", formatBool(m.Enabled)},
+		{"NewPortMappingDescription", m.Description},
+		{"NewLeaseDuration", strconv.Itoa(int(m.LeaseDuration))},
+	}, 0
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+const (
+	envelopeStart = xml.Header + `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`
+	envelopeEnd = `</s:Body></s:Envelope>`
+)
+
+// writeResponse sends a successful action's response, with its out arguments in order.
+func writeResponse(w http.ResponseWriter, action string, args [][2]string) {
+	var body strings.Builder
+	body.WriteString(envelopeStart)
+	fmt.Fprintf(&body, `<u:%sResponse xmlns:u="%s">`, action, ServiceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%sResponse>`, action)
+	body.WriteString(envelopeEnd)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprint(w, body.String())
+}
+
+// writeFault sends a SOAP fault for a UPnP error, in the form routers use.
+func writeFault(w http.ResponseWriter, code int) {
+	description, ok := errorDescriptions[code]
+	if !ok {
+		description = "Error " + strconv.Itoa(code)
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `%s<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+		`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault>%s`,
+		envelopeStart, code, description, envelopeEnd)
+}
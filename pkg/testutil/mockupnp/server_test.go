@@ -0,0 +1,111 @@
+package mockupnp
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/huin/goupnp/soap"
+	"github.com/stretchr/testify/assert"
+)
+
+// client connects to the server in the same way as a real router would be found by its URL.
+func client(t *testing.T, srv *Server) *internetgateway1.WANIPConnection1 {
+	loc, err := url.Parse(srv.RootDescURL())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	clients, err := internetgateway1.NewWANIPConnection1ClientsByURL(loc)
+	if !assert.NoError(t, err) || !assert.Len(t, clients, 1) {
+		t.FailNow()
+	}
+	return clients[0]
+}
+
+// assertFault checks that err is a SOAP fault for the given UPnP error code.
+func assertFault(t *testing.T, err error, code int) {
+	t.Helper()
+	var fault *soap.SOAPFaultError
+	if assert.True(t, errors.As(err, &fault), "expected a SOAP fault, got %v", err) {
+		assert.Contains(t, string(fault.Detail.Raw), "<errorCode>"+strconv.Itoa(code)+"</errorCode>")
+	}
+}
+
+func TestServerPortMappings(t *testing.T) {
+	srv := NewServer(t)
+	defer srv.Close()
+	c := client(t, srv)
+
+	ip, err := c.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.1", ip)
+
+	assert.NoError(t, c.AddPortMapping("", 8080, "TCP", 80, "192.168.1.10", true, "web", 3600))
+	assert.NoError(t, c.AddPortMapping("", 53, "udp", 53, "192.168.1.11", true, "dns", 0))
+	assert.Equal(t, []Mapping{
+		{ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: "192.168.1.11", Enabled: true,
+			Description: "dns"},
+		{ExternalPort: 8080, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10", Enabled: true,
+			Description: "web", LeaseDuration: 3600},
+	}, srv.Mappings())
+
+	internalPort, internalClient, enabled, description, lease, err := c.GetSpecificPortMappingEntry("", 8080, "TCP")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(80), internalPort)
+	assert.Equal(t, "192.168.1.10", internalClient)
+	assert.True(t, enabled)
+	assert.Equal(t, "web", description)
+	assert.Equal(t, uint32(3600), lease)
+
+	_, externalPort, protocol, _, _, _, _, _, err := c.GetGenericPortMappingEntry(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(8080), externalPort)
+	assert.Equal(t, "TCP", protocol)
+	_, _, _, _, _, _, _, _, err = c.GetGenericPortMappingEntry(2)
+	assertFault(t, err, ErrCodeSpecifiedArrayIndexInvalid)
+
+	// The same internal client can renew its mapping, but nothing else can take it over.
+	assert.NoError(t, c.AddPortMapping("", 8080, "TCP", 80, "192.168.1.10", true, "web", 1800))
+	assertFault(t, c.AddPortMapping("", 8080, "TCP", 80, "192.168.1.99", true, "other", 3600),
+		ErrCodeConflictInMappingEntry)
+
+	assert.NoError(t, c.DeletePortMapping("", 8080, "TCP"))
+	assertFault(t, c.DeletePortMapping("", 8080, "TCP"), ErrCodeNoSuchEntryInArray)
+	_, _, _, _, _, err = c.GetSpecificPortMappingEntry("", 8080, "TCP")
+	assertFault(t, err, ErrCodeNoSuchEntryInArray)
+	assert.Len(t, srv.Mappings(), 1)
+	assert.Equal(t, 2, srv.Calls("DeletePortMapping"))
+}
+
+func TestServerBehaviours(t *testing.T) {
+	srv := NewServer(t)
+	c := client(t, srv)
+
+	srv.RequireSamePorts(true)
+	assertFault(t, c.AddPortMapping("", 8080, "TCP", 80, "192.168.1.10", true, "web", 3600),
+		ErrCodeSamePortValuesRequired)
+	assert.NoError(t, c.AddPortMapping("", 80, "TCP", 80, "192.168.1.10", true, "web", 3600))
+
+	srv.Fail("AddPortMapping", ErrCodeActionFailed)
+	assertFault(t, c.AddPortMapping("", 443, "TCP", 443, "192.168.1.10", true, "web", 3600), ErrCodeActionFailed)
+	srv.Fail("AddPortMapping", 0)
+	assert.NoError(t, c.AddPortMapping("", 443, "TCP", 443, "192.168.1.10", true, "web", 3600))
+
+	srv.AddMapping(Mapping{ExternalPort: 32400, Protocol: "tcp", InternalPort: 32400, InternalClient: "192.168.1.50",
+		Enabled: true, Description: "Plex Media Server"})
+	assertFault(t, c.AddPortMapping("", 32400, "TCP", 32400, "192.168.1.10", true, "web", 3600),
+		ErrCodeConflictInMappingEntry)
+
+	srv.SetExternalIP("198.51.100.7")
+	ip, err := c.GetExternalIPAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", ip)
+
+	_, _, err = c.GetNATRSIPStatus()
+	assertFault(t, err, ErrCodeInvalidAction)
+
+	// Closing again when the test finishes is harmless.
+	srv.Close()
+}
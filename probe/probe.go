@@ -0,0 +1,93 @@
+package probe
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+const (
+	// LivenessPath is the path the liveness probe is served on.
+	LivenessPath = "/healthz"
+	// ReadinessPath is the path the readiness probe is served on.
+	ReadinessPath = "/readyz"
+	// HistoryPath is the path the controller's recent history is served on.
+	HistoryPath = "/debug/history"
+	// ReconcilePath is the path operators can ask the controller to reconcile every service on.
+	ReconcilePath = "/api/v1/reconcile"
+)
+
+// Check returns nil if the controller is healthy, or an error saying why it isn't.
+type Check func() error
+
+// Probes serves the liveness and readiness probes for the controller, so that Kubernetes can restart it if it stops
+// working and knows when it has started up. A nil Check always passes.
+type Probes struct {
+	// Liveness fails if the controller isn't running, and needs restarting.
+	Liveness Check
+	// Readiness fails until the controller is able to forward ports.
+	Readiness Check
+	// History serves what the controller has done recently, for diagnosing problems. If nil then it isn't served.
+	History http.Handler
+	// Reconcile reconciles every service when asked to. It's only served if AdminToken is set too.
+	Reconcile http.Handler
+	// AdminToken is the bearer token requests to Reconcile must have.
+	AdminToken string
+}
+
+// Handler serves the probes, the controller's history if there is any, and the endpoint for reconciling every service
+// if there's a token for it.
+func (p *Probes) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(LivenessPath, serveCheck(p.Liveness))
+	mux.Handle(ReadinessPath, serveCheck(p.Readiness))
+	if p.History != nil {
+		mux.Handle(HistoryPath, p.History)
+	}
+	// Anyone who can reach the probes could otherwise make us hammer the router, so this is never served without a
+	// token.
+	if p.Reconcile != nil && p.AdminToken != "" {
+		mux.Handle(ReconcilePath, requireBearerToken(p.AdminToken, p.Reconcile))
+	}
+	return mux
+}
+
+// StartProbeServer starts serving the probes on addr, in the background. An error is only returned if we can't listen
+// on addr.
+func (p *Probes) StartProbeServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s for probes: %w", addr, err)
+	}
+	go func() {
+		_ = http.Serve(listener, p.Handler())
+	}()
+	return nil
+}
+
+// serveCheck responds with 200 OK if check passes, or 503 Service Unavailable with the reason it failed if not.
+func serveCheck(check Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if check != nil {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
+
+// requireBearerToken responds with 401 Unauthorized unless the request has the token in its Authorization header.
+func requireBearerToken(token string, handler http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,129 @@
+package probe
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+	return recorder.Code, strings.TrimSpace(string(body))
+}
+
+func TestProbesHealthy(t *testing.T) {
+	probes := &Probes{
+		Liveness:  func() error { return nil },
+		Readiness: func() error { return nil },
+	}
+	handler := probes.Handler()
+
+	code, body := get(t, handler, LivenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+	code, body = get(t, handler, ReadinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+}
+
+func TestProbesDegraded(t *testing.T) {
+	probes := &Probes{
+		Liveness:  func() error { return nil },
+		Readiness: func() error { return errors.New("no router contacted yet") },
+	}
+	handler := probes.Handler()
+
+	code, _ := get(t, handler, LivenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	code, body := get(t, handler, ReadinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "no router contacted yet", body)
+
+	probes.Liveness = func() error { return errors.New("controller stopped") }
+	code, body = get(t, probes.Handler(), LivenessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "controller stopped", body)
+}
+
+func TestProbesWithoutChecksPass(t *testing.T) {
+	handler := (&Probes{}).Handler()
+	for _, path := range []string{LivenessPath, ReadinessPath} {
+		code, _ := get(t, handler, path)
+		assert.Equal(t, http.StatusOK, code, path)
+	}
+}
+
+func TestStartProbeServer(t *testing.T) {
+	// Find a free port to listen on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	probes := &Probes{Readiness: func() error { return errors.New("not ready") }}
+	if !assert.NoError(t, probes.StartProbeServer(addr)) {
+		return
+	}
+	resp, err := http.Get("http://" + addr + ReadinessPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+
+	// The address is now in use.
+	assert.Error(t, (&Probes{}).StartProbeServer(addr))
+}
+
+func TestProbesServeHistory(t *testing.T) {
+	history := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[{"serviceKey":"default/my-service","success":true}]`))
+	})
+	code, body := get(t, (&Probes{History: history}).Handler(), HistoryPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[{"serviceKey":"default/my-service","success":true}]`, body)
+
+	// Without any history there's nothing to serve.
+	code, _ = get(t, (&Probes{}).Handler(), HistoryPath)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestProbesServeReconcileWithToken(t *testing.T) {
+	called := 0
+	reconcile := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		called++
+		w.WriteHeader(http.StatusAccepted)
+	})
+	handler := (&Probes{Reconcile: reconcile, AdminToken: "s3cret"}).Handler()
+	post := func(authorization string) int {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, ReconcilePath, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post("Bearer wrong"))
+	assert.Equal(t, http.StatusUnauthorized, post("s3cret"))
+	assert.Equal(t, 0, called)
+	assert.Equal(t, http.StatusAccepted, post("Bearer s3cret"))
+	assert.Equal(t, 1, called)
+
+	// Without a token there's no way to use it safely, so it isn't served at all.
+	code, _ := get(t, (&Probes{Reconcile: reconcile}).Handler(), ReconcilePath)
+	assert.Equal(t, http.StatusNotFound, code)
+}
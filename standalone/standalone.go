@@ -0,0 +1,295 @@
+// Package standalone forwards ports on a router in the same way that the holepunch controller does, but from a fixed
+// list of rules rather than from Kubernetes services. This is for people who want holepunch's port forwarding without
+// running a cluster at all.
+package standalone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/JamesLaverack/holepunch/controllers"
+)
+
+const (
+	// DefaultLeaseDuration is how long port mappings last for if a rule doesn't say.
+	DefaultLeaseDuration = time.Hour
+	// DefaultDescription is the description given to port mappings on the router.
+	DefaultDescription = "Holepunch standalone mapping"
+)
+
+// PortForwardRule is a port to forward from the router to a machine on the local network.
+type PortForwardRule struct {
+	// ExternalPort is the port on the router to forward.
+	ExternalPort uint16
+	// InternalPort is the port on the machine to forward to.
+	InternalPort uint16
+	// InternalIP is the local network IP address of the machine to forward to.
+	InternalIP string
+	// Protocol is either "TCP" or "UDP".
+	Protocol string
+	// LeaseDuration is how long the router keeps the port mapping for if it isn't renewed. It's renewed well before
+	// then. If zero then DefaultLeaseDuration is used.
+	LeaseDuration time.Duration
+}
+
+// key identifies the rule's external port and protocol, which the router only lets one mapping have.
+func (r PortForwardRule) key() string {
+	return ruleKey(r.ExternalPort, r.Protocol)
+}
+
+func ruleKey(externalPort uint16, protocol string) string {
+	return fmt.Sprintf("%d/%s", externalPort, strings.ToUpper(protocol))
+}
+
+// leaseSeconds is the rule's lease duration as the router wants it.
+func (r PortForwardRule) leaseSeconds() uint32 {
+	return uint32(r.LeaseDuration / time.Second)
+}
+
+// validate checks that the rule is complete, and fills in any defaults.
+func (r PortForwardRule) validate() (PortForwardRule, error) {
+	r.Protocol = strings.ToUpper(r.Protocol)
+	if r.Protocol != "TCP" && r.Protocol != "UDP" {
+		return r, fmt.Errorf("unsupported protocol %q, must be TCP or UDP", r.Protocol)
+	}
+	if r.ExternalPort == 0 || r.InternalPort == 0 {
+		return r, errors.New("external and internal ports must both be set")
+	}
+	if ip := net.ParseIP(r.InternalIP); ip == nil || ip.To4() == nil {
+		return r, fmt.Errorf("internal IP %q is not an IPv4 address", r.InternalIP)
+	}
+	if r.LeaseDuration == 0 {
+		r.LeaseDuration = DefaultLeaseDuration
+	}
+	if r.LeaseDuration < time.Second {
+		return r, fmt.Errorf("lease duration %s is less than a second", r.LeaseDuration)
+	}
+	return r, nil
+}
+
+// Option configures a StandaloneMapper created with NewStandaloneMapper.
+type Option func(*StandaloneMapper)
+
+// WithRouterClient sets the router to forward ports on, rather than discovering one when the mapper is started.
+func WithRouterClient(router controllers.RouterClient) Option {
+	return func(m *StandaloneMapper) {
+		m.router = router
+	}
+}
+
+// WithRouterRootDesc sets the root device description URLs of the routers to forward ports on, as for
+// controllers.PickRouterClient.
+func WithRouterRootDesc(rootDesc ...string) Option {
+	return func(m *StandaloneMapper) {
+		m.rootDesc = rootDesc
+	}
+}
+
+// WithDescription sets the description given to port mappings on the router.
+func WithDescription(description string) Option {
+	return func(m *StandaloneMapper) {
+		m.description = description
+	}
+}
+
+// WithLogger sets the logger used to report what the mapper is doing.
+func WithLogger(log logr.Logger) Option {
+	return func(m *StandaloneMapper) {
+		m.log = log
+	}
+}
+
+// StandaloneMapper forwards ports on a router for a list of rules, for as long as it's running. Each rule's port
+// mapping is added when it starts, renewed before its lease runs out, and removed when it stops.
+type StandaloneMapper struct {
+	router      controllers.RouterClient
+	rootDesc    []string
+	description string
+	log         logr.Logger
+	// after is used to wait until the port mappings need renewing. If nil then time.After is used.
+	after func(d time.Duration) <-chan time.Time
+
+	mu    sync.Mutex
+	rules map[string]PortForwardRule
+	// running is set while Start is, so that rules added or removed take effect on the router straight away.
+	running bool
+	// changed wakes up Start when the rules change, as they may need renewing sooner.
+	changed chan struct{}
+}
+
+// NewStandaloneMapper creates a StandaloneMapper that forwards ports for the given rules once it's started. Rules that
+// aren't valid are logged and ignored.
+func NewStandaloneMapper(rules []PortForwardRule, opts ...Option) *StandaloneMapper {
+	m := &StandaloneMapper{
+		description: DefaultDescription,
+		log:         logf.NullLogger{},
+		rules:       make(map[string]PortForwardRule, len(rules)),
+		changed:     make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	for _, rule := range rules {
+		rule, err := rule.validate()
+		if err != nil {
+			m.log.Error(err, "Ignoring invalid port forwarding rule", "external-port", rule.ExternalPort,
+				"protocol", rule.Protocol)
+			continue
+		}
+		m.rules[rule.key()] = rule
+	}
+	return m
+}
+
+// Rules returns the mapper's rules, in order of their external port and protocol.
+func (m *StandaloneMapper) Rules() []PortForwardRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.rules))
+	for key := range m.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rules := make([]PortForwardRule, 0, len(keys))
+	for _, key := range keys {
+		rules = append(rules, m.rules[key])
+	}
+	return rules
+}
+
+// Start forwards the ports for every rule, and keeps renewing them until ctx is done, when they're removed again. It
+// blocks until then. An error is returned if no router can be found, or if not every port mapping could be removed.
+// Failing to forward a port is only logged, as it's tried again when the mappings are next renewed.
+func (m *StandaloneMapper) Start(ctx context.Context) error {
+	if m.router == nil {
+		router, err := controllers.PickRouterClient(ctx, m.rootDesc...)
+		if err != nil {
+			return fmt.Errorf("unable to find router: %w", err)
+		}
+		m.router = router
+	}
+	after := m.after
+	if after == nil {
+		after = time.After
+	}
+
+	m.mu.Lock()
+	m.running = true
+	m.mu.Unlock()
+
+	m.forwardAll()
+	renew := after(m.renewInterval())
+	for {
+		select {
+		case <-ctx.Done():
+			return m.stop()
+		case <-m.changed:
+			// The new rule has already been forwarded, but it may need renewing sooner than the others.
+			renew = after(m.renewInterval())
+		case <-renew:
+			m.forwardAll()
+			renew = after(m.renewInterval())
+		}
+	}
+}
+
+// forwardAll adds, or renews, the port mapping for every rule.
+func (m *StandaloneMapper) forwardAll() {
+	for _, rule := range m.Rules() {
+		if err := m.addMapping(rule); err != nil {
+			m.log.Error(err, "Failed to forward port, will try again when renewing",
+				"external-port", rule.ExternalPort, "protocol", rule.Protocol)
+		}
+	}
+}
+
+// renewInterval is how long to wait before renewing the port mappings, which is half of the shortest lease so that
+// there's time to try again if renewing fails.
+func (m *StandaloneMapper) renewInterval() time.Duration {
+	interval := DefaultLeaseDuration / 2
+	for _, rule := range m.Rules() {
+		if rule.LeaseDuration/2 < interval {
+			interval = rule.LeaseDuration / 2
+		}
+	}
+	return interval
+}
+
+// stop removes the port mapping for every rule, now that we're no longer running to renew them.
+func (m *StandaloneMapper) stop() error {
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+
+	var failed []string
+	for _, rule := range m.Rules() {
+		if err := m.router.DeletePortMapping("", rule.ExternalPort, rule.Protocol); err != nil {
+			m.log.Error(err, "Failed to remove port mapping", "external-port", rule.ExternalPort,
+				"protocol", rule.Protocol)
+			failed = append(failed, rule.key())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to remove port mappings for %s, they will expire when their leases do",
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (m *StandaloneMapper) addMapping(rule PortForwardRule) error {
+	m.log.Info("Forwarding port", "external-port", rule.ExternalPort, "protocol", rule.Protocol,
+		"internal-ip", rule.InternalIP, "internal-port", rule.InternalPort)
+	return m.router.AddPortMapping("", rule.ExternalPort, rule.Protocol, rule.InternalPort, rule.InternalIP, true,
+		m.description, rule.leaseSeconds())
+}
+
+// AddRule adds a port to forward, replacing any rule for the same external port and protocol. If the mapper is
+// running then the port is forwarded straight away, and an error is returned if the router won't.
+func (m *StandaloneMapper) AddRule(rule PortForwardRule) error {
+	rule, err := rule.validate()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.rules[rule.key()] = rule
+	running := m.running
+	m.mu.Unlock()
+	if !running {
+		return nil
+	}
+
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+	return m.addMapping(rule)
+}
+
+// RemoveRule stops forwarding an external port. If the mapper is running then the port mapping is removed from the
+// router straight away, and an error is returned if the router won't.
+func (m *StandaloneMapper) RemoveRule(externalPort uint16, protocol string) error {
+	key := ruleKey(externalPort, protocol)
+	m.mu.Lock()
+	_, ok := m.rules[key]
+	delete(m.rules, key)
+	running := m.running
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no rule for %s", key)
+	}
+	if !running {
+		return nil
+	}
+
+	m.log.Info("Removing port mapping", "external-port", externalPort, "protocol", protocol)
+	return m.router.DeletePortMapping("", externalPort, strings.ToUpper(protocol))
+}
@@ -0,0 +1,214 @@
+package standalone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRouterClient is a controllers.RouterClient that keeps its port mappings in memory.
+type mockRouterClient struct {
+	mu        sync.Mutex
+	mappings  map[string]PortForwardRule
+	addCalls  int
+	deleteErr error
+}
+
+func newMockRouterClient() *mockRouterClient {
+	return &mockRouterClient{mappings: make(map[string]PortForwardRule)}
+}
+
+func (m *mockRouterClient) AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addCalls++
+	m.mappings[ruleKey(externalPort, protocol)] = PortForwardRule{
+		ExternalPort:  externalPort,
+		InternalPort:  internalPort,
+		InternalIP:    internalClient,
+		Protocol:      protocol,
+		LeaseDuration: time.Duration(leaseDuration) * time.Second,
+	}
+	return nil
+}
+
+func (m *mockRouterClient) DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleteErr != nil {
+		return m.deleteErr
+	}
+	delete(m.mappings, ruleKey(externalPort, protocol))
+	return nil
+}
+
+func (m *mockRouterClient) GetSpecificPortMappingEntry(remoteHost string, externalPort uint16, protocol string) (uint16, string, bool, string, uint32, error) {
+	return 0, "", false, "", 0, errors.New("not implemented")
+}
+
+func (m *mockRouterClient) GetGenericPortMappingEntry(index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	return "", 0, "", 0, "", false, "", 0, errors.New("not implemented")
+}
+
+func (m *mockRouterClient) GetExternalIPAddress() (string, error) {
+	return "203.0.113.1", nil
+}
+
+func (m *mockRouterClient) GetConnectionTypeInfo() (string, string, error) {
+	return "IP_Routed", "IP_Routed", nil
+}
+
+func (m *mockRouterClient) GetPortMappingNumberOfEntries() (uint16, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint16(len(m.mappings)), nil
+}
+
+// snapshot returns the router's mappings, and how many times one has been added.
+func (m *mockRouterClient) snapshot() (map[string]PortForwardRule, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mappings := make(map[string]PortForwardRule, len(m.mappings))
+	for key, rule := range m.mappings {
+		mappings[key] = rule
+	}
+	return mappings, m.addCalls
+}
+
+// manualTimer lets tests decide when the mapper's port mappings need renewing.
+type manualTimer struct {
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newManualTimer() *manualTimer {
+	return &manualTimer{waits: make(chan time.Duration, 10), fire: make(chan time.Time)}
+}
+
+func (t *manualTimer) after(d time.Duration) <-chan time.Time {
+	t.waits <- d
+	return t.fire
+}
+
+var gameServer = PortForwardRule{
+	ExternalPort:  25565,
+	InternalPort:  25565,
+	InternalIP:    "192.168.1.20",
+	Protocol:      "tcp",
+	LeaseDuration: 10 * time.Minute,
+}
+
+// startMapper runs the mapper until the returned function is called, which returns what Start did.
+func startMapper(t *testing.T, m *StandaloneMapper, timer *manualTimer) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.Start(ctx)
+	}()
+	// Start has forwarded every port once it waits to renew them.
+	select {
+	case <-timer.waits:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mapper did not start")
+	}
+	return func() error {
+		cancel()
+		return <-done
+	}
+}
+
+func TestNewStandaloneMapperIgnoresInvalidRules(t *testing.T) {
+	m := NewStandaloneMapper([]PortForwardRule{
+		gameServer,
+		{ExternalPort: 80, InternalPort: 80, InternalIP: "192.168.1.20", Protocol: "SCTP"},
+		{ExternalPort: 80, InternalPort: 80, InternalIP: "not-an-ip", Protocol: "TCP"},
+		{InternalPort: 80, InternalIP: "192.168.1.20", Protocol: "TCP"},
+	})
+	rules := m.Rules()
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, uint16(25565), rules[0].ExternalPort)
+		assert.Equal(t, "TCP", rules[0].Protocol)
+	}
+
+	// The lease duration defaults too.
+	assert.NoError(t, m.AddRule(PortForwardRule{ExternalPort: 53, InternalPort: 53, InternalIP: "192.168.1.2", Protocol: "udp"}))
+	assert.Equal(t, DefaultLeaseDuration, m.Rules()[1].LeaseDuration)
+}
+
+func TestStandaloneMapperLifecycle(t *testing.T) {
+	router := newMockRouterClient()
+	timer := newManualTimer()
+	m := NewStandaloneMapper([]PortForwardRule{gameServer}, WithRouterClient(router))
+	m.after = timer.after
+
+	stop := startMapper(t, m, timer)
+	mappings, adds := router.snapshot()
+	assert.Equal(t, map[string]PortForwardRule{"25565/TCP": {
+		ExternalPort: 25565, InternalPort: 25565, InternalIP: "192.168.1.20", Protocol: "TCP", LeaseDuration: 10 * time.Minute,
+	}}, mappings)
+	assert.Equal(t, 1, adds)
+
+	// Mappings are renewed at half their lease.
+	timer.fire <- time.Now()
+	assert.Equal(t, 5*time.Minute, <-timer.waits)
+	_, adds = router.snapshot()
+	assert.Equal(t, 2, adds)
+
+	assert.NoError(t, stop())
+	mappings, _ = router.snapshot()
+	assert.Empty(t, mappings, "mappings are removed once stopped")
+}
+
+func TestStandaloneMapperAddAndRemoveRules(t *testing.T) {
+	router := newMockRouterClient()
+	timer := newManualTimer()
+	m := NewStandaloneMapper(nil, WithRouterClient(router))
+	m.after = timer.after
+
+	// Before starting, rules are only remembered.
+	assert.NoError(t, m.AddRule(gameServer))
+	mappings, _ := router.snapshot()
+	assert.Empty(t, mappings)
+
+	stop := startMapper(t, m, timer)
+	mappings, _ = router.snapshot()
+	assert.Contains(t, mappings, "25565/TCP")
+
+	// Once running, rules take effect straight away, and a shorter lease is renewed sooner.
+	assert.NoError(t, m.AddRule(PortForwardRule{
+		ExternalPort: 53, InternalPort: 53, InternalIP: "192.168.1.2", Protocol: "UDP", LeaseDuration: time.Minute,
+	}))
+	mappings, _ = router.snapshot()
+	assert.Contains(t, mappings, "53/UDP")
+	assert.Equal(t, 30*time.Second, <-timer.waits)
+
+	assert.NoError(t, m.RemoveRule(25565, "tcp"))
+	mappings, _ = router.snapshot()
+	assert.NotContains(t, mappings, "25565/TCP")
+	assert.Error(t, m.RemoveRule(25565, "TCP"), "the rule has already gone")
+
+	assert.NoError(t, stop())
+	mappings, _ = router.snapshot()
+	assert.Empty(t, mappings)
+}
+
+func TestStandaloneMapperReportsFailedRemovals(t *testing.T) {
+	router := newMockRouterClient()
+	timer := newManualTimer()
+	m := NewStandaloneMapper([]PortForwardRule{gameServer}, WithRouterClient(router))
+	m.after = timer.after
+
+	stop := startMapper(t, m, timer)
+	router.mu.Lock()
+	router.deleteErr = fmt.Errorf("router went away")
+	router.mu.Unlock()
+	err := stop()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "25565/TCP")
+	}
+}
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/JamesLaverack/holepunch/controllers"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ServiceValidatorPath is the path the ServiceValidator should be served on.
+const ServiceValidatorPath = "/validate-v1-service"
+
+// +kubebuilder:webhook:path=/validate-v1-service,mutating=false,failurePolicy=ignore,groups="",resources=services,verbs=create;update,versions=v1,name=vservice.holepunch.io
+
+// ServiceValidator rejects services that ask for their ports to be forwarded, but have port mapping annotations we
+// can't parse. Otherwise we'd only find out when reconciling the service, at which point all we can do is log it.
+type ServiceValidator struct {
+	decoder *admission.Decoder
+}
+
+func (v *ServiceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var service corev1.Service
+	if err := v.decoder.Decode(req, &service); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// We only care about services that have our annotation on them
+	if !controllers.HasHolepunchAnnotation(service) {
+		return admission.Allowed("")
+	}
+
+	portMapping, err := controllers.GetPortMappings(service)
+	if err != nil {
+		return admission.Denied(fmt.Sprintf("invalid port mapping annotation: %v", err))
+	}
+
+	// Annotations for ports the service doesn't have are harmless, but probably a mistake. The version of the admission
+	// API we use can't attach warnings to a response, so the best we can do is give a reason for allowing it.
+	if unknown := unknownPorts(service, portMapping); len(unknown) > 0 {
+		return admission.Allowed(fmt.Sprintf("warning: port mapping annotations for ports %s don't match any port on the service",
+			strings.Join(unknown, ", ")))
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder is called by controller-runtime to give us a decoder for admission requests.
+func (v *ServiceValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// unknownPorts returns, in order, the internal ports in a port mapping that aren't ports on the service.
+func unknownPorts(service corev1.Service, portMapping map[uint16]uint16) []string {
+	servicePorts := make(map[uint16]bool)
+	for _, servicePort := range service.Spec.Ports {
+		servicePorts[uint16(servicePort.Port)] = true
+	}
+
+	var unknown []int
+	for internalPort := range portMapping {
+		if !servicePorts[internalPort] {
+			unknown = append(unknown, int(internalPort))
+		}
+	}
+	sort.Ints(unknown)
+
+	names := make([]string, 0, len(unknown))
+	for _, port := range unknown {
+		names = append(names, fmt.Sprintf("%d", port))
+	}
+	return names
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newValidator(t *testing.T) *ServiceValidator {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	assert.NoError(t, err)
+	v := &ServiceValidator{}
+	assert.NoError(t, v.InjectDecoder(decoder))
+	return v
+}
+
+func serviceRequest(t *testing.T, annotations map[string]string, ports ...int32) admission.Request {
+	service := corev1.Service{
+		TypeMeta:   v1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: v1.ObjectMeta{Name: "my-service", Namespace: "default", Annotations: annotations},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	for _, port := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Port: port, Protocol: corev1.ProtocolTCP})
+	}
+	raw, err := json.Marshal(service)
+	assert.NoError(t, err)
+	return admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestServiceValidatorAllowsValidAnnotations(t *testing.T) {
+	response := newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch/punch-external": "true",
+		"holepunch.port/80":        "3000",
+	}, 80, 443))
+	assert.True(t, response.Allowed)
+	assert.Empty(t, response.Result.Reason)
+}
+
+func TestServiceValidatorDeniesInvalidAnnotations(t *testing.T) {
+	for _, value := range []string{"http", "65536", "-1", ""} {
+		response := newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+			"holepunch/punch-external": "true",
+			"holepunch.port/80":        value,
+		}, 80))
+		assert.False(t, response.Allowed, "external port %q should be denied", value)
+		assert.Contains(t, string(response.Result.Reason), "invalid port mapping annotation")
+	}
+
+	response := newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch/punch-external": "true",
+		"holepunch.port/eighty":    "3000",
+	}, 80))
+	assert.False(t, response.Allowed)
+}
+
+func TestServiceValidatorChecksJSONPortMappings(t *testing.T) {
+	response := newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch/punch-external":   "true",
+		"holepunch.io/port-mappings": `[{"internal":80,"external":3000}]`,
+	}, 80))
+	assert.True(t, response.Allowed)
+
+	response = newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch/punch-external":   "true",
+		"holepunch.io/port-mappings": `[{"internal":80}]`,
+	}, 80))
+	assert.False(t, response.Allowed)
+	assert.Contains(t, string(response.Result.Reason), "invalid port mapping annotation")
+}
+
+func TestServiceValidatorWarnsAboutUnknownPorts(t *testing.T) {
+	response := newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch/punch-external": "true",
+		"holepunch.port/80":        "3000",
+		"holepunch.port/8443":      "4000",
+		"holepunch.port/8080":      "5000",
+	}, 80))
+	assert.True(t, response.Allowed)
+	assert.Contains(t, string(response.Result.Reason), "8080, 8443")
+}
+
+func TestServiceValidatorIgnoresServicesWithoutAnnotation(t *testing.T) {
+	response := newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch.port/80": "http",
+	}, 80))
+	assert.True(t, response.Allowed)
+
+	response = newValidator(t).Handle(context.Background(), serviceRequest(t, map[string]string{
+		"holepunch/punch-external": "false",
+		"holepunch.port/80":        "http",
+	}, 80))
+	assert.True(t, response.Allowed)
+}
+
+func TestServiceValidatorUndecodableRequestErrors(t *testing.T) {
+	response := newValidator(t).Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte("not json")},
+	}})
+	assert.False(t, response.Allowed)
+}